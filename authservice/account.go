@@ -0,0 +1,381 @@
+package authservice
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/mailer"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+var (
+	emailVerified = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "email_verified",
+		Help: "Accounts activated by verifying the email",
+	})
+	passwordResetRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "password_reset_requested",
+		Help: "Password reset mails requested",
+	})
+	passwordResets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "password_reset",
+		Help: "Passwords changed with a reset token",
+	})
+)
+
+// the purposes of the single use tokens we send by mail, of the MFA challenge and of the OIDC login state
+const (
+	purposeVerifyEmail   = "verify-email"
+	purposeResetPassword = "reset-password"
+	purposeMFA           = "mfa"
+	purposeOIDCLogin     = "oidc-login"
+
+	verifyTokenLifetime  = time.Hour * 24
+	resetTokenLifetime   = time.Hour * 1
+	mfaChallengeLifetime = time.Minute * 5
+	// sending must not keep the request waiting, but it should not hang forever either
+	mailTimeout = time.Second * 30
+)
+
+var errInvalidActionToken = errors.New("invalid or used token")
+
+// actionAudience is the audience of the tokens for the purpose. It differs from the
+// audience of the access tokens, so the TokenMiddleware never accepts them.
+func actionAudience(tokens *tokenconfig.Config, purpose string) string {
+	return tokens.Issuer + "/" + purpose
+}
+
+// passwordFingerprint binds a reset token to the password it replaces. Once the
+// password is changed all reset tokens sent before stop working.
+func passwordFingerprint(usr data.User) string {
+	sum := sha256.Sum256([]byte(usr.PasswordHash))
+	return base64.RawURLEncoding.EncodeToString(sum[:12])
+}
+
+// issueActionToken signs a token allowing the purpose for the user, issued like the access tokens by the configured issuer
+func issueActionToken(keyring *jwt.Keyring, tokens *tokenconfig.Config, purpose string, usr data.User, lifetime time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.Claims{
+		Audience:  jwt.Audience{actionAudience(tokens, purpose)},
+		Issuer:    tokens.Issuer,
+		Subject:   usr.Username,
+		Email:     usr.Email,
+		ExpiresAt: now.Add(lifetime).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        jwt.NewTokenID(),
+	}
+	if purpose == purposeResetPassword {
+		claims.Custom = map[string]interface{}{"pwd": passwordFingerprint(usr)}
+	}
+	return jwt.GenerateToken(keyring.SigningKey(), claims)
+}
+
+// sendMail sends in the background. The response must not wait for the mail server,
+// the time it takes would tell if the email belongs to an account.
+func sendMail(logger *zap.Logger, m mailer.Mailer, msg mailer.Message) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), mailTimeout)
+		defer cancel()
+		if err := m.Send(ctx, msg); err != nil {
+			logger.Error("Unable to send the mail", zap.String("to", msg.To), zap.String("subject", msg.Subject), zap.Error(err))
+		}
+	}()
+}
+
+// verificationMail is sent after the signup
+func verificationMail(usr data.User, token string) mailer.Message {
+	return mailer.Message{
+		To:      usr.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Hi %s,\n\nplease verify your email by opening the link below. It is valid for %v.\n\n%s/verify?token=%s\n",
+			usr.Fullname, verifyTokenLifetime, baseURL(), url.QueryEscape(token)),
+	}
+}
+
+// resetURL is the page of the frontend asking for the new password. It gets the token as a parameter.
+func resetURL() string {
+	if page := os.Getenv("AUTH_RESET_URL"); page != "" {
+		return page
+	}
+	return "http://localhost:3000/reset-password"
+}
+
+// AccountController verifies emails and resets forgotten passwords
+type AccountController struct {
+	logger                *zap.Logger
+	keyring               *jwt.Keyring
+	tokens                *tokenconfig.Config
+	users                 data.UserStore
+	hasher                *password.Hasher
+	refreshStore          tokenstore.RefreshStore
+	sessions              tokenstore.SessionStore
+	revocations           tokenstore.RevocationList
+	mailer                mailer.Mailer
+	guard                 *lockout.Guard
+	audit                 *audit.Recorder
+	promVerified          prometheus.Counter
+	promResetRequested    prometheus.Counter
+	promPasswordResetDone prometheus.Counter
+}
+
+// NewAccountController returns a frsh Account controller
+func NewAccountController(logger *zap.Logger, keyring *jwt.Keyring, tokens *tokenconfig.Config, users data.UserStore, hasher *password.Hasher,
+	refreshStore tokenstore.RefreshStore, sessions tokenstore.SessionStore, revocations tokenstore.RevocationList,
+	m mailer.Mailer, guard *lockout.Guard, recorder *audit.Recorder) *AccountController {
+	return &AccountController{
+		logger:                logger,
+		keyring:               keyring,
+		tokens:                tokens,
+		users:                 users,
+		hasher:                hasher,
+		refreshStore:          refreshStore,
+		sessions:              sessions,
+		revocations:           revocations,
+		mailer:                m,
+		guard:                 guard,
+		audit:                 recorder,
+		promVerified:          emailVerified,
+		promResetRequested:    passwordResetRequests,
+		promPasswordResetDone: passwordResets,
+	}
+}
+
+// checkActionToken validates the token for the purpose and returns its user
+func checkActionToken(ctx context.Context, keyring *jwt.Keyring, tokens *tokenconfig.Config, revocations tokenstore.RevocationList,
+	users data.UserStore, token string, purpose string) (data.User, *jwt.Claims, error) {
+	claims, err := jwt.ValidateToken(token, keyring, jwt.Validator{
+		Leeway:   jwt.GetLeeway(),
+		Issuer:   tokens.Issuer,
+		Audience: actionAudience(tokens, purpose),
+	})
+	if jwt.IsValidationError(err) {
+		return data.User{}, nil, errInvalidActionToken
+	}
+	if err != nil {
+		return data.User{}, nil, err
+	}
+	revoked, err := revocations.IsRevoked(ctx, claims.ID)
+	if err != nil {
+		return data.User{}, nil, err
+	}
+	if revoked || claims.ID == "" {
+		return data.User{}, nil, errInvalidActionToken
+	}
+
+	usr, err := users.GetByUsername(ctx, claims.Subject)
+	if err == data.ErrUserNotFound {
+		return data.User{}, nil, errInvalidActionToken
+	}
+	if err != nil {
+		return data.User{}, nil, err
+	}
+	// the email could have changed since the mail was sent
+	if usr.Email != claims.Email {
+		return data.User{}, nil, errInvalidActionToken
+	}
+	if purpose == purposeResetPassword && claims.Custom["pwd"] != passwordFingerprint(usr) {
+		return data.User{}, nil, errInvalidActionToken
+	}
+	// an admin could have disabled the account between the two steps of the signin
+	if purpose == purposeMFA && !usr.Active() {
+		return data.User{}, nil, errInvalidActionToken
+	}
+	return usr, claims, nil
+}
+
+// markActionTokenUsed puts the jti on the revocation list until the token expires, so it works only once
+func markActionTokenUsed(ctx context.Context, revocations tokenstore.RevocationList, claims *jwt.Claims) error {
+	return revocations.Revoke(ctx, claims.ID, time.Unix(claims.ExpiresAt, 0).Add(jwt.GetLeeway()))
+}
+
+// useActionToken validates the token for the purpose and marks it as used
+func (ctrl *AccountController) useActionToken(ctx context.Context, token string, purpose string) (data.User, error) {
+	usr, claims, err := checkActionToken(ctx, ctrl.keyring, ctrl.tokens, ctrl.revocations, ctrl.users, token, purpose)
+	if err != nil {
+		return data.User{}, err
+	}
+	if err := markActionTokenUsed(ctx, ctrl.revocations, claims); err != nil {
+		return data.User{}, err
+	}
+	return usr, nil
+}
+
+// writes the 400 for tokens that are invalid, expired or used, and the 500 otherwise
+func writeTokenError(logger *zap.Logger, rw http.ResponseWriter, r *http.Request, err error) {
+	if err == errInvalidActionToken {
+		logger.Warn("Invalid action token", zap.String("path", r.URL.Path))
+		p := problem.New(problem.TypeInvalidToken, http.StatusBadRequest, "Invalid token")
+		p.Detail = "The token is invalid, expired or was already used"
+		problem.Write(rw, r, p)
+		return
+	}
+	logger.Error("Unable to use the action token", zap.Error(err))
+	problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+}
+
+// VerifyHandler activates the account of the verification token. The token comes as
+// the token parameter of the link in the mail, or in a JSON body.
+func (ctrl *AccountController) VerifyHandler(rw http.ResponseWriter, r *http.Request) {
+	var req VerifyRequest
+	if r.Method == http.MethodGet {
+		req.Token = r.URL.Query().Get("token")
+	} else if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if req.Token == "" {
+		problem.Write(rw, r, problem.Validation([]problem.FieldError{{Field: "token", Message: "is required"}}))
+		return
+	}
+
+	usr, err := ctrl.useActionToken(r.Context(), req.Token, purposeVerifyEmail)
+	if err != nil {
+		writeTokenError(ctrl.logger, rw, r, err)
+		return
+	}
+	if usr.Status == data.StatusPending {
+		usr.Status = data.StatusActive
+		if err := ctrl.users.Update(r.Context(), usr); err != nil {
+			ctrl.logger.Error("Unable to activate the user", zap.Error(err))
+			problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+			return
+		}
+		ctrl.promVerified.Inc()
+	}
+	ctrl.logger.Info("Email verified", zap.String("email", usr.Email))
+	writeAccount(rw, http.StatusOK, usr)
+}
+
+// ForgotPasswordHandler mails a reset link. It answers the same whether the email
+// belongs to an account or not.
+func (ctrl *AccountController) ForgotPasswordHandler(rw http.ResponseWriter, r *http.Request) {
+	var req ForgotPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := validateEmail(req.Email); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	ctrl.promResetRequested.Inc()
+
+	// every request counts, known or not, so the answer still tells nothing about the accounts
+	accountKey := strings.ToLower(req.Email)
+	ip := clientIP(r)
+	wait, _, err := ctrl.guard.Check(r.Context(), accountKey, ip)
+	if err != nil {
+		ctrl.logger.Error("Unable to check the requested resets", zap.Error(err))
+	}
+	if wait > 0 {
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+		p := problem.New(problem.TypeTooMany, http.StatusTooManyRequests, "Too many reset requests")
+		p.Detail = "Try again later"
+		problem.Write(rw, r, p)
+		return
+	}
+	if _, err := ctrl.guard.Fail(r.Context(), accountKey, ip); err != nil {
+		ctrl.logger.Error("Unable to count the requested reset", zap.Error(err))
+	}
+
+	usr, err := ctrl.users.GetByEmail(r.Context(), req.Email)
+	if err != nil && err != data.ErrUserNotFound {
+		ctrl.logger.Error("Unable to look up the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if err == nil {
+		token, err := issueActionToken(ctrl.keyring, ctrl.tokens, purposeResetPassword, usr, resetTokenLifetime)
+		if err != nil {
+			ctrl.logger.Error("Unable to sign the reset token", zap.Error(err))
+			problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+			return
+		}
+		sendMail(ctrl.logger, ctrl.mailer, mailer.Message{
+			To:      usr.Email,
+			Subject: "Reset your password",
+			Body: fmt.Sprintf("Hi %s,\n\nsomebody asked to reset the password of your account. If it was you, open the link below within %v.\nOtherwise you can ignore this mail.\n\n%s?token=%s\n",
+				usr.Fullname, resetTokenLifetime, resetURL(), url.QueryEscape(token)),
+		})
+		ctrl.logger.Info("Password reset requested", zap.String("email", usr.Email))
+	} else {
+		ctrl.logger.Warn("Password reset for unknown email", zap.String("email", req.Email))
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(rw).Encode(map[string]string{"message": "If the email belongs to an account, a reset link was sent to it"})
+}
+
+// ResetPasswordHandler sets the new password of the reset token and signs out every session of the user
+func (ctrl *AccountController) ResetPasswordHandler(rw http.ResponseWriter, r *http.Request) {
+	var req ResetPasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+
+	usr, err := ctrl.useActionToken(r.Context(), req.Token, purposeResetPassword)
+	if err != nil {
+		writeTokenError(ctrl.logger, rw, r, err)
+		return
+	}
+	usr.PasswordHash, err = ctrl.hasher.Hash(req.Password)
+	if err != nil {
+		ctrl.logger.Error("Unable to hash the password", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	// the reset link reached the mailbox, that proves the email as well
+	if usr.Status == data.StatusPending {
+		usr.Status = data.StatusActive
+	}
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to save the password", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	// whoever took over the account must not keep it with a refresh token
+	if err := revokeUserSessions(r.Context(), ctrl.tokens, ctrl.sessions, ctrl.refreshStore, ctrl.revocations, usr.Username, ""); err != nil {
+		ctrl.logger.Error("Unable to revoke the sessions", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.promPasswordResetDone.Inc()
+	ctrl.logger.Info("Password reset", zap.String("email", usr.Email))
+	event := audit.FromRequest(r, audit.ActionPasswordReset)
+	event.Actor = usr.Username
+	event.Target = usr.Username
+	ctrl.audit.Record(r.Context(), event)
+	writeAccount(rw, http.StatusOK, usr)
+}
@@ -0,0 +1,174 @@
+package authservice
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/mailer"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+// recordingMailer hands the sent messages to the test
+type recordingMailer chan mailer.Message
+
+func (m recordingMailer) Send(ctx context.Context, msg mailer.Message) error {
+	m <- msg
+	return nil
+}
+
+// nextMail waits for the next mail
+func nextMail(t *testing.T, mails recordingMailer) mailer.Message {
+	select {
+	case msg := <-mails:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("No mail was sent")
+	}
+	return mailer.Message{}
+}
+
+// tokenFromMail waits for the next mail and returns the token of its link
+func tokenFromMail(t *testing.T, mails recordingMailer) string {
+	msg := nextMail(t, mails)
+	match := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(msg.Body)
+	if match == nil {
+		t.Fatalf("No token in the mail %q", msg.Body)
+	}
+	token, _ := url.QueryUnescape(match[1])
+	return token
+}
+
+func jsonRequest(method string, target string, body string) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func TestVerifyAndReset(t *testing.T) {
+	logger := zap.NewNop()
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	users := data.NewMemoryUserStore()
+	hasher, _ := password.NewHasher(password.Params{Algorithm: password.Bcrypt, Cost: 4})
+	mails := make(recordingMailer, 1)
+	// the issuer of the configuration, not the one of AUTH_ISSUER
+	tokens := tokenconfig.Default()
+	tokens.Issuer = "https://auth.example.com"
+	suc := NewSignupController(logger, users, hasher, keyring, tokens, mails, nil)
+	refreshStore, sessions := tokenstore.NewMemoryRefreshStore(), tokenstore.NewMemorySessionStore()
+	ac := NewAccountController(logger, keyring, tokens, users, hasher, refreshStore, sessions,
+		tokenstore.NewMemoryRevocationList(), mails,
+		lockout.NewGuard(lockout.NewMemoryTracker(lockout.DefaultMailPolicy()), lockout.NewMemoryTracker(lockout.DefaultIPPolicy())), nil)
+
+	rw := httptest.NewRecorder()
+	signup := jsonRequest("POST", "/auth/signup", `{"email":"new@gmail.com","username":"newbie","password":"hashedme1","fullname":"new user"}`)
+	signup.Host = "attacker.example"
+	suc.SignupHandler(rw, signup)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("Signup failed with %d: %s", rw.Code, rw.Body)
+	}
+	if usr, _ := users.GetByEmail(context.Background(), "new@gmail.com"); usr.Active() {
+		t.Fatalf("New accounts must be pending")
+	}
+
+	// the link comes from the configuration, never from the Host of the request
+	msg := nextMail(t, mails)
+	if strings.Contains(msg.Body, "attacker.example") || !strings.Contains(msg.Body, baseURL()+"/verify?token=") {
+		t.Fatalf("Expected the link to the configured base URL, got %q", msg.Body)
+	}
+	verifyToken, _ := url.QueryUnescape(regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(msg.Body)[1])
+	if _, err := jwt.ValidateToken(verifyToken, keyring, jwt.Validator{Issuer: tokens.Issuer, Audience: tokens.Issuer + "/verify-email"}); err != nil {
+		t.Fatalf("Expected the token of the configured issuer, got %v", err)
+	}
+	for i, expected := range []int{http.StatusOK, http.StatusBadRequest} {
+		rw = httptest.NewRecorder()
+		ac.VerifyHandler(rw, httptest.NewRequest("GET", "/auth/verify?token="+url.QueryEscape(verifyToken), nil))
+		if rw.Code != expected {
+			t.Fatalf("Verification %d: expected %d, got %d", i+1, expected, rw.Code)
+		}
+	}
+	if usr, _ := users.GetByEmail(context.Background(), "new@gmail.com"); !usr.Active() {
+		t.Fatalf("Verified accounts must be active")
+	}
+
+	// a verification token must not reset the password
+	rw = httptest.NewRecorder()
+	ac.ResetPasswordHandler(rw, jsonRequest("POST", "/auth/password/reset", `{"token":"`+verifyToken+`","password":"newpassword"}`))
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the verification token to be rejected, got %d", rw.Code)
+	}
+
+	for i := 0; i < 2; i++ {
+		rw = httptest.NewRecorder()
+		ac.ForgotPasswordHandler(rw, jsonRequest("POST", "/auth/password/forgot", `{"email":"new@gmail.com"}`))
+		if rw.Code != http.StatusAccepted {
+			t.Fatalf("Forgot password failed with %d", rw.Code)
+		}
+	}
+	first, second := tokenFromMail(t, mails), tokenFromMail(t, mails)
+
+	// somebody signed in with the old password, the reset has to throw them out
+	ctx := context.Background()
+	refreshStore.Save(ctx, tokenstore.RefreshToken{Hash: "stolen", Family: "family1", Subject: "newbie", ExpiresAt: time.Now().Add(time.Hour)})
+	sessions.Save(ctx, tokenstore.Session{ID: "family1", Subject: "newbie", ExpiresAt: time.Now().Add(time.Hour)})
+
+	rw = httptest.NewRecorder()
+	ac.ResetPasswordHandler(rw, jsonRequest("POST", "/auth/password/reset", `{"token":"`+first+`","password":"newpassword"}`))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Reset failed with %d: %s", rw.Code, rw.Body)
+	}
+	usr, _ := users.GetByEmail(context.Background(), "new@gmail.com")
+	if match, _, _ := hasher.Verify("newpassword", usr.PasswordHash); !match {
+		t.Fatalf("The new password must be set")
+	}
+	if _, err := refreshStore.Use(ctx, "stolen"); err != tokenstore.ErrRefreshTokenRevoked {
+		t.Fatalf("Expected the refresh tokens of the old password to be revoked, got %v", err)
+	}
+	if list, _ := sessions.ListBySubject(ctx, "newbie"); len(list) != 0 {
+		t.Fatalf("Expected every session to be signed out, got %+v", list)
+	}
+
+	// the second link was sent for the old password
+	rw = httptest.NewRecorder()
+	ac.ResetPasswordHandler(rw, jsonRequest("POST", "/auth/password/reset", `{"token":"`+second+`","password":"otherpassword"}`))
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Reset tokens of a replaced password must be rejected, got %d", rw.Code)
+	}
+
+	// unknown emails get the same answer and no mail
+	rw = httptest.NewRecorder()
+	ac.ForgotPasswordHandler(rw, jsonRequest("POST", "/auth/password/forgot", `{"email":"nobody@gmail.com"}`))
+	if rw.Code != http.StatusAccepted {
+		t.Fatalf("Unknown emails must get the same answer, got %d", rw.Code)
+	}
+	select {
+	case <-mails:
+		t.Fatalf("No mail must be sent to unknown emails")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a few more are fine, then the address has to wait so nobody floods the inbox
+	for i := 0; i < 3; i++ {
+		rw = httptest.NewRecorder()
+		ac.ForgotPasswordHandler(rw, jsonRequest("POST", "/auth/password/forgot", `{"email":"Nobody@gmail.com"}`))
+		if rw.Code != http.StatusAccepted {
+			t.Fatalf("Expected the request %d to be accepted, got %d", i+2, rw.Code)
+		}
+	}
+	rw = httptest.NewRecorder()
+	ac.ForgotPasswordHandler(rw, jsonRequest("POST", "/auth/password/forgot", `{"email":"nobody@gmail.com"}`))
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+		t.Fatalf("Expected the reset requests to be throttled, got %d", rw.Code)
+	}
+}
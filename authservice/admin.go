@@ -0,0 +1,262 @@
+package authservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+var adminActions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "admin_user_actions",
+	Help: "Changes admins made to user accounts by action",
+}, []string{"action"})
+
+// pages of the user list
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// userListResponse is a page of users. HasMore tells if there is a next page at offset+limit.
+type userListResponse struct {
+	Users   []userResponse `json:"users"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	HasMore bool           `json:"has_more"`
+}
+
+// AdminController is the route handler for admins managing the users.
+// The routes run behind the TokenMiddleware and the admin role check.
+type AdminController struct {
+	logger       *zap.Logger
+	promActions  *prometheus.CounterVec
+	tokens       *tokenconfig.Config
+	users        data.UserStore
+	refreshStore tokenstore.RefreshStore
+	sessions     tokenstore.SessionStore
+	revocations  tokenstore.RevocationList
+	audit        *audit.Recorder
+}
+
+// NewAdminController returns a frsh Admin controller
+func NewAdminController(logger *zap.Logger, tokens *tokenconfig.Config, users data.UserStore,
+	refreshStore tokenstore.RefreshStore, sessions tokenstore.SessionStore, revocations tokenstore.RevocationList,
+	recorder *audit.Recorder) *AdminController {
+	return &AdminController{
+		logger:       logger,
+		promActions:  adminActions,
+		tokens:       tokens,
+		users:        users,
+		refreshStore: refreshStore,
+		sessions:     sessions,
+		revocations:  revocations,
+		audit:        recorder,
+	}
+}
+
+// listOptions reads the paging and the filters of the query string
+func listOptions(r *http.Request) (data.ListOptions, []problem.FieldError) {
+	query := r.URL.Query()
+	opts := data.ListOptions{Limit: defaultPageSize, Status: query.Get("status"), Query: query.Get("q")}
+	var errs []problem.FieldError
+	if value := query.Get("offset"); value != "" {
+		offset, err := strconv.Atoi(value)
+		if err != nil || offset < 0 {
+			errs = append(errs, problem.FieldError{Field: "offset", Message: "must be a number of at least 0"})
+		}
+		opts.Offset = offset
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			errs = append(errs, problem.FieldError{Field: "limit", Message: "must be a number between 1 and 100"})
+		}
+		opts.Limit = limit
+	}
+	if value := query.Get("role"); value != "" {
+		role, ok := data.RoleFromName(value)
+		if !ok {
+			errs = append(errs, problem.FieldError{Field: "role", Message: "must be admin or user"})
+		}
+		opts.Role = &role
+	}
+	switch opts.Status {
+	case "", data.StatusActive, data.StatusPending, data.StatusDisabled:
+	default:
+		errs = append(errs, problem.FieldError{Field: "status", Message: "must be active, pending or disabled"})
+	}
+	return opts, errs
+}
+
+// ListUsersHandler returns a page of the users, filtered by role, status and a search in email, username and name
+func (ctrl *AdminController) ListUsersHandler(rw http.ResponseWriter, r *http.Request) {
+	opts, errs := listOptions(r)
+	if len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	// one more than asked for tells if there is a next page without counting all users
+	limit := opts.Limit
+	opts.Limit++
+	users, err := ctrl.users.List(r.Context(), opts)
+	if err != nil {
+		ctrl.logger.Error("Unable to list the users", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	resp := userListResponse{Users: []userResponse{}, Offset: opts.Offset, Limit: limit, HasMore: len(users) > limit}
+	for i, usr := range users {
+		if i == limit {
+			break
+		}
+		resp.Users = append(resp.Users, newUserResponse(usr))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// targetUser loads the user of the {id} in the path. Admins cannot change their own account here,
+// so the last admin cannot lock everybody out by accident.
+func (ctrl *AdminController) targetUser(rw http.ResponseWriter, r *http.Request) (data.User, bool) {
+	actor, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return data.User{}, false
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "User not found"))
+		return data.User{}, false
+	}
+	usr, err := ctrl.users.GetByID(r.Context(), uint(id))
+	if err == data.ErrUserNotFound {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "User not found"))
+		return data.User{}, false
+	}
+	if err != nil {
+		ctrl.logger.Error("Unable to look up the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return data.User{}, false
+	}
+	if usr.ID == actor.ID && r.Method != http.MethodGet {
+		p := problem.New(problem.TypeConflict, http.StatusConflict, "You cannot change your own account here")
+		p.Detail = "Ask another admin"
+		problem.Write(rw, r, p)
+		return data.User{}, false
+	}
+	return usr, true
+}
+
+// record audits a change of the target user
+func (ctrl *AdminController) record(r *http.Request, action string, usr data.User, details map[string]string) {
+	event := audit.FromRequest(r, action)
+	event.Target = usr.Username
+	event.Details = details
+	ctrl.audit.Record(r.Context(), event)
+}
+
+// save stores the changed user and answers with it. With signOut every session of the user
+// is signed out, so no token issued before the change keeps working.
+func (ctrl *AdminController) save(rw http.ResponseWriter, r *http.Request, usr data.User, action string, details map[string]string, signOut bool) {
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to update the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if signOut {
+		if err := revokeUserSessions(r.Context(), ctrl.tokens, ctrl.sessions, ctrl.refreshStore, ctrl.revocations, usr.Username, ""); err != nil {
+			ctrl.logger.Error("Unable to sign out the sessions of the user", zap.Error(err))
+			problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+			return
+		}
+	}
+	ctrl.promActions.WithLabelValues(strings.TrimPrefix(action, "user.")).Inc()
+	ctrl.logger.Info("User changed by an admin", zap.String("action", action), zap.String("user", usr.Username))
+	ctrl.record(r, action, usr, details)
+	writeUser(rw, usr)
+}
+
+// GetUserHandler returns one user
+func (ctrl *AdminController) GetUserHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := ctrl.targetUser(rw, r)
+	if !ok {
+		return
+	}
+	writeUser(rw, usr)
+}
+
+// UpdateRoleHandler changes the role of a user. Every session of the user is signed out,
+// so tokens carrying the old role stop working and the next signin gets the new one.
+func (ctrl *AdminController) UpdateRoleHandler(rw http.ResponseWriter, r *http.Request) {
+	var req UpdateRoleRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	usr, ok := ctrl.targetUser(rw, r)
+	if !ok {
+		return
+	}
+	from := data.RoleName(usr.Role)
+	usr.Role, _ = data.RoleFromName(req.Role)
+	ctrl.save(rw, r, usr, audit.ActionRoleChange, map[string]string{"from": from, "to": data.RoleName(usr.Role)}, true)
+}
+
+// DisableHandler turns the account off. Signin, refresh and api keys stop working at once,
+// and every session is signed out, so the access tokens already issued are rejected as well.
+func (ctrl *AdminController) DisableHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := ctrl.targetUser(rw, r)
+	if !ok {
+		return
+	}
+	usr.Status = data.StatusDisabled
+	ctrl.save(rw, r, usr, audit.ActionUserDisable, nil, true)
+}
+
+// EnableHandler turns the account on again. A pending account is activated without the verification mail.
+func (ctrl *AdminController) EnableHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := ctrl.targetUser(rw, r)
+	if !ok {
+		return
+	}
+	usr.Status = data.StatusActive
+	ctrl.save(rw, r, usr, audit.ActionUserEnable, nil, false)
+}
+
+// DeleteUserHandler removes the account and signs out its sessions. Its api keys fail with the user gone.
+func (ctrl *AdminController) DeleteUserHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := ctrl.targetUser(rw, r)
+	if !ok {
+		return
+	}
+	if err := ctrl.users.Delete(r.Context(), usr.ID); err != nil && err != data.ErrUserNotFound {
+		ctrl.logger.Error("Unable to delete the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if err := revokeUserSessions(r.Context(), ctrl.tokens, ctrl.sessions, ctrl.refreshStore, ctrl.revocations, usr.Username, ""); err != nil {
+		ctrl.logger.Error("Unable to sign out the sessions of the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.promActions.WithLabelValues("delete").Inc()
+	ctrl.logger.Info("User deleted by an admin", zap.String("user", usr.Username))
+	ctrl.record(r, audit.ActionUserDelete, usr, nil)
+	rw.WriteHeader(http.StatusNoContent)
+}
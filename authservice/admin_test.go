@@ -0,0 +1,107 @@
+package authservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+func TestAdminUsers(t *testing.T) {
+	users := data.NewMemoryUserStore(data.DefaultUsers()...)
+	for _, name := range []string{"user01", "user02", "user03"} {
+		users.Create(context.Background(), &data.User{Email: name + "@gmail.com", Username: name, Status: data.StatusPending})
+	}
+	trail := audit.NewMemoryTrail()
+	refreshStore, sessions := tokenstore.NewMemoryRefreshStore(), tokenstore.NewMemorySessionStore()
+	adc := NewAdminController(zap.NewNop(), tokenconfig.Default(), users, refreshStore, sessions,
+		tokenstore.NewMemoryRevocationList(), audit.NewRecorder(zap.NewNop(), trail))
+
+	list := func(query string) (int, userListResponse) {
+		rw := httptest.NewRecorder()
+		adc.ListUsersHandler(rw, asSubject(httptest.NewRequest("GET", "/auth/admin/users?"+query, nil), "abc12", "abc@gmail.com"))
+		var resp userListResponse
+		json.NewDecoder(rw.Body).Decode(&resp)
+		return rw.Code, resp
+	}
+	if _, resp := list("limit=2"); len(resp.Users) != 2 || !resp.HasMore {
+		t.Fatalf("Expected a first page of 2 with more to come, got %+v", resp)
+	}
+	if _, resp := list("status=pending&offset=2"); len(resp.Users) != 1 || resp.HasMore || resp.Users[0].Username != "user03" {
+		t.Fatalf("Expected the last pending user, got %+v", resp)
+	}
+	if code, _ := list("role=root"); code != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown role to be rejected, got %d", code)
+	}
+
+	act := func(handler http.HandlerFunc, actor string, id uint, body string) int {
+		req := httptest.NewRequest("POST", "/auth/admin/users/x", nil)
+		if body != "" {
+			req = jsonRequest("PATCH", "/auth/admin/users/x/role", body)
+		}
+		by, _ := users.GetByUsername(context.Background(), actor)
+		req = mux.SetURLVars(asSubject(req, actor, by.Email), map[string]string{"id": strconv.Itoa(int(id))})
+		rw := httptest.NewRecorder()
+		handler(rw, req)
+		return rw.Code
+	}
+	checkme, _ := users.GetByUsername(context.Background(), "checkme34")
+	admin, _ := users.GetByUsername(context.Background(), "abc12")
+	signIn := func(id string) {
+		refreshStore.Save(context.Background(), tokenstore.RefreshToken{Hash: id, Family: id, Subject: "checkme34", ExpiresAt: time.Now().Add(time.Hour)})
+		sessions.Save(context.Background(), tokenstore.Session{ID: id, Subject: "checkme34", ExpiresAt: time.Now().Add(time.Hour)})
+	}
+	signedOut := func(id string) bool {
+		_, err := refreshStore.Use(context.Background(), id)
+		list, _ := sessions.ListBySubject(context.Background(), "checkme34")
+		return err == tokenstore.ErrRefreshTokenRevoked && len(list) == 0
+	}
+	signIn("before-role")
+
+	if code := act(adc.UpdateRoleHandler, "abc12", checkme.ID, `{"role":"admin"}`); code != http.StatusOK {
+		t.Fatalf("Role change failed with %d", code)
+	}
+	if usr, _ := users.GetByID(context.Background(), checkme.ID); usr.Role != data.RoleAdmin {
+		t.Fatalf("The role was not saved")
+	}
+	if !signedOut("before-role") {
+		t.Fatalf("Sessions with the old role must be signed out")
+	}
+	events, _ := trail.Query(context.Background(), audit.Filter{Action: audit.ActionRoleChange})
+	if len(events) != 1 || events[0].Actor != "abc12" || events[0].Target != "checkme34" || events[0].Details["to"] != "admin" {
+		t.Fatalf("Expected the role change in the audit trail, got %+v", events)
+	}
+	if code := act(adc.DisableHandler, "abc12", admin.ID, ""); code != http.StatusConflict {
+		t.Fatalf("Admins must not disable themselves, got %d", code)
+	}
+	signIn("before-disable")
+	if code := act(adc.DisableHandler, "abc12", checkme.ID, ""); code != http.StatusOK {
+		t.Fatalf("Disable failed with %d", code)
+	}
+	if !signedOut("before-disable") {
+		t.Fatalf("Disabled users must be signed out")
+	}
+	if usr, _ := users.GetByID(context.Background(), checkme.ID); usr.Active() {
+		t.Fatalf("The user must be disabled")
+	}
+	signIn("before-delete")
+	if code := act(adc.DeleteUserHandler, "abc12", checkme.ID, ""); code != http.StatusNoContent {
+		t.Fatalf("Delete failed with %d", code)
+	}
+	if !signedOut("before-delete") {
+		t.Fatalf("Deleted users must be signed out")
+	}
+	if code := act(adc.GetUserHandler, "abc12", checkme.ID, ""); code != http.StatusNotFound {
+		t.Fatalf("Expected the deleted user to be gone, got %d", code)
+	}
+}
@@ -0,0 +1,55 @@
+// Package apikey is the format of our api keys: mpg_<prefix>_<secret>.
+// The prefix is public and finds the key in the store, the whole key is only kept as a hash.
+package apikey
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// Tag starts every key, so leaked keys are easy to find by secret scanners
+const Tag = "mpg"
+
+const (
+	prefixBytes = 8
+	secretBytes = 32
+)
+
+// Generate returns a new key, its prefix and the hash to store
+func Generate() (key string, prefix string, hash string) {
+	rawPrefix := make([]byte, prefixBytes)
+	rand.Read(rawPrefix)
+	rawSecret := make([]byte, secretBytes)
+	rand.Read(rawSecret)
+	prefix = hex.EncodeToString(rawPrefix)
+	key = Tag + "_" + prefix + "_" + base64.RawURLEncoding.EncodeToString(rawSecret)
+	return key, prefix, Hash(key)
+}
+
+// Prefix returns the prefix of the key, or false if it does not look like one of our keys.
+// The secret is base64url and can contain underscores, the prefix is hex and cannot.
+func Prefix(key string) (string, bool) {
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) != 3 || parts[0] != Tag || len(parts[1]) != 2*prefixBytes || parts[2] == "" {
+		return "", false
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// Hash hashes the key for the store. The key is random, a plain SHA-256 is enough.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify compares the key with the stored hash in constant time
+func Verify(key string, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(Hash(key)), []byte(hash)) == 1
+}
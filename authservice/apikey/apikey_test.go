@@ -0,0 +1,29 @@
+package apikey
+
+import "testing"
+
+func TestGenerate(t *testing.T) {
+	key, prefix, hash := Generate()
+	parsed, ok := Prefix(key)
+	if !ok || parsed != prefix {
+		t.Fatalf("Expected the prefix %s of %s, got %s", prefix, key, parsed)
+	}
+	if !Verify(key, hash) || Verify(key+"x", hash) {
+		t.Fatalf("The key must only match its own hash")
+	}
+	other, otherPrefix, _ := Generate()
+	if other == key || otherPrefix == prefix {
+		t.Fatalf("Two keys must differ")
+	}
+}
+
+func TestPrefix(t *testing.T) {
+	for _, key := range []string{"", "mpg", "mpg_0123456789abcdef", "abc_0123456789abcdef_secret", "mpg_0123_secret", "mpg_0123456789abcdeg_secret"} {
+		if _, ok := Prefix(key); ok {
+			t.Fatalf("Expected %q to be rejected", key)
+		}
+	}
+	if prefix, ok := Prefix("mpg_0123456789abcdef_se_cr-et"); !ok || prefix != "0123456789abcdef" {
+		t.Fatalf("Expected the prefix to be found, got %s", prefix)
+	}
+}
@@ -0,0 +1,206 @@
+package authservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/apikey"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"go.uber.org/zap"
+)
+
+var (
+	apiKeysCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "apikeys_created",
+		Help: "API keys created by users",
+	})
+	apiKeysRevoked = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "apikeys_revoked",
+		Help: "API keys revoked by users",
+	})
+)
+
+// a user cannot pile up keys, unused ones have to be revoked first
+const maxAPIKeysPerUser = 10
+
+// apiKeyResponse describes a key. Key is only set once, in the response of the creation.
+type apiKeyResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func newAPIKeyResponse(key data.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Prefix:     apikey.Tag + "_" + key.Prefix,
+		Scopes:     append([]string{}, key.ScopeList()...),
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+// APIKeyController is the api key route handler. The routes run behind TokenMiddleware.RequireUserToken,
+// a key can never be used to create more keys.
+type APIKeyController struct {
+	logger      *zap.Logger
+	promCreated prometheus.Counter
+	promRevoked prometheus.Counter
+	keys        data.APIKeyStore
+	users       data.UserStore
+	policy      *middleware.Policy
+	audit       *audit.Recorder
+}
+
+// NewAPIKeyController returns a frsh APIKey controller
+func NewAPIKeyController(logger *zap.Logger, keys data.APIKeyStore, users data.UserStore, policy *middleware.Policy, recorder *audit.Recorder) *APIKeyController {
+	return &APIKeyController{
+		logger:      logger,
+		promCreated: apiKeysCreated,
+		promRevoked: apiKeysRevoked,
+		keys:        keys,
+		users:       users,
+		policy:      policy,
+		audit:       recorder,
+	}
+}
+
+// CreateHandler creates a key for the caller. The key is in the response and never shown again.
+func (ctrl *APIKeyController) CreateHandler(rw http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	// a key can only narrow what the user may do, never widen it
+	for _, scope := range req.Scopes {
+		if !ctrl.policy.Allows(usr.Roles(), scope) {
+			problem.Write(rw, r, problem.Validation([]problem.FieldError{{Field: "scopes", Message: "you do not have the permission " + scope}}))
+			return
+		}
+	}
+
+	existing, err := ctrl.keys.ListByUser(r.Context(), usr.ID)
+	if err != nil {
+		ctrl.logger.Error("Unable to list the api keys", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	usable := 0
+	for _, key := range existing {
+		if key.Usable(time.Now()) {
+			usable++
+		}
+	}
+	if usable >= maxAPIKeysPerUser {
+		p := problem.New(problem.TypeConflict, http.StatusConflict, "Too many api keys")
+		p.Detail = "Revoke an api key before creating a new one"
+		problem.Write(rw, r, p)
+		return
+	}
+
+	plain, prefix, hash := apikey.Generate()
+	key := data.APIKey{
+		UserID:    usr.ID,
+		Name:      strings.TrimSpace(req.Name),
+		Prefix:    prefix,
+		Hash:      hash,
+		Scopes:    strings.Join(req.Scopes, " "),
+		ExpiresAt: req.ExpiresAt,
+	}
+	if err := ctrl.keys.Create(r.Context(), &key); err != nil {
+		ctrl.logger.Error("Unable to save the api key", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.promCreated.Inc()
+	ctrl.logger.Info("API key created", zap.String("subject", usr.Username), zap.String("prefix", prefix))
+	event := audit.FromRequest(r, audit.ActionAPIKeyCreate)
+	event.Target = prefix
+	event.Details = map[string]string{"name": key.Name, "scopes": key.Scopes}
+	ctrl.audit.Record(r.Context(), event)
+
+	resp := newAPIKeyResponse(key)
+	resp.Key = plain
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusCreated)
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// ListHandler lists the keys of the caller without the keys themselves
+func (ctrl *APIKeyController) ListHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	keys, err := ctrl.keys.ListByUser(r.Context(), usr.ID)
+	if err != nil {
+		ctrl.logger.Error("Unable to list the api keys", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	resp := make([]apiKeyResponse, 0, len(keys))
+	for _, key := range keys {
+		resp = append(resp, newAPIKeyResponse(key))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// RevokeHandler revokes a key of the caller. It stays in the list, so the last use can still be seen.
+func (ctrl *APIKeyController) RevokeHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	id, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "API key not found"))
+		return
+	}
+	err = ctrl.keys.Revoke(r.Context(), usr.ID, uint(id), time.Now())
+	if err == data.ErrAPIKeyNotFound {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "API key not found"))
+		return
+	}
+	if err != nil {
+		ctrl.logger.Error("Unable to revoke the api key", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.promRevoked.Inc()
+	ctrl.logger.Info("API key revoked", zap.String("subject", usr.Username), zap.Uint64("id", id))
+	event := audit.FromRequest(r, audit.ActionAPIKeyRevoke)
+	event.Target = strconv.FormatUint(id, 10)
+	ctrl.audit.Record(r.Context(), event)
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,99 @@
+package authservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+func TestAPIKeys(t *testing.T) {
+	logger := zap.NewNop()
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	users := data.NewMemoryUserStore(data.DefaultUsers()...)
+	keys := data.NewMemoryAPIKeyStore()
+	policy := middleware.DefaultPolicy()
+	akc := NewAPIKeyController(logger, keys, users, policy, nil)
+	tm := middleware.NewTokenMiddleware(logger, keyring, tokenstore.NewMemoryRevocationList()).AcceptAPIKeys(keys, users)
+	am := middleware.NewAuthorizationMiddleware(logger, policy)
+
+	asUser := func(r *http.Request, username string) *http.Request {
+		usr, _ := users.GetByUsername(r.Context(), username)
+		return r.WithContext(middleware.WithIdentity(r.Context(), middleware.Identity{Subject: username, Email: usr.Email}))
+	}
+	create := func(username string, body string) (*httptest.ResponseRecorder, apiKeyResponse) {
+		rw := httptest.NewRecorder()
+		akc.CreateHandler(rw, asUser(jsonRequest("POST", "/auth/apikeys", body), username))
+		var resp apiKeyResponse
+		json.NewDecoder(rw.Body).Decode(&resp)
+		return rw, resp
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { rw.WriteHeader(http.StatusOK) })
+	call := func(handler http.Handler, key string) int {
+		req := httptest.NewRequest("DELETE", "/product/deletebyid", nil)
+		req.Header.Set("Authorization", "ApiKey "+key)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	deleteRoute := tm.TokenValidationMiddleware(am.RequirePermission(middleware.PermProductDelete)(ok))
+
+	if rw, _ := create("checkme34", `{"name":"partner","scopes":["product:delete"]}`); rw.Code != http.StatusBadRequest {
+		t.Fatalf("A key must not get a permission the user lacks, got %d", rw.Code)
+	}
+	if rw, _ := create("abc12", `{"name":"old","expires_at":"2001-01-01T00:00:00Z"}`); rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an expiry in the past to be rejected, got %d", rw.Code)
+	}
+
+	rw, full := create("abc12", `{"name":"full"}`)
+	if rw.Code != http.StatusCreated || full.Key == "" {
+		t.Fatalf("Unable to create a key, got %d", rw.Code)
+	}
+	_, limited := create("abc12", `{"name":"coupons only","scopes":["coupon:purge"]}`)
+
+	if code := call(deleteRoute, full.Key); code != http.StatusOK {
+		t.Fatalf("Expected the key to have the permissions of the admin, got %d", code)
+	}
+	if code := call(deleteRoute, limited.Key); code != http.StatusForbidden {
+		t.Fatalf("Expected the scopes to limit the key, got %d", code)
+	}
+	if code := call(deleteRoute, full.Key+"x"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong key to be rejected, got %d", code)
+	}
+	if code := call(tm.RequireUserToken(ok), full.Key); code != http.StatusForbidden {
+		t.Fatalf("Account routes must not accept keys, got %d", code)
+	}
+
+	// the list never shows the keys again, but the last use
+	rw = httptest.NewRecorder()
+	akc.ListHandler(rw, asUser(httptest.NewRequest("GET", "/auth/apikeys", nil), "abc12"))
+	var list []apiKeyResponse
+	json.NewDecoder(rw.Body).Decode(&list)
+	if len(list) != 2 || list[1].Key != "" || list[1].LastUsedAt == nil {
+		t.Fatalf("Unexpected list %+v", list)
+	}
+
+	revoke := func(username string, id uint) int {
+		req := mux.SetURLVars(httptest.NewRequest("DELETE", "/auth/apikeys/x", nil), map[string]string{"id": strconv.Itoa(int(id))})
+		rw := httptest.NewRecorder()
+		akc.RevokeHandler(rw, asUser(req, username))
+		return rw.Code
+	}
+	if code := revoke("checkme34", full.ID); code != http.StatusNotFound {
+		t.Fatalf("Nobody can revoke the key of someone else, got %d", code)
+	}
+	if code := revoke("abc12", full.ID); code != http.StatusNoContent {
+		t.Fatalf("Unable to revoke the key, got %d", code)
+	}
+	if code := call(deleteRoute, full.Key); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a revoked key to be rejected, got %d", code)
+	}
+}
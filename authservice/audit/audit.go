@@ -0,0 +1,175 @@
+// Package audit keeps a durable record of who did what: signins, account changes and the
+// privileged calls to the other services. Events are only ever appended, and every event
+// carries the hash of the one before, so a changed or removed event breaks the chain.
+// With a key the hashes are HMACs, so nobody without the key can rebuild the chain after an edit.
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var ErrChainBroken = errors.New("audit chain broken")
+
+// Actions we record
+const (
+	ActionSignup         = "signup"
+	ActionSignin         = "signin"
+	ActionSigninMFA      = "signin.mfa"
+	ActionSigninOIDC     = "signin.oidc"
+	ActionLockout        = "signin.lockout"
+	ActionPasswordChange = "password.change"
+	ActionPasswordReset  = "password.reset"
+	ActionRoleChange     = "user.role"
+	ActionUserDisable    = "user.disable"
+	ActionUserEnable     = "user.enable"
+	ActionUserDelete     = "user.delete"
+	ActionAPIKeyCreate   = "apikey.create"
+	ActionAPIKeyRevoke   = "apikey.revoke"
+	ActionSessionRevoke  = "session.revoke"
+	ActionProductWrite   = "product.write"
+	ActionProductDelete  = "product.delete"
+	ActionCustomQuery    = "product.customquery"
+	ActionStreamPurge    = "coupon.purge"
+)
+
+// Outcomes of an action. Denied is an authenticated caller without the permission.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// Event is one entry of the trail. Seq, Time, PrevHash and Hash are set when it is recorded.
+type Event struct {
+	Seq      uint64            `json:"seq"`
+	Time     time.Time         `json:"time"`
+	Action   string            `json:"action"`
+	Actor    string            `json:"actor,omitempty"`
+	Target   string            `json:"target,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	Outcome  string            `json:"outcome"`
+	Details  map[string]string `json:"details,omitempty"`
+	PrevHash string            `json:"prev_hash"`
+	Hash     string            `json:"hash"`
+}
+
+// computeHash hashes the event without its own hash, an HMAC with the key if there is one.
+// encoding/json sorts the keys of Details, so the same event always gives the same hash.
+func (e Event) computeHash(key []byte) string {
+	e.Hash = ""
+	encoded, _ := json.Marshal(e)
+	if len(key) == 0 {
+		sum := sha256.Sum256(encoded)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(encoded)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Filter selects events for a query, empty fields match everything
+type Filter struct {
+	Action  string
+	Actor   string
+	Target  string
+	Outcome string
+	Since   time.Time
+	Until   time.Time
+	// Limit is the number of events returned, newest first
+	Limit int
+}
+
+func (f Filter) matches(e Event) bool {
+	switch {
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Actor != "" && e.Actor != f.Actor:
+		return false
+	case f.Target != "" && e.Target != f.Target:
+		return false
+	case f.Outcome != "" && e.Outcome != f.Outcome:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Trail is where the events are appended to
+type Trail interface {
+	// Append chains the event to the last one and stores it
+	Append(ctx context.Context, event Event) (Event, error)
+	Query(ctx context.Context, filter Filter) ([]Event, error)
+	// Verify walks the whole chain and returns ErrChainBroken at the first event that does not fit
+	Verify(ctx context.Context) error
+}
+
+// chain links the events, the trails only have to store them
+type chain struct {
+	key  []byte
+	seq  uint64
+	hash string
+}
+
+// link sets the chain fields of the next event
+func (c *chain) link(event Event) Event {
+	c.seq++
+	event.Seq = c.seq
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	// UTC also drops the monotonic clock, the time reads back from JSON exactly as it was hashed
+	event.Time = event.Time.UTC()
+	event.PrevHash = c.hash
+	event.Hash = event.computeHash(c.key)
+	c.hash = event.Hash
+	return event
+}
+
+// verifyEvents checks the events are complete and unchanged, in the order they were appended
+func verifyEvents(events []Event, key []byte) error {
+	prev := ""
+	for i, event := range events {
+		if event.Seq != uint64(i+1) || event.PrevHash != prev || !hmac.Equal([]byte(event.Hash), []byte(event.computeHash(key))) {
+			return &BrokenError{Seq: event.Seq}
+		}
+		prev = event.Hash
+	}
+	return nil
+}
+
+// BrokenError tells where the chain breaks. It matches ErrChainBroken with errors.Is.
+type BrokenError struct {
+	Seq uint64
+}
+
+func (e *BrokenError) Error() string {
+	return ErrChainBroken.Error() + " at event " + strconv.FormatUint(e.Seq, 10)
+}
+
+func (e *BrokenError) Is(target error) bool {
+	return target == ErrChainBroken
+}
+
+// newestFirst filters the events and returns the newest ones up to the limit
+func newestFirst(events []Event, filter Filter) []Event {
+	result := []Event{}
+	for i := len(events) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(result) >= filter.Limit {
+			break
+		}
+		if filter.matches(events[i]) {
+			result = append(result, events[i])
+		}
+	}
+	return result
+}
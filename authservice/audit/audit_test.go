@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"go.uber.org/zap"
+)
+
+func TestFileTrail(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	key := []byte("audit key")
+	trail, err := OpenFileTrail(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail.Append(ctx, Event{Action: ActionSignin, Actor: "abc12", Outcome: OutcomeSuccess})
+	trail.Append(ctx, Event{Action: ActionRoleChange, Actor: "abc12", Target: "checkme34", Outcome: OutcomeSuccess, Details: map[string]string{"to": "admin"}})
+	trail.Close()
+
+	// a restart continues the chain
+	trail, err = OpenFileTrail(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trail.Close()
+	last, _ := trail.Append(ctx, Event{Action: ActionUserDelete, Actor: "abc12", Target: "checkme34", Outcome: OutcomeSuccess})
+	if last.Seq != 3 {
+		t.Fatalf("Expected the chain to continue at 3, got %d", last.Seq)
+	}
+	if err := trail.Verify(ctx); err != nil {
+		t.Fatalf("Expected an intact chain, got %v", err)
+	}
+	events, _ := trail.Query(ctx, Filter{Target: "checkme34", Limit: 1})
+	if len(events) != 1 || events[0].Action != ActionUserDelete {
+		t.Fatalf("Expected the newest event of checkme34, got %+v", events)
+	}
+
+	// a crash in the middle of a write leaves a torn line, the next start drops it
+	content, _ := ioutil.ReadFile(path)
+	ioutil.WriteFile(path, append(content, `{"seq":4,"act`...), 0600)
+	torn, err := OpenFileTrail(path, key)
+	if err != nil {
+		t.Fatalf("Expected a torn last line not to stop the start, got %v", err)
+	}
+	torn.Close()
+	if err := trail.Verify(ctx); err != nil {
+		t.Fatalf("Expected the torn line to be removed, got %v", err)
+	}
+
+	// somebody makes the role change look like it never gave admin
+	ioutil.WriteFile(path, []byte(strings.Replace(string(content), `"to":"admin"`, `"to":"user"`, 1)), 0600)
+	var broken *BrokenError
+	if err := trail.Verify(ctx); !errors.As(err, &broken) || broken.Seq != 2 {
+		t.Fatalf("Expected the chain to break at 2, got %v", err)
+	}
+
+	// removing the event breaks the link of the next one
+	lines := strings.SplitAfter(string(content), "\n")
+	ioutil.WriteFile(path, []byte(lines[0]+lines[2]), 0600)
+	if err := trail.Verify(ctx); !errors.Is(err, ErrChainBroken) {
+		t.Fatalf("Expected a removed event to break the chain, got %v", err)
+	}
+
+	// without the key the hashes of a changed event cannot be made to fit again
+	forged := Event{Seq: 1, Time: time.Now().UTC(), Action: ActionSignin, Actor: "somebody", Outcome: OutcomeSuccess}
+	forged.Hash = forged.computeHash(nil)
+	line, _ := json.Marshal(forged)
+	ioutil.WriteFile(path, []byte(string(line)+"\n"+strings.Join(lines[1:], "")), 0600)
+	if err := trail.Verify(ctx); !errors.As(err, &broken) || broken.Seq != 1 {
+		t.Fatalf("Expected an event hashed without the key to break the chain, got %v", err)
+	}
+
+	// cutting the last event off leaves an intact chain, but it ends before the head
+	ioutil.WriteFile(path, []byte(lines[0]+lines[1]), 0600)
+	if err := trail.Verify(ctx); !errors.As(err, &broken) || broken.Seq != 3 {
+		t.Fatalf("Expected the missing last event to be noticed, got %v", err)
+	}
+	reopened, err := OpenFileTrail(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if err := reopened.Verify(ctx); !errors.As(err, &broken) || broken.Seq != 3 {
+		t.Fatalf("Expected the missing last event to be noticed after a restart, got %v", err)
+	}
+	if next, _ := reopened.Append(ctx, Event{Action: ActionSignin, Actor: "abc12", Outcome: OutcomeSuccess}); next.Seq != 4 {
+		t.Fatalf("Expected the chain to continue after the head, got %d", next.Seq)
+	}
+	if err := reopened.Verify(ctx); !errors.Is(err, ErrChainBroken) {
+		t.Fatalf("Expected the gap to stay visible, got %v", err)
+	}
+}
+
+func TestRoute(t *testing.T) {
+	trail := NewMemoryTrail()
+	rec := NewRecorder(zap.NewNop(), trail)
+	route := func(status int) http.Handler {
+		return rec.Route(ActionProductDelete, Header("Id"))(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(status)
+		}))
+	}
+	for _, status := range []int{http.StatusOK, http.StatusForbidden, http.StatusBadRequest} {
+		req := httptest.NewRequest("DELETE", "/product/deletebyid", nil)
+		req.Header.Set("Id", "42")
+		req = req.WithContext(middleware.WithIdentity(req.Context(), middleware.Identity{Subject: "checkme34"}))
+		route(status).ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	events, _ := trail.Query(context.Background(), Filter{})
+	outcomes := []string{}
+	for _, event := range events {
+		if event.Actor != "checkme34" || event.Target != "42" || event.IP != "192.0.2.1" {
+			t.Fatalf("Unexpected event %+v", event)
+		}
+		outcomes = append(outcomes, event.Outcome)
+	}
+	if strings.Join(outcomes, ",") != "failure,denied,success" {
+		t.Fatalf("Unexpected outcomes %v", outcomes)
+	}
+	if err := trail.Verify(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
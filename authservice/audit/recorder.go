@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"go.uber.org/zap"
+)
+
+var (
+	eventsRecorded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "audit_events_total",
+		Help: "Audit events recorded by action and outcome",
+	}, []string{"action", "outcome"})
+	eventsLost = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "audit_events_lost",
+		Help: "Audit events that could not be written",
+	})
+)
+
+// Recorder writes events to the trail for the handlers. A failing trail does not fail the
+// request, it is logged and counted instead. A nil Recorder records nothing.
+type Recorder struct {
+	logger     *zap.Logger
+	trail      Trail
+	promEvents *prometheus.CounterVec
+	promLost   prometheus.Counter
+}
+
+// NewRecorder returns a frsh Recorder
+func NewRecorder(logger *zap.Logger, trail Trail) *Recorder {
+	return &Recorder{
+		logger:     logger,
+		trail:      trail,
+		promEvents: eventsRecorded,
+		promLost:   eventsLost,
+	}
+}
+
+// Record appends the event
+func (rec *Recorder) Record(ctx context.Context, event Event) {
+	if rec == nil {
+		return
+	}
+	if _, err := rec.trail.Append(ctx, event); err != nil {
+		rec.logger.Error("Unable to write the audit event", zap.String("action", event.Action), zap.Error(err))
+		rec.promLost.Inc()
+		return
+	}
+	rec.promEvents.WithLabelValues(event.Action, event.Outcome).Inc()
+}
+
+// FromRequest starts an event with the caller and the address of the request
+func FromRequest(r *http.Request, action string) Event {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return Event{
+		Action:  action,
+		Actor:   middleware.SubjectFromContext(r.Context()),
+		IP:      ip,
+		Outcome: OutcomeSuccess,
+	}
+}
+
+// statusRecorder remembers the status the handler answered with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(body []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(body)
+}
+
+// Route records every call of the route with the outcome taken from the status of the response.
+// It has to run after the TokenMiddleware and before the permission check, so denied calls are recorded too.
+// describe fills in what the call acts on from the request, eg. the id of the product.
+func (rec *Recorder) Route(action string, describe func(r *http.Request, event *Event)) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			sr := &statusRecorder{ResponseWriter: rw}
+			// a handler that panics is still recorded, as a failure
+			panicked := true
+			defer func() {
+				if panicked {
+					rec.recordRoute(r, action, describe, http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(sr, r)
+			panicked = false
+			rec.recordRoute(r, action, describe, sr.status)
+		})
+	}
+}
+
+func (rec *Recorder) recordRoute(r *http.Request, action string, describe func(r *http.Request, event *Event), status int) {
+	event := FromRequest(r, action)
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		event.Outcome = OutcomeDenied
+	case status >= http.StatusBadRequest:
+		event.Outcome = OutcomeFailure
+	}
+	if identity, ok := middleware.IdentityFromContext(r.Context()); ok && identity.ViaAPIKey() {
+		event.Details = map[string]string{"api_key": identity.APIKey}
+	}
+	if describe != nil {
+		describe(r, &event)
+	}
+	rec.Record(r.Context(), event)
+}
+
+// Header describes the call with a request header as the target
+func Header(name string) func(r *http.Request, event *Event) {
+	return func(r *http.Request, event *Event) {
+		event.Target = r.Header.Get(name)
+	}
+}
+
+// Var describes the call with a variable of the route path as the target, eg. the id of /products/{id}
+func Var(name string) func(r *http.Request, event *Event) {
+	return func(r *http.Request, event *Event) {
+		event.Target = mux.Vars(r)[name]
+	}
+}
+
+// maxDetailLength cuts long values, eg. queries, so one call cannot blow up the log
+const maxDetailLength = 256
+
+// Detail sets a detail of the event, cut to a sane length
+func (e *Event) Detail(name string, value string) {
+	if len(value) > maxDetailLength {
+		value = value[:maxDetailLength] + "..."
+	}
+	if e.Details == nil {
+		e.Details = map[string]string{}
+	}
+	e.Details[name] = value
+}
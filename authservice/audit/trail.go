@@ -0,0 +1,243 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// MemoryTrail keeps the events in a slice, for tests and local development
+type MemoryTrail struct {
+	mu     sync.Mutex
+	chain  chain
+	events []Event
+}
+
+// NewMemoryTrail returns an empty trail
+func NewMemoryTrail() *MemoryTrail {
+	return &MemoryTrail{}
+}
+
+// Append chains and keeps the event
+func (t *MemoryTrail) Append(ctx context.Context, event Event) (Event, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	event = t.chain.link(event)
+	t.events = append(t.events, event)
+	return event, nil
+}
+
+// Query returns the matching events, newest first
+func (t *MemoryTrail) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return newestFirst(t.events, filter), nil
+}
+
+// Verify checks the chain
+func (t *MemoryTrail) Verify(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return verifyEvents(t.events, t.chain.key)
+}
+
+// FileTrail appends the events as JSON lines to a file. The file is opened in append mode
+// and synced after every event. Queries read the whole file, it is meant for a single instance.
+// The seq and hash of the last event are kept in a second file, the head, so events cut off
+// the end of the log are noticed as well.
+type FileTrail struct {
+	mu       sync.Mutex
+	path     string
+	headPath string
+	file     *os.File
+	// size is the length of the file up to the last complete event
+	size  int64
+	chain chain
+}
+
+// head is the last event appended, stored next to the log
+type head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// OpenFileTrail opens or creates the file and continues the chain after its last event, hashed with the key.
+// A last line cut off by a crash while it was written is removed, its Append never returned.
+// Lines that are no events do not stop the start, the chain continues after the last event and Verify reports them.
+// If the head is past the last event, events were cut off the end: the chain continues after the head,
+// so the gap stays visible to Verify.
+func OpenFileTrail(path string, key []byte) (*FileTrail, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	// every event goes out in one write with its newline, so a last line without one is torn
+	if end := bytes.LastIndexByte(content, '\n') + 1; end < len(content) {
+		if err := os.Truncate(path, int64(end)); err != nil {
+			return nil, err
+		}
+		content = content[:end]
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	trail := &FileTrail{path: path, headPath: path + ".head", file: file, size: int64(len(content)), chain: chain{key: key}}
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var event Event
+		if json.Unmarshal(line, &event) == nil && event.Hash != "" {
+			trail.chain.seq, trail.chain.hash = event.Seq, event.Hash
+		}
+	}
+	last, err := readHead(trail.headPath)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if last.Seq > trail.chain.seq {
+		trail.chain.seq, trail.chain.hash = last.Seq, last.Hash
+	}
+	return trail, nil
+}
+
+// readHead reads the head, a new log has none
+func readHead(path string) (head, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return head{}, nil
+	}
+	if err != nil {
+		return head{}, err
+	}
+	var last head
+	if err := json.Unmarshal(content, &last); err != nil {
+		return head{}, fmt.Errorf("%w: the head is unreadable", ErrChainBroken)
+	}
+	return last, nil
+}
+
+// writeHead replaces the head. It is written aside and renamed, a crash leaves the old or the new one.
+func writeHead(path string, last head) error {
+	content, err := json.Marshal(last)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// readEvents reads every line of the file. A line that is not an event is an error,
+// somebody edited the file.
+func readEvents(path string) ([]Event, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return nil, fmt.Errorf("%w: line %d is not an event", ErrChainBroken, line)
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// Append chains the event and writes it as a line
+func (t *FileTrail) Append(ctx context.Context, event Event) (Event, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	next := t.chain
+	event = next.link(event)
+	line, err := json.Marshal(event)
+	if err != nil {
+		return Event{}, err
+	}
+	line = append(line, '\n')
+	_, err = t.file.Write(line)
+	if err == nil {
+		err = t.file.Sync()
+	}
+	if err != nil {
+		// a part of the line may be in the file, the next event must not start behind it
+		t.file.Truncate(t.size)
+		return Event{}, err
+	}
+	// the chain only moves on once the event is on disk
+	t.chain = next
+	t.size += int64(len(line))
+	if err := writeHead(t.headPath, head{Seq: event.Seq, Hash: event.Hash}); err != nil {
+		return event, fmt.Errorf("the event was written, but not the head: %w", err)
+	}
+	return event, nil
+}
+
+// Query reads the file and returns the matching events, newest first
+func (t *FileTrail) Query(ctx context.Context, filter Filter) ([]Event, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events, err := readEvents(t.path)
+	if err != nil {
+		return nil, err
+	}
+	return newestFirst(events, filter), nil
+}
+
+// Verify reads the file and checks the chain, and that it reaches the last event we appended
+func (t *FileTrail) Verify(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	events, err := readEvents(t.path)
+	if err != nil {
+		return err
+	}
+	if err := verifyEvents(events, t.chain.key); err != nil {
+		return err
+	}
+	var last Event
+	if len(events) > 0 {
+		last = events[len(events)-1]
+	}
+	if last.Seq != t.chain.seq || last.Hash != t.chain.hash {
+		return &BrokenError{Seq: last.Seq + 1}
+	}
+	return nil
+}
+
+// Close closes the file
+func (t *FileTrail) Close() error {
+	return t.file.Close()
+}
+
+// FileFromEnv opens the trail at AUDIT_LOG_FILE, audit.log in the working directory by default.
+// The hashes are keyed with AUDIT_KEY, without it anybody who can write the file can rebuild the chain.
+func FileFromEnv() (*FileTrail, error) {
+	path := os.Getenv("AUDIT_LOG_FILE")
+	if path == "" {
+		path = "audit.log"
+	}
+	return OpenFileTrail(path, []byte(os.Getenv("AUDIT_KEY")))
+}
@@ -0,0 +1,115 @@
+package authservice
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"go.uber.org/zap"
+)
+
+// pages of the audit log
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// auditVerifyResponse tells if the chain is intact, and if not, the first event that does not fit
+type auditVerifyResponse struct {
+	Intact   bool   `json:"intact"`
+	BrokenAt uint64 `json:"broken_at,omitempty"`
+}
+
+// AuditController lets admins read the audit log. The routes run behind the admin role check.
+type AuditController struct {
+	logger *zap.Logger
+	trail  audit.Trail
+}
+
+// NewAuditController returns a frsh Audit controller
+func NewAuditController(logger *zap.Logger, trail audit.Trail) *AuditController {
+	return &AuditController{
+		logger: logger,
+		trail:  trail,
+	}
+}
+
+// auditFilter reads the filters of the query string
+func auditFilter(r *http.Request) (audit.Filter, []problem.FieldError) {
+	query := r.URL.Query()
+	filter := audit.Filter{
+		Action:  query.Get("action"),
+		Actor:   query.Get("actor"),
+		Target:  query.Get("target"),
+		Outcome: query.Get("outcome"),
+		Limit:   defaultAuditLimit,
+	}
+	var errs []problem.FieldError
+	for _, param := range []struct {
+		name string
+		to   *time.Time
+	}{{"since", &filter.Since}, {"until", &filter.Until}} {
+		if value := query.Get(param.name); value != "" {
+			at, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				errs = append(errs, problem.FieldError{Field: param.name, Message: "must be a RFC 3339 time"})
+			}
+			*param.to = at
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxAuditLimit {
+			errs = append(errs, problem.FieldError{Field: "limit", Message: "must be a number between 1 and 1000"})
+		}
+		filter.Limit = limit
+	}
+	switch filter.Outcome {
+	case "", audit.OutcomeSuccess, audit.OutcomeFailure, audit.OutcomeDenied:
+	default:
+		errs = append(errs, problem.FieldError{Field: "outcome", Message: "must be success, failure or denied"})
+	}
+	return filter, errs
+}
+
+// QueryHandler returns the newest events matching the filters
+func (ctrl *AuditController) QueryHandler(rw http.ResponseWriter, r *http.Request) {
+	filter, errs := auditFilter(r)
+	if len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	events, err := ctrl.trail.Query(r.Context(), filter)
+	if err != nil {
+		ctrl.logger.Error("Unable to read the audit log", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(events)
+}
+
+// VerifyHandler walks the whole chain. It reads every event, so it is not meant to be polled.
+func (ctrl *AuditController) VerifyHandler(rw http.ResponseWriter, r *http.Request) {
+	resp := auditVerifyResponse{Intact: true}
+	err := ctrl.trail.Verify(r.Context())
+	switch {
+	case errors.Is(err, audit.ErrChainBroken):
+		ctrl.logger.Error("The audit log was tampered with", zap.Error(err))
+		resp.Intact = false
+		var broken *audit.BrokenError
+		if errors.As(err, &broken) {
+			resp.BrokenAt = broken.Seq
+		}
+	case err != nil:
+		ctrl.logger.Error("Unable to verify the audit log", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
@@ -0,0 +1,135 @@
+// Package clients holds the registered OAuth2 clients, the machine identities of the
+// services calling our endpoints. Each client gets only the scopes it needs.
+package clients
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+var ErrClientNotFound = errors.New("client not found")
+
+// Client is a registered client. SecretHash is a hash of the password package,
+// the secret itself is only known to the client.
+type Client struct {
+	ID         string   `yaml:"id"`
+	Name       string   `yaml:"name"`
+	SecretHash string   `yaml:"secret_hash"`
+	Scopes     []string `yaml:"scopes"`
+	// Audiences are the services the client may get tokens for, without them it gets the default audiences
+	Audiences []string `yaml:"audiences"`
+	// TokenLifetime overrides the client token lifetime of the token config
+	TokenLifetime time.Duration `yaml:"token_lifetime"`
+}
+
+// AllowsAudience checks if the client may get tokens for the audience
+func (c *Client) AllowsAudience(audience string) bool {
+	if len(c.Audiences) == 0 {
+		return true
+	}
+	for _, allowed := range c.Audiences {
+		if allowed == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks if the scope was granted to the client
+func (c *Client) Allows(scope string) bool {
+	for _, granted := range c.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Store looks up the clients
+type Store interface {
+	Get(ctx context.Context, id string) (Client, error)
+}
+
+// MemoryStore keeps the clients in a map
+type MemoryStore struct {
+	mu      sync.RWMutex
+	clients map[string]Client
+}
+
+// NewMemoryStore returns a store of the clients
+func NewMemoryStore(clients ...Client) *MemoryStore {
+	store := &MemoryStore{clients: map[string]Client{}}
+	for _, client := range clients {
+		store.clients[client.ID] = client
+	}
+	return store
+}
+
+// Get returns the client with the id
+func (s *MemoryStore) Get(ctx context.Context, id string) (Client, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	client, ok := s.clients[id]
+	if !ok {
+		return Client{}, ErrClientNotFound
+	}
+	return client, nil
+}
+
+// clientsFile is the layout of the YAML file
+type clientsFile struct {
+	Clients []Client `yaml:"clients"`
+}
+
+// LoadFile reads the clients from a YAML file. Secrets have to be hashed,
+// a clear text secret in the file is refused.
+func LoadFile(path string) ([]Client, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file clientsFile
+	if err := yaml.UnmarshalStrict(content, &file); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	seen := map[string]bool{}
+	for _, client := range file.Clients {
+		if client.ID == "" || seen[client.ID] {
+			return nil, fmt.Errorf("%s: client ids must be set and unique, got %q", path, client.ID)
+		}
+		seen[client.ID] = true
+		if !strings.HasPrefix(client.SecretHash, "$") {
+			return nil, fmt.Errorf("%s: the secret_hash of %s is not a hash", path, client.ID)
+		}
+		if client.TokenLifetime < 0 {
+			return nil, fmt.Errorf("%s: the token_lifetime of %s must be positive", path, client.ID)
+		}
+		for _, scope := range client.Scopes {
+			if scope == "" || strings.ContainsAny(scope, " \"\\") {
+				return nil, fmt.Errorf("%s: invalid scope %q of %s", path, scope, client.ID)
+			}
+		}
+	}
+	return file.Clients, nil
+}
+
+// StoreFromEnv loads the clients from the file at AUTH_CLIENTS_FILE. Without the variable there are no clients.
+func StoreFromEnv() (*MemoryStore, error) {
+	path := os.Getenv("AUTH_CLIENTS_FILE")
+	if path == "" {
+		return NewMemoryStore(), nil
+	}
+	list, err := LoadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMemoryStore(list...), nil
+}
@@ -0,0 +1,57 @@
+package clients
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "clients")
+	if err != nil {
+		t.Fatalf("Unable to create Temp Dir: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "clients.yaml")
+	ioutil.WriteFile(path, []byte(content), 0600)
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	path := writeFile(t, `
+clients:
+  - id: monitor
+    name: Monitor module
+    secret_hash: "$2y$10$abcdefghijklmnopqrstuu5Gq8kZ3m3kq0Q9m1kQ2m3kq0Q9m1kQ2"
+    scopes: [monitor:write]
+`)
+	list, err := LoadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to load the clients: %v", err)
+	}
+	store := NewMemoryStore(list...)
+	client, err := store.Get(context.Background(), "monitor")
+	if err != nil || !client.Allows("monitor:write") || client.Allows("product:delete") {
+		t.Fatalf("Unexpected client %+v %v", client, err)
+	}
+	if _, err := store.Get(context.Background(), "nobody"); err != ErrClientNotFound {
+		t.Fatalf("Expected ErrClientNotFound, got %v", err)
+	}
+}
+
+func TestLoadFileRejects(t *testing.T) {
+	for name, content := range map[string]string{
+		"Clear Text Secret": "clients:\n  - id: monitor\n    secret_hash: secret\n",
+		"Duplicate Id":      "clients:\n  - id: a\n    secret_hash: $x\n  - id: a\n    secret_hash: $x\n",
+		"Unknown Field":     "clients:\n  - id: a\n    secret: $x\n",
+		"Space In Scope":    "clients:\n  - id: a\n    secret_hash: $x\n    scopes: [\"a b\"]\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := LoadFile(writeFile(t, content)); err == nil {
+				t.Fatalf("Expected the file to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is a long lived credential of a user. Only the hash of the key is stored,
+// the Prefix is the public part used to find the key and to tell keys apart in lists.
+type APIKey struct {
+	ID     uint   `gorm:"primary_key"`
+	UserID uint   `gorm:"not null"`
+	Name   string `gorm:"type:varchar(64);not null"`
+	Prefix string `gorm:"type:varchar(32);not null"`
+	Hash   string `gorm:"type:varchar(64);not null"`
+	// Scopes are the space separated permissions the key is limited to, empty means all of the user
+	Scopes     string    `gorm:"type:varchar(255);not null;default:''"`
+	CreatedAt  time.Time `gorm:"not null"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// ScopeList splits the scopes of the key
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// Usable tells if the key is neither revoked nor expired
+func (k *APIKey) Usable(now time.Time) bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || now.Before(*k.ExpiresAt)
+}
+
+// APIKeyStore keeps the api keys of the users
+type APIKeyStore interface {
+	// Create sets the ID and the CreatedAt of the key
+	Create(ctx context.Context, key *APIKey) error
+	GetByPrefix(ctx context.Context, prefix string) (APIKey, error)
+	// ListByUser returns all keys of the user, revoked ones included, newest first
+	ListByUser(ctx context.Context, userID uint) ([]APIKey, error)
+	// Revoke only revokes a key of the user, for other keys it returns ErrAPIKeyNotFound
+	Revoke(ctx context.Context, userID uint, id uint, at time.Time) error
+	// Touch records the last use of the key
+	Touch(ctx context.Context, id uint, at time.Time) error
+}
+
+// MemoryAPIKeyStore keeps the api keys in a map, like the MemoryUserStore
+type MemoryAPIKeyStore struct {
+	mu     sync.RWMutex
+	nextID uint
+	keys   map[uint]APIKey
+}
+
+// NewMemoryAPIKeyStore returns an empty store
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{nextID: 1, keys: map[uint]APIKey{}}
+}
+
+// Create adds the key
+func (s *MemoryAPIKeyStore) Create(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key.ID = s.nextID
+	s.nextID++
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	s.keys[key.ID] = *key
+	return nil
+}
+
+// GetByPrefix finds the key with the prefix
+func (s *MemoryAPIKeyStore) GetByPrefix(ctx context.Context, prefix string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if key.Prefix == prefix {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrAPIKeyNotFound
+}
+
+// ListByUser returns the keys of the user, newest first
+func (s *MemoryAPIKeyStore) ListByUser(ctx context.Context, userID uint) ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []APIKey{}
+	for _, key := range s.keys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID > keys[j].ID })
+	return keys, nil
+}
+
+// Revoke revokes the key if it belongs to the user
+func (s *MemoryAPIKeyStore) Revoke(ctx context.Context, userID uint, id uint, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok || key.UserID != userID {
+		return ErrAPIKeyNotFound
+	}
+	if key.RevokedAt == nil {
+		key.RevokedAt = &at
+		s.keys[id] = key
+	}
+	return nil
+}
+
+// Touch records the last use of the key
+func (s *MemoryAPIKeyStore) Touch(ctx context.Context, id uint, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[id]
+	if !ok {
+		return ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = &at
+	s.keys[id] = key
+	return nil
+}
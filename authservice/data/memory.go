@@ -0,0 +1,172 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryUserStore keeps the users in maps guarded by a lock. It is lost on restart,
+// so it is meant for local development and tests.
+type MemoryUserStore struct {
+	mu         sync.RWMutex
+	nextID     uint
+	users      map[uint]User
+	byEmail    map[string]uint
+	byUsername map[string]uint
+}
+
+// NewMemoryUserStore returns a store holding the given users
+func NewMemoryUserStore(users ...User) *MemoryUserStore {
+	store := &MemoryUserStore{
+		nextID:     1,
+		users:      map[uint]User{},
+		byEmail:    map[string]uint{},
+		byUsername: map[string]uint{},
+	}
+	for _, usr := range users {
+		store.Create(context.Background(), &usr)
+	}
+	return store
+}
+
+// key is the key of the email and username maps. MySQL compares them ignoring the case,
+// so the memory store does the same, otherwise Bob@x and bob@x would be two accounts.
+func key(s string) string {
+	return strings.ToLower(s)
+}
+
+// GetByID finds the user with the id
+func (s *MemoryUserStore) GetByID(ctx context.Context, id uint) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	usr, ok := s.users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return usr, nil
+}
+
+// GetByEmail finds the user with the email
+func (s *MemoryUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.byEmail[key(email)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return s.users[id], nil
+}
+
+// GetByUsername finds the user with the username
+func (s *MemoryUserStore) GetByUsername(ctx context.Context, username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	id, ok := s.byUsername[key(username)]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return s.users[id], nil
+}
+
+// GetByExternalID finds the user linked to the account of the identity provider.
+// There are few users in memory, so we simply look at all of them.
+func (s *MemoryUserStore) GetByExternalID(ctx context.Context, issuer string, subject string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, usr := range s.users {
+		if usr.External() && usr.ExternalIssuer == issuer && usr.ExternalSubject == subject {
+			return usr, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+// Create adds the user. The check and the insert happen under one lock, so concurrent signups cannot race.
+func (s *MemoryUserStore) Create(ctx context.Context, usr *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byEmail[key(usr.Email)]; ok {
+		return ErrUserExists
+	}
+	if _, ok := s.byUsername[key(usr.Username)]; ok {
+		return ErrUserExists
+	}
+	usr.ID = s.nextID
+	s.nextID++
+	if usr.CreateDate.IsZero() {
+		usr.CreateDate = time.Now()
+	}
+	// same as the default of the status column
+	if usr.Status == "" {
+		usr.Status = StatusActive
+	}
+	s.users[usr.ID] = *usr
+	s.byEmail[key(usr.Email)] = usr.ID
+	s.byUsername[key(usr.Username)] = usr.ID
+	return nil
+}
+
+// Update replaces the user with the same id
+func (s *MemoryUserStore) Update(ctx context.Context, usr User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.users[usr.ID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if id, ok := s.byEmail[key(usr.Email)]; ok && id != usr.ID {
+		return ErrUserExists
+	}
+	if id, ok := s.byUsername[key(usr.Username)]; ok && id != usr.ID {
+		return ErrUserExists
+	}
+	delete(s.byEmail, key(old.Email))
+	delete(s.byUsername, key(old.Username))
+	s.users[usr.ID] = usr
+	s.byEmail[key(usr.Email)] = usr.ID
+	s.byUsername[key(usr.Username)] = usr.ID
+	return nil
+}
+
+// Delete removes the user with the id
+func (s *MemoryUserStore) Delete(ctx context.Context, id uint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usr, ok := s.users[id]
+	if !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, id)
+	delete(s.byEmail, key(usr.Email))
+	delete(s.byUsername, key(usr.Username))
+	return nil
+}
+
+// List returns a page of users ordered by id
+func (s *MemoryUserStore) List(ctx context.Context, opts ListOptions) ([]User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	users := make([]User, 0, len(s.users))
+	for _, usr := range s.users {
+		if opts.matches(usr) {
+			users = append(users, usr)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return page(users, opts), nil
+}
+
+// page cuts the page out of the ordered users
+func page(users []User, opts ListOptions) []User {
+	if opts.Offset >= len(users) {
+		return []User{}
+	}
+	users = users[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(users) {
+		users = users[:opts.Limit]
+	}
+	return users
+}
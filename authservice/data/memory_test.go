@@ -0,0 +1,99 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestMemoryUserStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore(DefaultUsers()...)
+
+	usr, err := store.GetByEmail(ctx, "abc@gmail.com")
+	if err != nil || usr.Username != "abc12" || usr.Roles()[0] != "admin" {
+		t.Fatalf("Default user not found, got %+v %v", usr, err)
+	}
+	if _, err := store.GetByUsername(ctx, "nobody"); err != ErrUserNotFound {
+		t.Fatalf("Expected ErrUserNotFound, got %v", err)
+	}
+
+	if found, err := store.GetByEmail(ctx, "ABC@gmail.com"); err != nil || found.ID != usr.ID {
+		t.Fatalf("Expected the email to ignore the case like MySQL, got %+v %v", found, err)
+	}
+	if err := store.Create(ctx, &User{Email: "Abc@Gmail.com", Username: "other"}); err != ErrUserExists {
+		t.Fatalf("Expected the email in another case to be taken, got %v", err)
+	}
+
+	usr.Email = "chekme@example.com"
+	if err := store.Update(ctx, usr); err != ErrUserExists {
+		t.Fatalf("Update must not take the email of another user, got %v", err)
+	}
+	usr.Email = "new@gmail.com"
+	if err := store.Update(ctx, usr); err != nil {
+		t.Fatalf("Update failed: %v", err)
+	}
+	if _, err := store.GetByEmail(ctx, "abc@gmail.com"); err != ErrUserNotFound {
+		t.Fatalf("The old email must be released, got %v", err)
+	}
+
+	if err := store.Delete(ctx, usr.ID); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	users, _ := store.List(ctx, ListOptions{})
+	if len(users) != 1 || users[0].Username != "checkme34" {
+		t.Fatalf("Unexpected users after delete %+v", users)
+	}
+}
+
+func TestConcurrentSignups(t *testing.T) {
+	store := NewMemoryUserStore()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created := 0
+
+	// the same username from many signups at once, only one of them may win
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			usr := User{Email: fmt.Sprintf("user%d@gmail.com", i), Username: "racer"}
+			if store.Create(context.Background(), &usr) == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if created != 1 {
+		t.Fatalf("Expected exactly one signup to succeed, got %d", created)
+	}
+}
+
+func TestListFilters(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryUserStore(DefaultUsers()...)
+	store.Create(ctx, &User{Email: "pending@gmail.com", Username: "pending1", Fullname: "Still Pending", Status: StatusPending})
+
+	admin := RoleAdmin
+	tests := []struct {
+		name string
+		opts ListOptions
+		want []string
+	}{
+		{"Role", ListOptions{Role: &admin}, []string{"abc12"}},
+		{"Status", ListOptions{Status: StatusPending}, []string{"pending1"}},
+		{"Query", ListOptions{Query: "CHECK"}, []string{"checkme34"}},
+		{"Page", ListOptions{Offset: 1, Limit: 1}, []string{"checkme34"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			users, _ := store.List(ctx, tc.opts)
+			if len(users) != len(tc.want) || users[0].Username != tc.want[0] {
+				t.Fatalf("Expected %v, got %+v", tc.want, users)
+			}
+		})
+	}
+}
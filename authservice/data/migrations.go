@@ -0,0 +1,155 @@
+package data
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// migration is one versioned change of the schema. Applied versions are recorded
+// in user_schema_migrations, so every migration runs exactly once per database.
+type migration struct {
+	version int
+	name    string
+	up      func(tx *gorm.DB) error
+}
+
+// schemaMigration is a row of the user_schema_migrations table
+type schemaMigration struct {
+	Version   int `gorm:"primary_key;auto_increment:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (schemaMigration) TableName() string {
+	return "user_schema_migrations"
+}
+
+// usersV1 is the users table as it was created by the first migration.
+// Later migrations alter the table, they never change this struct.
+type usersV1 struct {
+	ID           uint      `gorm:"primary_key"`
+	Email        string    `gorm:"type:varchar(255);not null"`
+	Username     string    `gorm:"type:varchar(64);not null"`
+	PasswordHash string    `gorm:"type:varchar(255);not null"`
+	Fullname     string    `gorm:"type:varchar(255)"`
+	CreateDate   time.Time `gorm:"not null"`
+	Role         int       `gorm:"not null;default:0"`
+}
+
+func (usersV1) TableName() string {
+	return "users"
+}
+
+// apiKeysV1 is the api_keys table as it was created
+type apiKeysV1 struct {
+	ID         uint      `gorm:"primary_key"`
+	UserID     uint      `gorm:"not null"`
+	Name       string    `gorm:"type:varchar(64);not null"`
+	Prefix     string    `gorm:"type:varchar(32);not null"`
+	Hash       string    `gorm:"type:varchar(64);not null"`
+	Scopes     string    `gorm:"type:varchar(255);not null;default:''"`
+	CreatedAt  time.Time `gorm:"not null"`
+	ExpiresAt  *time.Time
+	LastUsedAt *time.Time
+	RevokedAt  *time.Time
+}
+
+func (apiKeysV1) TableName() string {
+	return "api_keys"
+}
+
+// new migrations are appended with the next version, applied ones are never edited
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create users table",
+		up: func(tx *gorm.DB) error {
+			return tx.CreateTable(&usersV1{}).Error
+		},
+	},
+	{
+		version: 2,
+		name:    "unique email and username",
+		up: func(tx *gorm.DB) error {
+			if err := tx.Model(&usersV1{}).AddUniqueIndex("idx_users_email", "email").Error; err != nil {
+				return err
+			}
+			return tx.Model(&usersV1{}).AddUniqueIndex("idx_users_username", "username").Error
+		},
+	},
+	{
+		version: 3,
+		name:    "account status",
+		up: func(tx *gorm.DB) error {
+			// the users that already exist were never asked to verify, they stay active
+			return tx.Exec("ALTER TABLE users ADD COLUMN status varchar(16) NOT NULL DEFAULT 'active'").Error
+		},
+	},
+	{
+		version: 4,
+		name:    "two-factor authentication",
+		up: func(tx *gorm.DB) error {
+			return tx.Exec("ALTER TABLE users ADD COLUMN mfa_secret varchar(64) NOT NULL DEFAULT '', " +
+				"ADD COLUMN mfa_enabled boolean NOT NULL DEFAULT false, " +
+				"ADD COLUMN mfa_last_step bigint NOT NULL DEFAULT 0, " +
+				"ADD COLUMN recovery_codes text").Error
+		},
+	},
+	{
+		version: 5,
+		name:    "api keys",
+		up: func(tx *gorm.DB) error {
+			if err := tx.CreateTable(&apiKeysV1{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Model(&apiKeysV1{}).AddUniqueIndex("idx_api_keys_prefix", "prefix").Error; err != nil {
+				return err
+			}
+			return tx.Model(&apiKeysV1{}).AddIndex("idx_api_keys_user_id", "user_id").Error
+		},
+	},
+	{
+		version: 6,
+		name:    "external identities",
+		up: func(tx *gorm.DB) error {
+			// not unique, all the local users share the empty values
+			err := tx.Exec("ALTER TABLE users ADD COLUMN external_issuer varchar(255) NOT NULL DEFAULT '', " +
+				"ADD COLUMN external_subject varchar(255) NOT NULL DEFAULT ''").Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("CREATE INDEX idx_users_external ON users (external_issuer, external_subject)").Error
+		},
+	},
+}
+
+// migrate applies the migrations that were not applied to the database yet
+func migrate(db *gorm.DB) error {
+	if err := db.AutoMigrate(&schemaMigration{}).Error; err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		var count int
+		if err := db.Model(&schemaMigration{}).Where("version = ?", m.version).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			continue
+		}
+		// MySQL commits DDL implicitly, the transaction only keeps the bookkeeping consistent
+		tx := db.Begin()
+		if err := m.up(tx); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Create(&schemaMigration{Version: m.version, Name: m.name, AppliedAt: time.Now()}).Error; err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit().Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
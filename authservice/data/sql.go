@@ -0,0 +1,217 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+)
+
+// mysql error number for a violated unique index
+const mysqlDuplicateEntry = 1062
+
+// escapes the wildcards of LIKE, so a search for "a_b" does not match "axb"
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SQLUserStore keeps the users in the users table. Uniqueness of email and username
+// is enforced by unique indexes, so concurrent signups on several instances cannot race.
+type SQLUserStore struct {
+	db *gorm.DB
+}
+
+// OpenSQLUserStore connects to the MySQL database the same way the productservice does
+// and migrates the users table to the latest version
+func OpenSQLUserStore(secret string) (*SQLUserStore, error) {
+	if secret == "" {
+		return nil, errors.New("empty mysql secret")
+	}
+	db, err := gorm.Open("mysql", secret)
+	if err != nil {
+		return nil, err
+	}
+	return NewSQLUserStore(db)
+}
+
+// NewSQLUserStore uses an open connection and migrates the users table to the latest version
+func NewSQLUserStore(db *gorm.DB) (*SQLUserStore, error) {
+	if err := migrate(db); err != nil {
+		return nil, err
+	}
+	return &SQLUserStore{db: db}, nil
+}
+
+// translates the gorm errors to the errors of the UserStore
+func storeError(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrUserNotFound
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry {
+		return ErrUserExists
+	}
+	return err
+}
+
+// GetByID finds the user with the id
+func (s *SQLUserStore) GetByID(ctx context.Context, id uint) (User, error) {
+	var usr User
+	err := s.db.Where("id = ?", id).First(&usr).Error
+	return usr, storeError(err)
+}
+
+// GetByEmail finds the user with the email
+func (s *SQLUserStore) GetByEmail(ctx context.Context, email string) (User, error) {
+	var usr User
+	err := s.db.Where("email = ?", email).First(&usr).Error
+	return usr, storeError(err)
+}
+
+// GetByUsername finds the user with the username
+func (s *SQLUserStore) GetByUsername(ctx context.Context, username string) (User, error) {
+	var usr User
+	err := s.db.Where("username = ?", username).First(&usr).Error
+	return usr, storeError(err)
+}
+
+// GetByExternalID finds the user linked to the account of the identity provider
+func (s *SQLUserStore) GetByExternalID(ctx context.Context, issuer string, subject string) (User, error) {
+	var usr User
+	err := s.db.Where("external_issuer = ? AND external_subject = ?", issuer, subject).First(&usr).Error
+	return usr, storeError(err)
+}
+
+// Create inserts the user, the unique indexes reject duplicates
+func (s *SQLUserStore) Create(ctx context.Context, usr *User) error {
+	if usr.CreateDate.IsZero() {
+		usr.CreateDate = time.Now()
+	}
+	if usr.Status == "" {
+		usr.Status = StatusActive
+	}
+	return storeError(s.db.Create(usr).Error)
+}
+
+// Update saves all fields of the user
+func (s *SQLUserStore) Update(ctx context.Context, usr User) error {
+	result := s.db.Model(&User{}).Where("id = ?", usr.ID).Updates(map[string]interface{}{
+		"email":            usr.Email,
+		"username":         usr.Username,
+		"password_hash":    usr.PasswordHash,
+		"fullname":         usr.Fullname,
+		"role":             usr.Role,
+		"status":           usr.Status,
+		"mfa_secret":       usr.MFASecret,
+		"mfa_enabled":      usr.MFAEnabled,
+		"mfa_last_step":    usr.MFALastStep,
+		"recovery_codes":   usr.RecoveryCodes,
+		"external_issuer":  usr.ExternalIssuer,
+		"external_subject": usr.ExternalSubject,
+	})
+	if result.Error != nil {
+		return storeError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// nothing changed or the user does not exist, we have to look which one it is
+		var count int
+		if err := s.db.Model(&User{}).Where("id = ?", usr.ID).Count(&count).Error; err != nil {
+			return storeError(err)
+		}
+		if count == 0 {
+			return ErrUserNotFound
+		}
+	}
+	return nil
+}
+
+// Delete removes the user with the id
+func (s *SQLUserStore) Delete(ctx context.Context, id uint) error {
+	result := s.db.Delete(&User{}, id)
+	if result.Error != nil {
+		return storeError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// List returns a page of users ordered by id
+func (s *SQLUserStore) List(ctx context.Context, opts ListOptions) ([]User, error) {
+	users := []User{}
+	query := s.db.Order("id").Offset(opts.Offset)
+	if opts.Role != nil {
+		query = query.Where("role = ?", *opts.Role)
+	}
+	if opts.Status != "" {
+		query = query.Where("status = ?", opts.Status)
+	}
+	if opts.Query != "" {
+		like := "%" + likeEscaper.Replace(opts.Query) + "%"
+		query = query.Where("email LIKE ? OR username LIKE ? OR fullname LIKE ?", like, like, like)
+	}
+	if opts.Limit > 0 {
+		query = query.Limit(opts.Limit)
+	}
+	err := query.Find(&users).Error
+	return users, storeError(err)
+}
+
+// APIKeys returns the api key store on the same connection, the migrations already created its table
+func (s *SQLUserStore) APIKeys() *SQLAPIKeyStore {
+	return &SQLAPIKeyStore{db: s.db}
+}
+
+// SQLAPIKeyStore keeps the api keys in the api_keys table
+type SQLAPIKeyStore struct {
+	db *gorm.DB
+}
+
+func apiKeyError(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// Create inserts the key, the unique index on the prefix rejects the unlikely collision
+func (s *SQLAPIKeyStore) Create(ctx context.Context, key *APIKey) error {
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	return s.db.Create(key).Error
+}
+
+// GetByPrefix finds the key with the prefix
+func (s *SQLAPIKeyStore) GetByPrefix(ctx context.Context, prefix string) (APIKey, error) {
+	var key APIKey
+	err := s.db.Where("prefix = ?", prefix).First(&key).Error
+	return key, apiKeyError(err)
+}
+
+// ListByUser returns the keys of the user, newest first
+func (s *SQLAPIKeyStore) ListByUser(ctx context.Context, userID uint) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := s.db.Where("user_id = ?", userID).Order("id desc").Find(&keys).Error
+	return keys, apiKeyError(err)
+}
+
+// Revoke revokes the key if it belongs to the user. Revoking twice keeps the first time.
+func (s *SQLAPIKeyStore) Revoke(ctx context.Context, userID uint, id uint, at time.Time) error {
+	var count int
+	if err := s.db.Model(&APIKey{}).Where("id = ? AND user_id = ?", id, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return s.db.Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", id).Update("revoked_at", at).Error
+}
+
+// Touch records the last use of the key
+func (s *SQLAPIKeyStore) Touch(ctx context.Context, id uint, at time.Time) error {
+	return s.db.Model(&APIKey{}).Where("id = ?", id).Update("last_used_at", at).Error
+}
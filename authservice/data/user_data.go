@@ -1,68 +1,177 @@
 package data
 
-// User struct
-type user struct {
-	email        string
-	username     string
-	passwordhash string
-	fullname     string
-	createDate   string
-	role         int
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("email or username already exists")
+)
+
+// Roles a user can have
+const (
+	RoleUser  = 0
+	RoleAdmin = 1
+)
+
+// Status of an account. New accounts are pending until the email is verified,
+// disabled ones were turned off by an admin.
+const (
+	StatusPending  = "pending"
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// RoleName is the name of the role as it is written to the roles claim of the token
+func RoleName(role int) string {
+	switch role {
+	case RoleAdmin:
+		return "admin"
+	case RoleUser:
+		return "user"
+	}
+	return ""
 }
 
-// currently this is acting as our database
-var userList = []user{
-	{
-		email:        "abc@gmail.com",
-		username:     "abc12",
-		passwordhash: "hashedme1",
-		fullname:     "abc def",
-		createDate:   "1631600786",
-		role:         1,
-	},
-	{
-		email:        "chekme@example.com",
-		username:     "checkme34",
-		passwordhash: "hashedme2",
-		fullname:     "check me",
-		createDate:   "1631600837",
-		role:         0,
-	},
+// RoleFromName is the reverse of RoleName
+func RoleFromName(name string) (int, bool) {
+	switch name {
+	case "admin":
+		return RoleAdmin, true
+	case "user":
+		return RoleUser, true
+	}
+	return 0, false
 }
 
-// based on the email id provided, finds the user object
-// can be seen as the main constructor to start validation
-func GetUserObject(email string) (user, bool) {
-	//needs to be replaces using Database
-	for _, user := range userList {
-		if user.email == email {
-			return user, true
-		}
+// User struct. The gorm tags describe the users table of the SQL store.
+// PasswordHash is the encoded hash of the password package, never the password itself.
+type User struct {
+	ID           uint      `gorm:"primary_key"`
+	Email        string    `gorm:"type:varchar(255);not null"`
+	Username     string    `gorm:"type:varchar(64);not null"`
+	PasswordHash string    `gorm:"type:varchar(255);not null"`
+	Fullname     string    `gorm:"type:varchar(255)"`
+	CreateDate   time.Time `gorm:"not null"`
+	Role         int       `gorm:"not null;default:0"`
+	Status       string    `gorm:"type:varchar(16);not null;default:'active'"`
+	// MFASecret is the TOTP secret, MFAEnabled is only set once the user confirmed a code.
+	// MFALastStep is the time step of the last accepted code, so codes cannot be replayed.
+	MFASecret   string `gorm:"column:mfa_secret;type:varchar(64);not null;default:''"`
+	MFAEnabled  bool   `gorm:"column:mfa_enabled;not null;default:false"`
+	MFALastStep int64  `gorm:"column:mfa_last_step;not null;default:0"`
+	// RecoveryCodes are the hashes of the unused recovery codes, separated by commas
+	RecoveryCodes string `gorm:"column:recovery_codes;type:text"`
+	// ExternalIssuer and ExternalSubject link the user to an account of an OpenID Connect provider,
+	// the iss and sub of its ID tokens. Both are empty for local users.
+	ExternalIssuer  string `gorm:"type:varchar(255);not null;default:''"`
+	ExternalSubject string `gorm:"type:varchar(255);not null;default:''"`
+}
+
+// RecoveryCodeHashes returns the hashes of the unused recovery codes
+func (u *User) RecoveryCodeHashes() []string {
+	if u.RecoveryCodes == "" {
+		return nil
 	}
-	return user{}, false
+	return strings.Split(u.RecoveryCodes, ",")
+}
+
+// SetRecoveryCodeHashes replaces the recovery codes
+func (u *User) SetRecoveryCodeHashes(hashes []string) {
+	u.RecoveryCodes = strings.Join(hashes, ",")
 }
 
-// checks if the password hash is valid
-func (u *user) ValidatePasswordHash(pswdhash string) bool {
-	return u.passwordhash == pswdhash
+// HasPassword tells if the user can sign in with a password. Users created
+// by the identity provider sign in there and have none.
+func (u *User) HasPassword() bool {
+	return u.PasswordHash != ""
 }
 
-// this simply adds the user to the list
-func AddUserObject(email string, username string, passwordhash string, fullname string, role int) bool {
-	// declare the new user object
-	newUser := user{
-		email:        email,
-		passwordhash: passwordhash,
-		username:     username,
-		fullname:     fullname,
-		role:         role,
+// External tells if the user is linked to an account of the identity provider
+func (u *User) External() bool {
+	return u.ExternalIssuer != "" && u.ExternalSubject != ""
+}
+
+// Active tells if the user may sign in
+func (u *User) Active() bool {
+	return u.Status == StatusActive
+}
+
+// Roles returns the names of the roles of the user for the token
+func (u *User) Roles() []string {
+	if name := RoleName(u.Role); name != "" {
+		return []string{name}
+	}
+	return nil
+}
+
+// ListOptions pages through the users, ordered by id. The filters are optional,
+// Query matches a part of the email, the username or the full name.
+type ListOptions struct {
+	Offset int
+	Limit  int
+	Role   *int
+	Status string
+	Query  string
+}
+
+// matches tells if the user passes the filters of the options
+func (opts ListOptions) matches(usr User) bool {
+	if opts.Role != nil && usr.Role != *opts.Role {
+		return false
 	}
-	// check if a user already exists
-	for _, ele := range userList {
-		if ele.email == email || ele.username == username {
-			return false
-		}
+	if opts.Status != "" && usr.Status != opts.Status {
+		return false
+	}
+	if opts.Query != "" {
+		query := strings.ToLower(opts.Query)
+		return strings.Contains(strings.ToLower(usr.Email), query) ||
+			strings.Contains(strings.ToLower(usr.Username), query) ||
+			strings.Contains(strings.ToLower(usr.Fullname), query)
 	}
-	userList = append(userList, newUser)
 	return true
 }
+
+// UserStore is our database of users. Email and username are unique,
+// creating a user with an existing one returns ErrUserExists.
+type UserStore interface {
+	GetByID(ctx context.Context, id uint) (User, error)
+	GetByEmail(ctx context.Context, email string) (User, error)
+	GetByUsername(ctx context.Context, username string) (User, error)
+	// GetByExternalID finds the user linked to the account of the identity provider
+	GetByExternalID(ctx context.Context, issuer string, subject string) (User, error)
+	// Create sets the ID and the CreateDate of the user
+	Create(ctx context.Context, usr *User) error
+	Update(ctx context.Context, usr User) error
+	Delete(ctx context.Context, id uint) error
+	List(ctx context.Context, opts ListOptions) ([]User, error)
+}
+
+// DefaultUsers are the users we start the in-memory store with.
+// The passwords are in clear text here and get hashed when the store is set up.
+func DefaultUsers() []User {
+	return []User{
+		{
+			Email:        "abc@gmail.com",
+			Username:     "abc12",
+			PasswordHash: "hashedme1",
+			Fullname:     "abc def",
+			CreateDate:   time.Unix(1631600786, 0),
+			Role:         RoleAdmin,
+			Status:       StatusActive,
+		},
+		{
+			Email:        "chekme@example.com",
+			Username:     "checkme34",
+			PasswordHash: "hashedme2",
+			Fullname:     "check me",
+			CreateDate:   time.Unix(1631600837, 0),
+			Role:         RoleUser,
+			Status:       StatusActive,
+		},
+	}
+}
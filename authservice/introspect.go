@@ -0,0 +1,199 @@
+package authservice
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/clients"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+var introspections = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "introspection_total",
+	Help: "Token introspections by result",
+}, []string{"result"})
+
+// IntrospectionResponse is the answer of RFC 7662 2.2. An inactive token only gets active false,
+// the caller learns nothing else about it.
+type IntrospectionResponse struct {
+	Active    bool         `json:"active"`
+	Scope     string       `json:"scope,omitempty"`
+	ClientID  string       `json:"client_id,omitempty"`
+	Username  string       `json:"username,omitempty"`
+	TokenType string       `json:"token_type,omitempty"`
+	ExpiresAt int64        `json:"exp,omitempty"`
+	IssuedAt  int64        `json:"iat,omitempty"`
+	NotBefore int64        `json:"nbf,omitempty"`
+	Subject   string       `json:"sub,omitempty"`
+	Audience  jwt.Audience `json:"aud,omitempty"`
+	Issuer    string       `json:"iss,omitempty"`
+	ID        string       `json:"jti,omitempty"`
+	Email     string       `json:"email,omitempty"`
+	Roles     []string     `json:"roles,omitempty"`
+	AMR       []string     `json:"amr,omitempty"`
+	SessionID string       `json:"sid,omitempty"`
+}
+
+// IntrospectionController answers registered clients asking about a token, for the services
+// that cannot validate the tokens themselves or have to know about revocations
+type IntrospectionController struct {
+	logger      *zap.Logger
+	promResults *prometheus.CounterVec
+	keyring     *jwt.Keyring
+	tokens      *tokenconfig.Config
+	clients     clients.Store
+	hasher      *password.Hasher
+	revocations tokenstore.RevocationList
+	users       data.UserStore
+}
+
+// NewIntrospectionController returns a frsh Introspection controller
+func NewIntrospectionController(logger *zap.Logger, keyring *jwt.Keyring, tokens *tokenconfig.Config, clientStore clients.Store, hasher *password.Hasher, revocations tokenstore.RevocationList, users data.UserStore) *IntrospectionController {
+	return &IntrospectionController{
+		logger:      logger,
+		promResults: introspections,
+		keyring:     keyring,
+		tokens:      tokens,
+		clients:     clientStore,
+		hasher:      hasher,
+		revocations: revocations,
+		users:       users,
+	}
+}
+
+// IntrospectHandler implements RFC 7662. Only our access tokens can be active, refresh tokens
+// are never shown to other services and are reported inactive like any unknown token.
+func (ctrl *IntrospectionController) IntrospectHandler(rw http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		ctrl.writeError(rw, http.StatusBadRequest, "invalid_request", "Content-Type must be application/x-www-form-urlencoded")
+		return
+	}
+	r.Body = http.MaxBytesReader(rw, r.Body, maxBodySize)
+	if err := r.ParseForm(); err != nil {
+		ctrl.writeError(rw, http.StatusBadRequest, "invalid_request", "The body is not a valid form")
+		return
+	}
+
+	client, err := authenticateClient(r, ctrl.clients, ctrl.hasher, ctrl.logger)
+	switch err {
+	case nil:
+	case errClientMissing:
+		ctrl.writeError(rw, http.StatusUnauthorized, "invalid_client", "Client authentication is missing")
+		return
+	case errClientFailed:
+		ctrl.writeError(rw, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	default:
+		ctrl.writeError(rw, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	token := r.PostForm.Get("token")
+	if token == "" {
+		ctrl.writeError(rw, http.StatusBadRequest, "invalid_request", "The token is missing")
+		return
+	}
+	// token_type_hint is only a hint, RFC 7662 2.1 says to look further when it is wrong,
+	// and there is only one kind of token we could find anyway
+
+	response, reason, err := ctrl.introspect(r.Context(), token)
+	if err != nil {
+		ctrl.logger.Error("Unable to introspect the token", zap.Error(err))
+		ctrl.writeError(rw, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if response.Active {
+		ctrl.promResults.WithLabelValues("active").Inc()
+		ctrl.logger.Info("Introspected an active token", zap.String("client_id", client.ID), zap.String("jti", response.ID))
+	} else {
+		ctrl.promResults.WithLabelValues("inactive").Inc()
+		ctrl.logger.Info("Introspected an inactive token", zap.String("client_id", client.ID), zap.String("reason", reason))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(rw).Encode(response)
+}
+
+// introspect checks the token like the middleware does, and then that the account behind it
+// still exists. The reason of an inactive token is only for our logs.
+func (ctrl *IntrospectionController) introspect(ctx context.Context, token string) (IntrospectionResponse, string, error) {
+	inactive := IntrospectionResponse{}
+	claims, err := jwt.ValidateToken(token, ctrl.keyring, jwt.Validator{Leeway: jwt.GetLeeway(), Issuer: ctrl.tokens.Issuer})
+	if err != nil {
+		return inactive, err.Error(), nil
+	}
+	// the action tokens of mails and MFA are signed by us too, but they are no access tokens
+	known := false
+	for _, audience := range claims.Audience {
+		known = known || ctrl.tokens.Known(audience)
+	}
+	if !known {
+		return inactive, "not an access token", nil
+	}
+
+	revoked, err := ctrl.revocations.IsRevoked(ctx, claims.ID)
+	if err == nil && !revoked && claims.SessionID != "" {
+		revoked, err = ctrl.revocations.IsRevoked(ctx, tokenstore.SessionRevocation(claims.SessionID))
+	}
+	if err != nil {
+		return inactive, "", err
+	}
+	if revoked {
+		return inactive, "token was revoked", nil
+	}
+
+	response := IntrospectionResponse{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt,
+		IssuedAt:  claims.IssuedAt,
+		NotBefore: claims.NotBefore,
+		Subject:   claims.Subject,
+		Audience:  claims.Audience,
+		Issuer:    claims.Issuer,
+		ID:        claims.ID,
+		Email:     claims.Email,
+		Roles:     claims.Roles,
+		AMR:       claims.AMR,
+		SessionID: claims.SessionID,
+	}
+	if claims.ClientID != "" {
+		_, err := ctrl.clients.Get(ctx, claims.ClientID)
+		if err == clients.ErrClientNotFound {
+			return inactive, "client was deleted", nil
+		}
+		if err != nil {
+			return inactive, "", err
+		}
+		return response, "", nil
+	}
+
+	usr, err := ctrl.users.GetByUsername(ctx, claims.Subject)
+	if err != nil && err != data.ErrUserNotFound {
+		return inactive, "", err
+	}
+	// a deleted account could have been taken over by a new signup with the same username
+	if err == data.ErrUserNotFound || !usr.Active() || usr.Email != claims.Email {
+		return inactive, "user does not exist anymore or was disabled", nil
+	}
+	response.Username = usr.Username
+	return response, "", nil
+}
+
+func (ctrl *IntrospectionController) writeError(rw http.ResponseWriter, status int, code string, description string) {
+	ctrl.promResults.WithLabelValues(code).Inc()
+	writeOAuthError(rw, status, code, description)
+}
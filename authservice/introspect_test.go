@@ -0,0 +1,99 @@
+package authservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/clients"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+func TestIntrospection(t *testing.T) {
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	tokens := tokenconfig.Default()
+	hasher, _ := password.NewHasher(password.Params{Algorithm: password.Bcrypt, Cost: 4})
+	secretHash, _ := hasher.Hash("gateway-secret")
+	monitor := clients.Client{ID: "monitor", SecretHash: secretHash, Scopes: []string{"monitor:write"}}
+	store := clients.NewMemoryStore(clients.Client{ID: "gateway", SecretHash: secretHash}, monitor)
+	users := data.NewMemoryUserStore(data.User{Email: "abc@gmail.com", Username: "abc12", PasswordHash: "hashedme1", Role: data.RoleAdmin})
+	revocations := tokenstore.NewMemoryRevocationList()
+	ctrl := NewIntrospectionController(zap.NewNop(), keyring, tokens, store, hasher, revocations, users)
+
+	introspect := func(token string, basic ...string) (int, IntrospectionResponse) {
+		req := formRequest(url.Values{"token": {token}, "token_type_hint": {"access_token"}})
+		if len(basic) == 2 {
+			req.SetBasicAuth(basic[0], basic[1])
+		}
+		rw := httptest.NewRecorder()
+		ctrl.IntrospectHandler(rw, req)
+		var resp IntrospectionResponse
+		json.NewDecoder(rw.Body).Decode(&resp)
+		return rw.Code, resp
+	}
+
+	usr, _ := users.GetByUsername(context.Background(), "abc12")
+	access, _ := getSignedToken(keyring, tokens, usr, []string{"pwd"}, "session-1", nil)
+	if code, _ := introspect(access.token); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the caller to authenticate, got %d", code)
+	}
+	code, resp := introspect(access.token, "gateway", "gateway-secret")
+	if code != http.StatusOK || !resp.Active || resp.Subject != "abc12" || resp.Username != "abc12" || resp.SessionID != "session-1" || resp.TokenType != "Bearer" {
+		t.Fatalf("Expected the user token to be active, got %d %+v", code, resp)
+	}
+
+	clientToken, _ := getClientToken(keyring, tokens, monitor, monitor.Scopes, tokens.DefaultAudiences)
+	if _, resp := introspect(clientToken.token, "gateway", "gateway-secret"); !resp.Active || resp.ClientID != "monitor" || resp.Scope != "monitor:write" {
+		t.Fatalf("Expected the client token to be active, got %+v", resp)
+	}
+
+	// whatever is wrong with a token, the caller only learns it is not active
+	mfaToken, _ := jwt.GenerateToken(keyring.SigningKey(), jwt.Claims{Issuer: tokens.Issuer, Subject: "abc12",
+		Audience: jwt.Audience{actionAudience(tokenconfig.Default(), purposeMFA)}, ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	for name, token := range map[string]string{"garbage": "not-a-token", "action token": mfaToken, "tampered": access.token + "x"} {
+		if _, resp := introspect(token, "gateway", "gateway-secret"); resp.Active || resp.Subject != "" {
+			t.Fatalf("Expected the %s to be inactive, got %+v", name, resp)
+		}
+	}
+	revocations.Revoke(context.Background(), tokenstore.SessionRevocation("session-1"), time.Now().Add(time.Hour))
+	if _, resp := introspect(access.token, "gateway", "gateway-secret"); resp.Active {
+		t.Fatalf("Expected the token of the signed out session to be inactive")
+	}
+	other, _ := getSignedToken(keyring, tokens, usr, []string{"pwd"}, "session-2", nil)
+	usr.Status = data.StatusDisabled
+	users.Update(context.Background(), usr)
+	if _, resp := introspect(other.token, "gateway", "gateway-secret"); resp.Active {
+		t.Fatalf("Expected the token of the disabled user to be inactive")
+	}
+}
+
+func TestUserInfo(t *testing.T) {
+	users := data.NewMemoryUserStore(data.User{Email: "abc@gmail.com", Username: "abc12", PasswordHash: "hashedme1", Fullname: "abc def", Role: data.RoleAdmin})
+	pc := NewProfileController(zap.NewNop(), nil, users, nil, nil, nil, nil, nil, nil)
+
+	rw := httptest.NewRecorder()
+	pc.UserInfoHandler(rw, asSubject(httptest.NewRequest("GET", "/auth/userinfo", nil), "abc12", "abc@gmail.com"))
+	var info userInfoResponse
+	json.NewDecoder(rw.Body).Decode(&info)
+	if rw.Code != http.StatusOK || info.Subject != "abc12" || info.Name != "abc def" || !info.EmailVerified || len(info.Roles) == 0 {
+		t.Fatalf("Unexpected userinfo %d %+v", rw.Code, info)
+	}
+
+	req := httptest.NewRequest("GET", "/auth/userinfo", nil)
+	req = req.WithContext(middleware.WithIdentity(req.Context(), middleware.Identity{Subject: "monitor", ClientID: "monitor"}))
+	rw = httptest.NewRecorder()
+	pc.UserInfoHandler(rw, req)
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("Clients have no userinfo, got %d", rw.Code)
+	}
+}
@@ -0,0 +1,220 @@
+package jwt
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	NOT_YET_VALID_TOKEN = "Token Not Yet Valid"
+	INVALID_AUDIENCE    = "Invalid Audience"
+	INVALID_ISSUER      = "Invalid Issuer"
+)
+
+// DefaultLeeway is the clock skew we tolerate between the services by default
+const DefaultLeeway = 30 * time.Second
+
+// GetLeeway fetches the tolerated clock skew from the JWT_LEEWAY environment variable, eg. "45s"
+func GetLeeway() time.Duration {
+	leeway, err := time.ParseDuration(os.Getenv("JWT_LEEWAY"))
+	if err != nil {
+		return DefaultLeeway
+	}
+	return leeway
+}
+
+// Values of the amr claim (RFC 8176), how the subject authenticated
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRMFA      = "mfa"
+)
+
+// Audience is the aud claim. RFC 7519 allows a single string or an array of strings.
+type Audience []string
+
+// MarshalJSON writes a single audience as a plain string, like most issuers do
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+// UnmarshalJSON accepts both a string and an array of strings
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*a = Audience(multiple)
+	return nil
+}
+
+// Contains checks if aud is one of the audiences
+func (a Audience) Contains(aud string) bool {
+	for _, ele := range a {
+		if ele == aud {
+			return true
+		}
+	}
+	return false
+}
+
+// Claims are the attributes of the token.
+// The registered claims of RFC 7519 have their own fields, dates are seconds since the unix epoch.
+// Email and Roles describe the user the token was issued to, AMR how the user signed in
+// and SessionID (sid, OpenID Connect Front-Channel Logout 1.0) the session the token belongs to.
+// Tokens of OAuth2 clients carry ClientID and the granted Scope (RFC 8693 4.2) instead.
+// Everything else we do not know about ends up in Custom.
+type Claims struct {
+	Issuer    string   `json:"iss,omitempty"`
+	Subject   string   `json:"sub,omitempty"`
+	Audience  Audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	ID        string   `json:"jti,omitempty"`
+	Email     string   `json:"email,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+	AMR       []string `json:"amr,omitempty"`
+	SessionID string   `json:"sid,omitempty"`
+	Scope     string   `json:"scope,omitempty"`
+	ClientID  string   `json:"client_id,omitempty"`
+
+	Custom map[string]interface{} `json:"-"`
+}
+
+// the claims with their own field in Claims, they can never be set through Custom
+var registeredNames = []string{"iss", "sub", "aud", "exp", "nbf", "iat", "jti", "email", "roles", "amr", "sid", "scope", "client_id"}
+
+// registeredClaims is Claims without the JSON methods, so we can encode the fields without recursion
+type registeredClaims Claims
+
+// MarshalJSON merges the custom claims into the registered ones. Custom claims with a registered name are dropped.
+func (c Claims) MarshalJSON() ([]byte, error) {
+	registered, err := json.Marshal(registeredClaims(c))
+	if err != nil || len(c.Custom) == 0 {
+		return registered, err
+	}
+
+	merged := map[string]interface{}{}
+	for name, value := range c.Custom {
+		merged[name] = value
+	}
+	for _, name := range registeredNames {
+		delete(merged, name)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(registered, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return json.Marshal(merged)
+}
+
+// UnmarshalJSON fills the registered claims and keeps all other claims in Custom
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	var registered registeredClaims
+	if err := json.Unmarshal(data, &registered); err != nil {
+		return err
+	}
+	var all map[string]interface{}
+	if err := json.Unmarshal(data, &all); err != nil {
+		return err
+	}
+	for _, name := range registeredNames {
+		delete(all, name)
+	}
+	*c = Claims(registered)
+	if len(all) > 0 {
+		c.Custom = all
+	}
+	return nil
+}
+
+// HasRole checks if the role was granted to the subject
+func (c *Claims) HasRole(role string) bool {
+	for _, ele := range c.Roles {
+		if ele == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Scopes splits the space separated scope claim
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// NewTokenID returns a random value for the jti claim
+func NewTokenID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return segmentEncoding.EncodeToString(id)
+}
+
+// Validator checks the claims of a token once the signature is verified.
+// The zero value only checks the dates without any leeway.
+type Validator struct {
+	// Leeway is the clock skew tolerated on exp, nbf and iat
+	Leeway time.Duration
+	// Audience, if set, has to be one of the audiences of the token
+	Audience string
+	// Issuer, if set, has to match the issuer of the token
+	Issuer string
+	// Now is used instead of time.Now in tests
+	Now func() time.Time
+}
+
+// Validate checks the dates, the audience and the issuer of the claims
+func (v Validator) Validate(claims *Claims) error {
+	now := time.Now()
+	if v.Now != nil {
+		now = v.Now()
+	}
+	leeway := int64(v.Leeway / time.Second)
+
+	// a token without expiry would be valid forever, so exp is required
+	if claims.ExpiresAt == 0 || now.Unix() > claims.ExpiresAt+leeway {
+		return errors.New(EXPIRED_TOKEN)
+	}
+	if claims.NotBefore != 0 && now.Unix() < claims.NotBefore-leeway {
+		return errors.New(NOT_YET_VALID_TOKEN)
+	}
+	// a token issued in the future was not issued by a sane clock
+	if claims.IssuedAt != 0 && now.Unix() < claims.IssuedAt-leeway {
+		return errors.New(NOT_YET_VALID_TOKEN)
+	}
+	if v.Issuer != "" && claims.Issuer != v.Issuer {
+		return errors.New(INVALID_ISSUER)
+	}
+	if v.Audience != "" && !claims.Audience.Contains(v.Audience) {
+		return errors.New(INVALID_AUDIENCE)
+	}
+	return nil
+}
+
+// IsValidationError tells apart tokens that were rejected from internal errors
+func IsValidationError(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.Error() {
+	case CORRUPT_TOKEN, INVALID_TOKEN, EXPIRED_TOKEN, NOT_YET_VALID_TOKEN, INVALID_AUDIENCE, INVALID_ISSUER:
+		return true
+	}
+	return false
+}
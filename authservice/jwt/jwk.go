@@ -0,0 +1,154 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// JWK is the public part of a key in the JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC and OKP
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is the document served at the jwks_uri
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public key in JWK format. HS256 keys are secret and are never published.
+func (k *Key) JWK() (JWK, bool) {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Algorithm}
+
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = segmentEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = segmentEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		// coordinates are padded to the size of the curve (RFC 7518 section 6.2.1.2)
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		x := make([]byte, size)
+		y := make([]byte, size)
+		pub.X.FillBytes(x)
+		pub.Y.FillBytes(y)
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = segmentEncoding.EncodeToString(x)
+		jwk.Y = segmentEncoding.EncodeToString(y)
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = segmentEncoding.EncodeToString(pub)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
+
+// JWKS returns the public keys of the keyring, the signing key first followed by
+// the keys that were rotated out but still verify tokens.
+func (kr *Keyring) JWKS() JWKS {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	// sorted, so the document only changes when the keys change
+	var others []string
+	for kid := range kr.keys {
+		if kid != kr.signing.ID {
+			others = append(others, kid)
+		}
+	}
+	sort.Strings(others)
+
+	set := JWKS{Keys: []JWK{}}
+	if jwk, ok := kr.signing.JWK(); ok {
+		set.Keys = append(set.Keys, jwk)
+	}
+	for _, kid := range others {
+		if jwk, ok := kr.keys[kid].JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// KeyFromJWK builds a verification key from a public JWK, eg. one of the keys an identity provider publishes.
+// The algorithm follows from the key like for our own keys. A JWK naming another one is refused.
+func KeyFromJWK(jwk JWK) (*Key, error) {
+	if jwk.Use != "" && jwk.Use != "sig" {
+		return nil, fmt.Errorf("key %s is not a signing key", jwk.Kid)
+	}
+	var public crypto.PublicKey
+	switch jwk.Kty {
+	case "RSA":
+		n, errN := segmentEncoding.DecodeString(jwk.N)
+		e, errE := segmentEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("key %s is not a valid RSA key", jwk.Kid)
+		}
+		public = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("key %s has the unsupported curve %s", jwk.Kid, jwk.Crv)
+		}
+		x, errX := segmentEncoding.DecodeString(jwk.X)
+		y, errY := segmentEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("key %s is not a valid EC key", jwk.Kid)
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		// a point off the curve would make the verification meaningless
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, fmt.Errorf("key %s is not on the curve", jwk.Kid)
+		}
+		public = pub
+	case "OKP":
+		x, err := segmentEncoding.DecodeString(jwk.X)
+		if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s is not a valid Ed25519 key", jwk.Kid)
+		}
+		public = ed25519.PublicKey(x)
+	default:
+		return nil, fmt.Errorf("key %s has the unsupported type %s", jwk.Kid, jwk.Kty)
+	}
+	key, err := NewVerificationKey(jwk.Kid, public)
+	if err != nil {
+		return nil, err
+	}
+	if jwk.Alg != "" && jwk.Alg != key.Algorithm {
+		return nil, fmt.Errorf("key %s is for %s, not %s", jwk.Kid, key.Algorithm, jwk.Alg)
+	}
+	return key, nil
+}
+
+// Keyring returns a keyring verifying with the keys of the set. Keys we cannot use, like encryption keys
+// or unsupported types, are skipped. It cannot sign, it is only meant for the tokens of someone else.
+func (set JWKS) Keyring() (*Keyring, error) {
+	var keys []*Key
+	for _, jwk := range set.Keys {
+		if key, err := KeyFromJWK(jwk); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable key in the set")
+	}
+	return NewKeyring(keys[0], keys[1:]...), nil
+}
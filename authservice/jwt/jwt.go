@@ -1,15 +1,12 @@
 package jwt
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
-	"time"
 )
 
 const (
@@ -18,14 +15,17 @@ const (
 	EXPIRED_TOKEN = "Expired Token"
 )
 
-// claims are attributes.
-// Aud - audience
-// Iss - issuer
-// Exp - expiration of the Token
-type ClaimsMap struct {
-	Aud string
-	Iss string
-	Exp string
+// HS256 is HMAC using SHA-256. It needs the same secret for signing and verifying.
+const HS256 = "HS256"
+
+// JWTs use base64url encoding without the trailing '=' padding (RFC 7515 section 2)
+var segmentEncoding = base64.RawURLEncoding
+
+// Header is the JOSE header of the token. It tells the verifier how the token was signed.
+type Header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
 }
 
 // GetSecret fetches the value for the JWT_SECRET from the environment variable
@@ -33,77 +33,102 @@ func GetSecret() string {
 	return os.Getenv("JWT_SECRET")
 }
 
-// Function for generating the tokens.
-func GenerateToken(header string, payload ClaimsMap, secret string) (string, error) {
-	// create a new hash of type sha256. We pass the secret key to it
-	// sha256 is a symmetric cryptographic algorithm
-	h := hmac.New(sha256.New, []byte(secret))
+// GetIssuer fetches the issuer of our tokens from the AUTH_ISSUER environment variable
+func GetIssuer() string {
+	if issuer := os.Getenv("AUTH_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return "knowsearch.ml"
+}
+
+// GetAudience fetches the audience of our access tokens from the AUTH_AUDIENCE environment variable.
+// Tokens we issue for other purposes, like verifying an email, have another audience.
+func GetAudience() string {
+	if audience := os.Getenv("AUTH_AUDIENCE"); audience != "" {
+		return audience
+	}
+	return "frontend.knowsearch.ml"
+}
 
-	// We base encode the header which is a normal string
-	header64 := base64.StdEncoding.EncodeToString([]byte(header))
+// Function for generating the tokens. The token is signed with the key and carries its ID in the kid header.
+func GenerateToken(key *Key, payload Claims) (string, error) {
+	// The header is a JSON object as well, not just the name of the algorithm
+	headerstr, err := json.Marshal(Header{Alg: key.Algorithm, Typ: "JWT", Kid: key.ID})
+	if err != nil {
+		return "", fmt.Errorf("Error generating token when encoding header to string: %w", err)
+	}
 	// We then Marshal the payload which is a map. This converts it to a string of JSON.
-	// Now we base encode this string
 	payloadstr, err := json.Marshal(payload)
 	if err != nil {
-		return string(payloadstr), fmt.Errorf("Error generating token when encoding payload to string: %w", err)
+		return "", fmt.Errorf("Error generating token when encoding payload to string: %w", err)
 	}
-	payload64 := base64.StdEncoding.EncodeToString(payloadstr)
-
-	// Now add the encoded string.
-	message := header64 + "." + payload64
 
-	// We have the unsigned message ready. This is simply concat of header and payload
-	unsignedStr := header + string(payloadstr)
-
-	// we write this to the SHA256 to hash it. We can use this to generate the signature now
-	h.Write([]byte(unsignedStr))
-	signature := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	// The signing input is the encoded header and payload joined by a '.'
+	// The signature is computed over these encoded strings and not over the raw JSON
+	signingInput := segmentEncoding.EncodeToString(headerstr) + "." + segmentEncoding.EncodeToString(payloadstr)
+	signature, err := key.sign(signingInput)
+	if err != nil {
+		return "", fmt.Errorf("Error generating token when signing: %w", err)
+	}
 
 	//Finally we have the token
-	tokenStr := message + "." + signature
-	return tokenStr, nil
+	return signingInput + "." + segmentEncoding.EncodeToString(signature), nil
 }
 
-// This helps in validating the token
-func ValidateToken(token string, secret string) error {
+// This helps in validating the token. The kid header picks the key from the keyring
+// and the validator checks the claims. The validated claims are returned.
+func ValidateToken(token string, keys *Keyring, validator Validator) (*Claims, error) {
 	// JWT has 3 parts separated by '.'
 	splitToken := strings.Split(token, ".")
 	// if length is not 3, we know that the token is corrupt
 	if len(splitToken) != 3 {
-		return errors.New(CORRUPT_TOKEN)
+		return nil, errors.New(CORRUPT_TOKEN)
 	}
 
-	// decode the header and payload back to strings
-	header, err := base64.StdEncoding.DecodeString(splitToken[0])
+	// decode the header, payload and signature back to bytes
+	headerstr, err := segmentEncoding.DecodeString(splitToken[0])
 	if err != nil {
-		return err
+		return nil, errors.New(CORRUPT_TOKEN)
 	}
-	payload, err := base64.StdEncoding.DecodeString(splitToken[1])
+	payload, err := segmentEncoding.DecodeString(splitToken[1])
 	if err != nil {
-		return err
+		return nil, errors.New(CORRUPT_TOKEN)
+	}
+	signature, err := segmentEncoding.DecodeString(splitToken[2])
+	if err != nil {
+		return nil, errors.New(INVALID_TOKEN)
 	}
 
-	//again create the signature
-	unsignedStr := string(header) + string(payload)
-	h := hmac.New(sha256.New, []byte(secret))
-	h.Write([]byte(unsignedStr))
-
-	signature := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	var header Header
+	if err := json.Unmarshal(headerstr, &header); err != nil {
+		return nil, errors.New(CORRUPT_TOKEN)
+	}
+	key, ok := keys.Lookup(header.Kid)
+	if !ok {
+		return nil, errors.New(INVALID_TOKEN)
+	}
+	// we only accept the algorithm of the key. Accepting whatever the header says
+	// would let a caller downgrade the token to "none" or verify a RS256 public key as HMAC secret.
+	if header.Alg != key.Algorithm {
+		return nil, errors.New(INVALID_TOKEN)
+	}
 
-	// if both the signature dont match, this means token is wrong
-	if signature != splitToken[2] {
-		return errors.New(INVALID_TOKEN)
+	// if the signature does not match, this means token is wrong
+	if !key.verify(splitToken[0]+"."+splitToken[1], signature) {
+		return nil, errors.New(INVALID_TOKEN)
 	}
 
-	//Unmarshal payload into ClaimsMap struct
-	var payloadMap ClaimsMap
-	json.Unmarshal(payload, &payloadMap)
+	//Unmarshal payload into the Claims struct
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errors.New(CORRUPT_TOKEN)
+	}
 
-	//Check if token is expired
-	if payloadMap.Exp < fmt.Sprint(time.Now().Unix()) {
-		return errors.New(EXPIRED_TOKEN)
+	//Check if token is expired, not yet valid or meant for someone else
+	if err := validator.Validate(&claims); err != nil {
+		return nil, err
 	}
 
 	// This means the token matches
-	return nil
+	return &claims, nil
 }
@@ -1,46 +1,63 @@
 package jwt
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 )
 
+// Example token and key from RFC 7519 section 3.1 and RFC 7515 appendix A.1
+const (
+	rfcToken = "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9" +
+		".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ" +
+		".dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	rfcKey = "AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow"
+)
+
+// returns the validation error as a string, the way the middleware looks at it
+func validate(token string, keys *Keyring) string {
+	_, err := ValidateToken(token, keys, Validator{})
+	return fmt.Sprint(err)
+}
+
 func TestTokenValidation(t *testing.T) {
 
-	secret := GetSecret()
-	longExpiryClaims := ClaimsMap{
-		Aud: "frontend.knowsearch.ml",
-		Iss: "knowsearch.ml",
-		Exp: fmt.Sprint(time.Now().Add(time.Minute * 60).Unix()),
+	keys := NewKeyring(NewHMACKey("", GetSecret()))
+	longExpiryClaims := Claims{
+		Audience:  Audience{"frontend.knowsearch.ml"},
+		Issuer:    "knowsearch.ml",
+		ExpiresAt: time.Now().Add(time.Minute * 60).Unix(),
 	}
-	longExpiryToken, err := GenerateToken("HS256", longExpiryClaims, secret)
+	longExpiryToken, err := GenerateToken(keys.SigningKey(), longExpiryClaims)
 	if err != nil {
 		t.Error("Token generation failed")
 	}
 	//Token with long expiry date must not be expired at this time
-	if EXPIRED_TOKEN == fmt.Sprint(ValidateToken(longExpiryToken, secret)) {
+	if EXPIRED_TOKEN == validate(longExpiryToken, keys) {
 		t.Error("Token must not be expired")
 	}
 
 	//Corrupt token i.e without 3 sections must throw 'Token is corrupt' on validation
 	corruptTokenString := "randomcorrupttokenstring"
-	if CORRUPT_TOKEN != fmt.Sprint(ValidateToken(corruptTokenString, secret)) {
+	if CORRUPT_TOKEN != validate(corruptTokenString, keys) {
 		t.Error("Should throw 'Token is corrupt' for corrupt tokens")
 	}
 
 	//Invalid token i.e signature mismatched token must throw 'Invalid Token' on validation
 	invalidTokenString := longExpiryToken + "randomsignaturesuffix"
-	if INVALID_TOKEN != fmt.Sprint(ValidateToken(invalidTokenString, secret)) {
+	if INVALID_TOKEN != validate(invalidTokenString, keys) {
 		t.Error("Should throw 'Invalid Token' for invalid tokens")
 	}
 
-	shortExpiryClaims := ClaimsMap{
-		Aud: "frontend.knowsearch.ml",
-		Iss: "knowsearch.ml",
-		Exp: fmt.Sprint(time.Now().Unix()),
+	shortExpiryClaims := Claims{
+		Audience:  Audience{"frontend.knowsearch.ml"},
+		Issuer:    "knowsearch.ml",
+		ExpiresAt: time.Now().Unix(),
 	}
-	shortExpiryToken, err := GenerateToken("HS256", shortExpiryClaims, secret)
+	shortExpiryToken, err := GenerateToken(keys.SigningKey(), shortExpiryClaims)
 	if err != nil {
 		t.Error("Token generation failed")
 	}
@@ -48,8 +65,134 @@ func TestTokenValidation(t *testing.T) {
 	time.Sleep(5 * time.Second)
 
 	//Expired token must throw 'Token Expired' on validation
-	if EXPIRED_TOKEN != fmt.Sprint(ValidateToken(shortExpiryToken, secret)) {
+	if EXPIRED_TOKEN != validate(shortExpiryToken, keys) {
 		t.Error("Failed to detect expired token")
 	}
 
 }
+
+func TestTokenEncoding(t *testing.T) {
+	token, err := GenerateToken(NewHMACKey("", "secret"), Claims{Issuer: "knowsearch.ml", ExpiresAt: 1300819380})
+	if err != nil {
+		t.Fatalf("Token generation failed: %v", err)
+	}
+	if strings.ContainsAny(token, "+/=") {
+		t.Fatalf("Token must be base64url encoded without padding: %s", token)
+	}
+
+	segments := strings.Split(token, ".")
+	headerstr, err := base64.RawURLEncoding.DecodeString(segments[0])
+	if err != nil {
+		t.Fatalf("Header is not base64url: %v", err)
+	}
+	var header map[string]string
+	if err := json.Unmarshal(headerstr, &header); err != nil {
+		t.Fatalf("Header is not a JSON object: %s", headerstr)
+	}
+	if header["alg"] != HS256 || header["typ"] != "JWT" {
+		t.Fatalf("Unexpected header: %s", headerstr)
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(segments[1])
+	if string(payload) != `{"iss":"knowsearch.ml","exp":1300819380}` {
+		t.Fatalf("Unexpected payload: %s", payload)
+	}
+}
+
+func TestRFCVector(t *testing.T) {
+	key, err := base64.RawURLEncoding.DecodeString(rfcKey)
+	if err != nil {
+		t.Fatalf("Unable to decode the RFC key: %v", err)
+	}
+	segments := strings.Split(rfcToken, ".")
+	keys := NewKeyring(NewHMACKey("", string(key)))
+
+	t.Run("Signature", func(t *testing.T) {
+		signature, _ := keys.SigningKey().sign(segments[0] + "." + segments[1])
+		if got := base64.RawURLEncoding.EncodeToString(signature); got != segments[2] {
+			t.Fatalf("Signature mismatch, got %s want %s", got, segments[2])
+		}
+	})
+	t.Run("Validation", func(t *testing.T) {
+		// the signature is valid, but the example expired in 2011
+		if EXPIRED_TOKEN != validate(rfcToken, keys) {
+			t.Fatalf("RFC token should only fail on expiry, got %v", validate(rfcToken, keys))
+		}
+	})
+	t.Run("Wrong Key", func(t *testing.T) {
+		if INVALID_TOKEN != validate(rfcToken, NewKeyring(NewHMACKey("", "not the key"))) {
+			t.Fatalf("RFC token must not validate with another key")
+		}
+	})
+	t.Run("Custom Claims", func(t *testing.T) {
+		claims, err := ValidateToken(rfcToken, keys, Validator{Now: func() time.Time { return time.Unix(1300819000, 0) }})
+		if err != nil {
+			t.Fatalf("RFC token should be valid before it expires: %v", err)
+		}
+		if claims.Issuer != "joe" || claims.ExpiresAt != 1300819380 || claims.Custom["http://example.com/is_root"] != true {
+			t.Fatalf("Unexpected claims %+v", claims)
+		}
+	})
+	t.Run("Alg None", func(t *testing.T) {
+		none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`))
+		if INVALID_TOKEN != validate(none+"."+segments[1]+".", keys) {
+			t.Fatalf("Tokens with alg none must be rejected")
+		}
+	})
+}
+
+func TestClaimsValidation(t *testing.T) {
+	now := time.Unix(1631600786, 0)
+	claims := Claims{
+		Issuer:    "knowsearch.ml",
+		Subject:   "abc12",
+		Audience:  Audience{"claims.knowsearch.ml", "product.knowsearch.ml"},
+		ExpiresAt: now.Add(time.Minute).Unix(),
+		NotBefore: now.Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        NewTokenID(),
+		Roles:     []string{"admin"},
+		Custom:    map[string]interface{}{"tenant": "eu", "exp": "ignored"},
+	}
+	keys := NewKeyring(NewHMACKey("", "secret"))
+	token, err := GenerateToken(keys.SigningKey(), claims)
+	if err != nil {
+		t.Fatalf("Token generation failed: %v", err)
+	}
+
+	// digit counts differ, a string comparison would think 999999999 is after 1631600846
+	if err := (Validator{Now: func() time.Time { return time.Unix(999999999, 0) }}).Validate(&Claims{ExpiresAt: 1631600846}); err != nil {
+		t.Fatalf("Expiry must be compared as numbers: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		validator Validator
+		want      string
+	}{
+		{"Valid", Validator{Audience: "product.knowsearch.ml", Issuer: "knowsearch.ml"}, "<nil>"},
+		{"Expired", Validator{Now: func() time.Time { return now.Add(2 * time.Minute) }}, EXPIRED_TOKEN},
+		{"Expired Within Leeway", Validator{Leeway: 2 * time.Minute, Now: func() time.Time { return now.Add(2 * time.Minute) }}, "<nil>"},
+		{"Not Yet Valid", Validator{Now: func() time.Time { return now.Add(-time.Minute) }}, NOT_YET_VALID_TOKEN},
+		{"Not Yet Valid Within Leeway", Validator{Leeway: time.Minute, Now: func() time.Time { return now.Add(-time.Minute) }}, "<nil>"},
+		{"Wrong Audience", Validator{Audience: "frontend.knowsearch.ml"}, INVALID_AUDIENCE},
+		{"Wrong Issuer", Validator{Issuer: "example.com"}, INVALID_ISSUER},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.validator.Now == nil {
+				tc.validator.Now = func() time.Time { return now }
+			}
+			validated, err := ValidateToken(token, keys, tc.validator)
+			if fmt.Sprint(err) != tc.want {
+				t.Fatalf("Expected %s, got %v", tc.want, err)
+			}
+			if err == nil && (validated.Subject != "abc12" || !validated.HasRole("admin") || validated.Custom["tenant"] != "eu") {
+				t.Fatalf("Claims were not returned: %+v", validated)
+			}
+			if err == nil && validated.ExpiresAt != claims.ExpiresAt {
+				t.Fatalf("Custom claims must not override registered claims")
+			}
+		})
+	}
+}
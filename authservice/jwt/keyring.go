@@ -0,0 +1,194 @@
+package jwt
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RetiredKeyRetention is how long a rotated out key can still verify tokens.
+// It has to be longer than the lifetime of any token we sign.
+const RetiredKeyRetention = 24 * time.Hour
+
+// Keyring holds the key we sign with and every key we still accept for verification.
+// Rotating keeps the previous signing key around, so tokens that are still in flight stay valid.
+type Keyring struct {
+	mu      sync.RWMutex
+	signing *Key
+	keys    map[string]*Key
+	// retired maps the kid of a rotated out key to the time it was rotated out
+	retired map[string]time.Time
+	// expires maps the kid of a key accepted only for a while to the end of that while
+	expires map[string]time.Time
+}
+
+// NewKeyring returns a keyring signing with the given key and also accepting the verification keys
+func NewKeyring(signing *Key, verification ...*Key) *Keyring {
+	kr := &Keyring{
+		signing: signing,
+		keys:    map[string]*Key{signing.ID: signing},
+		retired: map[string]time.Time{},
+		expires: map[string]time.Time{},
+	}
+	for _, key := range verification {
+		kr.keys[key.ID] = key
+	}
+	return kr
+}
+
+// KeyringFromEnv builds the keyring from the environment.
+// JWT_SIGNING_KEY is the path of a PEM private key, JWT_VERIFICATION_KEYS a comma separated
+// list of PEM files that are accepted as well. Without a signing key we fall back to HS256 with JWT_SECRET.
+// With a signing key HS256 tokens are refused, unless JWT_HS256_ACCEPT_UNTIL (RFC 3339) gives a deadline
+// for the switch. The secret is shared by every service, anybody who knows it could sign tokens.
+func KeyringFromEnv() (*Keyring, error) {
+	var verification []*Key
+	for _, path := range strings.Split(os.Getenv("JWT_VERIFICATION_KEYS"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		key, err := LoadKeyFromPEM(path)
+		if err != nil {
+			return nil, err
+		}
+		verification = append(verification, key)
+	}
+
+	var hmacKey *Key
+	if secret := GetSecret(); secret != "" {
+		hmacKey = NewHMACKey("hs256", secret)
+	}
+
+	signingPath := os.Getenv("JWT_SIGNING_KEY")
+	if signingPath == "" {
+		if hmacKey == nil {
+			return nil, errors.New("neither JWT_SIGNING_KEY nor JWT_SECRET is set")
+		}
+		return NewKeyring(hmacKey, verification...), nil
+	}
+
+	signing, err := LoadKeyFromPEM(signingPath)
+	if err != nil {
+		return nil, err
+	}
+	if !signing.CanSign() {
+		return nil, errors.New("JWT_SIGNING_KEY must be a private key")
+	}
+	kr := NewKeyring(signing, verification...)
+	// HS256 tokens signed before the switch to key pairs are accepted until the deadline, never longer
+	if until := os.Getenv("JWT_HS256_ACCEPT_UNTIL"); until != "" && hmacKey != nil {
+		deadline, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return nil, errors.New("JWT_HS256_ACCEPT_UNTIL must be a time of RFC 3339")
+		}
+		if deadline.After(time.Now()) {
+			kr.AddUntil(hmacKey, deadline)
+		}
+	}
+	return kr, nil
+}
+
+// SigningKey returns the key new tokens are signed with
+func (kr *Keyring) SigningKey() *Key {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.signing
+}
+
+// Lookup finds the verification key for a kid. Tokens without a kid are checked with the signing key.
+func (kr *Keyring) Lookup(kid string) (*Key, bool) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kid == "" {
+		return kr.signing, true
+	}
+	key, ok := kr.keys[kid]
+	if until, limited := kr.expires[kid]; limited && time.Now().After(until) {
+		return nil, false
+	}
+	return key, ok
+}
+
+// Add accepts another key for verification only
+func (kr *Keyring) Add(key *Key) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[key.ID] = key
+}
+
+// AddUntil accepts another key for verification only until the time
+func (kr *Keyring) AddUntil(key *Key, until time.Time) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[key.ID] = key
+	kr.expires[key.ID] = until
+}
+
+// Remove stops accepting tokens signed by the key. The signing key cannot be removed.
+func (kr *Keyring) Remove(kid string) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.signing.ID == kid {
+		return errors.New("cannot remove the signing key, rotate it first")
+	}
+	delete(kr.keys, kid)
+	delete(kr.retired, kid)
+	delete(kr.expires, kid)
+	return nil
+}
+
+// Rotate makes next the signing key. The previous signing key is retired,
+// it keeps verifying tokens until it is pruned.
+func (kr *Keyring) Rotate(next *Key) error {
+	if !next.CanSign() {
+		return errors.New("the new signing key must have a private key")
+	}
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.signing.ID == next.ID {
+		return nil
+	}
+	kr.retired[kr.signing.ID] = time.Now()
+	delete(kr.retired, next.ID)
+	kr.keys[next.ID] = next
+	kr.signing = next
+	return nil
+}
+
+// RotateFromEnv reloads JWT_SIGNING_KEY and rotates to it. Used when the key file was replaced.
+func (kr *Keyring) RotateFromEnv() error {
+	path := os.Getenv("JWT_SIGNING_KEY")
+	if path == "" {
+		return errors.New("JWT_SIGNING_KEY is not set")
+	}
+	key, err := LoadKeyFromPEM(path)
+	if err != nil {
+		return err
+	}
+	if err := kr.Rotate(key); err != nil {
+		return err
+	}
+	kr.Prune(RetiredKeyRetention)
+	return nil
+}
+
+// Prune removes the keys that were retired longer than retention ago, and those past their end
+func (kr *Keyring) Prune(retention time.Duration) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	for kid, retiredAt := range kr.retired {
+		if time.Since(retiredAt) > retention {
+			delete(kr.keys, kid)
+			delete(kr.retired, kid)
+		}
+	}
+	for kid, until := range kr.expires {
+		if time.Now().After(until) {
+			delete(kr.keys, kid)
+			delete(kr.expires, kid)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func generateSigners(t *testing.T) map[string]crypto.Signer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Unable to generate RSA key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate ECDSA key: %v", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate Ed25519 key: %v", err)
+	}
+	return map[string]crypto.Signer{RS256: rsaKey, ES256: ecKey, EdDSA: edKey}
+}
+
+func TestAsymmetricKeys(t *testing.T) {
+	claims := Claims{Issuer: "knowsearch.ml", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+
+	for alg, signer := range generateSigners(t) {
+		t.Run(alg, func(t *testing.T) {
+			key, err := NewKey("", signer)
+			if err != nil {
+				t.Fatalf("Unable to wrap key: %v", err)
+			}
+			if key.Algorithm != alg {
+				t.Fatalf("Expected algorithm %s, got %s", alg, key.Algorithm)
+			}
+			token, err := GenerateToken(key, claims)
+			if err != nil {
+				t.Fatalf("Token generation failed: %v", err)
+			}
+
+			// verifiers only need the public key
+			public, _ := NewVerificationKey(key.ID, signer.Public())
+			verifier := NewKeyring(NewHMACKey("hs256", "secret"), public)
+			if _, err := ValidateToken(token, verifier, Validator{}); err != nil {
+				t.Fatalf("Token should validate with the public key: %v", err)
+			}
+
+			other, _ := NewKey(key.ID, generateSigners(t)[alg])
+			if INVALID_TOKEN != validate(token, NewKeyring(other)) {
+				t.Fatalf("Token must not validate with another key of the same kid")
+			}
+			if INVALID_TOKEN != validate(token, NewKeyring(NewHMACKey("", "secret"))) {
+				t.Fatalf("Token with an unknown kid must be rejected")
+			}
+		})
+	}
+}
+
+func TestAlgorithmConfusion(t *testing.T) {
+	signer := generateSigners(t)[RS256]
+	public, _ := NewVerificationKey("rsa", signer.Public())
+	der, _ := x509.MarshalPKIXPublicKey(signer.Public())
+
+	// a HS256 token "signed" with the public key must not be accepted by the RSA key of the same kid
+	forged, _ := GenerateToken(NewHMACKey("rsa", string(der)), Claims{ExpiresAt: time.Now().Add(time.Minute).Unix()})
+	if INVALID_TOKEN != validate(forged, NewKeyring(NewHMACKey("hs256", "secret"), public)) {
+		t.Fatalf("HS256 tokens must not be checked against RSA keys")
+	}
+}
+
+func TestRotation(t *testing.T) {
+	signers := generateSigners(t)
+	first, _ := NewKey("", signers[ES256])
+	second, _ := NewKey("", signers[EdDSA])
+	claims := Claims{ExpiresAt: time.Now().Add(time.Minute).Unix()}
+
+	keys := NewKeyring(first)
+	inFlight, _ := GenerateToken(keys.SigningKey(), claims)
+
+	if err := keys.Rotate(second); err != nil {
+		t.Fatalf("Rotation failed: %v", err)
+	}
+	if keys.SigningKey().ID != second.ID {
+		t.Fatalf("New tokens must be signed with the rotated key")
+	}
+	fresh, _ := GenerateToken(keys.SigningKey(), claims)
+
+	if _, err := ValidateToken(inFlight, keys, Validator{}); err != nil {
+		t.Fatalf("Tokens signed before the rotation must stay valid: %v", err)
+	}
+	if _, err := ValidateToken(fresh, keys, Validator{}); err != nil {
+		t.Fatalf("Tokens signed after the rotation must be valid: %v", err)
+	}
+
+	keys.Prune(time.Hour)
+	if _, err := ValidateToken(inFlight, keys, Validator{}); err != nil {
+		t.Fatalf("Recently retired keys must not be pruned: %v", err)
+	}
+	keys.Prune(0)
+	if INVALID_TOKEN != validate(inFlight, keys) {
+		t.Fatalf("Pruned keys must not verify tokens")
+	}
+	if _, err := ValidateToken(fresh, keys, Validator{}); err != nil {
+		t.Fatalf("The signing key must never be pruned: %v", err)
+	}
+
+	legacy := NewHMACKey("hs256", "secret")
+	old, _ := GenerateToken(legacy, claims)
+	keys.AddUntil(legacy, time.Now().Add(time.Hour))
+	if _, err := ValidateToken(old, keys, Validator{}); err != nil {
+		t.Fatalf("Keys must verify tokens until their end: %v", err)
+	}
+	keys.AddUntil(legacy, time.Now().Add(-time.Second))
+	if INVALID_TOKEN != validate(old, keys) {
+		t.Fatalf("Keys past their end must not verify tokens")
+	}
+}
+
+func TestLoadKeyFromPEM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatalf("Unable to create Temp Dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for alg, signer := range generateSigners(t) {
+		privateDER, _ := x509.MarshalPKCS8PrivateKey(signer)
+		publicDER, _ := x509.MarshalPKIXPublicKey(signer.Public())
+		privatePath := filepath.Join(dir, alg+".pem")
+		publicPath := filepath.Join(dir, alg+".pub.pem")
+		ioutil.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+		ioutil.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+
+		private, err := LoadKeyFromPEM(privatePath)
+		if err != nil {
+			t.Fatalf("Unable to load %s private key: %v", alg, err)
+		}
+		public, err := LoadKeyFromPEM(publicPath)
+		if err != nil {
+			t.Fatalf("Unable to load %s public key: %v", alg, err)
+		}
+		if !private.CanSign() || public.CanSign() {
+			t.Fatalf("Only private keys can sign")
+		}
+		if private.ID != public.ID {
+			t.Fatalf("Private and public key must get the same kid")
+		}
+	}
+}
+
+func TestJWKS(t *testing.T) {
+	signers := generateSigners(t)
+	first, _ := NewKey("", signers[RS256])
+	second, _ := NewKey("", signers[ES256])
+	keys := NewKeyring(first, NewHMACKey("hs256", "secret"))
+	keys.Rotate(second)
+
+	set := keys.JWKS()
+	if len(set.Keys) != 2 {
+		t.Fatalf("Expected the signing and the retired key, got %v", set.Keys)
+	}
+	if set.Keys[0].Kid != second.ID || set.Keys[0].Kty != "EC" || len(set.Keys[0].X) != 43 {
+		t.Fatalf("Unexpected signing key %+v", set.Keys[0])
+	}
+	if set.Keys[1].Kid != first.ID || set.Keys[1].Kty != "RSA" || set.Keys[1].E != "AQAB" {
+		t.Fatalf("Unexpected retired key %+v", set.Keys[1])
+	}
+}
+
+func TestKeyFromJWK(t *testing.T) {
+	claims := Claims{Issuer: "idp.example.com", ExpiresAt: time.Now().Add(time.Minute).Unix()}
+	set := JWKS{}
+	tokens := map[string]string{}
+	for alg, signer := range generateSigners(t) {
+		key, _ := NewKey("", signer)
+		jwk, _ := key.JWK()
+		set.Keys = append(set.Keys, jwk)
+		tokens[alg], _ = GenerateToken(key, claims)
+	}
+	// an encryption key of the provider is skipped
+	set.Keys = append(set.Keys, JWK{Kty: "RSA", Kid: "enc", Use: "enc"})
+
+	verifier, err := set.Keyring()
+	if err != nil {
+		t.Fatalf("Unable to build the keyring: %v", err)
+	}
+	for alg, token := range tokens {
+		if _, err := ValidateToken(token, verifier, Validator{Issuer: "idp.example.com"}); err != nil {
+			t.Fatalf("The %s token should validate with the JWK: %v", alg, err)
+		}
+	}
+
+	rsaKey, _ := NewKey("rsa", generateSigners(t)[RS256])
+	jwk, _ := rsaKey.JWK()
+	jwk.Alg = ES256
+	if _, err := KeyFromJWK(jwk); err == nil {
+		t.Fatalf("A JWK naming another algorithm must be refused")
+	}
+	ecKey, _ := NewKey("ec", generateSigners(t)[ES256])
+	jwk, _ = ecKey.JWK()
+	jwk.Y = jwk.X
+	if _, err := KeyFromJWK(jwk); err == nil {
+		t.Fatalf("A point off the curve must be refused")
+	}
+}
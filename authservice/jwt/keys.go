@@ -0,0 +1,223 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+)
+
+// Signing algorithms supported next to HS256
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+)
+
+// Key is a single signing or verification key. The ID ends up in the kid header
+// so the verifier knows which key of the Keyring to use.
+type Key struct {
+	ID        string
+	Algorithm string
+
+	// secret is only set for HS256 keys
+	secret []byte
+	// private is nil for keys which can only verify
+	private crypto.Signer
+	public  crypto.PublicKey
+}
+
+// NewHMACKey returns a HS256 key for the shared secret. The same key signs and verifies.
+func NewHMACKey(id string, secret string) *Key {
+	return &Key{
+		ID:        id,
+		Algorithm: HS256,
+		secret:    []byte(secret),
+	}
+}
+
+// NewKey wraps a RSA, ECDSA P-256 or Ed25519 private key. If id is empty it is derived from the public key.
+func NewKey(id string, private crypto.Signer) (*Key, error) {
+	key, err := NewVerificationKey(id, private.Public())
+	if err != nil {
+		return nil, err
+	}
+	key.private = private
+	return key, nil
+}
+
+// NewVerificationKey wraps a public key that can only be used to verify tokens.
+func NewVerificationKey(id string, public crypto.PublicKey) (*Key, error) {
+	alg, err := algorithmFor(public)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		id, err = keyID(public)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &Key{
+		ID:        id,
+		Algorithm: alg,
+		public:    public,
+	}, nil
+}
+
+// LoadKeyFromPEM reads a private or public key from a PEM file.
+// Private keys can sign and verify, public keys can only verify.
+func LoadKeyFromPEM(path string) (*Key, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := parsed.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key in %s", path)
+		}
+		return NewKey("", signer)
+	case "RSA PRIVATE KEY":
+		parsed, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey("", parsed)
+	case "EC PRIVATE KEY":
+		parsed, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewKey("", parsed)
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewVerificationKey("", parsed)
+	case "RSA PUBLIC KEY":
+		parsed, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return NewVerificationKey("", parsed)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q in %s", block.Type, path)
+}
+
+// CanSign reports if the key holds the private part (or the secret for HS256)
+func (k *Key) CanSign() bool {
+	return k.private != nil || k.secret != nil
+}
+
+// Public returns the public key, it is nil for HS256 keys
+func (k *Key) Public() crypto.PublicKey {
+	return k.public
+}
+
+// picks the algorithm for the type of the public key
+func algorithmFor(public crypto.PublicKey) (string, error) {
+	switch pub := public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < 2048 {
+			return "", errors.New("RSA keys must be at least 2048 bits")
+		}
+		return RS256, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve != elliptic.P256() {
+			return "", errors.New("only P-256 ECDSA keys are supported")
+		}
+		return ES256, nil
+	case ed25519.PublicKey:
+		return EdDSA, nil
+	}
+	return "", fmt.Errorf("unsupported key type %T", public)
+}
+
+// the default key id is derived from the public key, so the same file always gets the same kid
+func keyID(public crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return segmentEncoding.EncodeToString(sum[:12]), nil
+}
+
+// sign computes the raw signature of the signing input
+func (k *Key) sign(signingInput string) ([]byte, error) {
+	if !k.CanSign() {
+		return nil, fmt.Errorf("key %q can only verify tokens", k.ID)
+	}
+	digest := sha256.Sum256([]byte(signingInput))
+
+	switch k.Algorithm {
+	case HS256:
+		h := hmac.New(sha256.New, k.secret)
+		h.Write([]byte(signingInput))
+		return h.Sum(nil), nil
+	case RS256:
+		return rsa.SignPKCS1v15(rand.Reader, k.private.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case ES256:
+		r, s, err := ecdsa.Sign(rand.Reader, k.private.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// JWS wants the fixed size R || S and not the ASN.1 encoding (RFC 7518 section 3.4)
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	case EdDSA:
+		return ed25519.Sign(k.private.(ed25519.PrivateKey), []byte(signingInput)), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %q", k.Algorithm)
+}
+
+// verify checks the raw signature of the signing input
+func (k *Key) verify(signingInput string, signature []byte) bool {
+	digest := sha256.Sum256([]byte(signingInput))
+
+	switch k.Algorithm {
+	case HS256:
+		if k.secret == nil {
+			return false
+		}
+		h := hmac.New(sha256.New, k.secret)
+		h.Write([]byte(signingInput))
+		return hmac.Equal(h.Sum(nil), signature)
+	case RS256:
+		return rsa.VerifyPKCS1v15(k.public.(*rsa.PublicKey), crypto.SHA256, digest[:], signature) == nil
+	case ES256:
+		if len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k.public.(*ecdsa.PublicKey), digest[:], r, s)
+	case EdDSA:
+		return ed25519.Verify(k.public.(ed25519.PublicKey), []byte(signingInput), signature)
+	}
+	return false
+}
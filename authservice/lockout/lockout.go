@@ -0,0 +1,171 @@
+// Package lockout slows down password guessing. Failed signins are counted per key,
+// eg. per account and per IP. After a few free attempts every further failure doubles
+// the time until the next attempt is allowed, and too many failures lock the key for a while.
+package lockout
+
+import (
+	"context"
+	"time"
+)
+
+// Policy decides how long a key has to wait after its failures
+type Policy struct {
+	// FreeAttempts can fail without any delay
+	FreeAttempts int
+	// BaseDelay is the wait after the first failure past the free attempts, it doubles with every failure
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff
+	MaxDelay time.Duration
+	// LockAfter failures lock the key for LockDuration
+	LockAfter    int
+	LockDuration time.Duration
+	// Window is how long failures are remembered after the last one
+	Window time.Duration
+}
+
+// DefaultAccountPolicy protects a single account. It is strict, but the lock is
+// temporary so an attacker cannot lock out a user for good.
+func DefaultAccountPolicy() Policy {
+	return Policy{
+		FreeAttempts: 5,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockAfter:    10,
+		LockDuration: 15 * time.Minute,
+		Window:       15 * time.Minute,
+	}
+}
+
+// DefaultIPPolicy protects against one client trying many accounts.
+// Many users can share an IP behind a NAT, so it allows a lot more failures.
+func DefaultIPPolicy() Policy {
+	return Policy{
+		FreeAttempts: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockAfter:    100,
+		LockDuration: 15 * time.Minute,
+		Window:       15 * time.Minute,
+	}
+}
+
+// DefaultMailPolicy limits the mails requested for a single address, eg. the reset mails.
+// Every request counts, a few per hour are enough for a user who lost the first one.
+func DefaultMailPolicy() Policy {
+	return Policy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Minute,
+		MaxDelay:     time.Hour,
+		LockAfter:    10,
+		LockDuration: time.Hour,
+		Window:       time.Hour,
+	}
+}
+
+// Delay is the wait after the given number of failures
+func (p Policy) Delay(failures int) time.Duration {
+	if p.LockAfter > 0 && failures >= p.LockAfter {
+		return p.LockDuration
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// Status is the state of a key after a failure
+type Status struct {
+	Failures int
+	// Wait until the next attempt is allowed
+	Wait time.Duration
+	// Locked is true for the failure that locked the key
+	Locked bool
+}
+
+// status builds the Status for the failure count
+func (p Policy) status(failures int) Status {
+	return Status{
+		Failures: failures,
+		Wait:     p.Delay(failures),
+		Locked:   p.LockAfter > 0 && failures == p.LockAfter,
+	}
+}
+
+// Tracker counts the failed attempts of keys
+type Tracker interface {
+	// Check returns how long the key still has to wait, 0 if it may try now
+	Check(ctx context.Context, key string) (time.Duration, error)
+	// Fail records a failed attempt of the key
+	Fail(ctx context.Context, key string) (Status, error)
+	// Reset forgets the failures of the key
+	Reset(ctx context.Context, key string) error
+}
+
+// Guard tracks the accounts and the IPs of the signins together
+type Guard struct {
+	accounts Tracker
+	ips      Tracker
+}
+
+// NewGuard returns a Guard using the two trackers
+func NewGuard(accounts Tracker, ips Tracker) *Guard {
+	return &Guard{accounts: accounts, ips: ips}
+}
+
+// the scopes of a Guard, used as label of the metrics
+const (
+	ScopeAccount = "account"
+	ScopeIP      = "ip"
+)
+
+// Check returns the longer wait of the account and the IP and which of them has to wait
+func (g *Guard) Check(ctx context.Context, account string, ip string) (time.Duration, string, error) {
+	accountWait, err := g.accounts.Check(ctx, account)
+	if err != nil {
+		return 0, "", err
+	}
+	ipWait, err := g.ips.Check(ctx, ip)
+	if err != nil {
+		return 0, "", err
+	}
+	if ipWait > accountWait {
+		return ipWait, ScopeIP, nil
+	}
+	if accountWait > 0 {
+		return accountWait, ScopeAccount, nil
+	}
+	return 0, "", nil
+}
+
+// Fail records the failure for the account and the IP. It returns the scopes that just got locked.
+func (g *Guard) Fail(ctx context.Context, account string, ip string) ([]string, error) {
+	var locked []string
+	status, err := g.accounts.Fail(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if status.Locked {
+		locked = append(locked, ScopeAccount)
+	}
+	status, err = g.ips.Fail(ctx, ip)
+	if err != nil {
+		return locked, err
+	}
+	if status.Locked {
+		locked = append(locked, ScopeIP)
+	}
+	return locked, nil
+}
+
+// Succeed forgets the failures of the account. The IP keeps its failures,
+// otherwise a single valid account would let a client guess the others forever.
+func (g *Guard) Succeed(ctx context.Context, account string) error {
+	return g.accounts.Reset(ctx, account)
+}
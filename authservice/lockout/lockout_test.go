@@ -0,0 +1,91 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPolicyDelay(t *testing.T) {
+	policy := DefaultAccountPolicy()
+	expected := map[int]time.Duration{
+		1:  0,
+		5:  0,
+		6:  time.Second,
+		7:  2 * time.Second,
+		9:  8 * time.Second,
+		10: 15 * time.Minute,
+		50: 15 * time.Minute,
+	}
+	for failures, delay := range expected {
+		if got := policy.Delay(failures); got != delay {
+			t.Fatalf("Expected %v after %d failures, got %v", delay, failures, got)
+		}
+	}
+
+	policy.LockAfter = 0
+	if got := policy.Delay(40); got != policy.MaxDelay {
+		t.Fatalf("Backoff must be capped at %v, got %v", policy.MaxDelay, got)
+	}
+}
+
+func TestMemoryTracker(t *testing.T) {
+	ctx := context.Background()
+	now := time.Unix(1631600786, 0)
+	tracker := NewMemoryTracker(DefaultAccountPolicy())
+	tracker.now = func() time.Time { return now }
+
+	var status Status
+	for i := 0; i < 6; i++ {
+		status, _ = tracker.Fail(ctx, "abc@gmail.com")
+	}
+	if wait, _ := tracker.Check(ctx, "abc@gmail.com"); wait != time.Second || status.Wait != time.Second {
+		t.Fatalf("Expected to wait a second after 6 failures, got %v", wait)
+	}
+	if wait, _ := tracker.Check(ctx, "chekme@example.com"); wait != 0 {
+		t.Fatalf("Other keys must not be affected, got %v", wait)
+	}
+
+	for i := 0; i < 4; i++ {
+		status, _ = tracker.Fail(ctx, "abc@gmail.com")
+	}
+	if !status.Locked {
+		t.Fatalf("The 10th failure must lock the key")
+	}
+	now = now.Add(10 * time.Minute)
+	if wait, _ := tracker.Check(ctx, "abc@gmail.com"); wait != 5*time.Minute {
+		t.Fatalf("Expected the lock to last 5 more minutes, got %v", wait)
+	}
+
+	// after the lock and the window the failures are forgotten
+	now = now.Add(15 * time.Minute)
+	if status, _ = tracker.Fail(ctx, "abc@gmail.com"); status.Failures != 1 {
+		t.Fatalf("Expected the failures to be forgotten, got %d", status.Failures)
+	}
+	tracker.Reset(ctx, "abc@gmail.com")
+	if len(tracker.entries) != 0 {
+		t.Fatalf("Reset must drop the key")
+	}
+}
+
+func TestGuard(t *testing.T) {
+	ctx := context.Background()
+	ipPolicy := DefaultIPPolicy()
+	ipPolicy.LockAfter = 3
+	guard := NewGuard(NewMemoryTracker(DefaultAccountPolicy()), NewMemoryTracker(ipPolicy))
+
+	// one IP trying a different account every time
+	var locked []string
+	for _, account := range []string{"a@x.com", "b@x.com", "c@x.com"} {
+		locked, _ = guard.Fail(ctx, account, "10.0.0.1")
+	}
+	if len(locked) != 1 || locked[0] != ScopeIP {
+		t.Fatalf("Expected the IP to be locked, got %v", locked)
+	}
+	if wait, scope, _ := guard.Check(ctx, "d@x.com", "10.0.0.1"); wait == 0 || scope != ScopeIP {
+		t.Fatalf("Expected the IP to wait, got %v %s", wait, scope)
+	}
+	if wait, _, _ := guard.Check(ctx, "d@x.com", "10.0.0.2"); wait != 0 {
+		t.Fatalf("Other IPs must not wait, got %v", wait)
+	}
+}
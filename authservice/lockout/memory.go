@@ -0,0 +1,96 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	failures int
+	last     time.Time
+	until    time.Time
+}
+
+// MemoryTracker keeps the failures in a map. It only protects a single instance,
+// several instances should share a RedisTracker.
+type MemoryTracker struct {
+	mu        sync.Mutex
+	policy    Policy
+	entries   map[string]*entry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemoryTracker returns an empty tracker with the policy
+func NewMemoryTracker(policy Policy) *MemoryTracker {
+	return &MemoryTracker{
+		policy:  policy,
+		entries: map[string]*entry{},
+		now:     time.Now,
+	}
+}
+
+// forgotten tells if the entry can be dropped
+func (t *MemoryTracker) forgotten(e *entry, now time.Time) bool {
+	return now.After(e.last.Add(t.policy.Window)) && now.After(e.until)
+}
+
+// Check returns how long the key still has to wait
+func (t *MemoryTracker) Check(ctx context.Context, key string) (time.Duration, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.entries[key]
+	if !ok {
+		return 0, nil
+	}
+	now := t.now()
+	if t.forgotten(e, now) {
+		delete(t.entries, key)
+		return 0, nil
+	}
+	if wait := e.until.Sub(now); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// Fail records a failed attempt of the key
+func (t *MemoryTracker) Fail(ctx context.Context, key string) (Status, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	t.sweep(now)
+
+	e, ok := t.entries[key]
+	if !ok || t.forgotten(e, now) {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.last = now
+	status := t.policy.status(e.failures)
+	e.until = now.Add(status.Wait)
+	return status, nil
+}
+
+// Reset forgets the failures of the key
+func (t *MemoryTracker) Reset(ctx context.Context, key string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+	return nil
+}
+
+// sweep drops the forgotten entries once per window, so scans from many IPs do not fill the memory
+func (t *MemoryTracker) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < t.policy.Window {
+		return
+	}
+	t.lastSweep = now
+	for key, e := range t.entries {
+		if t.forgotten(e, now) {
+			delete(t.entries, key)
+		}
+	}
+}
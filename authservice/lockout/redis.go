@@ -0,0 +1,66 @@
+package lockout
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisTracker keeps the failures of every key as a Redis hash, shared by all instances.
+// The hash expires once the failures are forgotten.
+type RedisTracker struct {
+	rdbi   *redis.Client
+	prefix string
+	policy Policy
+}
+
+// NewRedisTracker returns a tracker in Redis. The prefix separates the trackers, eg. "lockout:account:"
+func NewRedisTracker(instance *redis.Client, prefix string, policy Policy) *RedisTracker {
+	return &RedisTracker{
+		rdbi:   instance,
+		prefix: prefix,
+		policy: policy,
+	}
+}
+
+// Check returns how long the key still has to wait
+func (t *RedisTracker) Check(ctx context.Context, key string) (time.Duration, error) {
+	until, err := t.rdbi.HGet(ctx, t.prefix+key, "until").Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if wait := time.Until(time.Unix(0, until)); wait > 0 {
+		return wait, nil
+	}
+	return 0, nil
+}
+
+// Fail records a failed attempt of the key. HINCRBY is atomic, so concurrent
+// failures from several instances are all counted.
+func (t *RedisTracker) Fail(ctx context.Context, key string) (Status, error) {
+	failures, err := t.rdbi.HIncrBy(ctx, t.prefix+key, "failures", 1).Result()
+	if err != nil {
+		return Status{}, err
+	}
+	status := t.policy.status(int(failures))
+	ttl := t.policy.Window
+	if status.Wait > ttl {
+		ttl = status.Wait
+	}
+	_, err = t.rdbi.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, t.prefix+key, "until", strconv.FormatInt(time.Now().Add(status.Wait).UnixNano(), 10))
+		pipe.PExpire(ctx, t.prefix+key, ttl)
+		return nil
+	})
+	return status, err
+}
+
+// Reset forgets the failures of the key
+func (t *RedisTracker) Reset(ctx context.Context, key string) error {
+	return t.rdbi.Del(ctx, t.prefix+key).Err()
+}
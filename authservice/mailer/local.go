@@ -0,0 +1,50 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LogMailer only logs the messages. The links in them can be copied from the log.
+type LogMailer struct {
+	logger *zap.Logger
+}
+
+// NewLogMailer returns a mailer writing to the logger
+func NewLogMailer(logger *zap.Logger) *LogMailer {
+	return &LogMailer{logger: logger}
+}
+
+// Send logs the message
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	m.logger.Info("Mail", zap.String("to", msg.To), zap.String("subject", msg.Subject), zap.String("body", msg.Body))
+	return nil
+}
+
+// FileMailer writes every message as an .eml file into a directory, mail clients can open them
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+// NewFileMailer returns a mailer writing into dir
+func NewFileMailer(dir string, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from}
+}
+
+// Send writes the message to a new file
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := os.MkdirAll(m.dir, 0755); err != nil {
+		return err
+	}
+	recipient := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(msg.To)
+	name := fmt.Sprintf("%d_%s.eml", time.Now().UnixNano(), recipient)
+	return ioutil.WriteFile(filepath.Join(m.dir, name), format(m.from, msg), 0600)
+}
@@ -0,0 +1,37 @@
+// Package mailer sends the emails of the authservice, like the verification and the password reset mails.
+package mailer
+
+import (
+	"context"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// FromEnv picks the mailer from the environment. SMTP_ADDR (host:port) selects the SMTPMailer,
+// MAIL_DIR the FileMailer. Without either the mails are only logged, which is meant for local testing.
+func FromEnv(logger *zap.Logger) Mailer {
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "no-reply@knowsearch.ml"
+	}
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		return NewSMTPMailer(addr, from, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+	}
+	if dir := os.Getenv("MAIL_DIR"); dir != "" {
+		return NewFileMailer(dir, from)
+	}
+	return NewLogMailer(logger)
+}
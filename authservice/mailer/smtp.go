@@ -0,0 +1,53 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// SMTPMailer sends the messages through an SMTP server. net/smtp uses STARTTLS
+// when the server offers it and refuses to send credentials over plain text.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer for the server at addr. Without a username no authentication is used.
+func NewSMTPMailer(addr string, from string, username string, password string) *SMTPMailer {
+	m := &SMTPMailer{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+// Send delivers the message
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	// the addresses end up in the headers, a line break would let them add their own
+	if strings.ContainsAny(msg.To, "\r\n") || strings.ContainsAny(msg.Subject, "\r\n") {
+		return fmt.Errorf("invalid message header")
+	}
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{msg.To}, format(m.from, msg))
+}
+
+// format writes the message in the internet message format
+func format(from string, msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("\r\n")
+	buf.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return buf.Bytes()
+}
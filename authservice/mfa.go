@@ -0,0 +1,315 @@
+package authservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"github.com/shadowshot-x/micro-product-go/authservice/totp"
+	"go.uber.org/zap"
+)
+
+var (
+	mfaEnrolled = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mfa_enrolled",
+		Help: "Users who enabled two-factor authentication",
+	})
+	mfaSigninSuccess = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mfa_signin_success",
+		Help: "Signins completed with a second factor",
+	})
+	mfaSigninFail = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "mfa_signin_fail",
+		Help: "Wrong codes at the second step of the signin",
+	})
+)
+
+// recoveryCodeCount is the number of recovery codes a user gets when enabling MFA
+const recoveryCodeCount = 10
+
+// MFAController enrolls users into TOTP two-factor authentication and runs the second step of the signin
+type MFAController struct {
+	logger         *zap.Logger
+	keyring        *jwt.Keyring
+	tokens         *tokenconfig.Config
+	users          data.UserStore
+	refreshStore   tokenstore.RefreshStore
+	sessions       tokenstore.SessionStore
+	revocations    tokenstore.RevocationList
+	guard          *lockout.Guard
+	audit          *audit.Recorder
+	legacyHeaders  bool
+	cookies        *middleware.Cookies
+	promEnrolled   prometheus.Counter
+	promMFASuccess prometheus.Counter
+	promMFAFail    prometheus.Counter
+}
+
+// NewMFAController returns a frsh MFA controller
+func NewMFAController(logger *zap.Logger, keyring *jwt.Keyring, tokens *tokenconfig.Config, users data.UserStore, refreshStore tokenstore.RefreshStore, sessions tokenstore.SessionStore,
+	revocations tokenstore.RevocationList, guard *lockout.Guard, recorder *audit.Recorder) *MFAController {
+	return &MFAController{
+		logger:         logger,
+		keyring:        keyring,
+		tokens:         tokens,
+		users:          users,
+		refreshStore:   refreshStore,
+		sessions:       sessions,
+		revocations:    revocations,
+		guard:          guard,
+		audit:          recorder,
+		legacyHeaders:  legacyHeaders(),
+		cookies:        middleware.CookiesFromEnv(),
+		promEnrolled:   mfaEnrolled,
+		promMFASuccess: mfaSigninSuccess,
+		promMFAFail:    mfaSigninFail,
+	}
+}
+
+// checkSecondFactor accepts a TOTP code or an unused recovery code. The user is updated
+// in place, so the caller has to save it: the step of the code, or the remaining recovery codes.
+func checkSecondFactor(usr *data.User, code string, recoveryCode string) bool {
+	if code != "" {
+		step, ok := totp.Validate(usr.MFASecret, code, time.Now(), usr.MFALastStep)
+		if ok {
+			usr.MFALastStep = step
+		}
+		return ok
+	}
+	if recoveryCode != "" {
+		hash := totp.HashRecoveryCode(recoveryCode)
+		hashes := usr.RecoveryCodeHashes()
+		for i, stored := range hashes {
+			if stored == hash {
+				usr.SetRecoveryCodeHashes(append(hashes[:i:i], hashes[i+1:]...))
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EnrollHandler creates a new TOTP secret for the caller. It is only enabled once a code is confirmed.
+func (ctrl *MFAController) EnrollHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	if usr.MFAEnabled {
+		problem.Write(rw, r, problem.New(problem.TypeConflict, http.StatusConflict, "Two-factor authentication is already enabled"))
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		ctrl.logger.Error("Unable to generate the TOTP secret", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	usr.MFASecret = secret
+	usr.MFALastStep = 0
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to save the TOTP secret", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+
+	ctrl.logger.Info("MFA enrollment started", zap.String("subject", usr.Username))
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	// the URI is what the QR code shown to the user encodes
+	json.NewEncoder(rw).Encode(mfaEnrollResponse{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(secret, ctrl.tokens.Issuer, usr.Email),
+	})
+}
+
+// ConfirmHandler enables MFA once the user sent a code of the new secret, and returns the recovery codes
+func (ctrl *MFAController) ConfirmHandler(rw http.ResponseWriter, r *http.Request) {
+	var req MFACodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	if usr.MFAEnabled {
+		problem.Write(rw, r, problem.New(problem.TypeConflict, http.StatusConflict, "Two-factor authentication is already enabled"))
+		return
+	}
+	if usr.MFASecret == "" {
+		p := problem.New(problem.TypeValidation, http.StatusBadRequest, "Start the enrollment first")
+		problem.Write(rw, r, p)
+		return
+	}
+	if !checkSecondFactor(&usr, req.Code, "") {
+		problem.Write(rw, r, problem.Validation([]problem.FieldError{{Field: "code", Message: "is not valid"}}))
+		return
+	}
+
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		ctrl.logger.Error("Unable to generate the recovery codes", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = totp.HashRecoveryCode(code)
+	}
+	usr.SetRecoveryCodeHashes(hashes)
+	usr.MFAEnabled = true
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to enable MFA", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+
+	ctrl.promEnrolled.Inc()
+	ctrl.logger.Info("MFA enabled", zap.String("subject", usr.Username))
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	// the codes are shown once, we only keep their hashes
+	json.NewEncoder(rw).Encode(mfaRecoveryResponse{RecoveryCodes: codes})
+}
+
+// DisableHandler turns MFA off. It takes a code as well, a stolen access token alone is not enough.
+func (ctrl *MFAController) DisableHandler(rw http.ResponseWriter, r *http.Request) {
+	var req MFACodeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	if !usr.MFAEnabled {
+		problem.Write(rw, r, problem.New(problem.TypeConflict, http.StatusConflict, "Two-factor authentication is not enabled"))
+		return
+	}
+	if !checkSecondFactor(&usr, req.Code, req.RecoveryCode) {
+		problem.Write(rw, r, problem.Validation([]problem.FieldError{{Field: "code", Message: "is not valid"}}))
+		return
+	}
+	usr.MFAEnabled = false
+	usr.MFASecret = ""
+	usr.MFALastStep = 0
+	usr.SetRecoveryCodeHashes(nil)
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to disable MFA", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.logger.Info("MFA disabled", zap.String("subject", usr.Username))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// SigninMFAHandler is the second step of the signin. It takes the challenge token from the
+// first step together with a TOTP or recovery code and returns the tokens.
+func (ctrl *MFAController) SigninMFAHandler(rw http.ResponseWriter, r *http.Request) {
+	var req MFASigninRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+
+	usr, challenge, err := checkActionToken(r.Context(), ctrl.keyring, ctrl.tokens, ctrl.revocations, ctrl.users, req.MFAToken, purposeMFA)
+	if err != nil {
+		writeTokenError(ctrl.logger, rw, r, err)
+		return
+	}
+
+	// six digits are guessed quickly, wrong codes count as failed signins
+	accountKey := strings.ToLower(usr.Email)
+	ip := clientIP(r)
+	wait, _, err := ctrl.guard.Check(r.Context(), accountKey, ip)
+	if err != nil {
+		ctrl.logger.Error("Unable to check the failed signins", zap.Error(err))
+	}
+	if wait > 0 {
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+		p := problem.New(problem.TypeTooMany, http.StatusTooManyRequests, "Too many failed signins")
+		p.Detail = "Try again later"
+		problem.Write(rw, r, p)
+		return
+	}
+	if !usr.MFAEnabled || !checkSecondFactor(&usr, req.Code, req.RecoveryCode) {
+		ctrl.logger.Warn("Wrong second factor", zap.String("email", usr.Email), zap.String("ip", ip))
+		locked, err := ctrl.guard.Fail(r.Context(), accountKey, ip)
+		if err != nil {
+			ctrl.logger.Error("Unable to record the failed signin", zap.Error(err))
+		}
+		event := audit.FromRequest(r, audit.ActionSigninMFA)
+		event.Target = accountKey
+		event.Outcome = audit.OutcomeFailure
+		ctrl.audit.Record(r.Context(), event)
+		for _, scope := range locked {
+			event := audit.FromRequest(r, audit.ActionLockout)
+			event.Target = accountKey
+			event.Details = map[string]string{"scope": scope}
+			ctrl.audit.Record(r.Context(), event)
+		}
+		ctrl.promMFAFail.Inc()
+		problem.Write(rw, r, problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "Invalid code"))
+		return
+	}
+
+	// the challenge and the code are used up before any token is handed out
+	if err := markActionTokenUsed(r.Context(), ctrl.revocations, challenge); err != nil {
+		ctrl.logger.Error("Unable to revoke the MFA challenge", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to save the used code", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if err := ctrl.guard.Succeed(r.Context(), accountKey); err != nil {
+		ctrl.logger.Error("Unable to reset the failed signins", zap.Error(err))
+	}
+
+	amr := []string{jwt.AMRPassword, jwt.AMROTP, jwt.AMRMFA}
+	access, refreshToken, err := startSession(r, ctrl.keyring, ctrl.tokens, ctrl.refreshStore, ctrl.sessions, usr, amr)
+	if err != nil {
+		ctrl.logger.Error("unable to start the session", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.promMFASuccess.Inc()
+	ctrl.logger.Info("Signin with MFA", zap.String("email", usr.Email), zap.Bool("recoveryCode", req.RecoveryCode != ""))
+	event := audit.FromRequest(r, audit.ActionSigninMFA)
+	event.Actor = usr.Username
+	event.Target = accountKey
+	if req.RecoveryCode != "" {
+		event.Details = map[string]string{"factor": "recovery_code"}
+	}
+	ctrl.audit.Record(r.Context(), event)
+	writeTokens(rw, ctrl.legacyHeaders, cookieDelivery(ctrl.cookies, r), ctrl.tokens, access, refreshToken)
+}
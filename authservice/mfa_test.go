@@ -0,0 +1,104 @@
+package authservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"github.com/shadowshot-x/micro-product-go/authservice/totp"
+	"go.uber.org/zap"
+)
+
+func TestMFASignin(t *testing.T) {
+	logger := zap.NewNop()
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	hasher, _ := password.NewHasher(password.Params{Algorithm: password.Bcrypt, Cost: 4})
+	passwordHash, _ := hasher.Hash("hashedme1")
+	users := data.NewMemoryUserStore(data.User{Email: "abc@gmail.com", Username: "abc12", PasswordHash: passwordHash, Role: data.RoleAdmin})
+	refreshStore := tokenstore.NewMemoryRefreshStore()
+	revocations := tokenstore.NewMemoryRevocationList()
+	guard := lockout.NewGuard(lockout.NewMemoryTracker(lockout.DefaultAccountPolicy()), lockout.NewMemoryTracker(lockout.DefaultIPPolicy()))
+	sic := NewSigninController(logger, keyring, tokenconfig.Default(), refreshStore, tokenstore.NewMemorySessionStore(), users, hasher, guard, nil)
+	mc := NewMFAController(logger, keyring, tokenconfig.Default(), users, refreshStore, tokenstore.NewMemorySessionStore(), revocations, guard, nil)
+
+	// enroll and confirm as the signed in user
+	asUser := func(r *http.Request) *http.Request {
+		return r.WithContext(middleware.WithIdentity(r.Context(), middleware.Identity{Subject: "abc12", Email: "abc@gmail.com"}))
+	}
+	rw := httptest.NewRecorder()
+	mc.EnrollHandler(rw, asUser(httptest.NewRequest("POST", "/auth/mfa/enroll", nil)))
+	var enrollment mfaEnrollResponse
+	json.NewDecoder(rw.Body).Decode(&enrollment)
+	if rw.Code != http.StatusOK || enrollment.Secret == "" {
+		t.Fatalf("Enrollment failed with %d", rw.Code)
+	}
+	code, _ := totp.Code(enrollment.Secret, time.Now())
+	rw = httptest.NewRecorder()
+	mc.ConfirmHandler(rw, asUser(jsonRequest("POST", "/auth/mfa/confirm", `{"code":"`+code+`"}`)))
+	var recovery mfaRecoveryResponse
+	json.NewDecoder(rw.Body).Decode(&recovery)
+	if rw.Code != http.StatusOK || len(recovery.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("Confirmation failed with %d", rw.Code)
+	}
+
+	// the password alone only gets a challenge
+	challenge := func() string {
+		rw := httptest.NewRecorder()
+		sic.SigninHandler(rw, jsonRequest("POST", "/auth/signin", `{"email":"abc@gmail.com","password":"hashedme1"}`))
+		var resp mfaChallengeResponse
+		json.NewDecoder(rw.Body).Decode(&resp)
+		if rw.Code != http.StatusOK || !resp.MFARequired || resp.MFAToken == "" {
+			t.Fatalf("Expected an MFA challenge, got %d", rw.Code)
+		}
+		if _, err := jwt.ValidateToken(resp.MFAToken, keyring, jwt.Validator{Audience: jwt.GetAudience()}); err == nil {
+			t.Fatalf("The challenge must not be usable as an access token")
+		}
+		return resp.MFAToken
+	}
+	secondStep := func(body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		mc.SigninMFAHandler(rw, jsonRequest("POST", "/auth/signin/mfa", body))
+		return rw
+	}
+
+	mfaToken := challenge()
+	if rw := secondStep(`{"mfa_token":"` + mfaToken + `","code":"` + code + `"}`); rw.Code != http.StatusUnauthorized {
+		t.Fatalf("The code used for the confirmation must not be accepted again, got %d", rw.Code)
+	}
+	next, _ := totp.Code(enrollment.Secret, time.Now().Add(totp.Period))
+	rw = secondStep(`{"mfa_token":"` + mfaToken + `","code":"` + next + `"}`)
+	var tokens TokenResponse
+	json.NewDecoder(rw.Body).Decode(&tokens)
+	if rw.Code != http.StatusOK {
+		t.Fatalf("Second step failed with %d", rw.Code)
+	}
+	claims, err := jwt.ValidateToken(tokens.AccessToken, keyring, jwt.Validator{Audience: jwt.GetAudience()})
+	if err != nil || len(claims.AMR) != 3 || claims.AMR[2] != jwt.AMRMFA {
+		t.Fatalf("Expected an access token with the mfa amr, got %+v %v", claims, err)
+	}
+	if rw := secondStep(`{"mfa_token":"` + mfaToken + `","recovery_code":"` + recovery.RecoveryCodes[0] + `"}`); rw.Code != http.StatusBadRequest {
+		t.Fatalf("A used challenge must be rejected, got %d", rw.Code)
+	}
+
+	// a recovery code works once
+	if rw := secondStep(`{"mfa_token":"` + challenge() + `","recovery_code":"` + recovery.RecoveryCodes[0] + `"}`); rw.Code != http.StatusOK {
+		t.Fatalf("Recovery code was rejected with %d", rw.Code)
+	}
+	if rw := secondStep(`{"mfa_token":"` + challenge() + `","recovery_code":"` + recovery.RecoveryCodes[0] + `"}`); rw.Code != http.StatusUnauthorized {
+		t.Fatalf("A used recovery code must be rejected, got %d", rw.Code)
+	}
+	usr, _ := users.GetByUsername(context.Background(), "abc12")
+	if len(usr.RecoveryCodeHashes()) != recoveryCodeCount-1 {
+		t.Fatalf("Expected %d recovery codes left, got %d", recoveryCodeCount-1, len(usr.RecoveryCodeHashes()))
+	}
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+)
+
+// Identity is the verified caller of a request. It only comes from a validated token,
+// so handlers should use it instead of anything the client sends in the headers.
+type Identity struct {
+	Subject string
+	Email   string
+	Roles   []string
+	TokenID string
+	// AMR are the methods the subject used to sign in, see jwt.AMRPassword
+	AMR []string
+	// SessionID is the session of the signin, tokens of clients and api keys have none
+	SessionID string
+	// ClientID is set when an OAuth2 client calls for itself, it then only has Scopes and no Roles
+	ClientID string
+	Scopes   []string
+	// APIKey is the prefix of the api key the user called with. The Scopes of a key limit
+	// the permissions of the user, a key without scopes has all of them.
+	APIKey string
+}
+
+// ViaAPIKey tells if the user called with an api key instead of a token
+func (i Identity) ViaAPIKey() bool {
+	return i.APIKey != ""
+}
+
+// IsClient tells if the caller is an OAuth2 client rather than a user
+func (i Identity) IsClient() bool {
+	return i.ClientID != ""
+}
+
+// HasScope checks if the scope was granted to the token
+func (i Identity) HasScope(scope string) bool {
+	for _, granted := range i.Scopes {
+		if granted == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// HasMFA tells if the subject signed in with a second factor
+func (i Identity) HasMFA() bool {
+	for _, method := range i.AMR {
+		if method == jwt.AMRMFA {
+			return true
+		}
+	}
+	return false
+}
+
+// unexported, so no other package can overwrite the identity in the context
+type contextKey int
+
+const identityKey contextKey = iota
+
+// identityFromClaims maps the validated claims of a token to the identity
+func identityFromClaims(claims *jwt.Claims) Identity {
+	return Identity{
+		Subject:   claims.Subject,
+		Email:     claims.Email,
+		Roles:     claims.Roles,
+		TokenID:   claims.ID,
+		AMR:       claims.AMR,
+		SessionID: claims.SessionID,
+		ClientID:  claims.ClientID,
+		Scopes:    claims.Scopes(),
+	}
+}
+
+// WithIdentity returns a copy of the context carrying the identity
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityKey, identity)
+}
+
+// IdentityFromContext returns the identity placed by the TokenMiddleware.
+// The bool is false for requests that did not go through the middleware.
+func IdentityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityKey).(Identity)
+	return identity, ok
+}
+
+// SubjectFromContext returns the verified subject or an empty string
+func SubjectFromContext(ctx context.Context) string {
+	identity, _ := IdentityFromContext(ctx)
+	return identity.Subject
+}
+
+// EmailFromContext returns the verified email or an empty string
+func EmailFromContext(ctx context.Context) string {
+	identity, _ := IdentityFromContext(ctx)
+	return identity.Email
+}
+
+// RolesFromContext returns the roles granted in the token
+func RolesFromContext(ctx context.Context) []string {
+	identity, _ := IdentityFromContext(ctx)
+	return identity.Roles
+}
+
+// TokenIDFromContext returns the jti of the token used for the request
+func TokenIDFromContext(ctx context.Context) string {
+	identity, _ := IdentityFromContext(ctx)
+	return identity.TokenID
+}
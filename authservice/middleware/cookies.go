@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// names of the cookies and the header of the cookie mode
+const (
+	AccessTokenCookie  = "access_token"
+	RefreshTokenCookie = "refresh_token"
+	CSRFCookie         = "csrf_token"
+	CSRFHeader         = "X-CSRF-Token"
+	// TokenDeliveryHeader set to "cookie" asks for the tokens as cookies instead of in the body
+	TokenDeliveryHeader = "X-Token-Delivery"
+)
+
+// the refresh token is only sent to the auth routes, the other services never see it
+const refreshTokenPath = "/auth"
+
+// Cookies is the cookie mode for browsers. The tokens go in HttpOnly cookies that scripts cannot read,
+// and a CSRF token in a cookie the scripts can read. Requests that change something have to repeat
+// the CSRF token in the X-CSRF-Token header (double submit), another site cannot read it and so cannot send it.
+// A nil *Cookies is the cookie mode turned off.
+type Cookies struct {
+	Domain   string
+	SameSite http.SameSite
+}
+
+// CookiesFromEnv turns the cookie mode on with AUTH_COOKIES=true. AUTH_COOKIE_DOMAIN sets the domain
+// of the cookies and AUTH_COOKIE_SAMESITE is strict (default), lax or none.
+func CookiesFromEnv() *Cookies {
+	if os.Getenv("AUTH_COOKIES") != "true" {
+		return nil
+	}
+	cookies := &Cookies{Domain: os.Getenv("AUTH_COOKIE_DOMAIN"), SameSite: http.SameSiteStrictMode}
+	switch strings.ToLower(os.Getenv("AUTH_COOKIE_SAMESITE")) {
+	case "lax":
+		cookies.SameSite = http.SameSiteLaxMode
+	case "none":
+		cookies.SameSite = http.SameSiteNoneMode
+	}
+	return cookies
+}
+
+// Requested tells if the client asked for the tokens as cookies. Always false with the cookie mode off.
+func (c *Cookies) Requested(r *http.Request) bool {
+	return c != nil && strings.EqualFold(r.Header.Get(TokenDeliveryHeader), "cookie")
+}
+
+// cookie builds one of our cookies. Secure cookies are still sent to http://localhost by the browsers.
+func (c *Cookies) cookie(name string, value string, path string, lifetime time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     path,
+		Domain:   c.Domain,
+		MaxAge:   int(lifetime / time.Second),
+		Secure:   true,
+		HttpOnly: name != CSRFCookie,
+		SameSite: c.SameSite,
+	}
+}
+
+// SetTokens sets the cookies of the tokens and a new CSRF token that lives as long as the refresh token
+func (c *Cookies) SetTokens(rw http.ResponseWriter, accessToken string, accessLifetime time.Duration, refreshToken string, refreshLifetime time.Duration) {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	http.SetCookie(rw, c.cookie(AccessTokenCookie, accessToken, "/", accessLifetime))
+	http.SetCookie(rw, c.cookie(RefreshTokenCookie, refreshToken, refreshTokenPath, refreshLifetime))
+	http.SetCookie(rw, c.cookie(CSRFCookie, base64.RawURLEncoding.EncodeToString(raw), "/", refreshLifetime))
+}
+
+// Clear removes the cookies, eg. on logout
+func (c *Cookies) Clear(rw http.ResponseWriter) {
+	if c == nil {
+		return
+	}
+	for _, cookie := range []*http.Cookie{
+		c.cookie(AccessTokenCookie, "", "/", 0),
+		c.cookie(RefreshTokenCookie, "", refreshTokenPath, 0),
+		c.cookie(CSRFCookie, "", "/", 0),
+	} {
+		cookie.MaxAge = -1
+		http.SetCookie(rw, cookie)
+	}
+}
+
+// Token returns the value of the cookie. Always false with the cookie mode off.
+func (c *Cookies) Token(r *http.Request, name string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	cookie, err := r.Cookie(name)
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// CheckCSRF tells if a request authenticated by a cookie may go through. Safe methods
+// do not change anything, the others need the CSRF header matching the CSRF cookie.
+func (c *Cookies) CheckCSRF(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	expected, ok := c.Token(r, CSRFCookie)
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(CSRFHeader)), []byte(expected)) == 1
+}
@@ -1,51 +1,236 @@
 package middleware
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/apikey"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
 	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
 	"go.uber.org/zap"
 )
 
+const (
+	REVOKED_TOKEN   = "Revoked Token"
+	INVALID_API_KEY = "Invalid API Key"
+)
+
+// the last use of a key is written at most this often, not on every request
+const apiKeyTouchInterval = time.Minute
+
+var apiKeyRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "apikey_requests_total",
+	Help: "Requests authenticated with an api key by result",
+}, []string{"result"})
+
 // TokenMiddleware is the token validation route handler
 type TokenMiddleware struct {
-	logger *zap.Logger
+	logger      *zap.Logger
+	keyring     *jwt.Keyring
+	revocations tokenstore.RevocationList
+	validator   jwt.Validator
+	apiKeys     data.APIKeyStore
+	users       data.UserStore
+	cookies     *Cookies
+	promAPIKeys *prometheus.CounterVec
 }
 
 // NewTokenMiddleware returns a frsh Token controller
-func NewTokenMiddleware(logger *zap.Logger) *TokenMiddleware {
+func NewTokenMiddleware(logger *zap.Logger, keyring *jwt.Keyring, revocations tokenstore.RevocationList) *TokenMiddleware {
 	return &TokenMiddleware{
-		logger: logger,
+		logger:      logger,
+		keyring:     keyring,
+		revocations: revocations,
+		// we only accept our own access tokens and tolerate a little clock skew between the services
+		validator: jwt.Validator{
+			Leeway:   jwt.GetLeeway(),
+			Issuer:   jwt.GetIssuer(),
+			Audience: jwt.GetAudience(),
+		},
+		promAPIKeys: apiKeyRequests,
+	}
+}
+
+// AcceptAPIKeys lets the middleware also accept an "Authorization: ApiKey <key>" header.
+// The user of the key is looked up on every request, so a deactivated user or a changed role applies at once.
+func (ctrl *TokenMiddleware) AcceptAPIKeys(apiKeys data.APIKeyStore, users data.UserStore) *TokenMiddleware {
+	ctrl.apiKeys = apiKeys
+	ctrl.users = users
+	return ctrl
+}
+
+// AcceptCookies lets the middleware also read the access token from the cookie of the cookie mode.
+// Requests authenticated by the cookie have to pass the CSRF check. A nil cookies leaves the cookie mode off.
+func (ctrl *TokenMiddleware) AcceptCookies(cookies *Cookies) *TokenMiddleware {
+	ctrl.cookies = cookies
+	return ctrl
+}
+
+// WithIssuer sets the issuer the tokens must come from, by default AUTH_ISSUER
+func (ctrl *TokenMiddleware) WithIssuer(issuer string) *TokenMiddleware {
+	ctrl.validator.Issuer = issuer
+	return ctrl
+}
+
+// ForAudience returns a copy of the middleware for a service with its own audience. Tokens
+// without the audience are rejected there, so a token of one service cannot be replayed against another.
+// API keys are not bound to an audience, they are accepted wherever the middleware accepts them.
+func (ctrl *TokenMiddleware) ForAudience(audience string) *TokenMiddleware {
+	copied := *ctrl
+	copied.validator.Audience = audience
+	return &copied
+}
+
+// apiKeyFromHeader returns the key of an "Authorization: ApiKey <key>" header
+func apiKeyFromHeader(r *http.Request) (string, bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "ApiKey") {
+		return "", false
+	}
+	return strings.TrimSpace(parts[1]), true
+}
+
+// tokenFromRequest finds the access token: an "Authorization: Bearer" header, the Token header
+// of the older clients, or the cookie in cookie mode. fromCookie tells the CSRF check is needed.
+func (ctrl *TokenMiddleware) tokenFromRequest(r *http.Request) (token string, fromCookie bool, ok bool) {
+	parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(parts) == 2 && strings.EqualFold(parts[0], "Bearer") {
+		return strings.TrimSpace(parts[1]), false, true
+	}
+	if values, ok := r.Header["Token"]; ok {
+		return values[0], false, true
+	}
+	if token, ok := ctrl.cookies.Token(r, AccessTokenCookie); ok {
+		return token, true, true
+	}
+	return "", false, false
+}
+
+// challenge sets the WWW-Authenticate header of a 401 (RFC 6750 3), params are pairs of names and values.
+// Without params the caller sent no credentials at all and also learns about the api keys.
+func (ctrl *TokenMiddleware) challenge(rw http.ResponseWriter, params ...string) {
+	rw.Header().Add("WWW-Authenticate", ctrl.challengeValue("Bearer", params...))
+	if len(params) == 0 && ctrl.apiKeys != nil {
+		rw.Header().Add("WWW-Authenticate", ctrl.challengeValue("ApiKey"))
+	}
+}
+
+// challengeValue formats the challenge of the scheme with our realm, the same way for tokens and api keys
+func (ctrl *TokenMiddleware) challengeValue(scheme string, params ...string) string {
+	// the values are quoted strings, they must not end the quotes
+	quote := strings.NewReplacer(`\`, "", `"`, "'")
+	value := scheme + ` realm="` + quote.Replace(ctrl.validator.Issuer) + `"`
+	for i := 0; i+1 < len(params); i += 2 {
+		value += ", " + params[i] + `="` + quote.Replace(params[i+1]) + `"`
 	}
+	return value
+}
+
+// apiKeyIdentity checks the key and builds the identity of its user.
+// All the reasons a key is refused look the same to the caller.
+func (ctrl *TokenMiddleware) apiKeyIdentity(ctx context.Context, key string) (Identity, int) {
+	if ctrl.apiKeys == nil {
+		return Identity{}, http.StatusUnauthorized
+	}
+	prefix, ok := apikey.Prefix(key)
+	if !ok {
+		return Identity{}, http.StatusUnauthorized
+	}
+	stored, err := ctrl.apiKeys.GetByPrefix(ctx, prefix)
+	if err == data.ErrAPIKeyNotFound {
+		return Identity{}, http.StatusUnauthorized
+	}
+	if err != nil {
+		ctrl.logger.Error("Unable to look up the api key", zap.Error(err))
+		return Identity{}, http.StatusInternalServerError
+	}
+	now := time.Now()
+	if !apikey.Verify(key, stored.Hash) || !stored.Usable(now) {
+		ctrl.logger.Warn(INVALID_API_KEY, zap.String("prefix", prefix))
+		return Identity{}, http.StatusUnauthorized
+	}
+	usr, err := ctrl.users.GetByID(ctx, stored.UserID)
+	if err == data.ErrUserNotFound || (err == nil && !usr.Active()) {
+		ctrl.logger.Warn("The user of the api key is gone or inactive", zap.String("prefix", prefix))
+		return Identity{}, http.StatusUnauthorized
+	}
+	if err != nil {
+		ctrl.logger.Error("Unable to look up the user of the api key", zap.Error(err))
+		return Identity{}, http.StatusInternalServerError
+	}
+	if stored.LastUsedAt == nil || now.Sub(*stored.LastUsedAt) > apiKeyTouchInterval {
+		if err := ctrl.apiKeys.Touch(ctx, stored.ID, now); err != nil {
+			ctrl.logger.Warn("Unable to record the use of the api key", zap.Error(err))
+		}
+	}
+	return Identity{
+		Subject: usr.Username,
+		Email:   usr.Email,
+		Roles:   usr.Roles(),
+		Scopes:  stored.ScopeList(),
+		APIKey:  prefix,
+	}, http.StatusOK
 }
 
 // Middleware itself returns a function that is a Handler. it is executed for each request.
-// We want all our routes for REST to be authenticated. So, we validate the token
+// We want all our routes for REST to be authenticated. So, we validate the token,
+// or the api key if AcceptAPIKeys was called
 func (ctrl *TokenMiddleware) TokenValidationMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// partners send an api key instead of a token, it ends up as the same identity
+		if key, ok := apiKeyFromHeader(r); ok {
+			identity, status := ctrl.apiKeyIdentity(r.Context(), key)
+			if status != http.StatusOK {
+				ctrl.promAPIKeys.WithLabelValues("rejected").Inc()
+				if status == http.StatusUnauthorized {
+					rw.Header().Set("WWW-Authenticate", ctrl.challengeValue("ApiKey", "error", "invalid_key"))
+				}
+				rw.WriteHeader(status)
+				if status == http.StatusUnauthorized {
+					rw.Write([]byte(INVALID_API_KEY))
+				} else {
+					rw.Write([]byte("Internal Server Error"))
+				}
+				return
+			}
+			ctrl.promAPIKeys.WithLabelValues("accepted").Inc()
+			next.ServeHTTP(rw, r.WithContext(WithIdentity(r.Context(), identity)))
+			return
+		}
+
 		// check if token is present
-		if _, ok := r.Header["Token"]; !ok {
-			ctrl.logger.Warn("Token was not found in the header")
+		token, fromCookie, ok := ctrl.tokenFromRequest(r)
+		if !ok {
+			ctrl.logger.Warn("Token was not found in the request")
+			ctrl.challenge(rw)
 			rw.WriteHeader(http.StatusUnauthorized)
 			rw.Write([]byte("Token Missing"))
 			return
 		}
-		token := r.Header["Token"][0]
-
-		secret := jwt.GetSecret()
-		if secret == "" {
-			ctrl.logger.Error("Empty JWT secret")
-			rw.WriteHeader(http.StatusInternalServerError)
-			rw.Write([]byte("Internal Server Error"))
+		// the browser sends the cookie along with any request, also one another site makes it send
+		if fromCookie && !ctrl.cookies.CheckCSRF(r) {
+			ctrl.logger.Warn("CSRF check failed", zap.String("path", r.URL.Path), zap.String("remote", r.RemoteAddr))
+			writeForbidden(rw, forbiddenError{
+				Error:   "csrf_failed",
+				Message: "The " + CSRFHeader + " header is missing or does not match the " + CSRFCookie + " cookie",
+			})
 			return
 		}
 
-		err := jwt.ValidateToken(token, secret)
+		// the kid header of the token picks the verification key from the keyring
+		claims, err := jwt.ValidateToken(token, ctrl.keyring, ctrl.validator)
 		if err != nil {
 			errInString := fmt.Sprint(err)
-			ctrl.logger.Error(errInString, zap.String("token", token))
-			if errInString == jwt.CORRUPT_TOKEN || errInString == jwt.INVALID_TOKEN || errInString == jwt.EXPIRED_TOKEN {
+			// the token itself is never logged, an expired one could still be replayed somewhere else
+			ctrl.logger.Warn("Token rejected", zap.String("error", errInString), zap.String("remote", r.RemoteAddr))
+			if jwt.IsValidationError(err) {
+				ctrl.challenge(rw, "error", "invalid_token", "error_description", errInString)
 				rw.WriteHeader(http.StatusUnauthorized)
 			} else {
 				rw.WriteHeader(http.StatusInternalServerError)
@@ -56,7 +241,76 @@ func (ctrl *TokenMiddleware) TokenValidationMiddleware(next http.Handler) http.H
 		// rw.WriteHeader(http.StatusOK)
 		// rw.Write([]byte("Authorized Token"))
 
+		// a valid token could have been revoked by a logout
+		revoked, err := ctrl.revocations.IsRevoked(r.Context(), claims.ID)
+		if err != nil {
+			ctrl.logger.Error("Unable to check the revocation list", zap.Error(err))
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Internal Server Error"))
+			return
+		}
+		// or its whole session was signed out from another device
+		if !revoked && claims.SessionID != "" {
+			revoked, err = ctrl.revocations.IsRevoked(r.Context(), tokenstore.SessionRevocation(claims.SessionID))
+			if err != nil {
+				ctrl.logger.Error("Unable to check the revocation list", zap.Error(err))
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte("Internal Server Error"))
+				return
+			}
+		}
+		if revoked {
+			ctrl.logger.Warn(REVOKED_TOKEN, zap.String("jti", claims.ID), zap.String("sid", claims.SessionID))
+			ctrl.challenge(rw, "error", "invalid_token", "error_description", REVOKED_TOKEN)
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte(REVOKED_TOKEN))
+			return
+		}
+
+		// the handlers find out who is calling from the request context
+		ctx := WithIdentity(r.Context(), identityFromClaims(claims))
+
 		// this calls the next function. If not included, the router wont entertain any requests
-		next.ServeHTTP(rw, r)
+		next.ServeHTTP(rw, r.WithContext(ctx))
 	})
 }
+
+// RequireScope validates the token like TokenValidationMiddleware and then requires all the scopes.
+// Only client tokens are checked for scopes, so these routes are for the internal services and not for users.
+func (ctrl *TokenMiddleware) RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return ctrl.TokenValidationMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			identity, _ := IdentityFromContext(r.Context())
+			for _, scope := range scopes {
+				if !identity.IsClient() || !identity.HasScope(scope) {
+					ctrl.logger.Warn("Scope missing", zap.String("subject", identity.Subject), zap.String("scope", scope))
+					ctrl.challenge(rw, "error", "insufficient_scope", "scope", scope)
+					writeForbidden(rw, forbiddenError{
+						Error:   "insufficient_scope",
+						Message: "The token needs the scope " + scope,
+						Scope:   scope,
+					})
+					return
+				}
+			}
+			next.ServeHTTP(rw, r)
+		}))
+	}
+}
+
+// RequireUserToken validates the token like TokenValidationMiddleware and refuses clients and api keys.
+// Managing the account, like api keys or MFA, needs a user who actually signed in.
+func (ctrl *TokenMiddleware) RequireUserToken(next http.Handler) http.Handler {
+	return ctrl.TokenValidationMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		identity, _ := IdentityFromContext(r.Context())
+		if identity.IsClient() || identity.ViaAPIKey() {
+			ctrl.logger.Warn("Route needs a signed in user", zap.String("subject", identity.Subject), zap.String("path", r.URL.Path))
+			writeForbidden(rw, forbiddenError{
+				Error:   "user_token_required",
+				Message: "This route needs the token of a signin",
+			})
+			return
+		}
+		next.ServeHTTP(rw, r)
+	}))
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+func TestTokenSources(t *testing.T) {
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	tm := NewTokenMiddleware(zap.NewNop(), keyring, tokenstore.NewMemoryRevocationList()).
+		AcceptCookies(&Cookies{SameSite: http.SameSiteStrictMode}).WithIssuer("knowsearch.ml").ForAudience("frontend.knowsearch.ml")
+	handler := tm.TokenValidationMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	token, _ := jwt.GenerateToken(keyring.SigningKey(), jwt.Claims{
+		Issuer:    "knowsearch.ml",
+		Subject:   "abc12",
+		Audience:  jwt.Audience{"frontend.knowsearch.ml"},
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		ID:        jwt.NewTokenID(),
+	})
+
+	tests := []struct {
+		name      string
+		method    string
+		headers   map[string]string
+		cookies   map[string]string
+		want      int
+		challenge string
+	}{
+		{"Bearer", "GET", map[string]string{"Authorization": "Bearer " + token}, nil, http.StatusOK, ""},
+		{"Token Header", "GET", map[string]string{"Token": token}, nil, http.StatusOK, ""},
+		{"Cookie", "GET", nil, map[string]string{AccessTokenCookie: token}, http.StatusOK, ""},
+		{"Cookie With CSRF", "POST", map[string]string{CSRFHeader: "csrf"}, map[string]string{AccessTokenCookie: token, CSRFCookie: "csrf"}, http.StatusOK, ""},
+		{"Cookie Without CSRF", "POST", nil, map[string]string{AccessTokenCookie: token, CSRFCookie: "csrf"}, http.StatusForbidden, ""},
+		{"Cookie With Wrong CSRF", "DELETE", map[string]string{CSRFHeader: "other"}, map[string]string{AccessTokenCookie: token, CSRFCookie: "csrf"}, http.StatusForbidden, ""},
+		{"Bearer Needs No CSRF", "POST", map[string]string{"Authorization": "Bearer " + token}, nil, http.StatusOK, ""},
+		{"Missing", "GET", nil, nil, http.StatusUnauthorized, `Bearer realm="knowsearch.ml"`},
+		{"Invalid", "GET", map[string]string{"Authorization": "Bearer " + token + "x"}, nil, http.StatusUnauthorized, `Bearer realm="knowsearch.ml", error="invalid_token"`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, "/auth/sessions", nil)
+			for name, value := range tc.headers {
+				req.Header.Set(name, value)
+			}
+			for name, value := range tc.cookies {
+				req.AddCookie(&http.Cookie{Name: name, Value: value})
+			}
+			outputCatcher := httptest.NewRecorder()
+			handler.ServeHTTP(outputCatcher, req)
+			if outputCatcher.Code != tc.want {
+				t.Fatalf("Expected status %d, got %d", tc.want, outputCatcher.Code)
+			}
+			if !strings.HasPrefix(outputCatcher.Header().Get("WWW-Authenticate"), tc.challenge) {
+				t.Fatalf("Expected the challenge %q, got %q", tc.challenge, outputCatcher.Header().Get("WWW-Authenticate"))
+			}
+		})
+	}
+}
+
+func TestChallenges(t *testing.T) {
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	tm := NewTokenMiddleware(zap.NewNop(), keyring, tokenstore.NewMemoryRevocationList()).
+		AcceptAPIKeys(data.NewMemoryAPIKeyStore(), data.NewMemoryUserStore()).WithIssuer(`evil", error="x`)
+	handler := tm.TokenValidationMiddleware(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	// both schemes quote the realm the same way
+	for header, expected := range map[string]string{
+		"":                    `Bearer realm="evil', error='x"`,
+		"ApiKey pk_unknown.x": `ApiKey realm="evil', error='x", error="invalid_key"`,
+	} {
+		req := httptest.NewRequest("GET", "/auth/sessions", nil)
+		req.Header.Set("Authorization", header)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		if rw.Code != http.StatusUnauthorized || rw.Header().Get("WWW-Authenticate") != expected {
+			t.Fatalf("Expected the challenge %q, got %d %q", expected, rw.Code, rw.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestCookies(t *testing.T) {
+	cookies := &Cookies{SameSite: http.SameSiteStrictMode}
+	rw := httptest.NewRecorder()
+	cookies.SetTokens(rw, "access", time.Minute, "refresh", time.Hour)
+	set := map[string]*http.Cookie{}
+	for _, cookie := range rw.Result().Cookies() {
+		set[cookie.Name] = cookie
+	}
+	if access := set[AccessTokenCookie]; access == nil || !access.HttpOnly || !access.Secure || access.MaxAge != 60 {
+		t.Fatalf("Expected a secure HttpOnly access token cookie, got %+v", access)
+	}
+	if refresh := set[RefreshTokenCookie]; refresh == nil || !refresh.HttpOnly || refresh.Path != "/auth" {
+		t.Fatalf("Expected the refresh token cookie only for the auth routes, got %+v", refresh)
+	}
+	if csrf := set[CSRFCookie]; csrf == nil || csrf.HttpOnly || csrf.Value == "" {
+		t.Fatalf("Expected a CSRF token the scripts can read, got %+v", csrf)
+	}
+
+	// turned off, nothing is read from the cookies
+	var off *Cookies
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: AccessTokenCookie, Value: "access"})
+	req.Header.Set(TokenDeliveryHeader, "cookie")
+	if _, ok := off.Token(req, AccessTokenCookie); ok || off.Requested(req) {
+		t.Fatalf("The cookie mode must be off for nil cookies")
+	}
+}
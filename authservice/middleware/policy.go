@@ -0,0 +1,207 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+// Permissions the routes can require
+const (
+	PermProductWrite       = "product:write"
+	PermProductDelete      = "product:delete"
+	PermProductCustomQuery = "product:customquery"
+	PermCouponPurge        = "coupon:purge"
+)
+
+// Scopes only granted to OAuth2 clients, the internal services
+const (
+	ScopeMonitorWrite = "monitor:write"
+)
+
+var authorizationDenied = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "authorization_denied_total",
+	Help: "Requests denied because the caller lacks a permission",
+}, []string{"permission"})
+
+// Policy maps each role to the permissions it grants. Some permissions can
+// additionally require that the caller signed in with a second factor.
+type Policy struct {
+	rolePermissions map[string][]string
+	mfaPermissions  map[string]bool
+}
+
+// NewPolicy returns a policy granting the listed permissions to each role
+func NewPolicy(rolePermissions map[string][]string) *Policy {
+	return &Policy{
+		rolePermissions: rolePermissions,
+		mfaPermissions:  map[string]bool{},
+	}
+}
+
+// RequireMFA makes the permissions require a token from a signin with two-factor authentication
+func (p *Policy) RequireMFA(permissions ...string) *Policy {
+	for _, permission := range permissions {
+		p.mfaPermissions[permission] = true
+	}
+	return p
+}
+
+// RequiresMFA tells if the permission needs a second factor
+func (p *Policy) RequiresMFA(permission string) bool {
+	return p.mfaPermissions[permission]
+}
+
+// MFAPermissionsFromEnv reads the comma separated permissions requiring MFA from AUTH_MFA_PERMISSIONS
+func MFAPermissionsFromEnv() []string {
+	var permissions []string
+	for _, permission := range strings.Split(os.Getenv("AUTH_MFA_PERMISSIONS"), ",") {
+		if permission = strings.TrimSpace(permission); permission != "" {
+			permissions = append(permissions, permission)
+		}
+	}
+	return permissions
+}
+
+// DefaultPolicy is the policy of the product API. Admins can do everything, users nothing privileged.
+func DefaultPolicy() *Policy {
+	return NewPolicy(map[string][]string{
+		"admin": {PermProductWrite, PermProductDelete, PermProductCustomQuery, PermCouponPurge},
+		"user":  {},
+	})
+}
+
+// Allows checks if any of the roles grants the permission
+func (p *Policy) Allows(roles []string, permission string) bool {
+	for _, role := range roles {
+		for _, granted := range p.rolePermissions[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Grants checks the permission for the caller. Users get it from their roles, OAuth2 clients
+// only if the permission was granted to them as a scope of the same name.
+// An api key with scopes only keeps the permissions of the user that are among them.
+func (p *Policy) Grants(identity Identity, permission string) bool {
+	if identity.IsClient() {
+		return identity.HasScope(permission)
+	}
+	if identity.ViaAPIKey() && len(identity.Scopes) > 0 && !identity.HasScope(permission) {
+		return false
+	}
+	return p.Allows(identity.Roles, permission)
+}
+
+// forbiddenError is the body of the 403 response
+type forbiddenError struct {
+	Error      string `json:"error"`
+	Message    string `json:"message"`
+	Permission string `json:"permission,omitempty"`
+	Role       string `json:"role,omitempty"`
+	Scope      string `json:"scope,omitempty"`
+}
+
+// AuthorizationMiddleware checks the identity placed in the context by the TokenMiddleware
+// against the policy. It has to run after the TokenMiddleware.
+type AuthorizationMiddleware struct {
+	logger     *zap.Logger
+	policy     *Policy
+	promDenied *prometheus.CounterVec
+}
+
+// NewAuthorizationMiddleware returns a frsh Authorization middleware
+func NewAuthorizationMiddleware(logger *zap.Logger, policy *Policy) *AuthorizationMiddleware {
+	return &AuthorizationMiddleware{
+		logger:     logger,
+		policy:     policy,
+		promDenied: authorizationDenied,
+	}
+}
+
+// RequirePermission only lets the request through if a role of the caller grants the permission,
+// or for clients if the token has the permission as scope
+func (ctrl *AuthorizationMiddleware) RequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			identity, ok := IdentityFromContext(r.Context())
+			if !ok {
+				ctrl.unauthenticated(rw, permission)
+				return
+			}
+			if !ctrl.policy.Grants(identity, permission) {
+				ctrl.logger.Warn("Permission denied", zap.String("subject", identity.Subject), zap.String("permission", permission))
+				ctrl.promDenied.WithLabelValues(permission).Inc()
+				writeForbidden(rw, forbiddenError{
+					Error:      "forbidden",
+					Message:    "You do not have the permission " + permission,
+					Permission: permission,
+				})
+				return
+			}
+			// the password alone is not enough for this permission. Clients have no second factor,
+			// their scope is granted explicitly in the clients file.
+			if ctrl.policy.RequiresMFA(permission) && !identity.IsClient() && !identity.HasMFA() {
+				ctrl.logger.Warn("Permission needs MFA", zap.String("subject", identity.Subject), zap.String("permission", permission))
+				ctrl.promDenied.WithLabelValues(permission).Inc()
+				writeForbidden(rw, forbiddenError{
+					Error:      "mfa_required",
+					Message:    "The permission " + permission + " requires a signin with two-factor authentication",
+					Permission: permission,
+				})
+				return
+			}
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// RequireRole only lets the request through if the caller has one of the roles
+func (ctrl *AuthorizationMiddleware) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			identity, ok := IdentityFromContext(r.Context())
+			if !ok {
+				ctrl.unauthenticated(rw, "role:"+roles[0])
+				return
+			}
+			for _, role := range roles {
+				for _, granted := range identity.Roles {
+					if role == granted {
+						next.ServeHTTP(rw, r)
+						return
+					}
+				}
+			}
+			ctrl.logger.Warn("Role missing", zap.String("subject", identity.Subject), zap.Strings("roles", roles))
+			ctrl.promDenied.WithLabelValues("role:" + roles[0]).Inc()
+			writeForbidden(rw, forbiddenError{
+				Error:   "forbidden",
+				Message: "You need the role " + roles[0],
+				Role:    roles[0],
+			})
+		})
+	}
+}
+
+// the route was wired without the TokenMiddleware in front, we refuse rather than guess
+func (ctrl *AuthorizationMiddleware) unauthenticated(rw http.ResponseWriter, permission string) {
+	ctrl.logger.Error("No identity in the request context, is the TokenMiddleware missing?", zap.String("permission", permission))
+	ctrl.promDenied.WithLabelValues(permission).Inc()
+	rw.WriteHeader(http.StatusUnauthorized)
+	rw.Write([]byte("Token Missing"))
+}
+
+func writeForbidden(rw http.ResponseWriter, body forbiddenError) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(rw).Encode(body)
+}
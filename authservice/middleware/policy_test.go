@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestRequirePermission(t *testing.T) {
+	am := NewAuthorizationMiddleware(zap.NewNop(), DefaultPolicy())
+	handler := am.RequirePermission(PermProductDelete)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		identity *Identity
+		want     int
+	}{
+		{"Admin", &Identity{Subject: "abc12", Roles: []string{"admin"}}, http.StatusOK},
+		{"User", &Identity{Subject: "checkme34", Roles: []string{"user"}}, http.StatusForbidden},
+		{"No Roles", &Identity{Subject: "checkme34"}, http.StatusForbidden},
+		{"Client With Scope", &Identity{Subject: "cleaner", ClientID: "cleaner", Scopes: []string{PermProductDelete}}, http.StatusOK},
+		{"Client Without Scope", &Identity{Subject: "monitor", ClientID: "monitor", Scopes: []string{"monitor:write"}}, http.StatusForbidden},
+		{"Client With Admin Role", &Identity{Subject: "monitor", ClientID: "monitor", Roles: []string{"admin"}}, http.StatusForbidden},
+		{"No Identity", nil, http.StatusUnauthorized},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/product/deletebyid", nil)
+			if tc.identity != nil {
+				req = req.WithContext(WithIdentity(req.Context(), *tc.identity))
+			}
+			outputCatcher := httptest.NewRecorder()
+			handler.ServeHTTP(outputCatcher, req)
+			if outputCatcher.Code != tc.want {
+				t.Fatalf("Expected status %d, got %d", tc.want, outputCatcher.Code)
+			}
+			if tc.want == http.StatusForbidden && outputCatcher.Header().Get("Content-Type") != "application/json" {
+				t.Fatalf("Forbidden responses must be structured")
+			}
+		})
+	}
+}
+
+func TestRequireMFA(t *testing.T) {
+	am := NewAuthorizationMiddleware(zap.NewNop(), DefaultPolicy().RequireMFA(PermCouponPurge))
+	handler := func(permission string) http.Handler {
+		return am.RequirePermission(permission)(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			rw.WriteHeader(http.StatusOK)
+		}))
+	}
+
+	tests := []struct {
+		name       string
+		permission string
+		amr        []string
+		want       int
+	}{
+		{"Password Only", PermCouponPurge, []string{"pwd"}, http.StatusForbidden},
+		{"With MFA", PermCouponPurge, []string{"pwd", "otp", "mfa"}, http.StatusOK},
+		{"Not Required", PermProductDelete, []string{"pwd"}, http.StatusOK},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("DELETE", "/coupon/delregionstream", nil)
+			req = req.WithContext(WithIdentity(req.Context(), Identity{Subject: "abc12", Roles: []string{"admin"}, AMR: tc.amr}))
+			outputCatcher := httptest.NewRecorder()
+			handler(tc.permission).ServeHTTP(outputCatcher, req)
+			if outputCatcher.Code != tc.want {
+				t.Fatalf("Expected status %d, got %d", tc.want, outputCatcher.Code)
+			}
+		})
+	}
+}
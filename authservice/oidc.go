@@ -0,0 +1,385 @@
+package authservice
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/oidc"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+var oidcLogins = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "oidc_logins",
+	Help: "Logins through the identity provider by result",
+}, []string{"result"})
+
+const (
+	// the login at the provider has to be finished within this time
+	oidcLoginLifetime = time.Minute * 10
+	// oidcLoginCookie carries the state, the nonce and the PKCE verifier from the login to the callback
+	oidcLoginCookie = "oidc_login"
+	oidcLoginPath   = "/auth/oidc"
+)
+
+var (
+	errOIDCNoEmail      = errors.New("the provider did not send an email")
+	errOIDCUnverified   = errors.New("an account with the email exists and the provider did not verify the email")
+	errOIDCDisabled     = errors.New("the account is disabled")
+	errOIDCNoUsername   = errors.New("no free username")
+	errOIDCLinkedToSome = errors.New("the account is linked to another identity")
+)
+
+// OIDCController is the route handler of the login through the identity provider (OpenID Connect).
+// Users are created on their first login and get their role from the groups at the provider.
+type OIDCController struct {
+	logger       *zap.Logger
+	provider     *oidc.Provider
+	keyring      *jwt.Keyring
+	tokens       *tokenconfig.Config
+	refreshStore tokenstore.RefreshStore
+	sessions     tokenstore.SessionStore
+	revocations  tokenstore.RevocationList
+	users        data.UserStore
+	audit        *audit.Recorder
+	cookies      *middleware.Cookies
+	promLogins   *prometheus.CounterVec
+}
+
+// NewOIDCController returns a frsh OIDC controller
+func NewOIDCController(logger *zap.Logger, provider *oidc.Provider, keyring *jwt.Keyring, tokens *tokenconfig.Config, refreshStore tokenstore.RefreshStore,
+	sessions tokenstore.SessionStore, revocations tokenstore.RevocationList, users data.UserStore, recorder *audit.Recorder) *OIDCController {
+	return &OIDCController{
+		logger:       logger,
+		provider:     provider,
+		keyring:      keyring,
+		tokens:       tokens,
+		refreshStore: refreshStore,
+		sessions:     sessions,
+		revocations:  revocations,
+		users:        users,
+		audit:        recorder,
+		cookies:      middleware.CookiesFromEnv(),
+		promLogins:   oidcLogins,
+	}
+}
+
+// loginCookie is the cookie holding the signed login state. It has to be Lax, the callback
+// is a navigation coming from the provider and would not get a Strict cookie.
+func loginCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     oidcLoginCookie,
+		Value:    value,
+		Path:     oidcLoginPath,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// LoginHandler sends the browser to the provider. The state, the nonce and the verifier stay
+// with the browser in a signed cookie, so any instance of the service can handle the callback.
+func (ctrl *OIDCController) LoginHandler(rw http.ResponseWriter, r *http.Request) {
+	state, nonce, verifier := oidc.RandomValue(), oidc.RandomValue(), oidc.RandomValue()
+	target, err := ctrl.provider.AuthCodeURL(r.Context(), state, nonce, verifier)
+	if err != nil {
+		ctrl.logger.Error("Unable to reach the identity provider", zap.Error(err))
+		ctrl.promLogins.WithLabelValues("provider_error").Inc()
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusBadGateway, "Identity provider unavailable"))
+		return
+	}
+	now := time.Now()
+	login, err := jwt.GenerateToken(ctrl.keyring.SigningKey(), jwt.Claims{
+		Issuer:    ctrl.tokens.Issuer,
+		Audience:  jwt.Audience{actionAudience(ctrl.tokens, purposeOIDCLogin)},
+		ExpiresAt: now.Add(oidcLoginLifetime).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        jwt.NewTokenID(),
+		Custom:    map[string]interface{}{"state": state, "nonce": nonce, "verifier": verifier},
+	})
+	if err != nil {
+		ctrl.logger.Error("unable to sign the login state", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	http.SetCookie(rw, loginCookie(login, int(oidcLoginLifetime/time.Second)))
+	http.Redirect(rw, r, target, http.StatusFound)
+}
+
+// loginState checks the cookie of the login belongs to the state of the callback and uses it up
+func (ctrl *OIDCController) loginState(r *http.Request) (*jwt.Claims, bool, error) {
+	cookie, err := r.Cookie(oidcLoginCookie)
+	if err != nil {
+		return nil, false, nil
+	}
+	claims, err := jwt.ValidateToken(cookie.Value, ctrl.keyring, jwt.Validator{
+		Leeway:   jwt.GetLeeway(),
+		Issuer:   ctrl.tokens.Issuer,
+		Audience: actionAudience(ctrl.tokens, purposeOIDCLogin),
+	})
+	if err != nil {
+		return nil, false, nil
+	}
+	state, _ := claims.Custom["state"].(string)
+	if subtle.ConstantTimeCompare([]byte(state), []byte(r.URL.Query().Get("state"))) != 1 {
+		return nil, false, nil
+	}
+	used, err := ctrl.revocations.IsRevoked(r.Context(), claims.ID)
+	if err != nil || used {
+		return nil, false, err
+	}
+	return claims, true, markActionTokenUsed(r.Context(), ctrl.revocations, claims)
+}
+
+// CallbackHandler is where the provider sends the browser back with the code. The code and the verifier
+// get the ID token, its user is found or created, and the signin ends like any other with our own tokens.
+func (ctrl *OIDCController) CallbackHandler(rw http.ResponseWriter, r *http.Request) {
+	// the login cookie is only good for one try
+	http.SetCookie(rw, loginCookie("", -1))
+	query := r.URL.Query()
+	if query.Get("error") != "" {
+		ctrl.logger.Warn("Login refused by the identity provider", zap.String("error", query.Get("error")))
+		ctrl.promLogins.WithLabelValues("refused").Inc()
+		p := problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "Login refused by the identity provider")
+		p.Detail = query.Get("error")
+		problem.Write(rw, r, p)
+		return
+	}
+	login, ok, err := ctrl.loginState(r)
+	if err != nil {
+		ctrl.logger.Error("Unable to check the login state", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if !ok || query.Get("code") == "" {
+		ctrl.logger.Warn("Callback without a matching login", zap.String("remote", r.RemoteAddr))
+		ctrl.promLogins.WithLabelValues("invalid_state").Inc()
+		p := problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "Login expired or invalid")
+		p.Detail = "Start the login again"
+		problem.Write(rw, r, p)
+		return
+	}
+
+	verifier, _ := login.Custom["verifier"].(string)
+	nonce, _ := login.Custom["nonce"].(string)
+	idToken, err := ctrl.provider.Exchange(r.Context(), query.Get("code"), verifier)
+	var identity oidc.Identity
+	if err == nil {
+		identity, err = ctrl.provider.VerifyIDToken(r.Context(), idToken, nonce)
+	}
+	if errors.Is(err, oidc.ErrProvider) {
+		ctrl.logger.Error("Unable to reach the identity provider", zap.Error(err))
+		ctrl.promLogins.WithLabelValues("provider_error").Inc()
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusBadGateway, "Identity provider unavailable"))
+		return
+	}
+	if err != nil {
+		ctrl.logger.Warn("ID token rejected", zap.Error(err))
+		ctrl.promLogins.WithLabelValues("invalid_token").Inc()
+		ctrl.record(r, identity, "", audit.OutcomeFailure, map[string]string{"reason": "invalid_id_token"})
+		problem.Write(rw, r, problem.New(problem.TypeInvalidToken, http.StatusUnauthorized, "Login failed"))
+		return
+	}
+
+	usr, created, err := ctrl.provision(r.Context(), identity)
+	if err != nil {
+		ctrl.refuse(rw, r, identity, err)
+		return
+	}
+	// our TOTP is not skipped because the provider says it did MFA, the user finishes at /auth/signin/mfa
+	if usr.MFAEnabled {
+		if err := writeMFAChallenge(rw, ctrl.keyring, ctrl.tokens, usr); err != nil {
+			ctrl.logger.Error("unable to sign the MFA challenge", zap.Error(err))
+			problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+			return
+		}
+		ctrl.promLogins.WithLabelValues("mfa_required").Inc()
+		ctrl.logger.Info("MFA challenge issued after the identity provider", zap.String("subject", usr.Username))
+		ctrl.record(r, identity, usr.Username, audit.OutcomeSuccess, map[string]string{"reason": "mfa_required"})
+		return
+	}
+	access, refreshToken, err := startSession(r, ctrl.keyring, ctrl.tokens, ctrl.refreshStore, ctrl.sessions, usr, ctrl.amr(identity))
+	if err != nil {
+		ctrl.logger.Error("unable to start the session", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.promLogins.WithLabelValues("success").Inc()
+	ctrl.logger.Info("Signin through the identity provider", zap.String("subject", usr.Username), zap.Bool("created", created))
+	ctrl.record(r, identity, usr.Username, audit.OutcomeSuccess, map[string]string{
+		"created": strconv.FormatBool(created),
+		"role":    data.RoleName(usr.Role),
+	})
+	// the browser cannot ask for cookies on a redirect, with the cookie mode on it gets them anyway
+	writeTokens(rw, false, ctrl.cookies, ctrl.tokens, access, refreshToken)
+}
+
+// amr is how the user signed in. We take what the provider tells, a user who did MFA
+// there and has none of ours does not have to repeat it here. Without it the user at least knew a password.
+func (ctrl *OIDCController) amr(identity oidc.Identity) []string {
+	var amr []string
+	for _, method := range identity.AMR {
+		switch method {
+		case jwt.AMRPassword, jwt.AMROTP, jwt.AMRMFA:
+			amr = append(amr, method)
+		}
+	}
+	if len(amr) == 0 {
+		return []string{jwt.AMRPassword}
+	}
+	return amr
+}
+
+// provision finds the user of the identity. A known email is linked to the identity if the provider
+// verified it, otherwise a new user is created. Groups with a mapped role decide the role on every login,
+// without them the user keeps the role. Linking keeps the role of the local account.
+func (ctrl *OIDCController) provision(ctx context.Context, identity oidc.Identity) (data.User, bool, error) {
+	config := ctrl.provider.Config()
+	role, mapped := config.RoleFor(identity.Groups)
+
+	usr, err := ctrl.users.GetByExternalID(ctx, identity.Issuer, identity.Subject)
+	if err == nil {
+		if usr.Status == data.StatusDisabled {
+			return data.User{}, false, errOIDCDisabled
+		}
+		if mapped && usr.Role != role {
+			usr.Role = role
+			if err := ctrl.users.Update(ctx, usr); err != nil {
+				return data.User{}, false, err
+			}
+		}
+		return usr, false, nil
+	}
+	if err != data.ErrUserNotFound {
+		return data.User{}, false, err
+	}
+	if identity.Email == "" {
+		return data.User{}, false, errOIDCNoEmail
+	}
+
+	usr, err = ctrl.users.GetByEmail(ctx, identity.Email)
+	switch {
+	case err == nil:
+		// anybody could claim the email at a sloppy provider, only a verified one takes over the account
+		if !identity.EmailVerified {
+			return data.User{}, false, errOIDCUnverified
+		}
+		if usr.External() {
+			return data.User{}, false, errOIDCLinkedToSome
+		}
+		if usr.Status == data.StatusDisabled {
+			return data.User{}, false, errOIDCDisabled
+		}
+		// the provider verified the email, so a pending account does not need our mail anymore
+		usr.Status = data.StatusActive
+		// the groups must not demote a local admin or promote a local user just by linking
+		usr.ExternalIssuer, usr.ExternalSubject = identity.Issuer, identity.Subject
+		return usr, false, ctrl.users.Update(ctx, usr)
+	case err != data.ErrUserNotFound:
+		return data.User{}, false, err
+	}
+
+	usr = data.User{
+		Email:           identity.Email,
+		Fullname:        identity.Name,
+		Role:            role,
+		Status:          data.StatusActive,
+		ExternalIssuer:  identity.Issuer,
+		ExternalSubject: identity.Subject,
+	}
+	if name := []rune(usr.Fullname); len(name) > maxFullnameLength {
+		usr.Fullname = string(name[:maxFullnameLength])
+	}
+	// the username the provider suggests can be taken, then we count up
+	base := usernameFor(identity)
+	for i := 1; i <= 20; i++ {
+		usr.Username = base
+		if i > 1 {
+			suffix := strconv.Itoa(i)
+			if len(base)+len(suffix) > maxUsernameLength {
+				usr.Username = base[:maxUsernameLength-len(suffix)]
+			}
+			usr.Username += suffix
+		}
+		err = ctrl.users.Create(ctx, &usr)
+		if err != data.ErrUserExists {
+			return usr, err == nil, err
+		}
+		// the email could have been taken in the meantime, counting up does not help then
+		if _, err := ctrl.users.GetByEmail(ctx, identity.Email); err == nil {
+			return data.User{}, false, data.ErrUserExists
+		}
+	}
+	return data.User{}, false, errOIDCNoUsername
+}
+
+// usernameFor makes a valid username from the preferred username or the email
+func usernameFor(identity oidc.Identity) string {
+	name := identity.PreferredUsername
+	if name == "" || strings.Contains(name, "@") {
+		name = strings.SplitN(identity.Email, "@", 2)[0]
+	}
+	var cleaned strings.Builder
+	for _, c := range name {
+		if usernamePattern.MatchString(string(c)) {
+			cleaned.WriteRune(c)
+		}
+	}
+	name = cleaned.String()
+	if len(name) > maxUsernameLength {
+		name = name[:maxUsernameLength]
+	}
+	for len(name) < minUsernameLength {
+		name += "_"
+	}
+	return name
+}
+
+// refuse answers a login whose user cannot be used
+func (ctrl *OIDCController) refuse(rw http.ResponseWriter, r *http.Request, identity oidc.Identity, err error) {
+	var p problem.Problem
+	switch err {
+	case errOIDCDisabled:
+		p = problem.New(problem.TypeDisabled, http.StatusForbidden, "Account disabled")
+	case errOIDCNoEmail:
+		p = problem.New(problem.TypeForbidden, http.StatusForbidden, "The identity provider did not share the email")
+	case errOIDCUnverified, errOIDCLinkedToSome, data.ErrUserExists:
+		p = problem.New(problem.TypeConflict, http.StatusConflict, "An account with the email already exists")
+		p.Detail = "Sign in with the password of the account"
+	default:
+		ctrl.logger.Error("Unable to provision the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.logger.Warn("Login through the identity provider refused", zap.String("sub", identity.Subject), zap.Error(err))
+	ctrl.promLogins.WithLabelValues("refused").Inc()
+	ctrl.record(r, identity, "", audit.OutcomeDenied, map[string]string{"reason": err.Error()})
+	problem.Write(rw, r, p)
+}
+
+// record audits the login. The target is the identity at the provider, the actor our user if there is one.
+func (ctrl *OIDCController) record(r *http.Request, identity oidc.Identity, actor string, outcome string, details map[string]string) {
+	event := audit.FromRequest(r, audit.ActionSigninOIDC)
+	event.Actor = actor
+	event.Target = identity.Email
+	event.Outcome = outcome
+	event.Details = details
+	if identity.Subject != "" {
+		event.Detail("sub", identity.Subject)
+	}
+	ctrl.audit.Record(r.Context(), event)
+}
@@ -0,0 +1,391 @@
+// Package oidc is the relying party side of OpenID Connect. Staff sign in at the identity
+// provider of the company with the authorization code flow and PKCE, we validate the ID token
+// against the keys the provider publishes and take the user and the groups from it.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+)
+
+var (
+	// ErrProvider is a provider that cannot be reached or answers with something we do not understand
+	ErrProvider = errors.New("identity provider unavailable")
+	// ErrInvalidIDToken is an ID token that does not pass the checks of OpenID Connect Core 3.1.3.7
+	ErrInvalidIDToken = errors.New("invalid ID token")
+)
+
+// the keys of the provider are fetched again for an unknown kid, but not more often than this
+const keyRefreshInterval = time.Minute
+
+// the answers of the provider are small, anything bigger is not meant for us
+const maxResponseSize = 1 << 20
+
+// Config is the registration of our service at the provider
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// GroupsClaim is the claim of the ID token listing the groups of the user
+	GroupsClaim string
+	// RoleMapping maps the groups to the names of our roles
+	RoleMapping map[string]string
+}
+
+// ConfigFromEnv reads the configuration. Without OIDC_ISSUER the OIDC login is off and ok is false.
+// OIDC_ROLE_MAPPING lists the groups and their roles, eg. "platform-admins=admin,staff=user".
+func ConfigFromEnv() (cfg Config, ok bool, err error) {
+	cfg = Config{
+		Issuer:       os.Getenv("OIDC_ISSUER"),
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		Scopes:       strings.Fields(os.Getenv("OIDC_SCOPES")),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM"),
+		RoleMapping:  map[string]string{},
+	}
+	if cfg.Issuer == "" {
+		return Config{}, false, nil
+	}
+	for _, pair := range strings.Split(os.Getenv("OIDC_ROLE_MAPPING"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return Config{}, false, fmt.Errorf("OIDC_ROLE_MAPPING: %q is not group=role", pair)
+		}
+		cfg.RoleMapping[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, false, err
+	}
+	return cfg, true, nil
+}
+
+// validate fills in the defaults and checks the rest
+func (c *Config) validate() error {
+	if len(c.Scopes) == 0 {
+		c.Scopes = []string{"openid", "email", "profile"}
+	}
+	if c.GroupsClaim == "" {
+		c.GroupsClaim = "groups"
+	}
+	if c.ClientID == "" || c.RedirectURL == "" {
+		return errors.New("OIDC needs the client id and the redirect url")
+	}
+	for group, role := range c.RoleMapping {
+		if _, ok := data.RoleFromName(role); !ok {
+			return fmt.Errorf("the group %s maps to the unknown role %s", group, role)
+		}
+	}
+	return nil
+}
+
+// RoleFor returns the highest role any of the groups maps to, and false if none of them is mapped
+func (c *Config) RoleFor(groups []string) (int, bool) {
+	role, mapped := data.RoleUser, false
+	for _, group := range groups {
+		name, ok := c.RoleMapping[group]
+		if !ok {
+			continue
+		}
+		groupRole, _ := data.RoleFromName(name)
+		if !mapped || groupRole > role {
+			role = groupRole
+		}
+		mapped = true
+	}
+	return role, mapped
+}
+
+// Metadata is the part of the discovery document we use (OpenID Connect Discovery 1.0 section 3)
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Identity is the user the ID token describes
+type Identity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	Groups            []string
+	// AMR is how the user signed in at the provider, if it tells us
+	AMR []string
+}
+
+// Provider talks to the identity provider. The discovery document and the keys are fetched
+// on first use and kept, so the service starts even while the provider is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	// Now is used instead of time.Now to check the ID tokens in tests
+	Now func() time.Time
+
+	mu          sync.Mutex
+	metadata    *Metadata
+	keys        *jwt.Keyring
+	keysFetched time.Time
+}
+
+// NewProvider returns a provider for the configuration. A nil client gets one with a timeout.
+func NewProvider(config Config, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &Provider{config: config, client: client}
+}
+
+// Config returns the configuration of the provider
+func (p *Provider) Config() Config {
+	return p.config
+}
+
+// RandomValue returns a random value for the state, the nonce or the PKCE verifier
+func RandomValue() string {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Challenge is the S256 code challenge of the verifier (RFC 7636 4.2)
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// getJSON fetches a document of the provider
+func (p *Provider) getJSON(ctx context.Context, endpoint string, target interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s answered %d", ErrProvider, endpoint, resp.StatusCode)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize)).Decode(target); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrProvider, endpoint, err)
+	}
+	return nil
+}
+
+// discover returns the discovery document, fetching it the first time
+func (p *Provider) discover(ctx context.Context) (Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.metadata != nil {
+		return *p.metadata, nil
+	}
+	var metadata Metadata
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &metadata); err != nil {
+		return Metadata{}, err
+	}
+	// the issuer of the document has to be exactly the one we trust (Discovery 4.3)
+	if metadata.Issuer != p.config.Issuer {
+		return Metadata{}, fmt.Errorf("%w: the document is for the issuer %s", ErrProvider, metadata.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return Metadata{}, fmt.Errorf("%w: the document misses an endpoint", ErrProvider)
+	}
+	p.metadata = &metadata
+	return metadata, nil
+}
+
+// AuthCodeURL is where the browser is sent to sign in, with the S256 challenge of the verifier
+func (p *Provider) AuthCodeURL(ctx context.Context, state string, nonce string, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// tokenResponse is the answer of the token endpoint, or its error (RFC 6749 5.1 and 5.2)
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Exchange trades the code for the tokens of the provider and returns the ID token.
+// The verifier proves we are the ones who started the login.
+func (p *Provider) Exchange(ctx context.Context, code string, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	// a confidential client authenticates with HTTP Basic, a public one only names itself
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		// RFC 6749 2.3.1 wants both form encoded before they go into Basic
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	var tokens tokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return "", fmt.Errorf("%w: the token endpoint answered %d", ErrProvider, resp.StatusCode)
+	}
+	// a code that is wrong, used or expired is the fault of the login, not of the provider
+	if tokens.Error != "" {
+		return "", fmt.Errorf("%w: %s %s", ErrInvalidIDToken, tokens.Error, tokens.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return "", fmt.Errorf("%w: the token endpoint answered %d without an ID token", ErrProvider, resp.StatusCode)
+	}
+	return tokens.IDToken, nil
+}
+
+// kidOf reads the kid header of the token without verifying anything
+func kidOf(token string) string {
+	header, err := base64.RawURLEncoding.DecodeString(strings.SplitN(token, ".", 2)[0])
+	if err != nil {
+		return ""
+	}
+	var parsed jwt.Header
+	json.Unmarshal(header, &parsed)
+	return parsed.Kid
+}
+
+// keyring returns the keys of the provider. An unknown kid fetches them again, the provider may have rotated.
+func (p *Provider) keyring(ctx context.Context, kid string) (*jwt.Keyring, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.keys != nil {
+		if _, ok := p.keys.Lookup(kid); ok || time.Since(p.keysFetched) < keyRefreshInterval {
+			return p.keys, nil
+		}
+	}
+	var set jwt.JWKS
+	if err := p.getJSON(ctx, metadata.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys, err := set.Keyring()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrProvider, err)
+	}
+	p.keys, p.keysFetched = keys, time.Now()
+	return keys, nil
+}
+
+// VerifyIDToken checks the ID token (OpenID Connect Core 3.1.3.7): the signature with the keys of the provider,
+// the issuer, our client id in the audience, the dates and the nonce of our login.
+func (p *Provider) VerifyIDToken(ctx context.Context, idToken string, nonce string) (Identity, error) {
+	keys, err := p.keyring(ctx, kidOf(idToken))
+	if err != nil {
+		return Identity{}, err
+	}
+	claims, err := jwt.ValidateToken(idToken, keys, jwt.Validator{
+		Leeway:   jwt.GetLeeway(),
+		Issuer:   p.config.Issuer,
+		Audience: p.config.ClientID,
+		Now:      p.Now,
+	})
+	if err != nil {
+		return Identity{}, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	// with more than one audience the token must have been issued to us
+	if azp, _ := claims.Custom["azp"].(string); len(claims.Audience) > 1 && azp != p.config.ClientID {
+		return Identity{}, fmt.Errorf("%w: issued to %s", ErrInvalidIDToken, azp)
+	}
+	tokenNonce, _ := claims.Custom["nonce"].(string)
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(tokenNonce), []byte(nonce)) != 1 {
+		return Identity{}, fmt.Errorf("%w: the nonce does not match", ErrInvalidIDToken)
+	}
+	if claims.Subject == "" || claims.IssuedAt == 0 {
+		return Identity{}, fmt.Errorf("%w: sub and iat are required", ErrInvalidIDToken)
+	}
+
+	identity := Identity{
+		Issuer:  claims.Issuer,
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		AMR:     claims.AMR,
+	}
+	identity.EmailVerified, _ = claims.Custom["email_verified"].(bool)
+	identity.Name, _ = claims.Custom["name"].(string)
+	identity.PreferredUsername, _ = claims.Custom["preferred_username"].(string)
+	// some providers send a single group as a string
+	switch groups := claims.Custom[p.config.GroupsClaim].(type) {
+	case string:
+		identity.Groups = []string{groups}
+	case []interface{}:
+		for _, group := range groups {
+			if name, ok := group.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	}
+	return identity, nil
+}
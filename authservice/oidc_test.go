@@ -0,0 +1,256 @@
+package authservice
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/oidc"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+// stubIdP is a tiny OpenID provider. The test approves a login at authorize, the
+// token endpoint then checks the PKCE verifier and hands out the ID token.
+type stubIdP struct {
+	server *httptest.Server
+	key    *jwt.Key
+	mu     sync.Mutex
+	codes  map[string]stubLogin
+}
+
+type stubLogin struct {
+	challenge string
+	nonce     string
+	claims    map[string]interface{}
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	signer, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key, _ := jwt.NewKey("idp-key", signer)
+	idp := &stubIdP{key: key, codes: map[string]stubLogin{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(rw).Encode(oidc.Metadata{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, r *http.Request) {
+		jwk, _ := idp.key.JWK()
+		json.NewEncoder(rw).Encode(jwt.JWKS{Keys: []jwt.JWK{jwk}})
+	})
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		id, secret, _ := r.BasicAuth()
+		idp.mu.Lock()
+		login, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		if id != "authservice" || secret != "idp-secret" || r.PostForm.Get("grant_type") != "authorization_code" {
+			rw.WriteHeader(http.StatusUnauthorized)
+			rw.Write([]byte(`{"error":"invalid_client"}`))
+			return
+		}
+		if !ok || oidc.Challenge(r.PostForm.Get("code_verifier")) != login.challenge {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		now := time.Now()
+		claims := jwt.Claims{
+			Issuer:    idp.server.URL,
+			Subject:   login.claims["sub"].(string),
+			Audience:  jwt.Audience{"authservice"},
+			ExpiresAt: now.Add(time.Minute).Unix(),
+			IssuedAt:  now.Unix(),
+			Custom:    map[string]interface{}{"nonce": login.nonce},
+		}
+		for name, value := range login.claims {
+			switch name {
+			case "sub":
+			case "email":
+				claims.Email = value.(string)
+			default:
+				claims.Custom[name] = value
+			}
+		}
+		idToken, _ := jwt.GenerateToken(idp.key, claims)
+		json.NewEncoder(rw).Encode(map[string]string{"access_token": "idp-access", "token_type": "Bearer", "id_token": idToken})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// approve signs the user in at the provider and returns where the browser is sent back to
+func (idp *stubIdP) approve(t *testing.T, authURL string, claims map[string]interface{}) url.Values {
+	parsed, err := url.Parse(authURL)
+	if err != nil || !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+		t.Fatalf("Unexpected redirect to %s", authURL)
+	}
+	query := parsed.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != "authservice" || query.Get("nonce") == "" {
+		t.Fatalf("Expected a PKCE request of our client with a nonce, got %v", query)
+	}
+	code := oidc.RandomValue()
+	nonce := query.Get("nonce")
+	if override, ok := claims["nonce"].(string); ok {
+		nonce = override
+		delete(claims, "nonce")
+	}
+	idp.mu.Lock()
+	idp.codes[code] = stubLogin{challenge: query.Get("code_challenge"), nonce: nonce, claims: claims}
+	idp.mu.Unlock()
+	return url.Values{"code": {code}, "state": {query.Get("state")}}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	logger := zap.NewNop()
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	users := data.NewMemoryUserStore(data.User{Email: "abc@gmail.com", Username: "abc12", PasswordHash: "hashedme1", Role: data.RoleAdmin})
+	idp := newStubIdP(t)
+	provider := oidc.NewProvider(oidc.Config{
+		Issuer:       idp.server.URL,
+		ClientID:     "authservice",
+		ClientSecret: "idp-secret",
+		RedirectURL:  "http://localhost:9090/auth/oidc/callback",
+		Scopes:       []string{"openid", "email", "profile"},
+		GroupsClaim:  "groups",
+		RoleMapping:  map[string]string{"platform-admins": "admin", "staff": "user"},
+	}, idp.server.Client())
+	oc := NewOIDCController(logger, provider, keyring, tokenconfig.Default(), tokenstore.NewMemoryRefreshStore(),
+		tokenstore.NewMemorySessionStore(), tokenstore.NewMemoryRevocationList(), users, nil)
+
+	// login redirects to the provider and leaves the login cookie, the callback brings both together
+	login := func() (string, *http.Cookie) {
+		rw := httptest.NewRecorder()
+		oc.LoginHandler(rw, httptest.NewRequest("GET", "/auth/oidc/login", nil))
+		if rw.Code != http.StatusFound || len(rw.Result().Cookies()) != 1 {
+			t.Fatalf("Expected a redirect with the login cookie, got %d", rw.Code)
+		}
+		return rw.Header().Get("Location"), rw.Result().Cookies()[0]
+	}
+	callback := func(query url.Values, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/auth/oidc/callback?"+query.Encode(), nil)
+		req.AddCookie(cookie)
+		rw := httptest.NewRecorder()
+		oc.CallbackHandler(rw, req)
+		return rw
+	}
+	staff := func(groups ...string) map[string]interface{} {
+		return map[string]interface{}{"sub": "idp-42", "email": "jane@corp.example", "email_verified": true,
+			"name": "Jane Doe", "preferred_username": "jane.doe", "groups": groups}
+	}
+
+	// the first login creates the user with the role of the groups
+	authURL, cookie := login()
+	back := idp.approve(t, authURL, staff("platform-admins", "staff"))
+	rw := callback(back, cookie)
+	var tokens TokenResponse
+	json.NewDecoder(rw.Body).Decode(&tokens)
+	if rw.Code != http.StatusOK || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("Expected our tokens after the login, got %d", rw.Code)
+	}
+	claims, err := jwt.ValidateToken(tokens.AccessToken, keyring, jwt.Validator{Audience: jwt.GetAudience()})
+	if err != nil || claims.Subject != "jane.doe" || !claims.HasRole("admin") || claims.SessionID == "" {
+		t.Fatalf("Unexpected access token %+v %v", claims, err)
+	}
+	usr, err := users.GetByExternalID(context.Background(), idp.server.URL, "idp-42")
+	if err != nil || usr.HasPassword() || usr.Fullname != "Jane Doe" {
+		t.Fatalf("Expected the provisioned user without a password, got %+v %v", usr, err)
+	}
+
+	// the login cookie is single use
+	if rw := callback(back, cookie); rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a replayed callback to be refused, got %d", rw.Code)
+	}
+	authURL, cookie = login()
+	back = idp.approve(t, authURL, staff("staff"))
+	back.Set("state", "forged")
+	if rw := callback(back, cookie); rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected another state to be refused, got %d", rw.Code)
+	}
+
+	// the next login finds the same user, and the groups at the provider still decide the role
+	authURL, cookie = login()
+	if rw := callback(idp.approve(t, authURL, staff("staff")), cookie); rw.Code != http.StatusOK {
+		t.Fatalf("Second login failed with %d", rw.Code)
+	}
+	usr, _ = users.GetByExternalID(context.Background(), idp.server.URL, "idp-42")
+	all, _ := users.List(context.Background(), data.ListOptions{})
+	if usr.Role != data.RoleUser || len(all) != 2 {
+		t.Fatalf("Expected the same user with the role user, got %+v of %d users", usr, len(all))
+	}
+
+	// an ID token of another login is refused
+	authURL, cookie = login()
+	other := staff()
+	other["nonce"] = "someone-else"
+	if rw := callback(idp.approve(t, authURL, other), cookie); rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected a foreign nonce to be refused, got %d", rw.Code)
+	}
+
+	// a local account is only linked when the provider verified the email
+	local := map[string]interface{}{"sub": "idp-7", "email": "abc@gmail.com", "email_verified": false}
+	authURL, cookie = login()
+	if rw := callback(idp.approve(t, authURL, local), cookie); rw.Code != http.StatusConflict {
+		t.Fatalf("Expected the unverified email to be refused, got %d", rw.Code)
+	}
+	local["email_verified"] = true
+	authURL, cookie = login()
+	if rw := callback(idp.approve(t, authURL, local), cookie); rw.Code != http.StatusOK {
+		t.Fatalf("Expected the verified email to be linked, got %d", rw.Code)
+	}
+	usr, _ = users.GetByEmail(context.Background(), "abc@gmail.com")
+	if usr.Username != "abc12" || !usr.External() || usr.Role != data.RoleAdmin {
+		t.Fatalf("Expected abc12 to be linked and stay admin, got %+v", usr)
+	}
+
+	// with our TOTP enrolled the provider's word on MFA is not enough, the login gets our challenge
+	usr.MFAEnabled, usr.MFASecret = true, "JBSWY3DPEHPK3PXP"
+	users.Update(context.Background(), usr)
+	local["amr"] = []string{"pwd", "mfa"}
+	authURL, cookie = login()
+	rw = callback(idp.approve(t, authURL, local), cookie)
+	var challenge mfaChallengeResponse
+	json.NewDecoder(rw.Body).Decode(&challenge)
+	if rw.Code != http.StatusOK || !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Fatalf("Expected the MFA challenge instead of tokens, got %d %+v", rw.Code, challenge)
+	}
+
+	// groups without a mapped role leave the role alone, a mapped one decides it
+	if usr, _ = users.GetByEmail(context.Background(), "abc@gmail.com"); usr.Role != data.RoleAdmin {
+		t.Fatalf("Expected unmapped groups to keep the role, got %+v", usr)
+	}
+	local["groups"] = []string{"staff"}
+	authURL, cookie = login()
+	callback(idp.approve(t, authURL, local), cookie)
+	if usr, _ = users.GetByEmail(context.Background(), "abc@gmail.com"); usr.Role != data.RoleUser {
+		t.Fatalf("Expected the mapped group to decide the role, got %+v", usr)
+	}
+
+	// a long name is cut to the characters we allow, not in the middle of one
+	long := map[string]interface{}{"sub": "idp-99", "email": "zoe@corp.example", "email_verified": true,
+		"name": strings.Repeat("é", maxFullnameLength+10)}
+	authURL, cookie = login()
+	callback(idp.approve(t, authURL, long), cookie)
+	if usr, _ = users.GetByEmail(context.Background(), "zoe@corp.example"); usr.Fullname != strings.Repeat("é", maxFullnameLength) {
+		t.Fatalf("Expected the name to be cut to %d characters, got %q", maxFullnameLength, usr.Fullname)
+	}
+}
@@ -0,0 +1,217 @@
+// Package password hashes the passwords of the users before they are stored.
+// Hashes are written in the PHC string format, so the algorithm and its parameters
+// are stored together with every hash and can be changed without breaking old users.
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The algorithms a Hasher can hash with
+const (
+	Argon2id = "argon2id"
+	Bcrypt   = "bcrypt"
+)
+
+// MinLength is the shortest password we accept at signup
+const MinLength = 8
+
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// PHC strings use standard base64 without padding
+var phcEncoding = base64.RawStdEncoding
+
+// Params tune the cost of hashing. Raising them makes every stored hash
+// with lower parameters get re-hashed on the next successful signin.
+type Params struct {
+	Algorithm string
+	// Argon2id, Memory is in KiB
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+	// bcrypt
+	Cost int
+}
+
+// DefaultParams follow the OWASP recommendations for Argon2id
+func DefaultParams() Params {
+	return Params{
+		Algorithm: Argon2id,
+		Time:      3,
+		Memory:    64 * 1024,
+		Threads:   2,
+		SaltLen:   16,
+		KeyLen:    32,
+		Cost:      12,
+	}
+}
+
+// ParamsFromEnv starts from DefaultParams and applies PASSWORD_ALGORITHM, PASSWORD_ARGON2_TIME,
+// PASSWORD_ARGON2_MEMORY, PASSWORD_ARGON2_THREADS and PASSWORD_BCRYPT_COST when they are set
+func ParamsFromEnv() (Params, error) {
+	params := DefaultParams()
+	if alg := os.Getenv("PASSWORD_ALGORITHM"); alg != "" {
+		params.Algorithm = alg
+	}
+	for name, target := range map[string]*uint32{
+		"PASSWORD_ARGON2_TIME":   &params.Time,
+		"PASSWORD_ARGON2_MEMORY": &params.Memory,
+	} {
+		if value := os.Getenv(name); value != "" {
+			parsed, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return Params{}, fmt.Errorf("%s: %v", name, err)
+			}
+			*target = uint32(parsed)
+		}
+	}
+	if value := os.Getenv("PASSWORD_ARGON2_THREADS"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 8)
+		if err != nil {
+			return Params{}, fmt.Errorf("PASSWORD_ARGON2_THREADS: %v", err)
+		}
+		params.Threads = uint8(parsed)
+	}
+	if value := os.Getenv("PASSWORD_BCRYPT_COST"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return Params{}, fmt.Errorf("PASSWORD_BCRYPT_COST: %v", err)
+		}
+		params.Cost = parsed
+	}
+	return params, params.check()
+}
+
+// check catches parameters the algorithms would reject or silently weaken
+func (p Params) check() error {
+	switch p.Algorithm {
+	case Argon2id:
+		if p.Time < 1 || p.Threads < 1 || p.Memory < 8*uint32(p.Threads) || p.SaltLen < 8 || p.KeyLen < 16 {
+			return errors.New("argon2id parameters are too weak")
+		}
+	case Bcrypt:
+		if p.Cost < bcrypt.MinCost || p.Cost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password algorithm %q", p.Algorithm)
+	}
+	return nil
+}
+
+// Hasher hashes new passwords with its Params and verifies hashes of any supported algorithm
+type Hasher struct {
+	params    Params
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// NewHasher returns a Hasher, the params are checked first
+func NewHasher(params Params) (*Hasher, error) {
+	if err := params.check(); err != nil {
+		return nil, err
+	}
+	return &Hasher{params: params}, nil
+}
+
+// Hash returns the encoded hash of the password with a fresh random salt
+func (h *Hasher) Hash(password string) (string, error) {
+	if h.params.Algorithm == Bcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.params.Cost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, h.params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		h.params.Memory, h.params.Time, h.params.Threads, phcEncoding.EncodeToString(salt), phcEncoding.EncodeToString(key)), nil
+}
+
+// Verify checks the password against the encoded hash in constant time.
+// needsRehash tells that the hash was made with other parameters than the Hasher's
+// and should be replaced with a new Hash of the password.
+//
+// Older versions stored the password as it was sent. Anything not looking like a
+// hash is treated as such a legacy value and always needs a rehash. An empty hash
+// is an account without a password, eg. one of OIDC, and never matches.
+func (h *Hasher) Verify(password string, encoded string) (match bool, needsRehash bool, err error) {
+	switch {
+	case encoded == "":
+		return false, false, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return h.verifyArgon2id(password, encoded)
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, ErrInvalidHash
+		}
+		cost, _ := bcrypt.Cost([]byte(encoded))
+		return true, h.params.Algorithm != Bcrypt || cost != h.params.Cost, nil
+	case strings.HasPrefix(encoded, "$"):
+		return false, false, ErrInvalidHash
+	}
+	match = subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1
+	return match, match, nil
+}
+
+// Burn does the work of a Verify against a hash that never matches. Signins of unknown
+// users take as long as wrong passwords, so the timing does not tell which emails exist.
+func (h *Hasher) Burn(password string) {
+	h.dummyOnce.Do(func() {
+		h.dummy, _ = h.Hash("not the password of anybody")
+	})
+	h.Verify(password, h.dummy)
+}
+
+func (h *Hasher) verifyArgon2id(password string, encoded string) (bool, bool, error) {
+	// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, ErrInvalidHash
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, false, ErrInvalidHash
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, false, ErrInvalidHash
+	}
+	salt, err := phcEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrInvalidHash
+	}
+	key, err := phcEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false, false, ErrInvalidHash
+	}
+
+	computed := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(computed, key) != 1 {
+		return false, false, nil
+	}
+	p := h.params
+	needsRehash := p.Algorithm != Argon2id || memory != p.Memory || time != p.Time || threads != p.Threads ||
+		uint32(len(salt)) != p.SaltLen || uint32(len(key)) != p.KeyLen
+	return true, needsRehash, nil
+}
@@ -0,0 +1,86 @@
+package password
+
+import (
+	"strings"
+	"testing"
+)
+
+// cheap parameters, the tests only care about the format and the comparisons
+func testParams(alg string) Params {
+	return Params{Algorithm: alg, Time: 1, Memory: 64, Threads: 1, SaltLen: 16, KeyLen: 32, Cost: 4}
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, alg := range []string{Argon2id, Bcrypt} {
+		t.Run(alg, func(t *testing.T) {
+			hasher, err := NewHasher(testParams(alg))
+			if err != nil {
+				t.Fatalf("Unable to create the hasher: %v", err)
+			}
+			first, _ := hasher.Hash("correct horse")
+			second, _ := hasher.Hash("correct horse")
+			if first == second {
+				t.Fatalf("Every hash must get its own salt")
+			}
+			if match, rehash, err := hasher.Verify("correct horse", first); !match || rehash || err != nil {
+				t.Fatalf("Expected a match without rehash, got %v %v %v", match, rehash, err)
+			}
+			if match, _, _ := hasher.Verify("wrong horse", first); match {
+				t.Fatalf("Wrong password must not match")
+			}
+		})
+	}
+}
+
+func TestArgon2idFormat(t *testing.T) {
+	hasher, _ := NewHasher(testParams(Argon2id))
+	hash, _ := hasher.Hash("correct horse")
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Fatalf("Unexpected PHC string %s", hash)
+	}
+	for _, broken := range []string{"$argon2id$v=19$m=64,t=1,p=1$salt", "$argon2id$v=18" + hash[len("$argon2id$v=19"):], "$unknown$"} {
+		if _, _, err := hasher.Verify("correct horse", broken); err != ErrInvalidHash {
+			t.Fatalf("Expected ErrInvalidHash for %s, got %v", broken, err)
+		}
+	}
+}
+
+func TestRehash(t *testing.T) {
+	weak, _ := NewHasher(testParams(Argon2id))
+	old, _ := weak.Hash("correct horse")
+
+	stronger := testParams(Argon2id)
+	stronger.Time = 2
+	hasher, _ := NewHasher(stronger)
+	if match, rehash, _ := hasher.Verify("correct horse", old); !match || !rehash {
+		t.Fatalf("Changed parameters must ask for a rehash")
+	}
+	if match, rehash, _ := hasher.Verify("wrong horse", old); match || rehash {
+		t.Fatalf("A wrong password must never ask for a rehash")
+	}
+
+	bcryptHasher, _ := NewHasher(testParams(Bcrypt))
+	if match, rehash, _ := bcryptHasher.Verify("correct horse", old); !match || !rehash {
+		t.Fatalf("Switching the algorithm must ask for a rehash")
+	}
+
+	// passwords stored by older versions as they were sent
+	if match, rehash, _ := hasher.Verify("hashedme1", "hashedme1"); !match || !rehash {
+		t.Fatalf("Legacy values must match and ask for a rehash")
+	}
+	// accounts without a password, not a legacy empty one
+	if match, _, _ := hasher.Verify("", ""); match {
+		t.Fatalf("An empty hash must never match")
+	}
+}
+
+func TestWeakParams(t *testing.T) {
+	params := testParams(Bcrypt)
+	params.Cost = 2
+	if _, err := NewHasher(params); err == nil {
+		t.Fatalf("Expected an error for a bcrypt cost below the minimum")
+	}
+	if _, err := NewHasher(testParams("md5")); err == nil {
+		t.Fatalf("Expected an error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,70 @@
+// Package problem writes error responses as RFC 7807 problem details,
+// so clients get a machine readable reason instead of a bare string.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// ContentType of problem responses
+const ContentType = "application/problem+json"
+
+// the types we use, relative URIs are allowed by RFC 7807
+const (
+	TypeValidation   = "/problems/validation"
+	TypeMalformed    = "/problems/malformed-request"
+	TypeConflict     = "/problems/conflict"
+	TypeUnauthorized = "/problems/unauthorized"
+	TypeForbidden    = "/problems/forbidden"
+	TypeNotFound     = "/problems/not-found"
+	TypeTooMany      = "/problems/too-many-attempts"
+	TypeUnverified   = "/problems/email-not-verified"
+	TypeDisabled     = "/problems/account-disabled"
+	TypeInvalidToken = "/problems/invalid-token"
+	TypeInternal     = "/problems/internal"
+)
+
+// FieldError is one invalid field of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Problem is the problem details object. Errors is our extension member
+// listing every invalid field, so a form can show all of them at once.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// New returns a problem of the type with the title and status
+func New(problemType string, status int, title string) Problem {
+	return Problem{Type: problemType, Title: title, Status: status}
+}
+
+// Validation returns the 400 problem for the invalid fields
+func Validation(errors []FieldError) Problem {
+	p := New(TypeValidation, http.StatusBadRequest, "Your request parameters didn't validate")
+	p.Errors = errors
+	return p
+}
+
+// Write sends the problem with its status. The path of the request is the instance.
+func Write(rw http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Instance == "" && r != nil {
+		p.Instance = r.URL.Path
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", ContentType)
+	rw.WriteHeader(p.Status)
+	rw.Write(body)
+}
@@ -0,0 +1,277 @@
+package authservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+var passwordChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "password_changes",
+	Help: "Password changes of signed in users by result",
+}, []string{"result"})
+
+// userResponse is a user as the API shows it, without any secrets
+type userResponse struct {
+	ID         uint      `json:"id"`
+	Email      string    `json:"email"`
+	Username   string    `json:"username"`
+	Fullname   string    `json:"fullname"`
+	CreateDate time.Time `json:"create_date"`
+	Role       string    `json:"role"`
+	Status     string    `json:"status"`
+	MFAEnabled bool      `json:"mfa_enabled"`
+}
+
+func newUserResponse(usr data.User) userResponse {
+	return userResponse{
+		ID:         usr.ID,
+		Email:      usr.Email,
+		Username:   usr.Username,
+		Fullname:   usr.Fullname,
+		CreateDate: usr.CreateDate,
+		Role:       data.RoleName(usr.Role),
+		Status:     usr.Status,
+		MFAEnabled: usr.MFAEnabled,
+	}
+}
+
+// userInfoResponse is the user with the standard claims of OpenID Connect Core 5.1.
+// The sub is the username, the same as in our tokens.
+type userInfoResponse struct {
+	Subject           string   `json:"sub"`
+	Name              string   `json:"name,omitempty"`
+	PreferredUsername string   `json:"preferred_username"`
+	Email             string   `json:"email"`
+	EmailVerified     bool     `json:"email_verified"`
+	Roles             []string `json:"roles"`
+}
+
+func writeUser(rw http.ResponseWriter, usr data.User) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(newUserResponse(usr))
+}
+
+// userFromIdentity loads the user the request was authenticated as. Clients have no user account,
+// and users who were disabled or deleted since the token was issued have none anymore.
+func userFromIdentity(logger *zap.Logger, users data.UserStore, rw http.ResponseWriter, r *http.Request) (data.User, bool) {
+	identity, ok := middleware.IdentityFromContext(r.Context())
+	if !ok {
+		problem.Write(rw, r, problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "Token Missing"))
+		return data.User{}, false
+	}
+	if identity.IsClient() {
+		problem.Write(rw, r, problem.New(problem.TypeForbidden, http.StatusForbidden, "Clients have no user account"))
+		return data.User{}, false
+	}
+	usr, err := users.GetByUsername(r.Context(), identity.Subject)
+	if err == data.ErrUserNotFound {
+		problem.Write(rw, r, problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "User Does not Exist"))
+		return data.User{}, false
+	}
+	if err != nil {
+		logger.Error("Unable to look up the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return data.User{}, false
+	}
+	// a deleted account could have been taken over by a new signup with the same username
+	if !usr.Active() || usr.Email != identity.Email {
+		logger.Warn("User of the token does not exist anymore or was disabled", zap.String("subject", identity.Subject))
+		problem.Write(rw, r, problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "User Does not Exist"))
+		return data.User{}, false
+	}
+	return usr, true
+}
+
+// ProfileController is the /auth/me route handler, the signed in user managing their own account
+type ProfileController struct {
+	logger        *zap.Logger
+	promPasswords *prometheus.CounterVec
+	tokens        *tokenconfig.Config
+	users         data.UserStore
+	hasher        *password.Hasher
+	refreshStore  tokenstore.RefreshStore
+	sessions      tokenstore.SessionStore
+	revocations   tokenstore.RevocationList
+	guard         *lockout.Guard
+	audit         *audit.Recorder
+}
+
+// NewProfileController returns a frsh Profile controller
+func NewProfileController(logger *zap.Logger, tokens *tokenconfig.Config, users data.UserStore, hasher *password.Hasher,
+	refreshStore tokenstore.RefreshStore, sessions tokenstore.SessionStore, revocations tokenstore.RevocationList,
+	guard *lockout.Guard, recorder *audit.Recorder) *ProfileController {
+	return &ProfileController{
+		logger:        logger,
+		promPasswords: passwordChanges,
+		tokens:        tokens,
+		users:         users,
+		hasher:        hasher,
+		refreshStore:  refreshStore,
+		sessions:      sessions,
+		revocations:   revocations,
+		guard:         guard,
+		audit:         recorder,
+	}
+}
+
+// MeHandler returns the profile of the caller
+func (ctrl *ProfileController) MeHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	writeUser(rw, usr)
+}
+
+// UserInfoHandler is the userinfo endpoint of OpenID Connect, the profile behind the bearer token.
+// A disabled account is refused like an invalid token, the token does not stand for anyone anymore.
+func (ctrl *ProfileController) UserInfoHandler(rw http.ResponseWriter, r *http.Request) {
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	if !usr.Active() {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		problem.Write(rw, r, problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "Account Disabled"))
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(userInfoResponse{
+		Subject:           usr.Username,
+		Name:              usr.Fullname,
+		PreferredUsername: usr.Username,
+		Email:             usr.Email,
+		// pending accounts have not confirmed the mail yet, the others did or were created by an admin
+		EmailVerified: usr.Status != data.StatusPending,
+		Roles:         usr.Roles(),
+	})
+}
+
+// UpdateMeHandler changes the profile of the caller
+func (ctrl *ProfileController) UpdateMeHandler(rw http.ResponseWriter, r *http.Request) {
+	var req UpdateProfileRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+	usr.Fullname = strings.TrimSpace(*req.Fullname)
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to update the profile", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.logger.Info("Profile updated", zap.String("subject", usr.Username))
+	writeUser(rw, usr)
+}
+
+// ChangePasswordHandler replaces the password of the caller. Wrong current passwords count
+// as failed signins, so a stolen access token cannot be used to guess the password.
+// Every other session of the caller is signed out.
+func (ctrl *ProfileController) ChangePasswordHandler(rw http.ResponseWriter, r *http.Request) {
+	var req ChangePasswordRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	usr, ok := userFromIdentity(ctrl.logger, ctrl.users, rw, r)
+	if !ok {
+		return
+	}
+
+	accountKey := strings.ToLower(usr.Email)
+	ip := clientIP(r)
+	wait, _, err := ctrl.guard.Check(r.Context(), accountKey, ip)
+	if err != nil {
+		ctrl.logger.Error("Unable to check the failed signins", zap.Error(err))
+	}
+	if wait > 0 {
+		ctrl.promPasswords.WithLabelValues("throttled").Inc()
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+		p := problem.New(problem.TypeTooMany, http.StatusTooManyRequests, "Too many failed signins")
+		p.Detail = "Try again later"
+		problem.Write(rw, r, p)
+		return
+	}
+	match, _, err := ctrl.hasher.Verify(req.CurrentPassword, usr.PasswordHash)
+	if err != nil {
+		ctrl.logger.Error("Unable to verify the password", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if !match {
+		if _, err := ctrl.guard.Fail(r.Context(), accountKey, ip); err != nil {
+			ctrl.logger.Error("Unable to count the failed signin", zap.Error(err))
+		}
+		ctrl.logger.Warn("Wrong current password", zap.String("subject", usr.Username))
+		ctrl.promPasswords.WithLabelValues("wrong_password").Inc()
+		event := audit.FromRequest(r, audit.ActionPasswordChange)
+		event.Target = usr.Username
+		event.Outcome = audit.OutcomeFailure
+		ctrl.audit.Record(r.Context(), event)
+		problem.Write(rw, r, problem.Validation([]problem.FieldError{{Field: "current_password", Message: "is wrong"}}))
+		return
+	}
+	if err := ctrl.guard.Succeed(r.Context(), accountKey); err != nil {
+		ctrl.logger.Error("Unable to reset the failed signins", zap.Error(err))
+	}
+
+	// the new hash also invalidates the reset mails sent before, see passwordFingerprint
+	usr.PasswordHash, err = ctrl.hasher.Hash(req.NewPassword)
+	if err != nil {
+		ctrl.logger.Error("Unable to hash the password", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	if err := ctrl.users.Update(r.Context(), usr); err != nil {
+		ctrl.logger.Error("Unable to save the password", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	// the other devices signed in with the old password, the caller stays signed in
+	identity, _ := middleware.IdentityFromContext(r.Context())
+	if err := revokeUserSessions(r.Context(), ctrl.tokens, ctrl.sessions, ctrl.refreshStore, ctrl.revocations, usr.Username, identity.SessionID); err != nil {
+		ctrl.logger.Error("Unable to revoke the other sessions", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	ctrl.promPasswords.WithLabelValues("changed").Inc()
+	ctrl.logger.Info("Password changed", zap.String("subject", usr.Username))
+	event := audit.FromRequest(r, audit.ActionPasswordChange)
+	event.Target = usr.Username
+	ctrl.audit.Record(r.Context(), event)
+	rw.WriteHeader(http.StatusNoContent)
+}
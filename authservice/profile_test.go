@@ -0,0 +1,74 @@
+package authservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+func asSubject(r *http.Request, username string, email string) *http.Request {
+	return r.WithContext(middleware.WithIdentity(r.Context(), middleware.Identity{Subject: username, Email: email}))
+}
+
+func TestProfile(t *testing.T) {
+	hasher, _ := password.NewHasher(password.Params{Algorithm: password.Bcrypt, Cost: 4})
+	passwordHash, _ := hasher.Hash("hashedme1")
+	users := data.NewMemoryUserStore(data.User{Email: "abc@gmail.com", Username: "abc12", PasswordHash: passwordHash, Fullname: "abc def"})
+	guard := lockout.NewGuard(lockout.NewMemoryTracker(lockout.DefaultAccountPolicy()), lockout.NewMemoryTracker(lockout.DefaultIPPolicy()))
+	refreshStore, sessions := tokenstore.NewMemoryRefreshStore(), tokenstore.NewMemorySessionStore()
+	pc := NewProfileController(zap.NewNop(), tokenconfig.Default(), users, hasher, refreshStore, sessions, tokenstore.NewMemoryRevocationList(), guard, nil)
+
+	rw := httptest.NewRecorder()
+	pc.UpdateMeHandler(rw, asSubject(jsonRequest("PATCH", "/auth/me", `{"fullname":"  New Name "}`), "abc12", "abc@gmail.com"))
+	var profile userResponse
+	json.NewDecoder(rw.Body).Decode(&profile)
+	if rw.Code != http.StatusOK || profile.Fullname != "New Name" || profile.Role != "user" {
+		t.Fatalf("Unexpected profile %d %+v", rw.Code, profile)
+	}
+	rw = httptest.NewRecorder()
+	pc.UpdateMeHandler(rw, asSubject(jsonRequest("PATCH", "/auth/me", `{"email":"other@gmail.com"}`), "abc12", "abc@gmail.com"))
+	if rw.Code != http.StatusBadRequest {
+		t.Fatalf("Only the full name can be changed, got %d", rw.Code)
+	}
+
+	// signed in on two devices, the change comes from the first one
+	ctx := context.Background()
+	for _, id := range []string{"laptop", "phone"} {
+		refreshStore.Save(ctx, tokenstore.RefreshToken{Hash: id, Family: id, Subject: "abc12", ExpiresAt: time.Now().Add(time.Hour)})
+		sessions.Save(ctx, tokenstore.Session{ID: id, Subject: "abc12", ExpiresAt: time.Now().Add(time.Hour)})
+	}
+	change := func(body string) int {
+		rw := httptest.NewRecorder()
+		r := jsonRequest("POST", "/auth/me/password", body)
+		r = r.WithContext(middleware.WithIdentity(r.Context(), middleware.Identity{Subject: "abc12", Email: "abc@gmail.com", SessionID: "laptop"}))
+		pc.ChangePasswordHandler(rw, r)
+		return rw.Code
+	}
+	if code := change(`{"current_password":"wrong-password","new_password":"new-password1"}`); code != http.StatusBadRequest {
+		t.Fatalf("Expected the wrong current password to be rejected, got %d", code)
+	}
+	if code := change(`{"current_password":"hashedme1","new_password":"new-password1"}`); code != http.StatusNoContent {
+		t.Fatalf("Password change failed with %d", code)
+	}
+	usr, _ := users.GetByUsername(context.Background(), "abc12")
+	if match, _, _ := hasher.Verify("new-password1", usr.PasswordHash); !match {
+		t.Fatalf("The new password was not saved")
+	}
+	if _, err := refreshStore.Use(ctx, "phone"); err != tokenstore.ErrRefreshTokenRevoked {
+		t.Fatalf("Expected the other session to be signed out, got %v", err)
+	}
+	if _, err := refreshStore.Use(ctx, "laptop"); err != nil {
+		t.Fatalf("Expected the session of the change to stay, got %v", err)
+	}
+}
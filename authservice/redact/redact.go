@@ -0,0 +1,83 @@
+// Package redact keeps secrets out of the logs. Whatever a handler passes to the logger,
+// fields named like a token, password or secret are masked before they are written.
+package redact
+
+import (
+	"strings"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Mask replaces the value of the sensitive fields
+const Mask = "[REDACTED]"
+
+// field names that always carry secrets, compared in lower case
+var sensitive = map[string]bool{
+	"token":         true,
+	"access_token":  true,
+	"refresh_token": true,
+	"mfa_token":     true,
+	"password":      true,
+	"pswd":          true,
+	"secret":        true,
+	"client_secret": true,
+	"authorization": true,
+	"apikey":        true,
+	"api_key":       true,
+	"code":          true,
+	"recovery_code": true,
+}
+
+// Sensitive tells if a field of this name is masked
+func Sensitive(name string) bool {
+	name = strings.ToLower(name)
+	return sensitive[name] || strings.HasSuffix(name, "_token") || strings.HasSuffix(name, "password") || strings.HasSuffix(name, "_secret")
+}
+
+func fields(fs []zapcore.Field) []zapcore.Field {
+	var masked []zapcore.Field
+	for i, f := range fs {
+		if !Sensitive(f.Key) {
+			continue
+		}
+		// the fields of the caller are not changed, we copy them on the first match
+		if masked == nil {
+			masked = append([]zapcore.Field{}, fs...)
+		}
+		masked[i] = zap.String(f.Key, Mask)
+	}
+	if masked == nil {
+		return fs
+	}
+	return masked
+}
+
+type core struct {
+	zapcore.Core
+}
+
+// Core wraps a core so it masks the sensitive fields
+func Core(c zapcore.Core) zapcore.Core {
+	return core{c}
+}
+
+// Option masks the sensitive fields of a logger, use it with logger.WithOptions
+func Option() zap.Option {
+	return zap.WrapCore(Core)
+}
+
+func (c core) With(fs []zapcore.Field) zapcore.Core {
+	return core{c.Core.With(fields(fs))}
+}
+
+func (c core) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+	return checked
+}
+
+func (c core) Write(entry zapcore.Entry, fs []zapcore.Field) error {
+	return c.Core.Write(entry, fields(fs))
+}
@@ -0,0 +1,25 @@
+package redact
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedact(t *testing.T) {
+	observed, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(observed).WithOptions(Option()).With(zap.String("client_secret", "s3cr3t"))
+
+	logger.Info("Token sign", zap.String("token", "eyJhbGciOi"), zap.String("refresh_token", "abc"), zap.String("email", "abc@gmail.com"))
+
+	fields := logs.All()[0].ContextMap()
+	for _, name := range []string{"token", "refresh_token", "client_secret"} {
+		if fields[name] != Mask {
+			t.Fatalf("Expected %s to be masked, got %v", name, fields[name])
+		}
+	}
+	if fields["email"] != "abc@gmail.com" {
+		t.Fatalf("Other fields must be kept, got %v", fields["email"])
+	}
+}
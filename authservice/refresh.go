@@ -0,0 +1,240 @@
+package authservice
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+var (
+	refreshRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "refresh_total",
+		Help: "Total number of refresh requests",
+	})
+	refreshReused = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "refresh_reused",
+		Help: "Refresh tokens presented a second time, their family is revoked",
+	})
+)
+
+// RefreshController is the Refresh and Logout route handler
+type RefreshController struct {
+	logger           *zap.Logger
+	keyring          *jwt.Keyring
+	tokens           *tokenconfig.Config
+	refreshStore     tokenstore.RefreshStore
+	sessions         tokenstore.SessionStore
+	revocations      tokenstore.RevocationList
+	users            data.UserStore
+	promRefreshTotal prometheus.Counter
+	promReused       prometheus.Counter
+	legacyHeaders    bool
+	cookies          *middleware.Cookies
+}
+
+// NewRefreshController returns a frsh Refresh controller
+func NewRefreshController(logger *zap.Logger, keyring *jwt.Keyring, tokens *tokenconfig.Config, refreshStore tokenstore.RefreshStore, sessions tokenstore.SessionStore,
+	revocations tokenstore.RevocationList, users data.UserStore) *RefreshController {
+	return &RefreshController{
+		logger:           logger,
+		users:            users,
+		keyring:          keyring,
+		tokens:           tokens,
+		refreshStore:     refreshStore,
+		sessions:         sessions,
+		revocations:      revocations,
+		promRefreshTotal: refreshRequests,
+		promReused:       refreshReused,
+		legacyHeaders:    legacyHeaders(),
+		cookies:          middleware.CookiesFromEnv(),
+	}
+}
+
+// refreshTokenFromRequest reads the Refreshtoken header, or the cookie in cookie mode
+func (ctrl *RefreshController) refreshTokenFromRequest(r *http.Request) (token string, fromCookie bool, ok bool) {
+	if values, ok := r.Header["Refreshtoken"]; ok {
+		return values[0], false, true
+	}
+	if token, ok := ctrl.cookies.Token(r, middleware.RefreshTokenCookie); ok {
+		return token, true, true
+	}
+	return "", false, false
+}
+
+// RefreshHandler exchanges a refresh token for a new access token and a new refresh token.
+// The refresh token is single use. If a used token shows up again it was probably stolen,
+// so the whole session is revoked and the user has to sign in again.
+// The Audience header asks for an access token of only one service, eg. the claims service.
+// A refresh token from the cookie gets the new tokens as cookies again.
+func (ctrl *RefreshController) RefreshHandler(rw http.ResponseWriter, r *http.Request) {
+	ctrl.promRefreshTotal.Inc()
+
+	presented, fromCookie, ok := ctrl.refreshTokenFromRequest(r)
+	if !ok {
+		ctrl.logger.Warn("Refreshtoken was not found in the request")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Refreshtoken Missing"))
+		return
+	}
+	delivery := cookieDelivery(ctrl.cookies, r)
+	if fromCookie {
+		// another site could make the browser send the cookie, but it cannot read the CSRF token
+		if !ctrl.cookies.CheckCSRF(r) {
+			ctrl.logger.Warn("CSRF check failed", zap.String("remote", r.RemoteAddr))
+			rw.WriteHeader(http.StatusForbidden)
+			rw.Write([]byte("CSRF Check Failed"))
+			return
+		}
+		delivery = ctrl.cookies
+	}
+	// checked before the refresh token is used up
+	var audiences []string
+	if audience := r.Header.Get("Audience"); audience != "" {
+		if !ctrl.tokens.Known(audience) {
+			ctrl.logger.Warn("Unknown audience", zap.String("audience", audience))
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("Unknown Audience"))
+			return
+		}
+		audiences = []string{audience}
+	}
+
+	used, err := ctrl.refreshStore.Use(r.Context(), tokenstore.HashRefreshToken(presented))
+	if err == tokenstore.ErrRefreshTokenReused {
+		ctrl.logger.Warn("Refresh token reused, revoking the session", zap.String("subject", used.Subject))
+		ctrl.promReused.Inc()
+		if err := revokeSession(r.Context(), ctrl.tokens, ctrl.sessions, ctrl.refreshStore, ctrl.revocations, used.Family); err != nil {
+			ctrl.logger.Error("Unable to revoke the session", zap.Error(err))
+		}
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Invalid Refresh Token"))
+		return
+	}
+	if err == tokenstore.ErrRefreshTokenNotFound || err == tokenstore.ErrRefreshTokenRevoked {
+		ctrl.logger.Warn("Refresh token rejected", zap.Error(err))
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Invalid Refresh Token"))
+		return
+	}
+	if err != nil {
+		ctrl.logger.Error("Unable to use the refresh token", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	// the roles could have changed since the signin, so we look the user up again
+	usr, err := ctrl.users.GetByUsername(r.Context(), used.Subject)
+	if err != nil && err != data.ErrUserNotFound {
+		ctrl.logger.Error("Unable to look up the user", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	// a deleted account could have been taken over by a new signup with the same username
+	if err == data.ErrUserNotFound || !usr.Active() || usr.Email != used.Email {
+		ctrl.logger.Warn("User of the refresh token does not exist anymore or was disabled", zap.String("subject", used.Subject))
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Invalid Refresh Token"))
+		return
+	}
+
+	// the refresh is the last time the session was seen. Sessions from before we kept them are started here.
+	session, err := ctrl.sessions.Get(r.Context(), used.Family)
+	if err == tokenstore.ErrSessionNotFound {
+		session, err = newSession(r, ctrl.tokens, usr, used.Family), nil
+	}
+	if err != nil {
+		ctrl.logger.Error("Unable to read the session", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	session.LastSeenAt = time.Now()
+	session.ExpiresAt = session.LastSeenAt.Add(ctrl.tokens.RefreshTokenLifetime)
+	session.IP = clientIP(r)
+	if err := ctrl.sessions.Save(r.Context(), session); err != nil {
+		ctrl.logger.Error("Unable to store the session", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	access, err := getSignedToken(ctrl.keyring, ctrl.tokens, usr, used.AMR, used.Family, audiences)
+	if err != nil {
+		ctrl.logger.Error("unable to sign the token", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	refreshToken, err := issueRefreshToken(r.Context(), ctrl.refreshStore, ctrl.tokens, used.Family, usr, used.AMR)
+	if err != nil {
+		ctrl.logger.Error("unable to store the refresh token", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	ctrl.logger.Info("Token refreshed", zap.String("subject", usr.Username))
+	writeTokens(rw, ctrl.legacyHeaders, delivery, ctrl.tokens, access, refreshToken)
+}
+
+// LogoutHandler revokes the session of the refresh token and the access token used for the request.
+// It runs behind the TokenMiddleware, so the caller is known.
+func (ctrl *RefreshController) LogoutHandler(rw http.ResponseWriter, r *http.Request) {
+	identity, ok := middleware.IdentityFromContext(r.Context())
+	if !ok {
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Token Missing"))
+		return
+	}
+	// the TokenMiddleware already checked the CSRF token if the access token came from the cookie
+	presented, _, ok := ctrl.refreshTokenFromRequest(r)
+	if !ok {
+		ctrl.logger.Warn("Refreshtoken was not found in the request")
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Refreshtoken Missing"))
+		return
+	}
+
+	refresh, err := ctrl.refreshStore.Get(r.Context(), tokenstore.HashRefreshToken(presented))
+	if err != nil && err != tokenstore.ErrRefreshTokenNotFound && err != tokenstore.ErrRefreshTokenRevoked {
+		ctrl.logger.Error("Unable to read the refresh token", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	// nobody can log out someone else, and clients have no refresh tokens
+	if err == nil && !identity.IsClient() && refresh.Subject == identity.Subject {
+		err = revokeSession(r.Context(), ctrl.tokens, ctrl.sessions, ctrl.refreshStore, ctrl.revocations, refresh.Family)
+		if err != nil {
+			ctrl.logger.Error("Unable to revoke the session", zap.Error(err))
+			rw.WriteHeader(http.StatusInternalServerError)
+			rw.Write([]byte("Internal Server Error"))
+			return
+		}
+	}
+
+	// the access token stays valid for the other services until it expires,
+	// but the TokenMiddleware checks the revocation list
+	err = ctrl.revocations.Revoke(r.Context(), identity.TokenID, time.Now().Add(ctrl.tokens.MaxAccessTokenLifetime()+jwt.GetLeeway()))
+	if err != nil {
+		ctrl.logger.Error("Unable to revoke the access token", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+
+	ctrl.logger.Info("User logged out", zap.String("subject", identity.Subject))
+	ctrl.cookies.Clear(rw)
+	rw.WriteHeader(http.StatusOK)
+	rw.Write([]byte("Logged Out"))
+}
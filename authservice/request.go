@@ -0,0 +1,353 @@
+package authservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+)
+
+// limits of the fields, they match the columns of the users table
+const (
+	maxEmailLength    = 254
+	minUsernameLength = 3
+	maxUsernameLength = 32
+	maxFullnameLength = 100
+	// bcrypt only looks at the first 72 bytes, a longer password would give a false sense of security
+	maxPasswordLength = 72
+	// the body never needs to be bigger than this
+	maxBodySize = 1 << 16
+)
+
+// limits of the api keys, the scopes are stored space separated in a varchar(255)
+const (
+	maxAPIKeyNameLength   = 64
+	maxAPIKeyScopesLength = 255
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// legacyHeaders tells if the credentials are read from the headers like before.
+// Set AUTH_LEGACY_HEADERS=true for clients that were not moved to JSON bodies yet.
+func legacyHeaders() bool {
+	return os.Getenv("AUTH_LEGACY_HEADERS") == "true"
+}
+
+// SignupRequest is the body of a signup
+type SignupRequest struct {
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Fullname string `json:"fullname"`
+}
+
+// SigninRequest is the body of a signin
+type SigninRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// VerifyRequest is the body of an email verification
+type VerifyRequest struct {
+	Token string `json:"token"`
+}
+
+// ForgotPasswordRequest asks for a reset mail
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+// ResetPasswordRequest sets a new password with the token from the reset mail
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// MFACodeRequest confirms or disables MFA with a TOTP code, or a recovery code when disabling
+type MFACodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// MFASigninRequest is the second step of a signin, with a TOTP code or a recovery code
+type MFASigninRequest struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code,omitempty"`
+	RecoveryCode string `json:"recovery_code,omitempty"`
+}
+
+// CreateAPIKeyRequest creates an api key. Without scopes the key has all permissions of the user,
+// without expires_at it lives until it is revoked.
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// UpdateProfileRequest changes the profile of the caller. Email and username identify
+// the account in tokens and mails, so only the full name can be changed.
+type UpdateProfileRequest struct {
+	Fullname *string `json:"fullname"`
+}
+
+// ChangePasswordRequest replaces the password of the caller, who has to know the current one
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+// UpdateRoleRequest sets the role of a user, by its name in the token
+type UpdateRoleRequest struct {
+	Role string `json:"role"`
+}
+
+// mfaChallengeResponse replaces the tokens when the user has to send a second factor
+type mfaChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// mfaEnrollResponse carries the new secret, the URI is what the QR code encodes
+type mfaEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+}
+
+// mfaRecoveryResponse returns the recovery codes, they are shown only once
+type mfaRecoveryResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// TokenResponse is returned by signin and refresh, the fields follow RFC 6749 section 5.1.
+// In cookie mode the tokens are left out, they are in the cookies.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// clientIP is the address the request came from. Behind a proxy the proxy
+// has to rewrite RemoteAddr, otherwise all clients share the proxy's address.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// decodeJSON reads the JSON body into v. Unknown fields are rejected, so typos do not go unnoticed.
+func decodeJSON(r *http.Request, v interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return errors.New("Content-Type must be application/json")
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("body is not valid JSON: %v", err)
+	}
+	return nil
+}
+
+// the first value of the header, or empty
+func headerValue(r *http.Request, name string) string {
+	if values, ok := r.Header[name]; ok && len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// in header mode the password still comes from the body, older clients send it in Passwordhash
+func legacyPassword(r *http.Request) string {
+	if pswd := r.PostFormValue("password"); pswd != "" {
+		return pswd
+	}
+	return headerValue(r, "Passwordhash")
+}
+
+// decodeSignup reads the signup from the JSON body, or from the headers in legacy mode
+func decodeSignup(r *http.Request, legacy bool) (SignupRequest, error) {
+	if legacy {
+		return SignupRequest{
+			Email:    headerValue(r, "Email"),
+			Username: headerValue(r, "Username"),
+			Password: legacyPassword(r),
+			Fullname: headerValue(r, "Fullname"),
+		}, nil
+	}
+	var req SignupRequest
+	err := decodeJSON(r, &req)
+	return req, err
+}
+
+// decodeSignin reads the signin from the JSON body, or from the headers in legacy mode
+func decodeSignin(r *http.Request, legacy bool) (SigninRequest, error) {
+	if legacy {
+		return SigninRequest{
+			Email:    headerValue(r, "Email"),
+			Password: legacyPassword(r),
+		}, nil
+	}
+	var req SigninRequest
+	err := decodeJSON(r, &req)
+	return req, err
+}
+
+// Validate returns every invalid field of the signup
+func (req SignupRequest) Validate() []problem.FieldError {
+	var errs []problem.FieldError
+	errs = append(errs, validateEmail(req.Email)...)
+
+	switch {
+	case req.Username == "":
+		errs = append(errs, problem.FieldError{Field: "username", Message: "is required"})
+	case len(req.Username) < minUsernameLength || len(req.Username) > maxUsernameLength:
+		errs = append(errs, problem.FieldError{Field: "username", Message: fmt.Sprintf("must be between %d and %d characters", minUsernameLength, maxUsernameLength)})
+	case !usernamePattern.MatchString(req.Username):
+		errs = append(errs, problem.FieldError{Field: "username", Message: "may only contain letters, digits, '_', '.' and '-'"})
+	}
+
+	errs = append(errs, validateNewPassword(req.Password)...)
+
+	switch {
+	case strings.TrimSpace(req.Fullname) == "":
+		errs = append(errs, problem.FieldError{Field: "fullname", Message: "is required"})
+	case utf8.RuneCountInString(req.Fullname) > maxFullnameLength:
+		errs = append(errs, problem.FieldError{Field: "fullname", Message: fmt.Sprintf("must be at most %d characters", maxFullnameLength)})
+	}
+	return errs
+}
+
+// Validate returns every invalid field of the signin. The password is only checked for presence,
+// the rules for new passwords must not lock out users with older passwords.
+func (req SigninRequest) Validate() []problem.FieldError {
+	errs := validateEmail(req.Email)
+	if req.Password == "" {
+		errs = append(errs, problem.FieldError{Field: "password", Message: "is required"})
+	}
+	return errs
+}
+
+// Validate returns every invalid field of the reset
+func (req ResetPasswordRequest) Validate() []problem.FieldError {
+	var errs []problem.FieldError
+	if req.Token == "" {
+		errs = append(errs, problem.FieldError{Field: "token", Message: "is required"})
+	}
+	return append(errs, validateNewPassword(req.Password)...)
+}
+
+// Validate returns every invalid field of the second step
+func (req MFASigninRequest) Validate() []problem.FieldError {
+	var errs []problem.FieldError
+	if req.MFAToken == "" {
+		errs = append(errs, problem.FieldError{Field: "mfa_token", Message: "is required"})
+	}
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		errs = append(errs, problem.FieldError{Field: "code", Message: "either code or recovery_code is required"})
+	}
+	return errs
+}
+
+// Validate returns every invalid field of the new api key. Whether the user holds the scopes is checked by the handler.
+func (req CreateAPIKeyRequest) Validate() []problem.FieldError {
+	var errs []problem.FieldError
+	switch {
+	case strings.TrimSpace(req.Name) == "":
+		errs = append(errs, problem.FieldError{Field: "name", Message: "is required"})
+	case utf8.RuneCountInString(req.Name) > maxAPIKeyNameLength:
+		errs = append(errs, problem.FieldError{Field: "name", Message: fmt.Sprintf("must be at most %d characters", maxAPIKeyNameLength)})
+	}
+	for _, scope := range req.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\n") {
+			errs = append(errs, problem.FieldError{Field: "scopes", Message: "must not be empty or contain spaces"})
+			break
+		}
+	}
+	if len(strings.Join(req.Scopes, " ")) > maxAPIKeyScopesLength {
+		errs = append(errs, problem.FieldError{Field: "scopes", Message: fmt.Sprintf("must be at most %d characters together", maxAPIKeyScopesLength)})
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		errs = append(errs, problem.FieldError{Field: "expires_at", Message: "must be in the future"})
+	}
+	return errs
+}
+
+// Validate returns every invalid field of the profile update
+func (req UpdateProfileRequest) Validate() []problem.FieldError {
+	switch {
+	case req.Fullname == nil || strings.TrimSpace(*req.Fullname) == "":
+		return []problem.FieldError{{Field: "fullname", Message: "is required"}}
+	case utf8.RuneCountInString(*req.Fullname) > maxFullnameLength:
+		return []problem.FieldError{{Field: "fullname", Message: fmt.Sprintf("must be at most %d characters", maxFullnameLength)}}
+	}
+	return nil
+}
+
+// Validate returns every invalid field of the password change
+func (req ChangePasswordRequest) Validate() []problem.FieldError {
+	var errs []problem.FieldError
+	if req.CurrentPassword == "" {
+		errs = append(errs, problem.FieldError{Field: "current_password", Message: "is required"})
+	}
+	for _, err := range validateNewPassword(req.NewPassword) {
+		err.Field = "new_password"
+		errs = append(errs, err)
+	}
+	if req.NewPassword != "" && req.NewPassword == req.CurrentPassword {
+		errs = append(errs, problem.FieldError{Field: "new_password", Message: "must differ from the current password"})
+	}
+	return errs
+}
+
+// Validate checks the role is one we know
+func (req UpdateRoleRequest) Validate() []problem.FieldError {
+	if _, ok := data.RoleFromName(req.Role); !ok {
+		return []problem.FieldError{{Field: "role", Message: "must be admin or user"}}
+	}
+	return nil
+}
+
+// validateNewPassword checks the rules for passwords that are about to be set
+func validateNewPassword(pswd string) []problem.FieldError {
+	switch {
+	case pswd == "":
+		return []problem.FieldError{{Field: "password", Message: "is required"}}
+	case utf8.RuneCountInString(pswd) < password.MinLength:
+		return []problem.FieldError{{Field: "password", Message: fmt.Sprintf("must be at least %d characters", password.MinLength)}}
+	case len(pswd) > maxPasswordLength:
+		return []problem.FieldError{{Field: "password", Message: fmt.Sprintf("must be at most %d bytes", maxPasswordLength)}}
+	}
+	return nil
+}
+
+func validateEmail(email string) []problem.FieldError {
+	if email == "" {
+		return []problem.FieldError{{Field: "email", Message: "is required"}}
+	}
+	if len(email) > maxEmailLength {
+		return []problem.FieldError{{Field: "email", Message: fmt.Sprintf("must be at most %d characters", maxEmailLength)}}
+	}
+	// ParseAddress also accepts "Name <addr>", we only want the bare address
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return []problem.FieldError{{Field: "email", Message: "is not a valid email address"}}
+	}
+	return nil
+}
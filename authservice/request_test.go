@@ -0,0 +1,56 @@
+package authservice
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSignupValidation(t *testing.T) {
+	valid := SignupRequest{Email: "abc@gmail.com", Username: "abc12", Password: "hashedme1", Fullname: "abc def"}
+	if errs := valid.Validate(); len(errs) != 0 {
+		t.Fatalf("Expected a valid request, got %v", errs)
+	}
+
+	// every invalid field is reported at once
+	invalid := SignupRequest{Email: "abc <abc@gmail.com>", Username: "ab cd", Password: "short"}
+	errs := invalid.Validate()
+	fields := map[string]bool{}
+	for _, err := range errs {
+		fields[err.Field] = true
+	}
+	for _, field := range []string{"email", "username", "password", "fullname"} {
+		if !fields[field] {
+			t.Fatalf("Expected an error for %s, got %v", field, errs)
+		}
+	}
+
+	long := valid
+	long.Password = strings.Repeat("a", maxPasswordLength+1)
+	if errs := long.Validate(); len(errs) != 1 || errs[0].Field != "password" {
+		t.Fatalf("Expected the password to be too long, got %v", errs)
+	}
+}
+
+func TestDecodeSignin(t *testing.T) {
+	r := httptest.NewRequest("POST", "/auth/signin", strings.NewReader(`{"email":"abc@gmail.com","password":"hashedme1"}`))
+	r.Header.Set("Content-Type", "application/json")
+	req, err := decodeSignin(r, false)
+	if err != nil || req.Email != "abc@gmail.com" || req.Password != "hashedme1" {
+		t.Fatalf("Unexpected signin %+v %v", req, err)
+	}
+
+	r = httptest.NewRequest("POST", "/auth/signin", strings.NewReader(`{"email":"abc@gmail.com","passwrd":"hashedme1"}`))
+	r.Header.Set("Content-Type", "application/json")
+	if _, err := decodeSignin(r, false); err == nil {
+		t.Fatalf("Unknown fields must be rejected")
+	}
+
+	r = httptest.NewRequest("POST", "/auth/signin", nil)
+	r.Header["Email"] = []string{"abc@gmail.com"}
+	r.Header["Passwordhash"] = []string{"hashedme1"}
+	req, err = decodeSignin(r, true)
+	if err != nil || req.Email != "abc@gmail.com" || req.Password != "hashedme1" {
+		t.Fatalf("Unexpected legacy signin %+v %v", req, err)
+	}
+}
@@ -0,0 +1,257 @@
+package authservice
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+var sessionsRevoked = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "sessions_revoked",
+	Help: "Sessions signed out by their user from the session list",
+})
+
+// the user agent is sent by the client, we keep a sane amount of it
+const maxUserAgentLength = 256
+
+// the names are checked in order, the first one found in the user agent names the device.
+// Edge and Chrome mention Safari, and Edge mentions Chrome, so the order matters.
+var (
+	browserNames = []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"},
+		{"Safari/", "Safari"}, {"curl/", "curl"}, {"PostmanRuntime/", "Postman"},
+	}
+	systemNames = []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	}
+)
+
+// deviceName makes a short name like "Firefox on Linux" out of the user agent, so users recognise their sessions
+func deviceName(userAgent string) string {
+	browser, system := "", ""
+	for _, known := range browserNames {
+		if strings.Contains(userAgent, known.token) {
+			browser = known.name
+			break
+		}
+	}
+	for _, known := range systemNames {
+		if strings.Contains(userAgent, known.token) {
+			system = known.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+// newSession describes the signin of the request. The id is the family of its refresh tokens.
+func newSession(r *http.Request, tokens *tokenconfig.Config, usr data.User, family string) tokenstore.Session {
+	userAgent := r.UserAgent()
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	now := time.Now()
+	return tokenstore.Session{
+		ID:         family,
+		Subject:    usr.Username,
+		Device:     deviceName(userAgent),
+		IP:         clientIP(r),
+		UserAgent:  userAgent,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(tokens.RefreshTokenLifetime),
+	}
+}
+
+// revokeSession signs the session out: its refresh tokens stop working at once, and the
+// TokenMiddleware rejects its access tokens until they would have expired anyway
+func revokeSession(ctx context.Context, tokens *tokenconfig.Config, sessions tokenstore.SessionStore, refreshStore tokenstore.RefreshStore,
+	revocations tokenstore.RevocationList, id string) error {
+	if err := refreshStore.RevokeFamily(ctx, id, time.Now().Add(tokens.RefreshTokenLifetime)); err != nil {
+		return err
+	}
+	if err := revocations.Revoke(ctx, tokenstore.SessionRevocation(id), time.Now().Add(tokens.MaxAccessTokenLifetime()+jwt.GetLeeway())); err != nil {
+		return err
+	}
+	return sessions.Delete(ctx, id)
+}
+
+// revokeUserSessions signs out every session of the user except the one with the id keep, an empty keep
+// signs out all of them. After the password changed, nobody holding an old refresh token may stay signed in.
+func revokeUserSessions(ctx context.Context, tokens *tokenconfig.Config, sessions tokenstore.SessionStore, refreshStore tokenstore.RefreshStore,
+	revocations tokenstore.RevocationList, subject string, keep string) error {
+	list, err := sessions.ListBySubject(ctx, subject)
+	if err != nil {
+		return err
+	}
+	for _, session := range list {
+		if session.ID == keep {
+			continue
+		}
+		if err := revokeSession(ctx, tokens, sessions, refreshStore, revocations, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sessionResponse is a session as the user sees it. Current marks the session of the request.
+type sessionResponse struct {
+	ID         string    `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// SessionController lets users see where they are signed in and sign out other devices.
+// The routes run behind TokenMiddleware.RequireUserToken.
+type SessionController struct {
+	logger       *zap.Logger
+	promRevoked  prometheus.Counter
+	tokens       *tokenconfig.Config
+	sessions     tokenstore.SessionStore
+	refreshStore tokenstore.RefreshStore
+	revocations  tokenstore.RevocationList
+	audit        *audit.Recorder
+}
+
+// NewSessionController returns a frsh Session controller
+func NewSessionController(logger *zap.Logger, tokens *tokenconfig.Config, sessions tokenstore.SessionStore, refreshStore tokenstore.RefreshStore,
+	revocations tokenstore.RevocationList, recorder *audit.Recorder) *SessionController {
+	return &SessionController{
+		logger:       logger,
+		promRevoked:  sessionsRevoked,
+		tokens:       tokens,
+		sessions:     sessions,
+		refreshStore: refreshStore,
+		revocations:  revocations,
+		audit:        recorder,
+	}
+}
+
+// identity returns the caller, the routes only run for users
+func (ctrl *SessionController) identity(rw http.ResponseWriter, r *http.Request) (middleware.Identity, bool) {
+	identity, ok := middleware.IdentityFromContext(r.Context())
+	if !ok {
+		problem.Write(rw, r, problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, "Token Missing"))
+	}
+	return identity, ok
+}
+
+// ListHandler lists the sessions of the caller, the last seen first
+func (ctrl *SessionController) ListHandler(rw http.ResponseWriter, r *http.Request) {
+	identity, ok := ctrl.identity(rw, r)
+	if !ok {
+		return
+	}
+	sessions, err := ctrl.sessions.ListBySubject(r.Context(), identity.Subject)
+	if err != nil {
+		ctrl.logger.Error("Unable to list the sessions", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	resp := make([]sessionResponse, 0, len(sessions))
+	for _, session := range sessions {
+		resp = append(resp, sessionResponse{
+			ID:         session.ID,
+			Device:     session.Device,
+			IP:         session.IP,
+			UserAgent:  session.UserAgent,
+			CreatedAt:  session.CreatedAt,
+			LastSeenAt: session.LastSeenAt,
+			ExpiresAt:  session.ExpiresAt,
+			Current:    session.ID == identity.SessionID,
+		})
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(resp)
+}
+
+// revoke signs out one session of the caller and audits it
+func (ctrl *SessionController) revoke(r *http.Request, session tokenstore.Session) error {
+	if err := revokeSession(r.Context(), ctrl.tokens, ctrl.sessions, ctrl.refreshStore, ctrl.revocations, session.ID); err != nil {
+		return err
+	}
+	ctrl.promRevoked.Inc()
+	ctrl.logger.Info("Session revoked", zap.String("subject", session.Subject), zap.String("device", session.Device))
+	event := audit.FromRequest(r, audit.ActionSessionRevoke)
+	event.Target = session.ID
+	event.Details = map[string]string{"device": session.Device}
+	ctrl.audit.Record(r.Context(), event)
+	return nil
+}
+
+// RevokeHandler signs out one session of the caller, the current one as well
+func (ctrl *SessionController) RevokeHandler(rw http.ResponseWriter, r *http.Request) {
+	identity, ok := ctrl.identity(rw, r)
+	if !ok {
+		return
+	}
+	session, err := ctrl.sessions.Get(r.Context(), mux.Vars(r)["id"])
+	// the sessions of other users do not exist for the caller
+	if err == tokenstore.ErrSessionNotFound || (err == nil && session.Subject != identity.Subject) {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "Session not found"))
+		return
+	}
+	if err == nil {
+		err = ctrl.revoke(r, session)
+	}
+	if err != nil {
+		ctrl.logger.Error("Unable to revoke the session", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// RevokeOthersHandler signs out every session of the caller except the current one
+func (ctrl *SessionController) RevokeOthersHandler(rw http.ResponseWriter, r *http.Request) {
+	identity, ok := ctrl.identity(rw, r)
+	if !ok {
+		return
+	}
+	sessions, err := ctrl.sessions.ListBySubject(r.Context(), identity.Subject)
+	if err != nil {
+		ctrl.logger.Error("Unable to list the sessions", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		return
+	}
+	for _, session := range sessions {
+		if session.ID == identity.SessionID {
+			continue
+		}
+		if err := ctrl.revoke(r, session); err != nil {
+			ctrl.logger.Error("Unable to revoke the session", zap.Error(err))
+			problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+			return
+		}
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,95 @@
+package authservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+func TestSessions(t *testing.T) {
+	logger := zap.NewNop()
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	hasher, _ := password.NewHasher(password.Params{Algorithm: password.Bcrypt, Cost: 4})
+	passwordHash, _ := hasher.Hash("hashedme1")
+	users := data.NewMemoryUserStore(data.User{Email: "abc@gmail.com", Username: "abc12", PasswordHash: passwordHash, Status: data.StatusActive})
+	refreshStore := tokenstore.NewMemoryRefreshStore()
+	sessions := tokenstore.NewMemorySessionStore()
+	revocations := tokenstore.NewMemoryRevocationList()
+	guard := lockout.NewGuard(lockout.NewMemoryTracker(lockout.DefaultAccountPolicy()), lockout.NewMemoryTracker(lockout.DefaultIPPolicy()))
+	sic := NewSigninController(logger, keyring, tokenconfig.Default(), refreshStore, sessions, users, hasher, guard, nil)
+	rc := NewRefreshController(logger, keyring, tokenconfig.Default(), refreshStore, sessions, revocations, users)
+	sc := NewSessionController(logger, tokenconfig.Default(), sessions, refreshStore, revocations, nil)
+	tm := middleware.NewTokenMiddleware(logger, keyring, revocations)
+
+	signin := func(userAgent string) TokenResponse {
+		req := jsonRequest("POST", "/auth/signin", `{"email":"abc@gmail.com","password":"hashedme1"}`)
+		req.Header.Set("User-Agent", userAgent)
+		rw := httptest.NewRecorder()
+		sic.SigninHandler(rw, req)
+		var tokens TokenResponse
+		json.NewDecoder(rw.Body).Decode(&tokens)
+		return tokens
+	}
+	// call runs the handler behind the TokenMiddleware like the router does
+	call := func(handler http.HandlerFunc, req *http.Request, accessToken string) *httptest.ResponseRecorder {
+		req.Header.Set("Token", accessToken)
+		rw := httptest.NewRecorder()
+		tm.RequireUserToken(handler).ServeHTTP(rw, req)
+		return rw
+	}
+	laptop := signin("Mozilla/5.0 (X11; Linux x86_64; rv:93.0) Gecko/20100101 Firefox/93.0")
+	phone := signin("Mozilla/5.0 (iPhone; CPU iPhone OS 15_0 like Mac OS X) AppleWebKit/605.1.15 Version/15.0 Mobile/15E148 Safari/604.1")
+
+	rw := call(sc.ListHandler, httptest.NewRequest("GET", "/auth/sessions", nil), laptop.AccessToken)
+	var list []sessionResponse
+	json.NewDecoder(rw.Body).Decode(&list)
+	if len(list) != 2 {
+		t.Fatalf("Expected two sessions, got %+v", list)
+	}
+	devices := map[string]bool{}
+	for _, session := range list {
+		devices[session.Device] = session.Current
+	}
+	if current, ok := devices["Firefox on Linux"]; !ok || !current || devices["Safari on iPhone"] {
+		t.Fatalf("Unexpected devices %v", devices)
+	}
+
+	// nobody else can sign out the session, it does not exist for them
+	other := mux.SetURLVars(httptest.NewRequest("DELETE", "/auth/sessions/x", nil), map[string]string{"id": list[0].ID})
+	otherToken, _ := getSignedToken(keyring, tokenconfig.Default(), data.User{Username: "checkme34"}, []string{jwt.AMRPassword}, "", nil)
+	if rw := call(sc.RevokeHandler, other, otherToken.token); rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected the session of someone else to be hidden, got %d", rw.Code)
+	}
+
+	// the laptop signs out the phone
+	if rw := call(sc.RevokeOthersHandler, httptest.NewRequest("DELETE", "/auth/sessions", nil), laptop.AccessToken); rw.Code != http.StatusNoContent {
+		t.Fatalf("Unable to revoke the other sessions, got %d", rw.Code)
+	}
+	if rw := call(sc.ListHandler, httptest.NewRequest("GET", "/auth/sessions", nil), phone.AccessToken); rw.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected the access token of the phone to be revoked, got %d", rw.Code)
+	}
+	refresh := func(refreshToken string) int {
+		req := httptest.NewRequest("POST", "/auth/refresh", nil)
+		req.Header.Set("Refreshtoken", refreshToken)
+		rw := httptest.NewRecorder()
+		rc.RefreshHandler(rw, req)
+		return rw.Code
+	}
+	if code := refresh(phone.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the refresh token of the phone to be revoked, got %d", code)
+	}
+	if code := refresh(laptop.RefreshToken); code != http.StatusOK {
+		t.Fatalf("Expected the laptop to stay signed in, got %d", code)
+	}
+}
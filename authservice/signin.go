@@ -15,15 +15,25 @@
 package authservice
 
 import (
-	"errors"
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
 	"github.com/shadowshot-x/micro-product-go/authservice/data"
 	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
 	"go.uber.org/zap"
 )
 
@@ -44,8 +54,25 @@ var (
 		Name: "signin_error",
 		Help: "Erroneous signup requests",
 	})
+	signinThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "signin_throttled",
+		Help: "Signin requests rejected because the account or the IP has to wait after failed attempts",
+	}, []string{"scope"})
+	signinLockouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "signin_lockouts",
+		Help: "Accounts and IPs locked after too many failed signins",
+	}, []string{"scope"})
 )
 
+// the only answer to a wrong email or password, so the response does not tell which emails exist
+const invalidCredentials = "Invalid credentials"
+
+// accessToken is a signed access token and how long it lives
+type accessToken struct {
+	token     string
+	expiresIn time.Duration
+}
+
 // SigninController is the Signin route handler
 type SigninController struct {
 	logger            *zap.Logger
@@ -53,116 +80,335 @@ type SigninController struct {
 	promSigninSuccess prometheus.Counter
 	promSigninFail    prometheus.Counter
 	promSigninError   prometheus.Counter
+	promThrottled     *prometheus.CounterVec
+	promLockouts      *prometheus.CounterVec
+	keyring           *jwt.Keyring
+	tokens            *tokenconfig.Config
+	refreshStore      tokenstore.RefreshStore
+	sessions          tokenstore.SessionStore
+	users             data.UserStore
+	hasher            *password.Hasher
+	guard             *lockout.Guard
+	audit             *audit.Recorder
+	legacyHeaders     bool
+	cookies           *middleware.Cookies
 }
 
 // NewSigninController returns a frsh Signin controller
-func NewSigninController(logger *zap.Logger) *SigninController {
+func NewSigninController(logger *zap.Logger, keyring *jwt.Keyring, tokens *tokenconfig.Config, refreshStore tokenstore.RefreshStore, sessions tokenstore.SessionStore,
+	users data.UserStore, hasher *password.Hasher, guard *lockout.Guard, recorder *audit.Recorder) *SigninController {
 	return &SigninController{
 		logger:            logger,
+		users:             users,
+		hasher:            hasher,
+		guard:             guard,
+		audit:             recorder,
+		legacyHeaders:     legacyHeaders(),
+		cookies:           middleware.CookiesFromEnv(),
+		keyring:           keyring,
+		tokens:            tokens,
+		refreshStore:      refreshStore,
+		sessions:          sessions,
 		promSigninTotal:   signinRequests,
 		promSigninSuccess: signinSuccess,
 		promSigninFail:    signinFail,
 		promSigninError:   signinError,
+		promThrottled:     signinThrottled,
+		promLockouts:      signinLockouts,
 	}
 }
 
-// we need this function to be private
-func getSignedToken() (string, error) {
+// we need this function to be private. Without audiences the token gets the default ones of the config.
+func getSignedToken(keyring *jwt.Keyring, tokens *tokenconfig.Config, usr data.User, amr []string, sessionID string, audiences []string) (accessToken, error) {
 	// we make a JWT Token here with signing method of ES256 and claims.
 	// claims are attributes.
 	// Aud - audience
 	// Iss - issuer
-	// Exp - expiration of the Token
-	// token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-	// 	"Aud": "frontend.knowsearch.ml",
-	// 	"Iss": "knowsearch.ml",
-	// 	"Exp": string(time.Now().Add(time.Minute * 1).Unix()),
-	// })
-	claimsMap := jwt.ClaimsMap{
-		Aud: "frontend.knowsearch.ml",
-		Iss: "knowsearch.ml",
-		Exp: fmt.Sprint(time.Now().Add(time.Minute * 1).Unix()),
+	// Sub - the user the token was issued to
+	// Roles - what the user is allowed to do, checked by the AuthorizationMiddleware
+	// Amr - how the user signed in, some permissions need a second factor
+	// Sid - the session, signing it out revokes all its tokens
+	// Exp - expiration of the Token, the config decides per audience
+	// Iat - when the token was issued
+	// Jti - unique id of the token
+	if len(audiences) == 0 {
+		audiences = tokens.DefaultAudiences
+	}
+	lifetime := tokens.AccessTokenLifetimeFor(audiences)
+	now := time.Now()
+	claims := jwt.Claims{
+		Audience:  jwt.Audience(append([]string{}, audiences...)),
+		Issuer:    tokens.Issuer,
+		Subject:   usr.Username,
+		Email:     usr.Email,
+		Roles:     usr.Roles(),
+		AMR:       amr,
+		SessionID: sessionID,
+		ExpiresAt: now.Add(lifetime).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        jwt.NewTokenID(),
 	}
 
-	secret := jwt.GetSecret()
-	if secret == "" {
-		return "", errors.New("empty JWT secret")
+	// the keyring decides which key and algorithm is used. The kid header tells the verifier.
+	tokenString, err := jwt.GenerateToken(keyring.SigningKey(), claims)
+	if err != nil {
+		return accessToken{}, err
 	}
+	return accessToken{token: tokenString, expiresIn: lifetime}, nil
+}
 
-	header := "HS256"
-	tokenString, err := jwt.GenerateToken(header, claimsMap, secret)
+// issueRefreshToken stores a new refresh token of the family and returns it.
+// A signin starts a new family, every refresh continues the family of the used token.
+func issueRefreshToken(ctx context.Context, store tokenstore.RefreshStore, tokens *tokenconfig.Config, family string, usr data.User, amr []string) (string, error) {
+	refreshToken, hash := tokenstore.NewRefreshToken()
+	err := store.Save(ctx, tokenstore.RefreshToken{
+		Hash:      hash,
+		Family:    family,
+		Subject:   usr.Username,
+		Email:     usr.Email,
+		ExpiresAt: time.Now().Add(tokens.RefreshTokenLifetime),
+		AMR:       amr,
+	})
 	if err != nil {
-		return tokenString, err
+		return "", err
 	}
-	return tokenString, nil
+	return refreshToken, nil
 }
 
-// searches the user in the database.
-func validateUser(email string, passwordHash string) (bool, error) {
-	usr, exists := data.GetUserObject(email)
-	if !exists {
-		return false, errors.New("user does not exist")
+// startSession signs the user in: a new session, its first refresh token and an access token.
+// The signin, the second step of MFA and the OIDC login all end up here.
+func startSession(r *http.Request, keyring *jwt.Keyring, tokens *tokenconfig.Config, refreshStore tokenstore.RefreshStore,
+	sessions tokenstore.SessionStore, usr data.User, amr []string) (accessToken, string, error) {
+	// every signin is a new session, its id is the family of the refresh tokens
+	family := tokenstore.NewFamily()
+	access, err := getSignedToken(keyring, tokens, usr, amr, family, nil)
+	if err != nil {
+		return accessToken{}, "", fmt.Errorf("signing the token: %w", err)
+	}
+	refreshToken, err := issueRefreshToken(r.Context(), refreshStore, tokens, family, usr, amr)
+	if err != nil {
+		return accessToken{}, "", fmt.Errorf("storing the refresh token: %w", err)
+	}
+	if err := sessions.Save(r.Context(), newSession(r, tokens, usr, family)); err != nil {
+		return accessToken{}, "", fmt.Errorf("storing the session: %w", err)
 	}
-	passwordCheck := usr.ValidatePasswordHash(passwordHash)
+	return access, refreshToken, nil
+}
 
+// searches the user in the database. Returns the user if the password is valid
+func (ctrl *SigninController) validateUser(ctx context.Context, email string, pswd string) (data.User, bool, error) {
+	usr, err := ctrl.users.GetByEmail(ctx, email)
+	if err == data.ErrUserNotFound {
+		ctrl.hasher.Burn(pswd)
+	}
+	if err != nil {
+		return data.User{}, false, err
+	}
+	// users from the identity provider have no password of ours, an empty one must never match
+	if !usr.HasPassword() {
+		ctrl.hasher.Burn(pswd)
+		return data.User{}, false, nil
+	}
+	passwordCheck, needsRehash, err := ctrl.hasher.Verify(pswd, usr.PasswordHash)
+	if err != nil {
+		return data.User{}, false, err
+	}
 	if !passwordCheck {
-		return false, nil
+		return data.User{}, false, nil
+	}
+
+	// the hash was made with older parameters. We know the password right now, so we upgrade it.
+	// The signin does not depend on it, the old hash keeps working until the next try.
+	if needsRehash {
+		if newHash, err := ctrl.hasher.Hash(pswd); err == nil {
+			usr.PasswordHash = newHash
+			err = ctrl.users.Update(ctx, usr)
+		}
+		if err != nil {
+			ctrl.logger.Error("Unable to rehash the password", zap.String("email", email), zap.Error(err))
+		}
+	}
+	return usr, true, nil
+}
+
+// cookieDelivery returns the cookies if the client asked for the tokens as cookies, otherwise nil
+func cookieDelivery(cookies *middleware.Cookies, r *http.Request) *middleware.Cookies {
+	if cookies.Requested(r) {
+		return cookies
+	}
+	return nil
+}
+
+// writeTokens sends the access and the refresh token as a TokenResponse.
+// In legacy mode the access token is the plain body and the refresh token goes in the Refreshtoken header.
+// With cookies the tokens only go in the cookies, where the scripts of the page cannot read them.
+func writeTokens(rw http.ResponseWriter, legacy bool, cookies *middleware.Cookies, tokens *tokenconfig.Config, access accessToken, refreshToken string) {
+	if cookies != nil {
+		cookies.SetTokens(rw, access.token, access.expiresIn, refreshToken, tokens.RefreshTokenLifetime)
+		access.token, refreshToken = "", ""
+	} else if legacy {
+		rw.Header().Set("Refreshtoken", refreshToken)
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte(access.token))
+		return
 	}
-	return true, nil
+	rw.Header().Set("Content-Type", "application/json")
+	// tokens must never be cached (RFC 6749 section 5.1)
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(TokenResponse{
+		AccessToken:  access.token,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(access.expiresIn / time.Second),
+		RefreshToken: refreshToken,
+	})
 }
 
 // This will be supplied to the MUX router. It will be called when signin request is sent
 // if user not found or not validates, returns the Unauthorized error
-// if found, returns the JWT back. [How to return this?]
+// if found, returns the JWT back as a TokenResponse
 func (ctrl *SigninController) SigninHandler(rw http.ResponseWriter, r *http.Request) {
 	// increment total singin requests
 	ctrl.promSigninTotal.Inc()
 
 	// validate the request first.
-	if _, ok := r.Header["Email"]; !ok {
-		ctrl.logger.Warn("Email was not found in the header")
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Email Missing"))
+	req, err := decodeSignin(r, ctrl.legacyHeaders)
+	if err != nil {
+		ctrl.logger.Warn("Unable to read the signin request", zap.Error(err))
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
 		ctrl.promSigninFail.Inc()
 		return
 	}
-	if _, ok := r.Header["Passwordhash"]; !ok {
-		ctrl.logger.Warn("Passwordhash was not found in the header")
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Passwordhash Missing"))
+	if errs := req.Validate(); len(errs) > 0 {
+		ctrl.logger.Warn("Invalid signin request", zap.Any("errors", errs))
+		problem.Write(rw, r, problem.Validation(errs))
 		ctrl.promSigninFail.Inc()
 		return
 	}
-	// lets see if the user exists
-	valid, err := validateUser(r.Header["Email"][0], r.Header["Passwordhash"][0])
+	// a client that failed too often has to wait before we even look at the password
+	accountKey := strings.ToLower(req.Email)
+	ip := clientIP(r)
+	wait, scope, err := ctrl.guard.Check(r.Context(), accountKey, ip)
 	if err != nil {
-		// this means either the user does not exist
-		ctrl.logger.Warn("User does not exist", zap.String("email", r.Header["Email"][0]))
-		rw.WriteHeader(http.StatusUnauthorized)
-		rw.Write([]byte("User Does not Exist"))
+		// we rather let the signin through than lock everybody out while the tracker is down
+		ctrl.logger.Error("Unable to check the failed signins", zap.Error(err))
+	}
+	if wait > 0 {
+		ctrl.logger.Warn("Signin throttled", zap.String("email", req.Email), zap.String("ip", ip), zap.String("scope", scope), zap.Duration("wait", wait))
+		ctrl.promThrottled.WithLabelValues(scope).Inc()
 		ctrl.promSigninFail.Inc()
+		// Retry-After is in whole seconds, we round up so the client does not come back too early
+		rw.Header().Set("Retry-After", strconv.FormatInt(int64((wait+time.Second-1)/time.Second), 10))
+		p := problem.New(problem.TypeTooMany, http.StatusTooManyRequests, "Too many failed signins")
+		p.Detail = "Try again later"
+		problem.Write(rw, r, p)
+		ctrl.recordSignin(r, accountKey, "", audit.OutcomeDenied, "throttled")
 		return
 	}
 
+	// lets see if the user exists
+	usr, valid, err := ctrl.validateUser(r.Context(), req.Email, req.Password)
+	if err != nil && err != data.ErrUserNotFound {
+		ctrl.logger.Error("Unable to look up the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+		ctrl.promSigninError.Inc()
+		return
+	}
 	if !valid {
-		// this means the password is wrong
-		ctrl.logger.Warn("Password is wrong", zap.String("email", r.Header["Email"][0]))
-		rw.WriteHeader(http.StatusUnauthorized)
-		rw.Write([]byte("Incorrect Password"))
+		// either the user does not exist or the password is wrong, the caller must not learn which
+		ctrl.logger.Warn("Invalid credentials", zap.String("email", req.Email), zap.String("ip", ip), zap.Bool("userExists", err == nil))
+		locked, err := ctrl.guard.Fail(r.Context(), accountKey, ip)
+		if err != nil {
+			ctrl.logger.Error("Unable to record the failed signin", zap.Error(err))
+		}
+		ctrl.recordSignin(r, accountKey, "", audit.OutcomeFailure, "invalid_credentials")
+		for _, scope := range locked {
+			ctrl.logger.Warn("Signin locked", zap.String("email", req.Email), zap.String("ip", ip), zap.String("scope", scope))
+			ctrl.promLockouts.WithLabelValues(scope).Inc()
+			event := audit.FromRequest(r, audit.ActionLockout)
+			event.Target = accountKey
+			event.Details = map[string]string{"scope": scope}
+			ctrl.audit.Record(r.Context(), event)
+		}
+		problem.Write(rw, r, problem.New(problem.TypeUnauthorized, http.StatusUnauthorized, invalidCredentials))
 		ctrl.promSigninFail.Inc()
 		return
 	}
-	tokenString, err := getSignedToken()
+	if err := ctrl.guard.Succeed(r.Context(), accountKey); err != nil {
+		ctrl.logger.Error("Unable to reset the failed signins", zap.Error(err))
+	}
+	if !usr.Active() {
+		// the password was right, so telling the reason does not reveal anything
+		ctrl.logger.Warn("Signin of an inactive account", zap.String("email", req.Email), zap.String("status", usr.Status))
+		p := problem.New(problem.TypeUnverified, http.StatusForbidden, "Email not verified")
+		p.Detail = "Open the link in the verification mail first"
+		if usr.Status == data.StatusDisabled {
+			p = problem.New(problem.TypeDisabled, http.StatusForbidden, "Account disabled")
+		}
+		problem.Write(rw, r, p)
+		ctrl.recordSignin(r, accountKey, usr.Username, audit.OutcomeDenied, "account_"+usr.Status)
+		ctrl.promSigninFail.Inc()
+		return
+	}
+
+	// with MFA enabled the password is only the first step, the tokens come from /auth/signin/mfa
+	if usr.MFAEnabled {
+		if err := writeMFAChallenge(rw, ctrl.keyring, ctrl.tokens, usr); err != nil {
+			ctrl.logger.Error("unable to sign the MFA challenge", zap.Error(err))
+			problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+			ctrl.promSigninError.Inc()
+			return
+		}
+		ctrl.logger.Info("MFA challenge issued", zap.String("email", req.Email))
+		ctrl.recordSignin(r, accountKey, usr.Username, audit.OutcomeSuccess, "mfa_required")
+		return
+	}
+
+	access, refreshToken, err := startSession(r, ctrl.keyring, ctrl.tokens, ctrl.refreshStore, ctrl.sessions, usr, []string{jwt.AMRPassword})
 	if err != nil {
-		ctrl.logger.Error("unable to sign the token", zap.Error(err))
-		rw.WriteHeader(http.StatusInternalServerError)
-		rw.Write([]byte("Internal Server Error"))
+		ctrl.logger.Error("unable to start the session", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
 		ctrl.promSigninError.Inc()
 		return
 	}
-	ctrl.logger.Info("Token sign", zap.String("token", tokenString), zap.String("email", r.Header["Email"][0]))
+	// never log the tokens themselves, anyone reading the logs could use them
+	ctrl.logger.Info("Token sign", zap.String("subject", usr.Username), zap.String("email", req.Email))
+	ctrl.recordSignin(r, accountKey, usr.Username, audit.OutcomeSuccess, "")
 
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte(tokenString))
+	// the access token is short lived. The refresh token gets a new one from /auth/refresh
+	writeTokens(rw, ctrl.legacyHeaders, cookieDelivery(ctrl.cookies, r), ctrl.tokens, access, refreshToken)
 	ctrl.promSigninSuccess.Inc()
 }
+
+// writeMFAChallenge answers the first step of a signin of a user with MFA enabled.
+// Nothing is written when the challenge cannot be signed.
+func writeMFAChallenge(rw http.ResponseWriter, keyring *jwt.Keyring, tokens *tokenconfig.Config, usr data.User) error {
+	challenge, err := issueActionToken(keyring, tokens, purposeMFA, usr, mfaChallengeLifetime)
+	if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(mfaChallengeResponse{
+		MFARequired: true,
+		MFAToken:    challenge,
+		ExpiresIn:   int64(mfaChallengeLifetime / time.Second),
+	})
+	return nil
+}
+
+// recordSignin audits a signin attempt. The target is the email that was tried, it may not belong to any user.
+// The actor is only set once the password was right.
+func (ctrl *SigninController) recordSignin(r *http.Request, email string, actor string, outcome string, reason string) {
+	event := audit.FromRequest(r, audit.ActionSignin)
+	event.Actor = actor
+	event.Target = email
+	event.Outcome = outcome
+	if reason != "" {
+		event.Details = map[string]string{"reason": reason}
+	}
+	ctrl.audit.Record(r.Context(), event)
+}
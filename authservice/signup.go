@@ -1,11 +1,18 @@
 package authservice
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
 	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/mailer"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
 	"go.uber.org/zap"
 )
 
@@ -30,12 +37,40 @@ type SignupController struct {
 	promSignupTotal   prometheus.Counter
 	promSignupSuccess prometheus.Counter
 	promSignupFail    prometheus.Counter
+	users             data.UserStore
+	hasher            *password.Hasher
+	keyring           *jwt.Keyring
+	tokens            *tokenconfig.Config
+	mailer            mailer.Mailer
+	audit             *audit.Recorder
+	legacyHeaders     bool
+}
+
+// accountResponse tells the state of the account after a signup or a verification
+type accountResponse struct {
+	Email    string `json:"email"`
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
+
+func writeAccount(rw http.ResponseWriter, status int, usr data.User) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(accountResponse{Email: usr.Email, Username: usr.Username, Status: usr.Status})
 }
 
 // NewSignupController returns a frsh Signup controller
-func NewSignupController(logger *zap.Logger) *SignupController {
+func NewSignupController(logger *zap.Logger, users data.UserStore, hasher *password.Hasher, keyring *jwt.Keyring, tokens *tokenconfig.Config,
+	m mailer.Mailer, recorder *audit.Recorder) *SignupController {
 	return &SignupController{
 		logger:            logger,
+		users:             users,
+		hasher:            hasher,
+		keyring:           keyring,
+		tokens:            tokens,
+		mailer:            m,
+		audit:             recorder,
+		legacyHeaders:     legacyHeaders(),
 		promSignupTotal:   singupRequests,
 		promSignupSuccess: signupSuccess,
 		promSignupFail:    signupFail,
@@ -47,50 +82,75 @@ func (ctrl *SignupController) SignupHandler(rw http.ResponseWriter, r *http.Requ
 	// we increment the signup request counter
 	ctrl.promSignupTotal.Inc()
 
-	// extra error handling should be done at server side to prevent malicious attacks
-	if _, ok := r.Header["Email"]; !ok {
-		ctrl.logger.Warn("Email was not found in the header")
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Email Missing"))
+	req, err := decodeSignup(r, ctrl.legacyHeaders)
+	if err != nil {
+		ctrl.logger.Warn("Unable to read the signup request", zap.Error(err))
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
 		ctrl.promSignupFail.Inc()
 		return
 	}
-	if _, ok := r.Header["Username"]; !ok {
-		ctrl.logger.Warn("Username was not found in the header")
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Username Missing"))
+	// extra error handling should be done at server side to prevent malicious attacks
+	if errs := req.Validate(); len(errs) > 0 {
+		ctrl.logger.Warn("Invalid signup request", zap.Any("errors", errs))
+		problem.Write(rw, r, problem.Validation(errs))
 		ctrl.promSignupFail.Inc()
 		return
 	}
-	if _, ok := r.Header["Passwordhash"]; !ok {
-		ctrl.logger.Warn("Passwordhash was not found in the header")
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Passwordhash Missing"))
+
+	// we only ever store the hash of the password
+	passwordHash, err := ctrl.hasher.Hash(req.Password)
+	if err != nil {
+		ctrl.logger.Error("Unable to hash the password", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
 		ctrl.promSignupFail.Inc()
 		return
 	}
-	if _, ok := r.Header["Fullname"]; !ok {
-		ctrl.logger.Warn("Fullname was not found in the header")
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Fullname Missing"))
+
+	// validate and then add the user
+	newUser := data.User{
+		Email:        req.Email,
+		Username:     req.Username,
+		PasswordHash: passwordHash,
+		Fullname:     req.Fullname,
+		Role:         data.RoleUser,
+		// the account is activated by the link in the verification mail
+		Status: data.StatusPending,
+	}
+	err = ctrl.users.Create(r.Context(), &newUser)
+	if err != nil && err != data.ErrUserExists {
+		ctrl.logger.Error("Unable to create the user", zap.Error(err))
+		problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
 		ctrl.promSignupFail.Inc()
 		return
 	}
-
-	// validate and then add the user
-	check := data.AddUserObject(r.Header["Email"][0], r.Header["Username"][0], r.Header["Passwordhash"][0],
-		r.Header["Fullname"][0], 0)
-	// if false means username already exists
-	if !check {
-		ctrl.logger.Warn("User already exists", zap.String("email", r.Header["Email"][0]), zap.String("username", r.Header["Username"][0]))
-		rw.WriteHeader(http.StatusConflict)
-		rw.Write([]byte("Email or Username already exists"))
+	// this means email or username already exists
+	if err == data.ErrUserExists {
+		ctrl.logger.Warn("User already exists", zap.String("email", req.Email), zap.String("username", req.Username))
+		problem.Write(rw, r, problem.New(problem.TypeConflict, http.StatusConflict, "Email or Username already exists"))
+		event := audit.FromRequest(r, audit.ActionSignup)
+		event.Target = req.Username
+		event.Outcome = audit.OutcomeFailure
+		event.Details = map[string]string{"reason": "exists"}
+		ctrl.audit.Record(r.Context(), event)
 		ctrl.promSignupFail.Inc()
 		return
 	}
-	ctrl.logger.Info("User created", zap.String("email", r.Header["Email"][0]), zap.String("username", r.Header["Username"][0]))
-	rw.WriteHeader(http.StatusOK)
-	rw.Write([]byte("User Created"))
+	ctrl.logger.Info("User created", zap.String("email", req.Email), zap.String("username", req.Username))
+	event := audit.FromRequest(r, audit.ActionSignup)
+	event.Actor = newUser.Username
+	event.Target = newUser.Username
+	ctrl.audit.Record(r.Context(), event)
+
+	token, err := issueActionToken(ctrl.keyring, ctrl.tokens, purposeVerifyEmail, newUser, verifyTokenLifetime)
+	if err != nil {
+		// the user can still get a link through the password reset, which verifies the email as well
+		ctrl.logger.Error("Unable to sign the verification token", zap.Error(err))
+	} else {
+		sendMail(ctrl.logger, ctrl.mailer, verificationMail(newUser, token))
+	}
+	writeAccount(rw, http.StatusCreated, newUser)
 	// this will mean the request was successfully added
 	ctrl.promSignupSuccess.Inc()
 }
@@ -0,0 +1,264 @@
+package authservice
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/clients"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"go.uber.org/zap"
+)
+
+var (
+	tokenRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "token_total",
+		Help: "Total number of client token requests",
+	})
+	tokenFail = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "token_fail",
+		Help: "Rejected client token requests by OAuth2 error code",
+	}, []string{"error"})
+)
+
+// grant types of RFC 6749, only client_credentials is supported
+const grantClientCredentials = "client_credentials"
+
+var (
+	errClientMissing = errors.New("client authentication is missing")
+	errClientFailed  = errors.New("client authentication failed")
+)
+
+// oauthError is the error body of the token endpoint, RFC 6749 5.2
+type oauthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// ClientTokenResponse is what a client gets for its credentials. There is no refresh token,
+// RFC 6749 4.4.3 says it should not be issued for this grant.
+type ClientTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// TokenController is the OAuth2 token route handler
+type TokenController struct {
+	logger    *zap.Logger
+	promTotal prometheus.Counter
+	promFail  *prometheus.CounterVec
+	keyring   *jwt.Keyring
+	tokens    *tokenconfig.Config
+	clients   clients.Store
+	hasher    *password.Hasher
+}
+
+// NewTokenController returns a frsh Token controller
+func NewTokenController(logger *zap.Logger, keyring *jwt.Keyring, tokens *tokenconfig.Config, clientStore clients.Store, hasher *password.Hasher) *TokenController {
+	return &TokenController{
+		logger:    logger,
+		promTotal: tokenRequests,
+		promFail:  tokenFail,
+		keyring:   keyring,
+		tokens:    tokens,
+		clients:   clientStore,
+		hasher:    hasher,
+	}
+}
+
+// getClientToken signs an access token for the client itself. The subject is the client id
+// and there are no roles, only the granted scopes. Client tokens cannot be revoked, a client
+// simply asks for a new one when it expires.
+func getClientToken(keyring *jwt.Keyring, tokens *tokenconfig.Config, client clients.Client, scopes []string, audiences []string) (accessToken, error) {
+	lifetime := tokens.ClientTokenLifetime
+	if client.TokenLifetime > 0 {
+		lifetime = client.TokenLifetime
+	}
+	now := time.Now()
+	claims := jwt.Claims{
+		Audience:  jwt.Audience(append([]string{}, audiences...)),
+		Issuer:    tokens.Issuer,
+		Subject:   client.ID,
+		ClientID:  client.ID,
+		Scope:     strings.Join(scopes, " "),
+		ExpiresAt: now.Add(lifetime).Unix(),
+		IssuedAt:  now.Unix(),
+		ID:        jwt.NewTokenID(),
+	}
+	token, err := jwt.GenerateToken(keyring.SigningKey(), claims)
+	if err != nil {
+		return accessToken{}, err
+	}
+	return accessToken{token: token, expiresIn: lifetime}, nil
+}
+
+// clientCredentials reads the client authentication, HTTP Basic or the form fields.
+// RFC 6749 2.3 forbids using both.
+func clientCredentials(r *http.Request) (id string, secret string, ok bool) {
+	basicID, basicSecret, basic := r.BasicAuth()
+	formID, formSecret := r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	if basic {
+		if formSecret != "" {
+			return "", "", false
+		}
+		// the Basic credentials are form encoded before the base64, RFC 6749 2.3.1
+		var errID, errSecret error
+		id, errID = url.QueryUnescape(basicID)
+		secret, errSecret = url.QueryUnescape(basicSecret)
+		return id, secret, errID == nil && errSecret == nil && id != ""
+	}
+	return formID, formSecret, formID != ""
+}
+
+// authenticateClient checks the client authentication of a parsed form request.
+// Unexpected errors are logged here, the caller only answers with server_error.
+func authenticateClient(r *http.Request, store clients.Store, hasher *password.Hasher, logger *zap.Logger) (clients.Client, error) {
+	id, secret, ok := clientCredentials(r)
+	if !ok {
+		return clients.Client{}, errClientMissing
+	}
+	client, err := store.Get(r.Context(), id)
+	if err == clients.ErrClientNotFound {
+		// same work as a wrong secret, so the timing does not tell which clients exist
+		hasher.Burn(secret)
+		logger.Warn("Unknown client", zap.String("client_id", id))
+		return clients.Client{}, errClientFailed
+	}
+	if err != nil {
+		logger.Error("Unable to look up the client", zap.Error(err))
+		return clients.Client{}, err
+	}
+	match, _, err := hasher.Verify(secret, client.SecretHash)
+	if err != nil {
+		logger.Error("Unable to verify the client secret", zap.String("client_id", id), zap.Error(err))
+		return clients.Client{}, err
+	}
+	if !match {
+		logger.Warn("Wrong client secret", zap.String("client_id", id))
+		return clients.Client{}, errClientFailed
+	}
+	return client, nil
+}
+
+// grantedScopes checks the requested scopes against the client. No request means all scopes of the client.
+func grantedScopes(client clients.Client, requested string) ([]string, bool) {
+	scopes := strings.Fields(requested)
+	if len(scopes) == 0 {
+		return client.Scopes, true
+	}
+	for _, scope := range scopes {
+		if !client.Allows(scope) {
+			return nil, false
+		}
+	}
+	return scopes, true
+}
+
+// grantedAudiences checks the requested audiences (RFC 8693 2.1) against the client and the config.
+// No request means all audiences of the client, or the default ones for a client without audiences.
+func grantedAudiences(tokens *tokenconfig.Config, client clients.Client, requested []string) ([]string, bool) {
+	if len(requested) == 0 {
+		requested = client.Audiences
+	}
+	if len(requested) == 0 {
+		return tokens.DefaultAudiences, true
+	}
+	for _, audience := range requested {
+		if !tokens.Known(audience) || !client.AllowsAudience(audience) {
+			return nil, false
+		}
+	}
+	return requested, true
+}
+
+// TokenHandler implements the client_credentials grant of RFC 6749 4.4
+func (ctrl *TokenController) TokenHandler(rw http.ResponseWriter, r *http.Request) {
+	ctrl.promTotal.Inc()
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" {
+		ctrl.writeError(rw, http.StatusBadRequest, "invalid_request", "Content-Type must be application/x-www-form-urlencoded")
+		return
+	}
+	r.Body = http.MaxBytesReader(rw, r.Body, maxBodySize)
+	if err := r.ParseForm(); err != nil {
+		ctrl.writeError(rw, http.StatusBadRequest, "invalid_request", "The body is not a valid form")
+		return
+	}
+	if grant := r.PostForm.Get("grant_type"); grant != grantClientCredentials {
+		ctrl.writeError(rw, http.StatusBadRequest, "unsupported_grant_type", "Only the client_credentials grant is supported")
+		return
+	}
+
+	client, err := authenticateClient(r, ctrl.clients, ctrl.hasher, ctrl.logger)
+	switch err {
+	case nil:
+	case errClientMissing:
+		ctrl.writeError(rw, http.StatusUnauthorized, "invalid_client", "Client authentication is missing")
+		return
+	case errClientFailed:
+		ctrl.writeError(rw, http.StatusUnauthorized, "invalid_client", "Client authentication failed")
+		return
+	default:
+		ctrl.writeError(rw, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	id := client.ID
+
+	scopes, ok := grantedScopes(client, r.PostForm.Get("scope"))
+	if !ok {
+		ctrl.logger.Warn("Scope not granted to the client", zap.String("client_id", id), zap.String("scope", r.PostForm.Get("scope")))
+		ctrl.writeError(rw, http.StatusBadRequest, "invalid_scope", "The requested scope exceeds the scope granted to the client")
+		return
+	}
+
+	audiences, ok := grantedAudiences(ctrl.tokens, client, r.PostForm["audience"])
+	if !ok {
+		ctrl.logger.Warn("Audience not granted to the client", zap.String("client_id", id), zap.Strings("audience", r.PostForm["audience"]))
+		ctrl.writeError(rw, http.StatusBadRequest, "invalid_target", "The requested audience is unknown or not granted to the client")
+		return
+	}
+
+	token, err := getClientToken(ctrl.keyring, ctrl.tokens, client, scopes, audiences)
+	if err != nil {
+		ctrl.logger.Error("Unable to sign the client token", zap.Error(err))
+		ctrl.writeError(rw, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	ctrl.logger.Info("Issued a client token", zap.String("client_id", id), zap.Strings("scopes", scopes), zap.Strings("audiences", audiences))
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+	json.NewEncoder(rw).Encode(ClientTokenResponse{
+		AccessToken: token.token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(token.expiresIn / time.Second),
+		Scope:       strings.Join(scopes, " "),
+	})
+}
+
+func (ctrl *TokenController) writeError(rw http.ResponseWriter, status int, code string, description string) {
+	ctrl.promFail.WithLabelValues(code).Inc()
+	writeOAuthError(rw, status, code, description)
+}
+
+// writeOAuthError writes the error body of RFC 6749 5.2. Failed client authentication gets the Basic challenge.
+func writeOAuthError(rw http.ResponseWriter, status int, code string, description string) {
+	if status == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", `Basic realm="auth"`)
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(oauthError{Error: code, ErrorDescription: description})
+}
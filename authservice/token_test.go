@@ -0,0 +1,171 @@
+package authservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/clients"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
+	"go.uber.org/zap"
+)
+
+func formRequest(form url.Values) *http.Request {
+	req := httptest.NewRequest("POST", "/auth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+func TestClientCredentials(t *testing.T) {
+	logger := zap.NewNop()
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	hasher, _ := password.NewHasher(password.Params{Algorithm: password.Bcrypt, Cost: 4})
+	secretHash, _ := hasher.Hash("monitor-secret")
+	store := clients.NewMemoryStore(clients.Client{ID: "monitor", SecretHash: secretHash, Scopes: []string{"monitor:write", "coupon:read"}})
+	ctrl := NewTokenController(logger, keyring, tokenconfig.Default(), store, hasher)
+
+	tests := []struct {
+		name   string
+		form   url.Values
+		basic  []string
+		want   int
+		error  string
+		scopes string
+	}{
+		{"Form Credentials", url.Values{"grant_type": {"client_credentials"}, "client_id": {"monitor"}, "client_secret": {"monitor-secret"}}, nil, http.StatusOK, "", "monitor:write coupon:read"},
+		{"Basic Credentials", url.Values{"grant_type": {"client_credentials"}, "scope": {"monitor:write"}}, []string{"monitor", "monitor-secret"}, http.StatusOK, "", "monitor:write"},
+		{"Scope Not Granted", url.Values{"grant_type": {"client_credentials"}, "scope": {"product:delete"}}, []string{"monitor", "monitor-secret"}, http.StatusBadRequest, "invalid_scope", ""},
+		{"Wrong Secret", url.Values{"grant_type": {"client_credentials"}}, []string{"monitor", "wrong"}, http.StatusUnauthorized, "invalid_client", ""},
+		{"Unknown Client", url.Values{"grant_type": {"client_credentials"}}, []string{"nobody", "monitor-secret"}, http.StatusUnauthorized, "invalid_client", ""},
+		{"No Credentials", url.Values{"grant_type": {"client_credentials"}}, nil, http.StatusUnauthorized, "invalid_client", ""},
+		{"Password Grant", url.Values{"grant_type": {"password"}}, []string{"monitor", "monitor-secret"}, http.StatusBadRequest, "unsupported_grant_type", ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := formRequest(tc.form)
+			if tc.basic != nil {
+				req.SetBasicAuth(tc.basic[0], tc.basic[1])
+			}
+			rw := httptest.NewRecorder()
+			ctrl.TokenHandler(rw, req)
+			if rw.Code != tc.want {
+				t.Fatalf("Expected status %d, got %d", tc.want, rw.Code)
+			}
+			if tc.want != http.StatusOK {
+				var body oauthError
+				json.NewDecoder(rw.Body).Decode(&body)
+				if body.Error != tc.error {
+					t.Fatalf("Expected error %s, got %s", tc.error, body.Error)
+				}
+				return
+			}
+			var resp ClientTokenResponse
+			json.NewDecoder(rw.Body).Decode(&resp)
+			claims, err := jwt.ValidateToken(resp.AccessToken, keyring, jwt.Validator{Audience: jwt.GetAudience()})
+			if err != nil || claims.ClientID != "monitor" || claims.Scope != tc.scopes || len(claims.Roles) != 0 {
+				t.Fatalf("Unexpected client token %+v %v", claims, err)
+			}
+		})
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	tm := middleware.NewTokenMiddleware(zap.NewNop(), keyring, tokenstore.NewMemoryRevocationList())
+	handler := tm.RequireScope("monitor:write")(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	call := func(token string) int {
+		req := httptest.NewRequest("POST", "/checkRoutine", nil)
+		req.Header.Set("Token", token)
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	tokens := tokenconfig.Default()
+	monitorToken, _ := getClientToken(keyring, tokens, clients.Client{ID: "monitor"}, []string{"monitor:write"}, tokens.DefaultAudiences)
+	otherToken, _ := getClientToken(keyring, tokens, clients.Client{ID: "region"}, []string{"coupon:read"}, tokens.DefaultAudiences)
+	userToken, _ := getSignedToken(keyring, tokens, data.User{Username: "abc12", Role: data.RoleAdmin}, []string{jwt.AMRPassword}, "", nil)
+	if code := call(monitorToken.token); code != http.StatusOK {
+		t.Fatalf("Expected the monitor to pass, got %d", code)
+	}
+	if code := call(otherToken.token); code != http.StatusForbidden {
+		t.Fatalf("Expected the scope to be missing, got %d", code)
+	}
+	if code := call(userToken.token); code != http.StatusForbidden {
+		t.Fatalf("User tokens have no scopes, got %d", code)
+	}
+}
+
+func TestAudiences(t *testing.T) {
+	logger := zap.NewNop()
+	keyring := jwt.NewKeyring(jwt.NewHMACKey("hs256", "secret"))
+	hasher, _ := password.NewHasher(password.Params{Algorithm: password.Bcrypt, Cost: 4})
+	secretHash, _ := hasher.Hash("claims-secret")
+	tokens := &tokenconfig.Config{
+		Issuer:              "knowsearch.ml",
+		AccessTokenLifetime: time.Minute,
+		ClientTokenLifetime: 5 * time.Minute,
+		Audiences: []tokenconfig.Audience{
+			{Name: "frontend.knowsearch.ml", Service: "auth"},
+			{Name: "claims.knowsearch.ml", Service: "claims", AccessTokenLifetime: 30 * time.Second},
+		},
+		DefaultAudiences: []string{"frontend.knowsearch.ml"},
+	}
+	store := clients.NewMemoryStore(clients.Client{ID: "uploader", SecretHash: secretHash, Audiences: []string{"claims.knowsearch.ml"}})
+	ctrl := NewTokenController(logger, keyring, tokens, store, hasher)
+
+	clientToken := func(audience string) (*httptest.ResponseRecorder, ClientTokenResponse) {
+		form := url.Values{"grant_type": {"client_credentials"}}
+		if audience != "" {
+			form.Set("audience", audience)
+		}
+		req := formRequest(form)
+		req.SetBasicAuth("uploader", "claims-secret")
+		rw := httptest.NewRecorder()
+		ctrl.TokenHandler(rw, req)
+		var resp ClientTokenResponse
+		json.NewDecoder(rw.Body).Decode(&resp)
+		return rw, resp
+	}
+	if rw, _ := clientToken("frontend.knowsearch.ml"); rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an audience the client may not use to be refused, got %d", rw.Code)
+	}
+	_, resp := clientToken("")
+
+	tm := middleware.NewTokenMiddleware(logger, keyring, tokenstore.NewMemoryRevocationList()).WithIssuer(tokens.Issuer)
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { rw.WriteHeader(http.StatusOK) })
+	call := func(service string, token string) int {
+		req := httptest.NewRequest("GET", "/claims/download", nil)
+		req.Header.Set("Token", token)
+		rw := httptest.NewRecorder()
+		tm.ForAudience(tokens.AudienceFor(service)).TokenValidationMiddleware(ok).ServeHTTP(rw, req)
+		return rw.Code
+	}
+	if code := call("claims", resp.AccessToken); code != http.StatusOK {
+		t.Fatalf("Expected the claims service to accept the token, got %d", code)
+	}
+	if code := call("auth", resp.AccessToken); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the token of the claims service to be refused elsewhere, got %d", code)
+	}
+
+	// users get the default audience, and the lifetime of the audience they ask for
+	userToken, _ := getSignedToken(keyring, tokens, data.User{Username: "abc12"}, []string{jwt.AMRPassword}, "", nil)
+	if code := call("claims", userToken.token); code != http.StatusUnauthorized {
+		t.Fatalf("Expected the frontend token to be refused by the claims service, got %d", code)
+	}
+	claimsToken, _ := getSignedToken(keyring, tokens, data.User{Username: "abc12"}, []string{jwt.AMRPassword}, "", []string{"claims.knowsearch.ml"})
+	if code := call("claims", claimsToken.token); code != http.StatusOK || claimsToken.expiresIn != 30*time.Second {
+		t.Fatalf("Expected a 30s token for the claims service, got %d %v", code, claimsToken.expiresIn)
+	}
+}
@@ -0,0 +1,217 @@
+// Package tokenconfig decides what goes into our tokens: the issuer, the audiences
+// and how long the tokens live. Each service checks the tokens are meant for its audience,
+// so a token of one service cannot be replayed against another.
+package tokenconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"gopkg.in/yaml.v2"
+)
+
+// default lifetimes of the tokens
+const (
+	// access tokens cannot be revoked cheaply by all services, so they are short lived
+	DefaultAccessTokenLifetime = time.Minute * 1
+	// refresh tokens are checked against the store on every use, they can live longer
+	DefaultRefreshTokenLifetime = time.Hour * 24 * 7
+	// clients ask for a new token when it expires, there is no refresh token for them.
+	// A client can have its own lifetime, see clients.Client.
+	DefaultClientTokenLifetime = time.Minute * 5
+)
+
+// the services besides auth that accept our tokens. Without a file each gets its own audience.
+var defaultServices = []string{"claims", "product", "coupon"}
+
+// Audience is a service accepting our tokens. AccessTokenLifetime overrides the default for tokens of the audience.
+type Audience struct {
+	Name string `yaml:"name"`
+	// Service names the part of the API validating the tokens, eg. claims or product
+	Service             string        `yaml:"service"`
+	AccessTokenLifetime time.Duration `yaml:"access_token_lifetime"`
+}
+
+// Config is the token configuration. The zero durations get the defaults.
+type Config struct {
+	Issuer               string        `yaml:"issuer"`
+	AccessTokenLifetime  time.Duration `yaml:"access_token_lifetime"`
+	RefreshTokenLifetime time.Duration `yaml:"refresh_token_lifetime"`
+	ClientTokenLifetime  time.Duration `yaml:"client_token_lifetime"`
+	Audiences            []Audience    `yaml:"audiences"`
+	// DefaultAudiences get the tokens of users and clients that do not ask for an audience
+	DefaultAudiences []string `yaml:"default_audiences"`
+}
+
+// Default is the configuration without a file: AUTH_ISSUER, AUTH_AUDIENCE for the routes of auth,
+// which users get at signin, and <issuer>/<service> for each of the other services
+func Default() *Config {
+	cfg := &Config{}
+	cfg.applyDefaults()
+	return cfg
+}
+
+func (c *Config) applyDefaults() {
+	if c.Issuer == "" {
+		c.Issuer = jwt.GetIssuer()
+	}
+	if c.AccessTokenLifetime == 0 {
+		c.AccessTokenLifetime = DefaultAccessTokenLifetime
+	}
+	if c.RefreshTokenLifetime == 0 {
+		c.RefreshTokenLifetime = DefaultRefreshTokenLifetime
+	}
+	if c.ClientTokenLifetime == 0 {
+		c.ClientTokenLifetime = DefaultClientTokenLifetime
+	}
+	if len(c.Audiences) == 0 {
+		c.Audiences = []Audience{{Name: jwt.GetAudience(), Service: "auth"}}
+		for _, service := range defaultServices {
+			c.Audiences = append(c.Audiences, Audience{Name: c.Issuer + "/" + service, Service: service})
+		}
+		if len(c.DefaultAudiences) == 0 {
+			c.DefaultAudiences = []string{jwt.GetAudience()}
+		}
+	}
+	if len(c.DefaultAudiences) == 0 {
+		for _, audience := range c.Audiences {
+			c.DefaultAudiences = append(c.DefaultAudiences, audience.Name)
+		}
+	}
+}
+
+// validate checks the file makes sense after the defaults were applied
+func (c *Config) validate() error {
+	if c.AccessTokenLifetime < 0 || c.RefreshTokenLifetime < 0 || c.ClientTokenLifetime < 0 {
+		return fmt.Errorf("lifetimes must be positive")
+	}
+	if c.RefreshTokenLifetime < c.AccessTokenLifetime {
+		return fmt.Errorf("the refresh tokens must live longer than the access tokens")
+	}
+	names, services := map[string]bool{}, map[string]bool{}
+	for _, audience := range c.Audiences {
+		if audience.Name == "" || names[audience.Name] {
+			return fmt.Errorf("audience names must be set and unique, got %q", audience.Name)
+		}
+		names[audience.Name] = true
+		if audience.Service != "" && services[audience.Service] {
+			return fmt.Errorf("the service %s has more than one audience", audience.Service)
+		}
+		services[audience.Service] = true
+		if audience.AccessTokenLifetime < 0 || audience.AccessTokenLifetime > c.RefreshTokenLifetime {
+			return fmt.Errorf("the lifetime of %s must be positive and shorter than the refresh tokens", audience.Name)
+		}
+	}
+	for _, name := range c.DefaultAudiences {
+		if !names[name] {
+			return fmt.Errorf("the default audience %s is not one of the audiences", name)
+		}
+	}
+	return nil
+}
+
+// LoadFile reads the configuration from a YAML file, what is not in the file gets the defaults
+func LoadFile(path string) (*Config, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	cfg.applyDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// FromEnv loads the file at AUTH_TOKEN_CONFIG, or returns the defaults without the variable
+func FromEnv() (*Config, error) {
+	path := os.Getenv("AUTH_TOKEN_CONFIG")
+	if path == "" {
+		return Default(), nil
+	}
+	return LoadFile(path)
+}
+
+// Known tells if the audience is configured
+func (c *Config) Known(name string) bool {
+	for _, audience := range c.Audiences {
+		if audience.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// AudienceFor returns the audience the service accepts. A service without its own
+// audience accepts the first default audience, the tokens every user gets.
+func (c *Config) AudienceFor(service string) string {
+	for _, audience := range c.Audiences {
+		if audience.Service == service && service != "" {
+			return audience.Name
+		}
+	}
+	return c.DefaultAudiences[0]
+}
+
+// CheckServices makes sure no token is accepted by two of the services: each needs its own audience,
+// and the default audiences, which every signin gets, may name only one of them
+func (c *Config) CheckServices(services ...string) error {
+	defaults := map[string]bool{}
+	for _, name := range c.DefaultAudiences {
+		defaults[name] = true
+	}
+	accepting, byDefault := map[string]string{}, ""
+	for _, service := range services {
+		name := c.AudienceFor(service)
+		if other, ok := accepting[name]; ok {
+			return fmt.Errorf("the services %s and %s both accept the audience %s, give each its own", other, service, name)
+		}
+		accepting[name] = service
+		if defaults[name] {
+			if byDefault != "" {
+				return fmt.Errorf("the default audiences are accepted by %s and %s, every user token would work for both", byDefault, service)
+			}
+			byDefault = service
+		}
+	}
+	return nil
+}
+
+// AccessTokenLifetimeFor returns how long a user token for the audiences lives: the shortest
+// lifetime among them, so no audience gets a token that lives longer than it wants
+func (c *Config) AccessTokenLifetimeFor(audiences []string) time.Duration {
+	var lifetime time.Duration
+	for _, name := range audiences {
+		audienceLifetime := c.AccessTokenLifetime
+		for _, audience := range c.Audiences {
+			if audience.Name == name && audience.AccessTokenLifetime > 0 {
+				audienceLifetime = audience.AccessTokenLifetime
+			}
+		}
+		if lifetime == 0 || audienceLifetime < lifetime {
+			lifetime = audienceLifetime
+		}
+	}
+	if lifetime == 0 {
+		return c.AccessTokenLifetime
+	}
+	return lifetime
+}
+
+// MaxAccessTokenLifetime is the longest a user token can live. A revocation has to last that long.
+func (c *Config) MaxAccessTokenLifetime() time.Duration {
+	lifetime := c.AccessTokenLifetime
+	for _, audience := range c.Audiences {
+		if audience.AccessTokenLifetime > lifetime {
+			lifetime = audience.AccessTokenLifetime
+		}
+	}
+	return lifetime
+}
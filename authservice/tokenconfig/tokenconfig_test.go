@@ -0,0 +1,72 @@
+package tokenconfig
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "tokens.yaml")
+		ioutil.WriteFile(path, []byte(content), 0600)
+		return path
+	}
+
+	cfg, err := LoadFile(write(`
+issuer: auth.knowsearch.ml
+audiences:
+  - name: frontend.knowsearch.ml
+  - name: claims.knowsearch.ml
+    service: claims
+    access_token_lifetime: 30s
+  - name: products.knowsearch.ml
+    service: product
+    access_token_lifetime: 5m
+default_audiences: [frontend.knowsearch.ml]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Issuer != "auth.knowsearch.ml" || cfg.RefreshTokenLifetime != DefaultRefreshTokenLifetime {
+		t.Fatalf("Unexpected config %+v", cfg)
+	}
+	if cfg.AudienceFor("claims") != "claims.knowsearch.ml" || cfg.AudienceFor("auth") != "frontend.knowsearch.ml" {
+		t.Fatalf("Unexpected audiences of the services")
+	}
+	if lifetime := cfg.AccessTokenLifetimeFor([]string{"products.knowsearch.ml"}); lifetime != 5*time.Minute {
+		t.Fatalf("Expected the lifetime of the audience, got %v", lifetime)
+	}
+	if lifetime := cfg.AccessTokenLifetimeFor([]string{"products.knowsearch.ml", "claims.knowsearch.ml"}); lifetime != 30*time.Second {
+		t.Fatalf("Expected the shortest lifetime, got %v", lifetime)
+	}
+	if cfg.MaxAccessTokenLifetime() != 5*time.Minute {
+		t.Fatalf("Unexpected longest lifetime %v", cfg.MaxAccessTokenLifetime())
+	}
+	// the coupon service has no audience, it would take the tokens of auth
+	if err := cfg.CheckServices("auth", "claims", "product", "coupon"); err == nil {
+		t.Fatalf("Expected two services sharing an audience to be refused")
+	}
+
+	// without a file every service has its own audience and users only get the one of auth
+	cfg = Default()
+	if err := cfg.CheckServices("auth", "claims", "product", "coupon"); err != nil {
+		t.Fatalf("Expected the default audiences to be separate, got %v", err)
+	}
+	if cfg.AudienceFor("product") != cfg.Issuer+"/product" || len(cfg.DefaultAudiences) != 1 || cfg.DefaultAudiences[0] != cfg.AudienceFor("auth") {
+		t.Fatalf("Unexpected default audiences %+v", cfg.Audiences)
+	}
+
+	for _, content := range []string{
+		"default_audiences: [unknown.knowsearch.ml]",
+		"audiences: [{name: a}, {name: a}]",
+		"access_token_lifetime: 48h\nrefresh_token_lifetime: 1h",
+		"lifetime: 1m",
+	} {
+		if _, err := LoadFile(write(content)); err == nil {
+			t.Fatalf("Expected %q to be refused", content)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package tokenstore
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryRevocationList keeps the revoked ids in a map. It is lost on restart.
+type MemoryRevocationList struct {
+	mu      sync.Mutex
+	revoked map[string]time.Time
+}
+
+// NewMemoryRevocationList returns an empty revocation list
+func NewMemoryRevocationList() *MemoryRevocationList {
+	return &MemoryRevocationList{
+		revoked: map[string]time.Time{},
+	}
+}
+
+// Revoke adds the id to the list until the given time
+func (l *MemoryRevocationList) Revoke(ctx context.Context, id string, until time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.revoked[id] = until
+	l.prune()
+	return nil
+}
+
+// IsRevoked checks if the id is on the list
+func (l *MemoryRevocationList) IsRevoked(ctx context.Context, id string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until, ok := l.revoked[id]
+	return ok && time.Now().Before(until), nil
+}
+
+// removes the entries that expired, the caller holds the lock
+func (l *MemoryRevocationList) prune() {
+	now := time.Now()
+	for id, until := range l.revoked {
+		if now.After(until) {
+			delete(l.revoked, id)
+		}
+	}
+}
+
+type memoryRefreshToken struct {
+	token RefreshToken
+	used  bool
+}
+
+// MemoryRefreshStore keeps the refresh tokens in a map. It is lost on restart.
+type MemoryRefreshStore struct {
+	mu       sync.Mutex
+	tokens   map[string]*memoryRefreshToken
+	families *MemoryRevocationList
+}
+
+// NewMemoryRefreshStore returns an empty refresh token store
+func NewMemoryRefreshStore() *MemoryRefreshStore {
+	return &MemoryRefreshStore{
+		tokens:   map[string]*memoryRefreshToken{},
+		families: NewMemoryRevocationList(),
+	}
+}
+
+// Save stores a newly issued token
+func (s *MemoryRefreshStore) Save(ctx context.Context, token RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Hash] = &memoryRefreshToken{token: token}
+	s.prune()
+	return nil
+}
+
+// Get returns the token if it exists, has not expired and its family was not revoked
+func (s *MemoryRefreshStore) Get(ctx context.Context, hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, err := s.lookup(ctx, hash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	return stored.token, nil
+}
+
+// Use marks the token as used, a token can only be used once
+func (s *MemoryRefreshStore) Use(ctx context.Context, hash string) (RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, err := s.lookup(ctx, hash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if stored.used {
+		return stored.token, ErrRefreshTokenReused
+	}
+	stored.used = true
+	return stored.token, nil
+}
+
+// RevokeFamily revokes all tokens sharing the family
+func (s *MemoryRefreshStore) RevokeFamily(ctx context.Context, family string, until time.Time) error {
+	return s.families.Revoke(ctx, family, until)
+}
+
+// the caller holds the lock
+func (s *MemoryRefreshStore) lookup(ctx context.Context, hash string) (*memoryRefreshToken, error) {
+	stored, ok := s.tokens[hash]
+	if !ok || time.Now().After(stored.token.ExpiresAt) {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if revoked, _ := s.families.IsRevoked(ctx, stored.token.Family); revoked {
+		return nil, ErrRefreshTokenRevoked
+	}
+	return stored, nil
+}
+
+// removes the expired tokens, the caller holds the lock
+func (s *MemoryRefreshStore) prune() {
+	now := time.Now()
+	for hash, stored := range s.tokens {
+		if now.After(stored.token.ExpiresAt) {
+			delete(s.tokens, hash)
+		}
+	}
+}
+
+// MemorySessionStore keeps the sessions in a map. It is lost on restart.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]Session
+}
+
+// NewMemorySessionStore returns an empty session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: map[string]Session{},
+	}
+}
+
+// Save creates or replaces the session
+func (s *MemorySessionStore) Save(ctx context.Context, session Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	s.prune()
+	return nil
+}
+
+// Get returns the session if it has not expired
+func (s *MemorySessionStore) Get(ctx context.Context, id string) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.sessions[id]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return Session{}, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+// ListBySubject returns the sessions of the user, the last seen first
+func (s *MemorySessionStore) ListBySubject(ctx context.Context, subject string) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		if session.Subject == subject {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// Delete removes the session
+func (s *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+// removes the expired sessions, the caller holds the lock
+func (s *MemorySessionStore) prune() {
+	now := time.Now()
+	for id, session := range s.sessions {
+		if now.After(session.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package tokenstore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryRefreshStore(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryRefreshStore()
+	family := NewFamily()
+
+	token, hash := NewRefreshToken()
+	if HashRefreshToken(token) != hash {
+		t.Fatalf("Hash must be reproducible from the token")
+	}
+	store.Save(ctx, RefreshToken{Hash: hash, Family: family, Subject: "abc12", ExpiresAt: time.Now().Add(time.Hour)})
+
+	used, err := store.Use(ctx, hash)
+	if err != nil || used.Subject != "abc12" {
+		t.Fatalf("First use must succeed, got %v", err)
+	}
+	if _, err := store.Use(ctx, hash); err != ErrRefreshTokenReused {
+		t.Fatalf("Second use must be detected, got %v", err)
+	}
+
+	_, next := NewRefreshToken()
+	store.Save(ctx, RefreshToken{Hash: next, Family: family, Subject: "abc12", ExpiresAt: time.Now().Add(time.Hour)})
+	store.RevokeFamily(ctx, family, time.Now().Add(time.Hour))
+	if _, err := store.Use(ctx, next); err != ErrRefreshTokenRevoked {
+		t.Fatalf("Tokens of a revoked family must be rejected, got %v", err)
+	}
+
+	_, expired := NewRefreshToken()
+	store.Save(ctx, RefreshToken{Hash: expired, Family: NewFamily(), ExpiresAt: time.Now().Add(-time.Second)})
+	if _, err := store.Get(ctx, expired); err != ErrRefreshTokenNotFound {
+		t.Fatalf("Expired tokens must not be found, got %v", err)
+	}
+}
+
+func TestMemoryRevocationList(t *testing.T) {
+	ctx := context.Background()
+	list := NewMemoryRevocationList()
+	list.Revoke(ctx, "jti-1", time.Now().Add(time.Minute))
+	list.Revoke(ctx, "jti-2", time.Now().Add(-time.Minute))
+
+	if revoked, _ := list.IsRevoked(ctx, "jti-1"); !revoked {
+		t.Fatalf("jti-1 must be revoked")
+	}
+	if revoked, _ := list.IsRevoked(ctx, "jti-2"); revoked {
+		t.Fatalf("Entries must expire")
+	}
+	if revoked, _ := list.IsRevoked(ctx, "jti-3"); revoked {
+		t.Fatalf("Unknown ids are not revoked")
+	}
+}
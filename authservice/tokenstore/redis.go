@@ -0,0 +1,228 @@
+package tokenstore
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisRevocationList keeps every revoked id as its own key which expires together with the token.
+// All instances sharing the Redis see the same list.
+type RedisRevocationList struct {
+	rdbi   *redis.Client
+	prefix string
+}
+
+// NewRedisRevocationList returns a revocation list stored in Redis
+func NewRedisRevocationList(instance *redis.Client) *RedisRevocationList {
+	return &RedisRevocationList{
+		rdbi:   instance,
+		prefix: "revoked:",
+	}
+}
+
+// Revoke adds the id to the list until the given time
+func (l *RedisRevocationList) Revoke(ctx context.Context, id string, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+	return l.rdbi.Set(ctx, l.prefix+id, 1, ttl).Err()
+}
+
+// IsRevoked checks if the id is on the list
+func (l *RedisRevocationList) IsRevoked(ctx context.Context, id string) (bool, error) {
+	count, err := l.rdbi.Exists(ctx, l.prefix+id).Result()
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// RedisRefreshStore keeps each refresh token as a Redis hash expiring with the token
+type RedisRefreshStore struct {
+	rdbi     *redis.Client
+	families *RedisRevocationList
+}
+
+// NewRedisRefreshStore returns a refresh token store in Redis
+func NewRedisRefreshStore(instance *redis.Client) *RedisRefreshStore {
+	return &RedisRefreshStore{
+		rdbi: instance,
+		families: &RedisRevocationList{
+			rdbi:   instance,
+			prefix: "refresh-family-revoked:",
+		},
+	}
+}
+
+func refreshKey(hash string) string {
+	return "refresh:" + hash
+}
+
+// Save stores a newly issued token
+func (s *RedisRefreshStore) Save(ctx context.Context, token RefreshToken) error {
+	tokenJson, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	key := refreshKey(token.Hash)
+	_, err = s.rdbi.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, "token", tokenJson, "uses", 0)
+		pipe.ExpireAt(ctx, key, token.ExpiresAt)
+		return nil
+	})
+	return err
+}
+
+// Get returns the token if it exists, has not expired and its family was not revoked
+func (s *RedisRefreshStore) Get(ctx context.Context, hash string) (RefreshToken, error) {
+	tokenJson, err := s.rdbi.HGet(ctx, refreshKey(hash), "token").Result()
+	if err == redis.Nil {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	var token RefreshToken
+	if err := json.Unmarshal([]byte(tokenJson), &token); err != nil {
+		return RefreshToken{}, err
+	}
+	token.Hash = hash
+
+	revoked, err := s.families.IsRevoked(ctx, token.Family)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if revoked {
+		return RefreshToken{}, ErrRefreshTokenRevoked
+	}
+	return token, nil
+}
+
+// increments the counter only while the token is still there. A plain HINCRBY on a key
+// that just expired would create it again, without a TTL.
+var useRefreshScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return false
+end
+return redis.call("HINCRBY", KEYS[1], "uses", 1)
+`)
+
+// Use marks the token as used. The counter is incremented atomically, so two
+// concurrent requests with the same token cannot both succeed.
+func (s *RedisRefreshStore) Use(ctx context.Context, hash string) (RefreshToken, error) {
+	token, err := s.Get(ctx, hash)
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	uses, err := useRefreshScript.Run(ctx, s.rdbi, []string{refreshKey(hash)}).Int64()
+	if err == redis.Nil {
+		return RefreshToken{}, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return RefreshToken{}, err
+	}
+	if uses > 1 {
+		return token, ErrRefreshTokenReused
+	}
+	return token, nil
+}
+
+// RevokeFamily revokes all tokens sharing the family
+func (s *RedisRefreshStore) RevokeFamily(ctx context.Context, family string, until time.Time) error {
+	return s.families.Revoke(ctx, family, until)
+}
+
+// RedisSessionStore keeps each session as a key expiring with the session, and a set
+// of the session ids of each user to list them
+type RedisSessionStore struct {
+	rdbi *redis.Client
+}
+
+// NewRedisSessionStore returns a session store in Redis
+func NewRedisSessionStore(instance *redis.Client) *RedisSessionStore {
+	return &RedisSessionStore{rdbi: instance}
+}
+
+func sessionKey(id string) string {
+	return "session:" + id
+}
+
+func subjectSessionsKey(subject string) string {
+	return "sessions:" + subject
+}
+
+// Save creates or replaces the session
+func (s *RedisSessionStore) Save(ctx context.Context, session Session) error {
+	sessionJson, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	_, err = s.rdbi.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, sessionKey(session.ID), sessionJson, time.Until(session.ExpiresAt))
+		pipe.SAdd(ctx, subjectSessionsKey(session.Subject), session.ID)
+		// the set lives as long as the newest session of the user
+		pipe.ExpireAt(ctx, subjectSessionsKey(session.Subject), session.ExpiresAt)
+		return nil
+	})
+	return err
+}
+
+// Get returns the session if it has not expired
+func (s *RedisSessionStore) Get(ctx context.Context, id string) (Session, error) {
+	sessionJson, err := s.rdbi.Get(ctx, sessionKey(id)).Result()
+	if err == redis.Nil {
+		return Session{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	var session Session
+	if err := json.Unmarshal([]byte(sessionJson), &session); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
+
+// ListBySubject returns the sessions of the user, the last seen first.
+// Ids of expired sessions are dropped from the set on the way.
+func (s *RedisSessionStore) ListBySubject(ctx context.Context, subject string) ([]Session, error) {
+	ids, err := s.rdbi.SMembers(ctx, subjectSessionsKey(subject)).Result()
+	if err != nil {
+		return nil, err
+	}
+	sessions := []Session{}
+	for _, id := range ids {
+		session, err := s.Get(ctx, id)
+		if err == ErrSessionNotFound {
+			s.rdbi.SRem(ctx, subjectSessionsKey(subject), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+// Delete removes the session
+func (s *RedisSessionStore) Delete(ctx context.Context, id string) error {
+	session, err := s.Get(ctx, id)
+	if err == ErrSessionNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.rdbi.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, sessionKey(id))
+		pipe.SRem(ctx, subjectSessionsKey(session.Subject), id)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,108 @@
+// Package tokenstore keeps the server side state of our tokens: refresh tokens and revoked token ids.
+// Every store has an in-memory implementation for a single instance and a Redis one for several instances.
+package tokenstore
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenReused   = errors.New("refresh token was already used")
+	ErrRefreshTokenRevoked  = errors.New("refresh token was revoked")
+	ErrSessionNotFound      = errors.New("session not found")
+)
+
+// RevocationList holds ids of tokens that must no longer be accepted, eg. the jti of an access token.
+// Entries only need to live until the token would have expired anyway.
+type RevocationList interface {
+	Revoke(ctx context.Context, id string, until time.Time) error
+	IsRevoked(ctx context.Context, id string) (bool, error)
+}
+
+// RefreshToken is what we remember about an issued refresh token. The token itself is never stored, only its hash.
+// All tokens rotated from the same signin share a Family, so a stolen token can be revoked with all its successors.
+type RefreshToken struct {
+	Hash      string    `json:"-"`
+	Family    string    `json:"family"`
+	Subject   string    `json:"subject"`
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// AMR of the signin, the access tokens of the family keep it
+	AMR []string `json:"amr,omitempty"`
+}
+
+// RefreshStore keeps the refresh tokens. Each token can be used once.
+type RefreshStore interface {
+	Save(ctx context.Context, token RefreshToken) error
+	// Get returns the token without using it
+	Get(ctx context.Context, hash string) (RefreshToken, error)
+	// Use marks the token as used and returns it. A second use returns ErrRefreshTokenReused.
+	Use(ctx context.Context, hash string) (RefreshToken, error)
+	// RevokeFamily makes every token of the family unusable
+	RevokeFamily(ctx context.Context, family string, until time.Time) error
+}
+
+// Session is a signin as the user sees it: one device, from the signin until the refresh tokens run out.
+// Its ID is the family of the refresh tokens, and the access tokens carry it as their sid.
+type Session struct {
+	ID         string    `json:"id"`
+	Subject    string    `json:"subject"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// ExpiresAt moves with every refresh, like the expiry of the refresh token
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SessionStore keeps the sessions of the users
+type SessionStore interface {
+	// Save creates the session or replaces it
+	Save(ctx context.Context, session Session) error
+	Get(ctx context.Context, id string) (Session, error)
+	// ListBySubject returns the sessions of the user that have not expired, the last seen first
+	ListBySubject(ctx context.Context, subject string) ([]Session, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// SessionRevocation is the id on the RevocationList that revokes the access tokens of a session
+func SessionRevocation(id string) string {
+	return "session:" + id
+}
+
+// sortSessions puts the last seen session first
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenAt.After(sessions[j].LastSeenAt)
+	})
+}
+
+// NewRefreshToken returns a random refresh token and the hash to store
+func NewRefreshToken() (string, string) {
+	raw := make([]byte, 32)
+	rand.Read(raw)
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	return token, HashRefreshToken(token)
+}
+
+// HashRefreshToken hashes the token for the store. The token is random, a plain SHA-256 is enough.
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewFamily returns a random id for a new family of refresh tokens
+func NewFamily() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
@@ -0,0 +1,131 @@
+// Package totp implements the time-based one-time passwords of RFC 6238, as shown
+// by authenticator apps, and the recovery codes for users who lost their device.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the parameters every authenticator app supports
+const (
+	Digits = 6
+	Period = 30 * time.Second
+	// Skew is the number of periods before and after now we accept, for clocks that are a little off
+	Skew = 1
+	// secrets of 160 bits, the size of the SHA-1 output recommended by RFC 4226
+	secretSize = 20
+)
+
+// the apps show the secret in base32 without padding
+var secretEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateSecret returns a new random secret, base32 encoded
+func GenerateSecret() (string, error) {
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return secretEncoding.EncodeToString(secret), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	return secretEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+}
+
+// hotp is the HOTP value of RFC 4226 for the counter
+func hotp(key []byte, counter uint64, digits int) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// Step is the number of the period t falls into
+func Step(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// Code returns the code of the secret at the time
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(Step(t)), Digits), nil
+}
+
+// Validate checks the code against the periods around t. It returns the step the code
+// belongs to. A code is only valid once: callers store the step and pass it as lastStep,
+// codes of that step or earlier are rejected.
+func Validate(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != Digits {
+		return 0, false
+	}
+	now := Step(t)
+	for step := now - Skew; step <= now+Skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step), Digits)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI is the otpauth URI of the key uri format, apps import it from a QR code
+func ProvisioningURI(secret string, issuer string, account string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(Digits))
+	values.Set("period", fmt.Sprint(int(Period/time.Second)))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// GenerateRecoveryCodes returns n codes like "k3f9-x2qa-7mwd". They are shown to the user once,
+// only HashRecoveryCode of them is stored.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		raw := make([]byte, 8)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(secretEncoding.EncodeToString(raw))[:12]
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12]
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode returns the stored form of the code. The codes are random enough
+// that a fast hash is fine. Dashes and case are ignored, users type them differently.
+func HashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,72 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// the SHA-1 test vectors of RFC 6238 appendix B, with the 8 digits used there
+func TestRFC6238Vectors(t *testing.T) {
+	key := []byte("12345678901234567890")
+	vectors := map[int64]string{
+		59:          "94287082",
+		1111111109:  "07081804",
+		1111111111:  "14050471",
+		1234567890:  "89005924",
+		2000000000:  "69279037",
+		20000000000: "65353130",
+	}
+	for unix, expected := range vectors {
+		if code := hotp(key, uint64(Step(time.Unix(unix, 0))), 8); code != expected {
+			t.Fatalf("Expected %s at %d, got %s", expected, unix, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil || len(secret) != 32 {
+		t.Fatalf("Unexpected secret %q %v", secret, err)
+	}
+	now := time.Unix(1631600786, 0)
+	code, _ := Code(secret, now)
+
+	step, ok := Validate(secret, code, now, 0)
+	if !ok || step != Step(now) {
+		t.Fatalf("The current code must be valid")
+	}
+	if _, ok := Validate(secret, code, now.Add(Period), 0); !ok {
+		t.Fatalf("The code of the last period must be valid")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period), 0); ok {
+		t.Fatalf("Old codes must be rejected")
+	}
+	if _, ok := Validate(secret, code, now, step); ok {
+		t.Fatalf("A used code must be rejected")
+	}
+	if _, ok := Validate(strings.ToLower(secret), code, now, 0); !ok {
+		t.Fatalf("Secrets typed in lowercase must work")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	codes, _ := GenerateRecoveryCodes(10)
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 14 || seen[code] {
+			t.Fatalf("Unexpected code %q", code)
+		}
+		seen[code] = true
+	}
+	if HashRecoveryCode(codes[0]) != HashRecoveryCode(strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))) {
+		t.Fatalf("Dashes and case must not matter")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("JBSWY3DPEHPK3PXP", "knowsearch.ml", "abc@gmail.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/knowsearch.ml:abc@gmail.com?") || !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Fatalf("Unexpected URI %s", uri)
+	}
+}
@@ -0,0 +1,97 @@
+package authservice
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"go.uber.org/zap"
+)
+
+// consumers may cache the keys for this long. Retired keys stay published
+// much longer than this, so a cached document never misses a key still in use.
+const jwksMaxAge = 300
+
+// baseURL is where the auth routes are reachable from outside. It comes from AUTH_BASE_URL only,
+// never from the Host of the request: anybody can set that, and the discovery document is cached
+// by proxies and the links in our mails carry tokens.
+func baseURL() string {
+	if base := os.Getenv("AUTH_BASE_URL"); base != "" {
+		return base
+	}
+	return "http://localhost:9090/auth"
+}
+
+// discoveryDocument is the OpenID style metadata pointing consumers to our keys
+type discoveryDocument struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	UserinfoEndpoint                 string   `json:"userinfo_endpoint"`
+	IntrospectionEndpoint            string   `json:"introspection_endpoint"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+}
+
+// WellKnownController serves the public keys and the discovery document
+type WellKnownController struct {
+	logger  *zap.Logger
+	keyring *jwt.Keyring
+	tokens  *tokenconfig.Config
+}
+
+// NewWellKnownController returns a frsh WellKnown controller
+func NewWellKnownController(logger *zap.Logger, keyring *jwt.Keyring, tokens *tokenconfig.Config) *WellKnownController {
+	return &WellKnownController{
+		logger:  logger,
+		keyring: keyring,
+		tokens:  tokens,
+	}
+}
+
+// JWKSHandler serves the current and recently retired public keys as a JWK Set
+func (ctrl *WellKnownController) JWKSHandler(rw http.ResponseWriter, r *http.Request) {
+	body, err := json.Marshal(ctrl.keyring.JWKS())
+	if err != nil {
+		ctrl.logger.Error("Unable to encode the JWKS", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	writeCacheable(rw, r, body)
+}
+
+// DiscoveryHandler serves the issuer and the location of the JWKS, userinfo and introspection
+func (ctrl *WellKnownController) DiscoveryHandler(rw http.ResponseWriter, r *http.Request) {
+	base := baseURL()
+	body, err := json.Marshal(discoveryDocument{
+		Issuer:                           ctrl.tokens.Issuer,
+		JWKSURI:                          base + "/.well-known/jwks.json",
+		UserinfoEndpoint:                 base + "/userinfo",
+		IntrospectionEndpoint:            base + "/introspect",
+		IDTokenSigningAlgValuesSupported: []string{ctrl.keyring.SigningKey().Algorithm},
+	})
+	if err != nil {
+		ctrl.logger.Error("Unable to encode the discovery document", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	writeCacheable(rw, r, body)
+}
+
+// writes the JSON body with cache headers. The ETag lets consumers revalidate cheaply after a rotation.
+func writeCacheable(rw http.ResponseWriter, r *http.Request, body []byte) {
+	etag := fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+	rw.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", jwksMaxAge))
+	rw.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		rw.WriteHeader(http.StatusNotModified)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(body)
+}
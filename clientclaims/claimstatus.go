@@ -4,11 +4,15 @@ import (
 	"compress/gzip"
 	"io/ioutil"
 	"net/http"
+	"path/filepath"
 	"strings"
 
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
 	"go.uber.org/zap"
 )
 
+const claimStatusDir = "./clientclaims/claimstatusdir/"
+
 // DownloadController is the Download route handler
 type DownloadController struct {
 	logger *zap.Logger
@@ -22,15 +26,17 @@ func NewDownloadController(logger *zap.Logger) *DownloadController {
 }
 
 func (ctrl *DownloadController) DownloadFile(rw http.ResponseWriter, r *http.Request) {
-	if _, ok := r.Header["Email"]; !ok {
-		ctrl.logger.Warn("Email was not found in the header")
-		rw.WriteHeader(http.StatusBadRequest)
-		rw.Write([]byte("Email Missing"))
+	// the email comes from the validated token. A header could be set to anyone's email.
+	email := middleware.EmailFromContext(r.Context())
+	if email == "" {
+		ctrl.logger.Warn("No verified email for the request")
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Email Missing in Token"))
 		return
 	}
 
-	fileName := strings.Replace(r.Header["Email"][0], ".", "_", -1)
-	files, err := ioutil.ReadDir("./clientclaims/claimstatusdir/")
+	fileName := strings.Replace(email, ".", "_", -1)
+	files, err := ioutil.ReadDir(claimStatusDir)
 	if err != nil {
 		ctrl.logger.Error("Unable to read the claim directory", zap.Error(err))
 		rw.WriteHeader(http.StatusInternalServerError)
@@ -39,51 +45,35 @@ func (ctrl *DownloadController) DownloadFile(rw http.ResponseWriter, r *http.Req
 	}
 
 	for _, claim := range files {
-		if strings.Contains(claim.Name(), fileName) {
-			writer := gzip.NewWriter(rw)
-			writer.Name = "claim-status.jpg"
-			writer.Comment = "Status of your Claim from the Accounting department"
-
-			fileContent, err := ioutil.ReadFile(claim.Name())
+		// the whole name without the extension has to match, otherwise "c@example_com"
+		// would get the claim of "abc@example_com"
+		if strings.TrimSuffix(claim.Name(), filepath.Ext(claim.Name())) == fileName {
+			fileContent, err := ioutil.ReadFile(filepath.Join(claimStatusDir, claim.Name()))
 			if err != nil {
 				ctrl.logger.Error("Unable to read file", zap.String("file", claim.Name()), zap.Error(err))
 				rw.WriteHeader(http.StatusInternalServerError)
 				rw.Write([]byte("Unable to read the claim file"))
-
-				err := closeGzipStream(writer)
-				if err != nil {
-					ctrl.logger.Error("Unable to close gzip stream", zap.String("file", claim.Name()), zap.Error(err))
-					rw.WriteHeader(http.StatusInternalServerError)
-					rw.Write([]byte("Unable to read the claim file"))
-					return
-				}
 				return
 			}
+
+			rw.Header().Set("Content-Type", "application/gzip")
+			rw.WriteHeader(http.StatusOK)
+			writer := gzip.NewWriter(rw)
+			writer.Name = "claim-status.jpg"
+			writer.Comment = "Status of your Claim from the Accounting department"
+
 			_, err = writer.Write(fileContent)
 			if err != nil {
+				// the status is already sent, all we can do is log it
 				ctrl.logger.Error("Unable to write the Gzipped File", zap.String("file", claim.Name()), zap.Error(err))
-				rw.WriteHeader(http.StatusInternalServerError)
-				rw.Write([]byte("Error writing the Gzipped File"))
-
-				err := closeGzipStream(writer)
-				if err != nil {
-					ctrl.logger.Error("Unable to close the gzip stream", zap.String("file", claim.Name()), zap.Error(err))
-					rw.WriteHeader(http.StatusInternalServerError)
-					rw.Write([]byte("Unable to read the claim file"))
-					return
-				}
-				return
 			}
 			err = closeGzipStream(writer)
 			if err != nil {
 				ctrl.logger.Error("Unable to close the gzip stream", zap.String("file", claim.Name()), zap.Error(err))
-				rw.WriteHeader(http.StatusInternalServerError)
-				rw.Write([]byte("Unable to read the claim file"))
 				return
 			}
 			ctrl.logger.Info("File Gzipped and Downloaded", zap.String("file", claim.Name()))
-			rw.WriteHeader(http.StatusOK)
-			rw.Write([]byte("File Gzipped and Downloaded"))
+			return
 		}
 	}
 	ctrl.logger.Warn("Claim not yet generated", zap.Int("nbFile", len(files)))
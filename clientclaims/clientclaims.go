@@ -1,11 +1,13 @@
 package clientclaims
 
 import (
-	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 
+	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
 	"go.uber.org/zap"
 )
 
@@ -21,8 +23,18 @@ func NewUploadController(logger *zap.Logger) *UploadController {
 	}
 }
 
+const saveImgDir = "./clientclaims/saveimgdir/"
+
 // Upload File Handler
 func (ctrl *UploadController) UploadFile(rw http.ResponseWriter, r *http.Request) {
+	// the upload is stored under the verified email of the caller, never under a name chosen by the client
+	email := middleware.EmailFromContext(r.Context())
+	if email == "" {
+		ctrl.logger.Warn("No verified email for the request")
+		rw.WriteHeader(http.StatusUnauthorized)
+		rw.Write([]byte("Email Missing in Token"))
+		return
+	}
 
 	// Create a MultiPart form with size of 128 KB main memory
 	err := r.ParseMultipartForm(128 * 1024)
@@ -43,17 +55,24 @@ func (ctrl *UploadController) UploadFile(rw http.ResponseWriter, r *http.Request
 		return
 	}
 
+	defer file.Close()
+
+	// only the extension is taken from the uploaded file name. The name itself could contain "../"
+	fileName := strings.Replace(email, ".", "_", -1) + filepath.Ext(filepath.Base(handler.Filename))
+	filePath := filepath.Join(saveImgDir, fileName)
+
 	//create the file in the directory and copy the file to the folder
-	f, err := os.OpenFile("./clientclaims/saveimgdir/"+handler.Filename, os.O_WRONLY|os.O_CREATE, 0666)
+	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		ctrl.logger.Warn("Unable to create file", zap.String("file", fmt.Sprintf("./clientclaims/saveimgdir/%s", handler.Filename)), zap.Error(err))
+		ctrl.logger.Warn("Unable to create file", zap.String("file", filePath), zap.Error(err))
 		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Unable to save the file to the servers disk"))
 		return
 	}
+	defer f.Close()
 	io.Copy(f, file)
 
-	ctrl.logger.Info("File Uploaded Successfully", zap.String("file", fmt.Sprintf("./clientclaims/saveimgdir/%s", handler.Filename)))
+	ctrl.logger.Info("File Uploaded Successfully", zap.String("file", filePath), zap.String("email", email))
 	// this means file upload successful
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte("File Uploaded Successfully"))
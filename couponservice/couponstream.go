@@ -207,7 +207,7 @@ func (ctrl *StreamController) GetCouponForInternalValidation(rw http.ResponseWri
 }
 
 // Lets assume that at any moment, You want to purge the stream. We need a method for that too.
-// We should use role authentication here.
+// The route requires the coupon:purge permission, which only admins have.
 func (ctrl *StreamController) PurgeStream(rw http.ResponseWriter, r *http.Request) {
 	//Lets take in the region
 	if _, ok := r.Header["Region"]; !ok {
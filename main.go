@@ -1,23 +1,38 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 
 	gohandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/shadowshot-x/micro-product-go/authservice"
+	"github.com/shadowshot-x/micro-product-go/authservice/audit"
+	"github.com/shadowshot-x/micro-product-go/authservice/clients"
+	"github.com/shadowshot-x/micro-product-go/authservice/data"
+	"github.com/shadowshot-x/micro-product-go/authservice/jwt"
+	"github.com/shadowshot-x/micro-product-go/authservice/lockout"
+	"github.com/shadowshot-x/micro-product-go/authservice/mailer"
 	"github.com/shadowshot-x/micro-product-go/authservice/middleware"
+	"github.com/shadowshot-x/micro-product-go/authservice/oidc"
+	"github.com/shadowshot-x/micro-product-go/authservice/password"
+	"github.com/shadowshot-x/micro-product-go/authservice/redact"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenconfig"
+	"github.com/shadowshot-x/micro-product-go/authservice/tokenstore"
 	"github.com/shadowshot-x/micro-product-go/clientclaims"
 	"github.com/shadowshot-x/micro-product-go/couponservice"
 	"github.com/shadowshot-x/micro-product-go/monitormodule"
 	"github.com/shadowshot-x/micro-product-go/ordertransformerservice"
 	"github.com/shadowshot-x/micro-product-go/productservice"
+	productstore "github.com/shadowshot-x/micro-product-go/productservice/store"
 	"go.uber.org/zap"
 )
 
@@ -43,6 +58,8 @@ func simplePostHandler(rw http.ResponseWriter, r *http.Request) {
 
 func main() {
 	log, _ := zap.NewProduction()
+	// tokens, passwords and secrets passed to the logger are masked
+	log = log.WithOptions(redact.Option())
 	defer log.Sync()
 
 	log.Info("Starting...")
@@ -59,22 +76,159 @@ func main() {
 		return
 	}
 
+	// the keyring holds the key we sign tokens with and all keys we still accept
+	keyring, err := jwt.KeyringFromEnv()
+	if err != nil {
+		log.Error("Unable to load the JWT keys", zap.Error(err))
+		return
+	}
+	// replacing the JWT_SIGNING_KEY file and sending SIGHUP rotates the signing key.
+	// The previous key keeps verifying the tokens that are still in flight.
+	rotate := make(chan os.Signal, 1)
+	signal.Notify(rotate, syscall.SIGHUP)
+	go func() {
+		for range rotate {
+			if err := keyring.RotateFromEnv(); err != nil {
+				log.Error("Unable to rotate the signing key", zap.Error(err))
+				continue
+			}
+			log.Info("Signing key rotated", zap.String("kid", keyring.SigningKey().ID))
+		}
+	}()
+
 	mainRouter := mux.NewRouter()
 
-	suc := authservice.NewSignupController(log)
-	sic := authservice.NewSigninController(log)
+	redisInstance := couponservice.RedisInstanceGenerator(log)
+
+	// refresh tokens, sessions and revoked tokens have to be shared by all instances, so they live in Redis.
+	// Without Redis we keep them in memory, which is fine for a single instance.
+	var refreshStore tokenstore.RefreshStore = tokenstore.NewMemoryRefreshStore()
+	var sessionStore tokenstore.SessionStore = tokenstore.NewMemorySessionStore()
+	var revocations tokenstore.RevocationList = tokenstore.NewMemoryRevocationList()
+	// failed signins are counted per account and per IP, the requested reset mails as well
+	var accountTracker, ipTracker, mailTracker, mailIPTracker lockout.Tracker
+	if redisInstance != nil {
+		refreshStore = tokenstore.NewRedisRefreshStore(redisInstance)
+		sessionStore = tokenstore.NewRedisSessionStore(redisInstance)
+		revocations = tokenstore.NewRedisRevocationList(redisInstance)
+		accountTracker = lockout.NewRedisTracker(redisInstance, "lockout:account:", lockout.DefaultAccountPolicy())
+		ipTracker = lockout.NewRedisTracker(redisInstance, "lockout:ip:", lockout.DefaultIPPolicy())
+		mailTracker = lockout.NewRedisTracker(redisInstance, "lockout:mail:", lockout.DefaultMailPolicy())
+		mailIPTracker = lockout.NewRedisTracker(redisInstance, "lockout:mail-ip:", lockout.DefaultIPPolicy())
+	} else {
+		log.Warn("Redis is not available, refresh tokens, sessions, revocations and failed signins are kept in memory")
+		accountTracker = lockout.NewMemoryTracker(lockout.DefaultAccountPolicy())
+		ipTracker = lockout.NewMemoryTracker(lockout.DefaultIPPolicy())
+		mailTracker = lockout.NewMemoryTracker(lockout.DefaultMailPolicy())
+		mailIPTracker = lockout.NewMemoryTracker(lockout.DefaultIPPolicy())
+	}
+	signinGuard := lockout.NewGuard(accountTracker, ipTracker)
+	mailGuard := lockout.NewGuard(mailTracker, mailIPTracker)
+
+	// passwords are hashed with Argon2id by default, the PASSWORD_* variables tune it
+	passwordParams, err := password.ParamsFromEnv()
+	if err != nil {
+		log.Error("Invalid password hashing parameters", zap.Error(err))
+		return
+	}
+	hasher, err := password.NewHasher(passwordParams)
+	if err != nil {
+		log.Error("Unable to create the password hasher", zap.Error(err))
+		return
+	}
+
+	// the users live in MySQL next to the products when AUTH_USER_STORE=sql, otherwise in memory
+	defaultUsers := data.DefaultUsers()
+	for i := range defaultUsers {
+		defaultUsers[i].PasswordHash, err = hasher.Hash(defaultUsers[i].PasswordHash)
+		if err != nil {
+			log.Error("Unable to hash the default users", zap.Error(err))
+			return
+		}
+	}
+	var userStore data.UserStore = data.NewMemoryUserStore(defaultUsers...)
+	var apiKeyStore data.APIKeyStore = data.NewMemoryAPIKeyStore()
+	if os.Getenv("AUTH_USER_STORE") == "sql" {
+		sqlStore, err := data.OpenSQLUserStore(productservice.GetSecret())
+		if err != nil {
+			log.Error("Unable to open the user database", zap.Error(err))
+			return
+		}
+		userStore = sqlStore
+		apiKeyStore = sqlStore.APIKeys()
+	}
+
+	// the OAuth2 clients of the internal services, AUTH_CLIENTS_FILE points to their YAML file
+	clientStore, err := clients.StoreFromEnv()
+	if err != nil {
+		log.Error("Unable to load the clients", zap.Error(err))
+		return
+	}
+	// issuer, audiences and lifetimes of the tokens, AUTH_TOKEN_CONFIG points to their YAML file
+	tokenConfig, err := tokenconfig.FromEnv()
+	if err != nil {
+		log.Error("Unable to load the token config", zap.Error(err))
+		return
+	}
+	// a token accepted by two services could be replayed from one against the other
+	if err := tokenConfig.CheckServices("auth", "claims", "product", "coupon"); err != nil {
+		log.Error("Unsafe token config", zap.Error(err))
+		return
+	}
+	// staff can sign in at the identity provider of the company when OIDC_ISSUER is set
+	oidcConfig, oidcEnabled, err := oidc.ConfigFromEnv()
+	if err != nil {
+		log.Error("Unable to load the OIDC config", zap.Error(err))
+		return
+	}
+
+	// the audit log records who signed in and who changed what, AUDIT_LOG_FILE points to it
+	auditTrail, err := audit.FileFromEnv()
+	if err != nil {
+		log.Error("Unable to open the audit log", zap.Error(err))
+		return
+	}
+	defer auditTrail.Close()
+	if os.Getenv("AUDIT_KEY") == "" {
+		log.Warn("AUDIT_KEY is not set, anybody who can write the audit log can rebuild its chain")
+	}
+	if err := auditTrail.Verify(context.Background()); err != nil {
+		// we keep running, the admins have to look into it, but it must not go unnoticed
+		log.Error("The audit log was tampered with", zap.Error(err))
+	}
+	recorder := audit.NewRecorder(log, auditTrail)
+
+	mail := mailer.FromEnv(log)
+	suc := authservice.NewSignupController(log, userStore, hasher, keyring, tokenConfig, mail, recorder)
+	sic := authservice.NewSigninController(log, keyring, tokenConfig, refreshStore, sessionStore, userStore, hasher, signinGuard, recorder)
+	rc := authservice.NewRefreshController(log, keyring, tokenConfig, refreshStore, sessionStore, revocations, userStore)
+	wkc := authservice.NewWellKnownController(log, keyring, tokenConfig)
+	ac := authservice.NewAccountController(log, keyring, tokenConfig, userStore, hasher, refreshStore, sessionStore, revocations, mail, mailGuard, recorder)
+	mc := authservice.NewMFAController(log, keyring, tokenConfig, userStore, refreshStore, sessionStore, revocations, signinGuard, recorder)
+	tc := authservice.NewTokenController(log, keyring, tokenConfig, clientStore, hasher)
+	ic := authservice.NewIntrospectionController(log, keyring, tokenConfig, clientStore, hasher, revocations, userStore)
 	uc := clientclaims.NewUploadController(log)
 	dc := clientclaims.NewDownloadController(log)
-	tm := middleware.NewTokenMiddleware(log)
-	pc := productservice.NewProductController(log)
+	// partners can call with an api key instead of a token, browsers with the cookie if AUTH_COOKIES=true
+	tm := middleware.NewTokenMiddleware(log, keyring, revocations).AcceptAPIKeys(apiKeyStore, userStore).
+		AcceptCookies(middleware.CookiesFromEnv()).WithIssuer(tokenConfig.Issuer).ForAudience(tokenConfig.AudienceFor("auth"))
+	// AUTH_MFA_PERMISSIONS lists the permissions that need a signin with a second factor
+	policy := middleware.DefaultPolicy().RequireMFA(middleware.MFAPermissionsFromEnv()...)
+	am := middleware.NewAuthorizationMiddleware(log, policy)
+	akc := authservice.NewAPIKeyController(log, apiKeyStore, userStore, policy, recorder)
+	prc := authservice.NewProfileController(log, tokenConfig, userStore, hasher, refreshStore, sessionStore, revocations, signinGuard, recorder)
+	adc := authservice.NewAdminController(log, tokenConfig, userStore, refreshStore, sessionStore, revocations, recorder)
+	auc := authservice.NewAuditController(log, auditTrail)
+	sc := authservice.NewSessionController(log, tokenConfig, sessionStore, refreshStore, revocations, recorder)
+	pc := productservice.NewProductController(log, productstore.NewMemoryStore())
 	transc := ordertransformerservice.NewTransformerController(log)
 
-	redisInstance := couponservice.RedisInstanceGenerator(log)
 	cc := couponservice.NewCouponStreamController(log, redisInstance)
 
 	// ping function
 	mainRouter.HandleFunc("/ping", PingHandler)
-	mainRouter.HandleFunc("/checkRoutine", simplePostHandler).Methods("POST")
+	// only the monitor module posts its metrics here, with a client token
+	mainRouter.Handle("/checkRoutine", tm.RequireScope(middleware.ScopeMonitorWrite)(http.HandlerFunc(simplePostHandler))).Methods("POST")
 
 	// We will create a Subrouter for Authentication service
 	// route for sign up and signin. The Function will come from auth-service package
@@ -85,35 +239,148 @@ func main() {
 	// The Signin will send the JWT Token back as we are making microservices.
 	// JWT token will make sure that other services are protected.
 	// So, ultimately, we would need a middleware
-	authRouter.HandleFunc("/signin", sic.SigninHandler).Methods("GET")
+	// The password is sent in the body, which is why this is a POST.
+	// Clients still sending the headers signed in with a GET before, so it stays for them.
+	signinMethods := []string{"POST"}
+	if os.Getenv("AUTH_LEGACY_HEADERS") == "true" {
+		signinMethods = append(signinMethods, "GET")
+	}
+	authRouter.HandleFunc("/signin", sic.SigninHandler).Methods(signinMethods...)
+
+	// The access token from signin is short lived. The refresh token returned with it
+	// gets a new pair, and logout revokes both.
+	authRouter.HandleFunc("/refresh", rc.RefreshHandler).Methods("POST")
+	authRouter.Handle("/logout", tm.RequireUserToken(http.HandlerFunc(rc.LogoutHandler))).Methods("POST")
+
+	// New accounts are pending until the link in the verification mail is opened.
+	// A forgotten password is replaced with the token of the reset mail.
+	authRouter.HandleFunc("/verify", ac.VerifyHandler).Methods("GET", "POST")
+	authRouter.HandleFunc("/password/forgot", ac.ForgotPasswordHandler).Methods("POST")
+	authRouter.HandleFunc("/password/reset", ac.ResetPasswordHandler).Methods("POST")
+
+	// OpenID Connect login, the provider sends the browser back to the callback with a code.
+	// New users are created on their first login.
+	if oidcEnabled {
+		oc := authservice.NewOIDCController(log, oidc.NewProvider(oidcConfig, nil), keyring, tokenConfig, refreshStore, sessionStore, revocations, userStore, recorder)
+		authRouter.HandleFunc("/oidc/login", oc.LoginHandler).Methods("GET")
+		authRouter.HandleFunc("/oidc/callback", oc.CallbackHandler).Methods("GET")
+	}
+
+	// TOTP two-factor authentication. With MFA enabled the signin returns a challenge
+	// that is exchanged for the tokens together with a code at /signin/mfa.
+	authRouter.HandleFunc("/signin/mfa", mc.SigninMFAHandler).Methods("POST")
+	authRouter.Handle("/mfa/enroll", tm.RequireUserToken(http.HandlerFunc(mc.EnrollHandler))).Methods("POST")
+	authRouter.Handle("/mfa/confirm", tm.RequireUserToken(http.HandlerFunc(mc.ConfirmHandler))).Methods("POST")
+	authRouter.Handle("/mfa/disable", tm.RequireUserToken(http.HandlerFunc(mc.DisableHandler))).Methods("POST")
+
+	// Long lived api keys for partners. Managing them needs a signin, a key cannot create keys.
+	authRouter.Handle("/apikeys", tm.RequireUserToken(http.HandlerFunc(akc.CreateHandler))).Methods("POST")
+	authRouter.Handle("/apikeys", tm.RequireUserToken(http.HandlerFunc(akc.ListHandler))).Methods("GET")
+	authRouter.Handle("/apikeys/{id:[0-9]+}", tm.RequireUserToken(http.HandlerFunc(akc.RevokeHandler))).Methods("DELETE")
+
+	// Every signin is a session. Users see where they are signed in and sign out other devices.
+	authRouter.Handle("/sessions", tm.RequireUserToken(http.HandlerFunc(sc.ListHandler))).Methods("GET")
+	authRouter.Handle("/sessions", tm.RequireUserToken(http.HandlerFunc(sc.RevokeOthersHandler))).Methods("DELETE")
+	authRouter.Handle("/sessions/{id}", tm.RequireUserToken(http.HandlerFunc(sc.RevokeHandler))).Methods("DELETE")
+
+	// The signed in user looks at their profile, changes the full name and the password
+	authRouter.Handle("/me", tm.TokenValidationMiddleware(http.HandlerFunc(prc.MeHandler))).Methods("GET")
+	authRouter.Handle("/me", tm.RequireUserToken(http.HandlerFunc(prc.UpdateMeHandler))).Methods("PATCH")
+	authRouter.Handle("/me/password", tm.RequireUserToken(http.HandlerFunc(prc.ChangePasswordHandler))).Methods("POST")
+	// the same profile in the claims of OpenID Connect, for consumers of our tokens
+	authRouter.Handle("/userinfo", tm.RequireUserToken(http.HandlerFunc(prc.UserInfoHandler))).Methods("GET", "POST")
+
+	// Admins manage the users. They have to sign in for it, api keys are not accepted here.
+	adminOnly := func(handler http.HandlerFunc) http.Handler {
+		return tm.RequireUserToken(am.RequireRole(data.RoleName(data.RoleAdmin))(handler))
+	}
+	adminRouter := authRouter.PathPrefix("/admin").Subrouter()
+	adminRouter.Handle("/users", adminOnly(adc.ListUsersHandler)).Methods("GET")
+	adminRouter.Handle("/users/{id:[0-9]+}", adminOnly(adc.GetUserHandler)).Methods("GET")
+	adminRouter.Handle("/users/{id:[0-9]+}", adminOnly(adc.DeleteUserHandler)).Methods("DELETE")
+	adminRouter.Handle("/users/{id:[0-9]+}/role", adminOnly(adc.UpdateRoleHandler)).Methods("PATCH")
+	adminRouter.Handle("/users/{id:[0-9]+}/disable", adminOnly(adc.DisableHandler)).Methods("POST")
+	adminRouter.Handle("/users/{id:[0-9]+}/enable", adminOnly(adc.EnableHandler)).Methods("POST")
+	adminRouter.Handle("/audit", adminOnly(auc.QueryHandler)).Methods("GET")
+	adminRouter.Handle("/audit/verify", adminOnly(auc.VerifyHandler)).Methods("GET")
+
+	// Internal services get their own tokens with the client_credentials grant,
+	// the scopes of the client decide what they may call
+	authRouter.HandleFunc("/token", tc.TokenHandler).Methods("POST")
+	// and services that cannot validate a token themselves, or have to know if it was revoked, ask here
+	authRouter.HandleFunc("/introspect", ic.IntrospectHandler).Methods("POST")
+
+	// Other services and partners fetch our public keys from here to verify the tokens themselves
+	authRouter.HandleFunc("/.well-known/jwks.json", wkc.JWKSHandler).Methods("GET")
+	authRouter.HandleFunc("/.well-known/openid-configuration", wkc.DiscoveryHandler).Methods("GET")
 
 	// File Upload SubRouter
 	claimsRouter := mainRouter.PathPrefix("/claims").Subrouter()
 	claimsRouter.HandleFunc("/upload", uc.UploadFile)
 	claimsRouter.HandleFunc("/download", dc.DownloadFile)
-	claimsRouter.Use(tm.TokenValidationMiddleware)
+	// each service only accepts tokens of its own audience
+	claimsRouter.Use(tm.ForAudience(tokenConfig.AudienceFor("claims")).TokenValidationMiddleware)
 
-	//Initialize the Gorm connection
+	// protect validates the token and then checks the roles in it grant the permission.
+	// The calls are audited, the denied ones too.
+	protect := func(service *middleware.TokenMiddleware, permission string, audited func(http.Handler) http.Handler, handler http.HandlerFunc) http.Handler {
+		return service.TokenValidationMiddleware(audited(am.RequirePermission(permission)(handler)))
+	}
+
+	//Initialize the Gorm connection, without it the products are kept in memory
 	// pc.InitGormConnection()
+	productTM := tm.ForAudience(tokenConfig.AudienceFor("product"))
+	productsRouter := mainRouter.PathPrefix("/products").Subrouter()
+	productsRouter.HandleFunc("", pc.ListHandler).Methods("GET")
+	productsRouter.Handle("", protect(productTM, middleware.PermProductWrite,
+		recorder.Route(audit.ActionProductWrite, audit.Var("id")), pc.CreateHandler)).Methods("POST")
+	// anybody signed in can query, the queries are compiled and capped by the product service
+	productsRouter.Handle("/query", productTM.TokenValidationMiddleware(http.HandlerFunc(pc.QueryHandler))).Methods("POST")
+	productsRouter.HandleFunc("/{id:[0-9]+}", pc.GetHandler).Methods("GET")
+	productsRouter.Handle("/{id:[0-9]+}", protect(productTM, middleware.PermProductWrite,
+		recorder.Route(audit.ActionProductWrite, audit.Var("id")), pc.ReplaceHandler)).Methods("PUT")
+	productsRouter.Handle("/{id:[0-9]+}", protect(productTM, middleware.PermProductWrite,
+		recorder.Route(audit.ActionProductWrite, audit.Var("id")), pc.UpdateHandler)).Methods("PATCH")
+	productsRouter.Handle("/{id:[0-9]+}", protect(productTM, middleware.PermProductDelete,
+		recorder.Route(audit.ActionProductDelete, audit.Var("id")), pc.DeleteHandler)).Methods("DELETE")
+
+	// the old routes with the product in headers, deprecated in favour of /products
 	productRouter := mainRouter.PathPrefix("/product").Subrouter()
 	productRouter.HandleFunc("/getprods", pc.GetAllProductsHandler).Methods("GET")
-	productRouter.HandleFunc("/addprod", pc.AddProductHandler).Methods("POST")
+	productRouter.Handle("/addprod", protect(productTM, middleware.PermProductWrite,
+		recorder.Route(audit.ActionProductWrite, audit.Header("Productname")), pc.AddProductHandler)).Methods("POST")
 	productRouter.HandleFunc("/getprodbyid", pc.GetAllProductByIdHandler).Methods("GET")
-	productRouter.HandleFunc("/deletebyid", pc.DeleteProductHandler).Methods("DELETE")
-	productRouter.HandleFunc("/customquery", pc.CustomQueryHandler).Methods("GET", "POST")
+	productRouter.Handle("/deletebyid", protect(productTM, middleware.PermProductDelete,
+		recorder.Route(audit.ActionProductDelete, audit.Header("Id")), pc.DeleteProductHandler)).Methods("DELETE")
+	productRouter.Handle("/customquery", protect(productTM, middleware.PermProductCustomQuery,
+		recorder.Route(audit.ActionCustomQuery, func(r *http.Request, event *audit.Event) {
+			event.Target = r.Header.Get("Type")
+			event.Detail("query", r.Header.Get("Query"))
+		}), pc.CustomQueryHandler)).Methods("GET", "POST")
 
 	//Coupon Service SubRouter
 	couponRouter := mainRouter.PathPrefix("/coupon").Subrouter()
+	couponTM := tm.ForAudience(tokenConfig.AudienceFor("coupon"))
 	couponRouter.HandleFunc("/addcoupon", cc.AddCouponList).Methods("POST")
 	couponRouter.HandleFunc("/getvendorcoupons", cc.GetCouponForInternalValidation).Methods("GET")
-	couponRouter.HandleFunc("/delregionstream", cc.PurgeStream).Methods("DELETE")
+	couponRouter.Handle("/delregionstream", protect(couponTM, middleware.PermCouponPurge,
+		recorder.Route(audit.ActionStreamPurge, audit.Header("Region")), cc.PurgeStream)).Methods("DELETE")
 
 	// Transformer Service SubRouter
 	transformerOrderRouter := mainRouter.PathPrefix("/transformer").Subrouter()
 	transformerOrderRouter.HandleFunc("/transform", transc.TransformerHandler).Methods("GET")
 
 	// CORS Header
-	cors := gohandlers.CORS(gohandlers.AllowedOrigins([]string{"http://localhost:3000"}))
+	// the frontend sends the tokens and the CSRF token in headers, and the cookies need the credentials allowed
+	cors := gohandlers.CORS(
+		gohandlers.AllowedOrigins([]string{"http://localhost:3000"}),
+		gohandlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}),
+		gohandlers.AllowedHeaders([]string{"Authorization", "Content-Type", "Token", "Refreshtoken", "Audience",
+			middleware.CSRFHeader, middleware.TokenDeliveryHeader}),
+		gohandlers.ExposedHeaders([]string{"WWW-Authenticate", "Refreshtoken", "Location", "Deprecation", "Link",
+			"X-Total-Count", "X-Next-Cursor"}),
+		gohandlers.AllowCredentials(),
+	)
 
 	// Adding Prometheus http handler to expose the metrics
 	// this will display our metrics as well as some standard metrics
@@ -104,16 +104,33 @@ func dataTransformer(log *zap.Logger, aggeregateChan <-chan []string, transformC
 	return nil
 }
 
-// dataTransportation send a POST request to our endpoint which is on our server only
-func dataTransportation(log *zap.Logger, transportChan <-chan string, successChan chan<- string) error {
+// dataTransportation send a POST request to our endpoint which is on our server only.
+// The endpoint needs a token of a client with the monitor:write scope.
+func dataTransportation(log *zap.Logger, tokens *tokenSource, transportChan <-chan string, successChan chan<- string) error {
 	for op := range transportChan {
 		// this is fanned in channel
 		// we send a POST request with our metric data
-		response, err := http.Post(outputEndpoint, "application/json", bytes.NewBuffer([]byte(op)))
+		request, err := http.NewRequest("POST", outputEndpoint, bytes.NewBuffer([]byte(op)))
 		if err != nil {
 			log.Error("Error in transportation", zap.Error(err))
+			continue
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if tokens.configured() {
+			token, err := tokens.Token()
+			if err != nil {
+				log.Error("Unable to get a token for the monitor", zap.Error(err))
+				continue
+			}
+			request.Header.Set("Token", token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			log.Error("Error in transportation", zap.Error(err))
+			continue
 		}
 		responseBody, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
 		if err != nil {
 			log.Error("Error in Reading Output body", zap.Error(err))
 			return err
@@ -175,9 +192,15 @@ func MonitorBinder(log *zap.Logger) error {
 	// this has te output from our server
 	successChan := make(chan string)
 
+	// both transporters share the token of the monitor client
+	tokens := newTokenSource()
+	if !tokens.configured() {
+		log.Warn("MONITOR_CLIENT_ID and MONITOR_CLIENT_SECRET are not set, /checkRoutine will reject the metrics")
+	}
+
 	// spin 2 gorotines in parallel to get the successChan fast
-	go dataTransportation(log, transportChan, successChan)
-	go dataTransportation(log, transportChan, successChan)
+	go dataTransportation(log, tokens, transportChan, successChan)
+	go dataTransportation(log, tokens, transportChan, successChan)
 
 	// now we implement a WaitGroup to get the first 5 values only of the response body
 	// this will
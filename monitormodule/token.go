@@ -0,0 +1,76 @@
+package monitormodule
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tokenEndpoint string = "http://localhost:9090/auth/token"
+
+// the only scope the monitor needs, it posts to /checkRoutine
+const monitorScope string = "monitor:write"
+
+// tokenSource gets access tokens for the monitor with the client_credentials grant.
+// The credentials come from MONITOR_CLIENT_ID and MONITOR_CLIENT_SECRET.
+type tokenSource struct {
+	clientID     string
+	clientSecret string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func newTokenSource() *tokenSource {
+	return &tokenSource{
+		clientID:     os.Getenv("MONITOR_CLIENT_ID"),
+		clientSecret: os.Getenv("MONITOR_CLIENT_SECRET"),
+	}
+}
+
+// configured tells if the monitor has client credentials at all
+func (ts *tokenSource) configured() bool {
+	return ts.clientID != "" && ts.clientSecret != ""
+}
+
+// Token returns the cached token or asks for a new one shortly before it expires
+func (ts *tokenSource) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Now().Before(ts.expires) {
+		return ts.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {monitorScope}}
+	req, err := http.NewRequest("POST", tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(ts.clientID), url.QueryEscape(ts.clientSecret))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint answered %s", resp.Status)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	ts.token = body.AccessToken
+	// renew a little early, so a token does not expire on the way
+	ts.expires = time.Now().Add(time.Duration(body.ExpiresIn)*time.Second - 30*time.Second)
+	return ts.token, nil
+}
@@ -1,34 +1,48 @@
 package productservice
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/jinzhu/gorm"
 	_ "github.com/jinzhu/gorm/dialects/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
 	"github.com/shadowshot-x/micro-product-go/productservice/store"
 	"go.uber.org/zap"
 )
 
-var db *gorm.DB
+var deprecatedCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "product_deprecated_calls",
+	Help: "Calls of the old product routes, they can go once nobody calls them",
+}, []string{"route"})
 
 func GetSecret() string {
 	return os.Getenv("MYSQL_SECRET")
 }
 
-// ProductController is the getproduct route handler
+// ProductController is the product route handler
 type ProductController struct {
-	logger *zap.Logger
+	logger         *zap.Logger
+	promDeprecated *prometheus.CounterVec
+	products       store.Store
 }
 
-// NewProductController returns a frsh Upload controller
-func NewProductController(logger *zap.Logger) *ProductController {
+// NewProductController returns a frsh Product controller
+func NewProductController(logger *zap.Logger, products store.Store) *ProductController {
 	return &ProductController{
-		logger: logger,
+		logger:         logger,
+		promDeprecated: deprecatedCalls,
+		products:       products,
 	}
 }
 
@@ -37,6 +51,7 @@ func handleNotInHeader(rw http.ResponseWriter, r *http.Request, param string) {
 	rw.Write([]byte(fmt.Sprintf("%s Missing", param)))
 }
 
+// InitGormConnection connects to MySQL and moves the products there, until then they are kept in memory
 func (ctrl *ProductController) InitGormConnection() {
 	// database configuration for mysql
 	// first we fetch the mysql secret string stored in environment variables
@@ -46,100 +61,307 @@ func (ctrl *ProductController) InitGormConnection() {
 		ctrl.logger.Warn("Unable to get mysql secret")
 		return
 	}
-	var err error
 	// lets open the conncection
-	db, err = gorm.Open("mysql", GetSecret())
+	db, err := gorm.Open("mysql", GetSecret())
 	if err != nil {
 		ctrl.logger.Warn("Connection Failed to Open", zap.Error(err))
-	} else {
-		ctrl.logger.Info("Connection Established")
+		return
 	}
+	ctrl.logger.Info("Connection Established")
 
 	//We have the database name in our Environment secret.
-	// Auto Migrate creates a table named products in that Database
-	db.AutoMigrate(&store.Product{})
+	// The store auto migrates the table named products in that Database
+	products, err := store.NewGormStore(db)
+	if err != nil {
+		ctrl.logger.Warn("Unable to migrate the products table", zap.Error(err))
+		return
+	}
+	ctrl.products = products
+}
+
+// productID reads the id of /products/{id}. An id too big for an int cannot exist either.
+func productID(r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	return id, err == nil
+}
+
+// lookup loads the product of the route and writes the problem if there is none
+func (ctrl *ProductController) lookup(rw http.ResponseWriter, r *http.Request) (store.Product, bool) {
+	id, ok := productID(r)
+	if !ok {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "Product Not Found"))
+		return store.Product{}, false
+	}
+	product, err := ctrl.products.Get(r.Context(), id)
+	if err == store.ErrProductNotFound {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "Product Not Found"))
+		return store.Product{}, false
+	}
+	if err != nil {
+		ctrl.internalError(rw, r, "Unable to read the product", err)
+		return store.Product{}, false
+	}
+	return product, true
+}
+
+func (ctrl *ProductController) internalError(rw http.ResponseWriter, r *http.Request, msg string, err error) {
+	ctrl.logger.Error(msg, zap.Error(err))
+	problem.Write(rw, r, problem.New(problem.TypeInternal, http.StatusInternalServerError, "Internal Server Error"))
+}
+
+func writeProduct(rw http.ResponseWriter, status int, product store.Product) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	json.NewEncoder(rw).Encode(product)
+}
+
+// page fetches one product more than the limit, so we know if there is a next page
+func (ctrl *ProductController) page(ctx context.Context, opts store.ListOptions) (ProductPage, error) {
+	limit := opts.Limit
+	opts.Limit++
+	products, err := ctrl.products.List(ctx, opts)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	total, err := ctrl.products.Count(ctx, opts.Filter)
+	if err != nil {
+		return ProductPage{}, err
+	}
+	page := ProductPage{Items: products, Total: total, Limit: limit, Offset: opts.Offset}
+	if len(products) > limit {
+		page.Items = products[:limit]
+		page.NextCursor = store.CursorAfter(products[limit-1], opts.Sort).Encode()
+	}
+	return page, nil
+}
+
+// ListHandler returns a page of the products, filtered and sorted by the query string
+func (ctrl *ProductController) ListHandler(rw http.ResponseWriter, r *http.Request) {
+	opts, errs := parseListQuery(r.URL.Query())
+	if len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	page, err := ctrl.page(r.Context(), opts)
+	if err != nil {
+		ctrl.internalError(rw, r, "Unable to list the products", err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(page)
+}
+
+// GetHandler returns the product of /products/{id}
+func (ctrl *ProductController) GetHandler(rw http.ResponseWriter, r *http.Request) {
+	product, ok := ctrl.lookup(rw, r)
+	if !ok {
+		return
+	}
+	writeProduct(rw, http.StatusOK, product)
+}
+
+// CreateHandler adds the product of the JSON body and points to it in the Location header
+func (ctrl *ProductController) CreateHandler(rw http.ResponseWriter, r *http.Request) {
+	var req ProductRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(false); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	product, err := ctrl.create(r.Context(), req)
+	if err != nil {
+		ctrl.internalError(rw, r, "Unable to add the product", err)
+		return
+	}
+	rw.Header().Set("Location", fmt.Sprintf("/products/%d", product.Id))
+	writeProduct(rw, http.StatusCreated, product)
+}
+
+func (ctrl *ProductController) create(ctx context.Context, req ProductRequest) (store.Product, error) {
+	product := store.Product{CreateAt: time.Now()}
+	req.apply(&product, false)
+	err := ctrl.products.Create(ctx, &product)
+	if err == nil {
+		ctrl.logger.Info("Product added", zap.Int("id", product.Id))
+	}
+	return product, err
+}
+
+// ReplaceHandler is PUT /products/{id}, the body has all fields of the product
+func (ctrl *ProductController) ReplaceHandler(rw http.ResponseWriter, r *http.Request) {
+	ctrl.update(rw, r, false)
+}
+
+// UpdateHandler is PATCH /products/{id}, only the fields in the body are changed
+func (ctrl *ProductController) UpdateHandler(rw http.ResponseWriter, r *http.Request) {
+	ctrl.update(rw, r, true)
+}
+
+func (ctrl *ProductController) update(rw http.ResponseWriter, r *http.Request, partial bool) {
+	product, ok := ctrl.lookup(rw, r)
+	if !ok {
+		return
+	}
+	var req ProductRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	if errs := req.Validate(partial); len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	req.apply(&product, partial)
+	err := ctrl.products.Update(r.Context(), product)
+	// deleted since we looked it up
+	if err == store.ErrProductNotFound {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "Product Not Found"))
+		return
+	}
+	if err != nil {
+		ctrl.internalError(rw, r, "Unable to update the product", err)
+		return
+	}
+	ctrl.logger.Info("Product updated", zap.Int("id", product.Id))
+	writeProduct(rw, http.StatusOK, product)
+}
+
+// DeleteHandler removes the product of /products/{id}.
+// The route is wrapped in the TokenMiddleware and the AuthorizationMiddleware,
+// only callers with the product:delete permission reach this point.
+func (ctrl *ProductController) DeleteHandler(rw http.ResponseWriter, r *http.Request) {
+	id, ok := productID(r)
+	err := store.ErrProductNotFound
+	if ok {
+		err = ctrl.products.Delete(r.Context(), id)
+	}
+	if err == store.ErrProductNotFound {
+		problem.Write(rw, r, problem.New(problem.TypeNotFound, http.StatusNotFound, "Product Not Found"))
+		return
+	}
+	if err != nil {
+		ctrl.internalError(rw, r, "Unable to delete the product", err)
+		return
+	}
+	ctrl.logger.Info("Product deleted", zap.Int("id", id))
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// deprecated marks the response of an old route (draft-ietf-httpapi-deprecation-header)
+// and links the route replacing it. The counter tells when the old routes can go.
+func (ctrl *ProductController) deprecated(rw http.ResponseWriter, route string, successor string) {
+	ctrl.promDeprecated.WithLabelValues(route).Inc()
+	rw.Header().Set("Deprecation", "true")
+	rw.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
 }
 
+// successor is the new route of the product with the id from the Id header
+func successor(id int, err error) string {
+	if err != nil {
+		return "/products"
+	}
+	return fmt.Sprintf("/products/%d", id)
+}
+
+// GetAllProductsHandler is the old /product/getprods.
+// Deprecated: use GET /products.
 func (ctrl *ProductController) GetAllProductsHandler(rw http.ResponseWriter, r *http.Request) {
-	// we know we will get a list of all products.
-	AllProducts := []store.Product{}
-	// here db.Find fetches all the existing Elements in Products and stores them in AllProducts
-	db.Find(&AllProducts)
+	ctrl.deprecated(rw, "getprods", "/products")
+	// we used to get a list of all products, now it is a page like /products.
+	// The body stays a list, so the total and the next cursor go in headers.
+	opts, errs := parseListQuery(r.URL.Query())
+	if len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	page, err := ctrl.page(r.Context(), opts)
+	if err != nil {
+		ctrl.logger.Error("Unable to list the products", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	rw.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		rw.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
 	// We can Send back all values to the ResponseWriter by jsonencoding the results
-	json.NewEncoder(rw).Encode(AllProducts)
+	json.NewEncoder(rw).Encode(page.Items)
 }
 
+// GetAllProductByIdHandler is the old /product/getprodbyid with the id in the Id header.
+// Deprecated: use GET /products/{id}.
 func (ctrl *ProductController) GetAllProductByIdHandler(rw http.ResponseWriter, r *http.Request) {
-	// we know we will get a list of all products with a certain id.
-	Products := store.Product{}
 	if _, ok := r.Header["Id"]; !ok {
 		ctrl.logger.Warn("Id was not found in the header")
 		handleNotInHeader(rw, r, "Id")
 		return
 	}
+	id, err := strconv.Atoi(r.Header["Id"][0])
+	ctrl.deprecated(rw, "getprodbyid", successor(id, err))
 
-	// here db.First fetches the first existing Elements in Products and stores them in Product
-	// we need to record errors because if none exist, that is an error.
-	err := db.First(&Products, r.Header["Id"][0]).Error
-
+	// if none exist, that is an error.
+	var product store.Product
+	if err == nil {
+		product, err = ctrl.products.Get(r.Context(), id)
+	}
 	if err != nil {
-		ctrl.logger.Error("The stated record was not found")
+		ctrl.logger.Error("The stated record was not found", zap.Error(err))
 		rw.WriteHeader(http.StatusBadRequest)
 		rw.Write([]byte("Record not found"))
 		return
 	}
 	// We can Send back all values to the ResponseWriter by jsonencoding the results
 	rw.WriteHeader(http.StatusOK)
-	json.NewEncoder(rw).Encode(Products)
+	json.NewEncoder(rw).Encode(product)
 }
 
+// AddProductHandler is the old /product/addprod with the product in headers.
+// Deprecated: use POST /products with a JSON body.
 func (ctrl *ProductController) AddProductHandler(rw http.ResponseWriter, r *http.Request) {
+	ctrl.deprecated(rw, "addprod", "/products")
 	//validate the request first
-	if _, ok := r.Header["Productname"]; !ok {
-		ctrl.logger.Warn("Name was not found in the header")
-		handleNotInHeader(rw, r, "name")
-		return
-	}
-	if _, ok := r.Header["Productvendor"]; !ok {
-		ctrl.logger.Warn("Vendor was not found in the header")
-		handleNotInHeader(rw, r, "Vendor")
-		return
-	}
-	if _, ok := r.Header["Productinventory"]; !ok {
-		ctrl.logger.Warn("Inventory was not found in the header")
-		handleNotInHeader(rw, r, "Inventory")
-		return
+	for _, header := range productHeaders {
+		if _, ok := r.Header[header]; !ok {
+			ctrl.logger.Warn("Header of the product was not found", zap.String("header", header))
+			handleNotInHeader(rw, r, header)
+			return
+		}
 	}
-	if _, ok := r.Header["Productdescription"]; !ok {
-		ctrl.logger.Warn("Description was not found in the header")
-		handleNotInHeader(rw, r, "Description")
+	// We want to get the details of the Product first. So these have to be in the request
+	req, errs := decodeHeaders(r)
+	if len(errs) > 0 {
+		// if the product is invalid, we dont want to execute any further
+		ctrl.logger.Warn("Invalid product in the headers")
+		problem.Write(rw, r, problem.Validation(errs))
 		return
 	}
-	// We want to get the details of the Product first. So these have to be in the request
-	inventory, err := strconv.Atoi(r.Header["Productinventory"][0])
+	product, err := ctrl.create(r.Context(), req)
 	if err != nil {
-		// if we get an error, we dont want to execute any further
-		ctrl.logger.Error("Error converting string to integer in inventory", zap.Error(err))
+		ctrl.logger.Error("Unable to add the product", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
 		return
 	}
-	// define the object we want to add
-	newProduct := store.Product{
-		Name:        r.Header["Productname"][0],
-		VendorName:  r.Header["Productvendor"][0],
-		Inventory:   inventory,
-		Description: r.Header["Productdescription"][0],
-		CreateAt:    time.Now(),
-	}
-	db.Omit("Id").Create(&newProduct)
 
+	rw.Header().Set("Location", fmt.Sprintf("/products/%d", product.Id))
 	rw.WriteHeader(http.StatusOK)
 	rw.Write([]byte("Record was added"))
 }
 
+// DeleteProductHandler is the old /product/deletebyid with the id in the Id header.
+// Deprecated: use DELETE /products/{id}.
 func (ctrl *ProductController) DeleteProductHandler(rw http.ResponseWriter, r *http.Request) {
-	// This is the ideal case where we want to make sure the user is authenticated and has a certain role
-	// however, right now I am keeping it simple
-	// lets create an issue for this
+	// The route is wrapped in the TokenMiddleware and the AuthorizationMiddleware.
+	// Only callers with the product:delete permission reach this point.
 
 	// first we see the request has the id for the product to be deleted.
 	if _, ok := r.Header["Id"]; !ok {
@@ -147,17 +369,23 @@ func (ctrl *ProductController) DeleteProductHandler(rw http.ResponseWriter, r *h
 		handleNotInHeader(rw, r, "Id")
 		return
 	}
-
-	// Now we know that the request has the parameter. Lets see how the gorm handles deletion
-	// We can use the Where clause in gorm to query this.
-	// db.Where(fmt.Sprintf("Id = %s", r.Header["Id"][0])).Delete(&store.Product{})
-	// There is another easy way. As we know that Id is primary Key, we can do the following :-
-	err := db.Delete(&store.Product{}, r.Header["Id"][0]).Error
-
+	// Now we know that the request has the parameter. As Id is the primary Key, the store deletes by it
+	id, err := strconv.Atoi(r.Header["Id"][0])
+	ctrl.deprecated(rw, "deletebyid", successor(id, err))
+	if err == nil {
+		err = ctrl.products.Delete(r.Context(), id)
+	}
+	// nothing matched, an id that is not a number neither
+	if err == store.ErrProductNotFound || errors.Is(err, strconv.ErrSyntax) || errors.Is(err, strconv.ErrRange) {
+		ctrl.logger.Warn("The product to delete was not found", zap.String("id", r.Header["Id"][0]))
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("Record not found"))
+		return
+	}
 	// this would mean there is an internal error
 	if err != nil {
-		ctrl.logger.Error("Could not delete the Given Product")
-		rw.WriteHeader(http.StatusBadRequest)
+		ctrl.logger.Error("Could not delete the Given Product", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
 		rw.Write([]byte("Record could not be deleted"))
 		return
 	}
@@ -167,17 +395,44 @@ func (ctrl *ProductController) DeleteProductHandler(rw http.ResponseWriter, r *h
 	rw.Write([]byte("Record deleted"))
 }
 
-// However, this is becoming a bit strict.
-// We dont want to add a function everytime we get a new SQL query required.
-// Doing this in gorm will be difficult.
-// We would need a wrapper to provide user with this support, but this will take significant effort
-// However something that executes queries as is can do the job.
-// So, we can have an Exec Query of Gorm to deal with this. Custom Queries!
+// However, adding a function everytime we get a new query required was becoming a bit strict.
+// Passing the SQL as is did the job, but it let anyone run anything, DROP TABLE included,
+// and no check of the SQL text keeps a UNION with the users table out.
+// So the queries are JSON now, with the fields of the products and the values as parameters.
 
+// QueryHandler runs a structured query, the where of the body is compiled by store.Compile
+// and the page works like the one of /products
+func (ctrl *ProductController) QueryHandler(rw http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if err := decodeJSON(r, &req); err != nil {
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed request")
+		p.Detail = err.Error()
+		problem.Write(rw, r, p)
+		return
+	}
+	opts, errs := req.options()
+	if len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	page, err := ctrl.page(r.Context(), opts)
+	if err != nil {
+		ctrl.internalError(rw, r, "Unable to run the query", err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	json.NewEncoder(rw).Encode(page)
+}
+
+// CustomQueryHandler is the old /product/customquery. The Query header no longer takes SQL,
+// it takes the JSON of /products/query and runs it the same way. The answer stays a list,
+// the total and the next cursor go in headers like the ones of /product/getprods.
+// The exec type that changed the data is gone.
+// Deprecated: use POST /products/query.
 func (ctrl *ProductController) CustomQueryHandler(rw http.ResponseWriter, r *http.Request) {
+	ctrl.deprecated(rw, "customquery", "/products/query")
 
-	// to Query ie. to use SELECT we have .Raw in Gorm
-	// to Execute like delete, add and update, we have .Exec in Gorm
 	if _, ok := r.Header["Type"]; !ok {
 		ctrl.logger.Warn("Type was not found in the header")
 		handleNotInHeader(rw, r, "Type")
@@ -190,35 +445,43 @@ func (ctrl *ProductController) CustomQueryHandler(rw http.ResponseWriter, r *htt
 		return
 	}
 
-	if r.Header["Type"][0] == "get" {
-		// we know that we can only get an array of Products.
-		var Products []store.Product
-		err := db.Raw(r.Header["Query"][0]).Scan(&Products).Error
-
-		if err != nil {
-			ctrl.logger.Error("Could not Execute your Query")
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte("Query not executed"))
-			return
-		}
-
-		rw.WriteHeader(http.StatusOK)
-		json.NewEncoder(rw).Encode(Products)
+	if r.Header["Type"][0] == "exec" {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Exec Queries Were Removed, Use /products"))
 		return
-	} else if r.Header["Type"][0] == "exec" {
-		err := db.Exec(r.Header["Query"][0]).Error
-
-		if err != nil {
-			ctrl.logger.Error("Could not Execute your Query")
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte("Query not executed"))
-			return
-		}
-		rw.WriteHeader(http.StatusOK)
-		rw.Write([]byte("Query Executed"))
+	}
+	if r.Header["Type"][0] != "get" {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("Incorrect Query Type"))
 		return
 	}
 
-	rw.WriteHeader(http.StatusBadRequest)
-	rw.Write([]byte("Incorrect Query Type"))
+	// SQL is never run as is, whatever looks like it is refused here
+	var req QueryRequest
+	decoder := json.NewDecoder(strings.NewReader(r.Header["Query"][0]))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		ctrl.logger.Warn("Refused a query that is not JSON", zap.Error(err))
+		p := problem.New(problem.TypeMalformed, http.StatusBadRequest, "Malformed query")
+		p.Detail = "Query must be the JSON of /products/query, SQL is not accepted anymore"
+		problem.Write(rw, r, p)
+		return
+	}
+	opts, errs := req.options()
+	if len(errs) > 0 {
+		problem.Write(rw, r, problem.Validation(errs))
+		return
+	}
+	page, err := ctrl.page(r.Context(), opts)
+	if err != nil {
+		ctrl.logger.Error("Could not Execute your Query", zap.Error(err))
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("Internal Server Error"))
+		return
+	}
+	rw.Header().Set("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		rw.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	json.NewEncoder(rw).Encode(page.Items)
 }
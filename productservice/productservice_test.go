@@ -0,0 +1,239 @@
+package productservice
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/productservice/store"
+	"go.uber.org/zap"
+)
+
+func newRouter(pc *ProductController) *mux.Router {
+	router := mux.NewRouter()
+	router.HandleFunc("/products", pc.ListHandler).Methods("GET")
+	router.HandleFunc("/products", pc.CreateHandler).Methods("POST")
+	router.HandleFunc("/products/query", pc.QueryHandler).Methods("POST")
+	router.HandleFunc("/products/{id:[0-9]+}", pc.GetHandler).Methods("GET")
+	router.HandleFunc("/products/{id:[0-9]+}", pc.ReplaceHandler).Methods("PUT")
+	router.HandleFunc("/products/{id:[0-9]+}", pc.UpdateHandler).Methods("PATCH")
+	router.HandleFunc("/products/{id:[0-9]+}", pc.DeleteHandler).Methods("DELETE")
+	router.HandleFunc("/product/addprod", pc.AddProductHandler).Methods("POST")
+	router.HandleFunc("/product/deletebyid", pc.DeleteProductHandler).Methods("DELETE")
+	router.HandleFunc("/product/customquery", pc.CustomQueryHandler).Methods("GET")
+	return router
+}
+
+func TestProducts(t *testing.T) {
+	router := newRouter(NewProductController(zap.NewNop(), store.NewMemoryStore()))
+	call := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := call("POST", "/products", `{"name":" prod1 ","vendor":"vendor1","inventory":5,"description":"first"}`)
+	var created store.Product
+	json.NewDecoder(rw.Body).Decode(&created)
+	if rw.Code != http.StatusCreated || rw.Header().Get("Location") != "/products/1" || created.Name != "prod1" {
+		t.Fatalf("Expected the product to be created at /products/1, got %d %s %+v", rw.Code, rw.Header().Get("Location"), created)
+	}
+
+	rw = call("POST", "/products", `{"name":"","inventory":-1}`)
+	var p problem.Problem
+	json.NewDecoder(rw.Body).Decode(&p)
+	if rw.Code != http.StatusBadRequest || len(p.Errors) != 3 {
+		t.Fatalf("Expected the name, vendor and inventory to be invalid, got %d %+v", rw.Code, p)
+	}
+	if rw := call("POST", "/products", `{"name":"prod2","vendor":"vendor2","inventory":1,"price":3}`); rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an unknown field to be rejected, got %d", rw.Code)
+	}
+
+	// PATCH only touches the fields of the body, PUT needs all of them
+	rw = call("PATCH", "/products/1", `{"inventory":0}`)
+	var updated store.Product
+	json.NewDecoder(rw.Body).Decode(&updated)
+	if rw.Code != http.StatusOK || updated.Inventory != 0 || updated.Name != "prod1" || updated.Description != "first" {
+		t.Fatalf("Unexpected partial update %d %+v", rw.Code, updated)
+	}
+	if rw := call("PUT", "/products/1", `{"inventory":3}`); rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a replace without the name to be rejected, got %d", rw.Code)
+	}
+	if rw := call("PUT", "/products/1", `{"name":"prod1","vendor":"vendor9","inventory":3}`); rw.Code != http.StatusOK {
+		t.Fatalf("Replace failed with %d", rw.Code)
+	}
+	rw = call("GET", "/products/1", "")
+	json.NewDecoder(rw.Body).Decode(&updated)
+	if updated.VendorName != "vendor9" || updated.Description != "" {
+		t.Fatalf("Expected the replaced product, got %+v", updated)
+	}
+	if rw := call("PATCH", "/products/7", `{"inventory":1}`); rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected an unknown product to be 404, got %d", rw.Code)
+	}
+
+	if rw := call("DELETE", "/products/1", ""); rw.Code != http.StatusNoContent {
+		t.Fatalf("Delete failed with %d", rw.Code)
+	}
+	if rw := call("DELETE", "/products/1", ""); rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected a second delete to be 404, got %d", rw.Code)
+	}
+}
+
+func TestDeprecatedRoutes(t *testing.T) {
+	router := newRouter(NewProductController(zap.NewNop(), store.NewMemoryStore()))
+	call := func(method string, path string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw
+	}
+	product := map[string]string{"Productname": "prod1", "Productvendor": "vendor1", "Productinventory": "many", "Productdescription": "desc"}
+
+	if rw := call("POST", "/product/addprod", product); rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an inventory that is no number to be rejected, got %d", rw.Code)
+	}
+	product["Productinventory"] = "6"
+	rw := call("POST", "/product/addprod", product)
+	if rw.Code != http.StatusOK || rw.Header().Get("Deprecation") != "true" || !strings.Contains(rw.Header().Get("Link"), "</products>") {
+		t.Fatalf("Expected the product to be added with the deprecation headers, got %d %v", rw.Code, rw.Header())
+	}
+	if rw := call("DELETE", "/product/deletebyid", map[string]string{"Id": "2"}); rw.Code != http.StatusNotFound {
+		t.Fatalf("Expected deleting an unknown product to be 404, got %d", rw.Code)
+	}
+	if rw := call("DELETE", "/product/deletebyid", map[string]string{"Id": "1"}); rw.Code != http.StatusOK {
+		t.Fatalf("Delete failed with %d", rw.Code)
+	}
+}
+
+func TestProductList(t *testing.T) {
+	day := time.Date(2021, 9, 14, 0, 0, 0, 0, time.UTC)
+	products := store.NewMemoryStore(
+		store.Product{Name: "Blue Shirt", VendorName: "acme", Inventory: 5, CreateAt: day},
+		store.Product{Name: "Red Shirt", VendorName: "acme", Inventory: 0, CreateAt: day.Add(time.Hour)},
+		store.Product{Name: "Hat", VendorName: "hats inc", Inventory: 12, CreateAt: day.Add(48 * time.Hour)},
+		store.Product{Name: "Green Shirt", VendorName: "acme", Inventory: 5, CreateAt: day.Add(72 * time.Hour)},
+		store.Product{Name: "Scarf", VendorName: "acme", Inventory: 30, CreateAt: day.Add(96 * time.Hour)},
+	)
+	router := newRouter(NewProductController(zap.NewNop(), products))
+	list := func(query string) (int, ProductPage) {
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, httptest.NewRequest("GET", "/products?"+query, nil))
+		var page ProductPage
+		json.NewDecoder(rw.Body).Decode(&page)
+		return rw.Code, page
+	}
+	ids := func(page ProductPage) []int {
+		var ids []int
+		for _, product := range page.Items {
+			ids = append(ids, product.Id)
+		}
+		return ids
+	}
+
+	_, page := list("vendor=ACME&name=shirt&inventory_min=1")
+	if page.Total != 2 || !reflect.DeepEqual(ids(page), []int{1, 4}) {
+		t.Fatalf("Expected the shirts of acme in stock, got %d %v", page.Total, ids(page))
+	}
+	_, page = list("created_after=2021-09-15&sort=-inventory")
+	if !reflect.DeepEqual(ids(page), []int{5, 3, 4}) {
+		t.Fatalf("Expected the newer products by inventory, got %v", ids(page))
+	}
+
+	// the cursor walks the sort order page by page, the ties broken by the id
+	var walked []int
+	query := "sort=-inventory,name&limit=2"
+	for pages := 0; pages < 5; pages++ {
+		code, page := list(query)
+		if code != http.StatusOK || page.Total != 5 {
+			t.Fatalf("Unexpected page %d %+v", code, page)
+		}
+		walked = append(walked, ids(page)...)
+		if page.NextCursor == "" {
+			break
+		}
+		query = "sort=-inventory,name&limit=2&cursor=" + page.NextCursor
+	}
+	if !reflect.DeepEqual(walked, []int{5, 3, 1, 4, 2}) {
+		t.Fatalf("Expected every product once in the sort order, got %v", walked)
+	}
+	if _, page := list("sort=-inventory,name&limit=2&offset=2"); !reflect.DeepEqual(ids(page), []int{1, 4}) || page.NextCursor == "" {
+		t.Fatalf("Expected the second page by offset, got %v", ids(page))
+	}
+
+	for _, query := range []string{"sort=price", "limit=1000", "inventory_min=-1", "created_after=yesterday",
+		"cursor=bogus", "offset=2&cursor=" + store.CursorAfter(store.Product{Id: 1}, nil).Encode()} {
+		if code, _ := list(query); code != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be rejected, got %d", query, code)
+		}
+	}
+	_, page = list("limit=2")
+	if code, _ := list("sort=name&cursor=" + page.NextCursor); code != http.StatusBadRequest {
+		t.Fatalf("Expected the cursor of another sort to be rejected, got %d", code)
+	}
+}
+
+func TestProductQuery(t *testing.T) {
+	products := store.NewMemoryStore(
+		store.Product{Name: "Blue Shirt", VendorName: "acme", Inventory: 5},
+		store.Product{Name: "Red Shirt", VendorName: "acme", Inventory: 0},
+		store.Product{Name: "Hat", VendorName: "hats inc", Inventory: 12},
+	)
+	router := newRouter(NewProductController(zap.NewNop(), products))
+	query := func(body string) (*httptest.ResponseRecorder, ProductPage) {
+		req := httptest.NewRequest("POST", "/products/query", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		var page ProductPage
+		json.Unmarshal(rw.Body.Bytes(), &page)
+		return rw, page
+	}
+
+	rw, page := query(`{"where": {"or": [{"field": "inventory", "op": "gte", "value": 10},
+		{"and": [{"field": "name", "op": "contains", "value": "shirt"}, {"not": {"field": "inventory", "op": "eq", "value": 0}}]}]},
+		"sort": "-inventory"}`)
+	if rw.Code != http.StatusOK || page.Total != 2 || len(page.Items) != 2 || page.Items[0].Id != 3 || page.Items[1].Id != 1 {
+		t.Fatalf("Expected the hat and the blue shirt, got %d %+v", rw.Code, page)
+	}
+	rw, _ = query(`{"where": {"field": "vendor_name", "op": "eq", "value": "acme"}, "limit": 1000}`)
+	var p problem.Problem
+	json.Unmarshal(rw.Body.Bytes(), &p)
+	if rw.Code != http.StatusBadRequest || len(p.Errors) != 2 || p.Errors[1].Field != "where.field" {
+		t.Fatalf("Expected the limit and the unknown field to be rejected, got %d %+v", rw.Code, p)
+	}
+
+	// the old route takes the same JSON in the Query header and never runs SQL
+	custom := func(queryType string, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/product/customquery", nil)
+		req.Header.Set("Type", queryType)
+		req.Header.Set("Query", query)
+		rw := httptest.NewRecorder()
+		router.ServeHTTP(rw, req)
+		return rw
+	}
+	for _, query := range []string{"SELECT * FROM products UNION SELECT * FROM users", `{"where": {"field": "password_hash", "op": "eq", "value": "x"}}`} {
+		if rw := custom("get", query); rw.Code != http.StatusBadRequest {
+			t.Fatalf("Expected %s to be refused, got %d", query, rw.Code)
+		}
+	}
+	if rw := custom("exec", `{}`); rw.Code != http.StatusBadRequest {
+		t.Fatalf("Expected exec to be refused, got %d", rw.Code)
+	}
+	rw = custom("get", `{"where": {"field": "vendor", "op": "eq", "value": "acme"}, "sort": "-inventory", "limit": 1}`)
+	var found []store.Product
+	json.Unmarshal(rw.Body.Bytes(), &found)
+	if rw.Code != http.StatusOK || len(found) != 1 || found[0].Id != 1 || rw.Header().Get("X-Total-Count") != "2" || rw.Header().Get("Deprecation") != "true" {
+		t.Fatalf("Expected the first product of acme as a list, got %d %v %+v", rw.Code, rw.Header(), found)
+	}
+}
@@ -0,0 +1,237 @@
+package productservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shadowshot-x/micro-product-go/authservice/problem"
+	"github.com/shadowshot-x/micro-product-go/productservice/store"
+)
+
+// limits of the fields, the columns are varchar(255)
+const (
+	maxNameLength        = 255
+	maxVendorLength      = 255
+	maxDescriptionLength = 255
+	// the body never needs to be bigger than this
+	maxBodySize = 1 << 16
+)
+
+// page sizes of the product list
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// ProductPage is one page of the product list. NextCursor continues behind the last
+// product of the page and is empty on the last page.
+type ProductPage struct {
+	Items      []store.Product `json:"items"`
+	Total      int             `json:"total"`
+	Limit      int             `json:"limit"`
+	Offset     int             `json:"offset,omitempty"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// ProductRequest is the body of a create, a replace or a partial update.
+// The fields are pointers so a PATCH can tell a missing field from a zero one.
+type ProductRequest struct {
+	Name        *string `json:"name"`
+	Vendor      *string `json:"vendor"`
+	Inventory   *int    `json:"inventory"`
+	Description *string `json:"description"`
+}
+
+// decodeJSON reads the JSON body into v. Unknown fields are rejected, so typos do not go unnoticed.
+func decodeJSON(r *http.Request, v interface{}) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		return errors.New("Content-Type must be application/json")
+	}
+	decoder := json.NewDecoder(io.LimitReader(r.Body, maxBodySize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("body is not valid JSON: %v", err)
+	}
+	return nil
+}
+
+// headers of the old /product/addprod route, they are all required
+var productHeaders = []string{"Productname", "Productvendor", "Productinventory", "Productdescription"}
+
+// decodeHeaders reads the product from the headers of the old route, the caller checked they are there.
+// An inventory that is not a number is a field error, like a negative one.
+func decodeHeaders(r *http.Request) (ProductRequest, []problem.FieldError) {
+	name, vendor, description := r.Header["Productname"][0], r.Header["Productvendor"][0], r.Header["Productdescription"][0]
+	req := ProductRequest{Name: &name, Vendor: &vendor, Description: &description}
+	inventory, err := strconv.Atoi(r.Header["Productinventory"][0])
+	if err != nil {
+		return req, []problem.FieldError{{Field: "inventory", Message: "must be a whole number"}}
+	}
+	req.Inventory = &inventory
+	return req, req.Validate(false)
+}
+
+// Validate returns every invalid field. A partial update only checks the fields it sets,
+// the others need the name, the vendor and the inventory. The description may be left out.
+func (req ProductRequest) Validate(partial bool) []problem.FieldError {
+	var errs []problem.FieldError
+	required := func(field string, value *string, max int) {
+		switch {
+		case value == nil && partial:
+		case value == nil || strings.TrimSpace(*value) == "":
+			errs = append(errs, problem.FieldError{Field: field, Message: "is required"})
+		case len(*value) > max:
+			errs = append(errs, problem.FieldError{Field: field, Message: fmt.Sprintf("must be at most %d characters", max)})
+		}
+	}
+	required("name", req.Name, maxNameLength)
+	required("vendor", req.Vendor, maxVendorLength)
+
+	switch {
+	case req.Inventory == nil && partial:
+	case req.Inventory == nil:
+		errs = append(errs, problem.FieldError{Field: "inventory", Message: "is required"})
+	case *req.Inventory < 0:
+		errs = append(errs, problem.FieldError{Field: "inventory", Message: "must not be negative"})
+	}
+
+	if req.Description != nil && len(*req.Description) > maxDescriptionLength {
+		errs = append(errs, problem.FieldError{Field: "description", Message: fmt.Sprintf("must be at most %d characters", maxDescriptionLength)})
+	}
+	return errs
+}
+
+// QueryRequest is the body of a structured query, see store.Expr for the where
+type QueryRequest struct {
+	Where  *store.Expr `json:"where"`
+	Sort   string      `json:"sort"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Cursor string      `json:"cursor"`
+}
+
+// options compiles the query into the options of the list, without a where all products match
+func (req QueryRequest) options() (store.ListOptions, []problem.FieldError) {
+	opts := store.ListOptions{Limit: req.Limit, Offset: req.Offset}
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageSize
+	}
+	errs := paging(&opts, req.Sort, req.Cursor)
+	if req.Where != nil {
+		where, err := store.Compile(*req.Where, "where")
+		if queryErr, ok := err.(*store.QueryError); ok {
+			errs = append(errs, problem.FieldError{Field: queryErr.Path, Message: queryErr.Message})
+		}
+		opts.Where = where
+	}
+	return opts, errs
+}
+
+// paging checks the limit and the offset and reads the sort and the cursor into the options.
+// A cursor cannot be combined with an offset.
+func paging(opts *store.ListOptions, sortParam string, cursor string) []problem.FieldError {
+	var errs []problem.FieldError
+	if opts.Limit < 1 || opts.Limit > maxPageSize {
+		errs = append(errs, problem.FieldError{Field: "limit", Message: fmt.Sprintf("must be between 1 and %d", maxPageSize)})
+	}
+	if opts.Offset < 0 {
+		errs = append(errs, problem.FieldError{Field: "offset", Message: "must not be negative"})
+	}
+	sort, err := store.ParseSort(sortParam)
+	if err != nil {
+		errs = append(errs, problem.FieldError{Field: "sort", Message: err.Error()})
+	}
+	opts.Sort = sort
+	if cursor == "" || err != nil {
+		return errs
+	}
+	if opts.Offset > 0 {
+		return append(errs, problem.FieldError{Field: "cursor", Message: "cannot be combined with an offset"})
+	}
+	opts.After, err = store.DecodeCursor(cursor, sort)
+	if err != nil {
+		errs = append(errs, problem.FieldError{Field: "cursor", Message: "is invalid or of another sort"})
+	}
+	return errs
+}
+
+// parseDate reads a date of a filter, a day or a time of RFC 3339
+func parseDate(value string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseListQuery reads the page, the filters and the sort of the product list from the query string.
+// The limit defaults to 20, the sort to the id. A cursor cannot be combined with an offset.
+func parseListQuery(query url.Values) (store.ListOptions, []problem.FieldError) {
+	var errs []problem.FieldError
+	opts := store.ListOptions{Limit: defaultPageSize}
+	number := func(name string, min int) *int {
+		value := query.Get(name)
+		if value == "" {
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < min {
+			errs = append(errs, problem.FieldError{Field: name, Message: fmt.Sprintf("must be a whole number of at least %d", min)})
+			return nil
+		}
+		return &n
+	}
+	date := func(name string) time.Time {
+		value := query.Get(name)
+		if value == "" {
+			return time.Time{}
+		}
+		t, err := parseDate(value)
+		if err != nil {
+			errs = append(errs, problem.FieldError{Field: name, Message: "must be a date like 2021-09-14 or a time of RFC 3339"})
+		}
+		return t
+	}
+
+	if limit := number("limit", 1); limit != nil {
+		opts.Limit = *limit
+	}
+	if offset := number("offset", 0); offset != nil {
+		opts.Offset = *offset
+	}
+	opts.Vendor = strings.TrimSpace(query.Get("vendor"))
+	opts.NameContains = strings.TrimSpace(query.Get("name"))
+	opts.MinInventory = number("inventory_min", 0)
+	opts.MaxInventory = number("inventory_max", 0)
+	opts.CreatedAfter = date("created_after")
+	opts.CreatedBefore = date("created_before")
+	errs = append(errs, paging(&opts, query.Get("sort"), query.Get("cursor"))...)
+	return opts, errs
+}
+
+// apply sets the fields of the request on the product, the names trimmed.
+// A replace without a description clears it.
+func (req ProductRequest) apply(product *store.Product, partial bool) {
+	if req.Name != nil {
+		product.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Vendor != nil {
+		product.VendorName = strings.TrimSpace(*req.Vendor)
+	}
+	if req.Inventory != nil {
+		product.Inventory = *req.Inventory
+	}
+	if req.Description != nil {
+		product.Description = *req.Description
+	} else if !partial {
+		product.Description = ""
+	}
+}
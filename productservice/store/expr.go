@@ -0,0 +1,254 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// limits of a query, so one request cannot build a query that keeps the database busy
+const (
+	MaxQueryDepth = 5
+	MaxQueryTerms = 32
+	MaxInValues   = 100
+)
+
+// operators comparing a field, contains and prefix only work on text fields
+var operators = map[string]string{
+	"eq":  "=",
+	"ne":  "<>",
+	"lt":  "<",
+	"lte": "<=",
+	"gt":  ">",
+	"gte": ">=",
+	// the SQL of these is built in sql
+	"in":       "",
+	"contains": "",
+	"prefix":   "",
+}
+
+// Expr is a query as the client sends it in JSON. A node either combines other nodes
+// with and, or and not, or compares a field with op and value:
+//
+//	{"and": [{"field": "vendor", "op": "eq", "value": "acme"},
+//	         {"not": {"field": "inventory", "op": "lt", "value": 5}}]}
+type Expr struct {
+	And   []Expr          `json:"and,omitempty"`
+	Or    []Expr          `json:"or,omitempty"`
+	Not   *Expr           `json:"not,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// QueryError tells which node of the query is wrong, eg. where.and[1].value
+type QueryError struct {
+	Path    string
+	Message string
+}
+
+func (e *QueryError) Error() string {
+	return e.Path + " " + e.Message
+}
+
+// Condition is a compiled query. The fields are from the whitelist and the values
+// are parsed for their field, the SQL of it only has parameters for the values.
+type Condition struct {
+	and    []Condition
+	or     []Condition
+	not    *Condition
+	field  string
+	op     string
+	values []interface{}
+}
+
+// Compile checks the query against the fields and the limits. path names the query in the errors.
+func Compile(expr Expr, path string) (*Condition, error) {
+	terms := 0
+	cond, err := compile(expr, path, 1, &terms)
+	if err != nil {
+		return nil, err
+	}
+	return &cond, nil
+}
+
+func compile(expr Expr, path string, depth int, terms *int) (Condition, error) {
+	*terms++
+	if *terms > MaxQueryTerms {
+		return Condition{}, &QueryError{Path: path, Message: fmt.Sprintf("makes the query longer than %d terms", MaxQueryTerms)}
+	}
+	kinds := 0
+	for _, set := range []bool{expr.And != nil, expr.Or != nil, expr.Not != nil, expr.Field != "" || expr.Op != "" || expr.Value != nil} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return Condition{}, &QueryError{Path: path, Message: "must have exactly one of and, or, not or a field comparison"}
+	}
+	if (expr.And != nil || expr.Or != nil || expr.Not != nil) && depth >= MaxQueryDepth {
+		return Condition{}, &QueryError{Path: path, Message: fmt.Sprintf("nests the query deeper than %d levels", MaxQueryDepth)}
+	}
+
+	switch {
+	case expr.And != nil || expr.Or != nil:
+		name, exprs := "and", expr.And
+		if expr.Or != nil {
+			name, exprs = "or", expr.Or
+		}
+		if len(exprs) == 0 {
+			return Condition{}, &QueryError{Path: path + "." + name, Message: "needs at least one condition"}
+		}
+		conds := make([]Condition, len(exprs))
+		for i, sub := range exprs {
+			cond, err := compile(sub, fmt.Sprintf("%s.%s[%d]", path, name, i), depth+1, terms)
+			if err != nil {
+				return Condition{}, err
+			}
+			conds[i] = cond
+		}
+		if name == "and" {
+			return Condition{and: conds}, nil
+		}
+		return Condition{or: conds}, nil
+	case expr.Not != nil:
+		cond, err := compile(*expr.Not, path+".not", depth+1, terms)
+		if err != nil {
+			return Condition{}, err
+		}
+		return Condition{not: &cond}, nil
+	}
+	return compileComparison(expr, path)
+}
+
+func compileComparison(expr Expr, path string) (Condition, error) {
+	f, ok := Fields[expr.Field]
+	if !ok {
+		return Condition{}, &QueryError{Path: path + ".field", Message: fmt.Sprintf("must be one of %s", strings.Join(fieldNames(), ", "))}
+	}
+	if _, ok := operators[expr.Op]; !ok {
+		return Condition{}, &QueryError{Path: path + ".op", Message: "must be one of eq, ne, lt, lte, gt, gte, in, contains or prefix"}
+	}
+	if (expr.Op == "contains" || expr.Op == "prefix") && !f.text {
+		return Condition{}, &QueryError{Path: path + ".op", Message: fmt.Sprintf("%s only works on text fields", expr.Op)}
+	}
+	if len(expr.Value) == 0 || bytes.Equal(expr.Value, []byte("null")) {
+		return Condition{}, &QueryError{Path: path + ".value", Message: "is required"}
+	}
+
+	raws := []json.RawMessage{expr.Value}
+	if expr.Op == "in" {
+		raws = nil
+		if err := json.Unmarshal(expr.Value, &raws); err != nil || len(raws) == 0 {
+			return Condition{}, &QueryError{Path: path + ".value", Message: "must be a list of values for in"}
+		}
+		if len(raws) > MaxInValues {
+			return Condition{}, &QueryError{Path: path + ".value", Message: fmt.Sprintf("must have at most %d values", MaxInValues)}
+		}
+	}
+	cond := Condition{field: expr.Field, op: expr.Op}
+	for _, raw := range raws {
+		value, err := f.parse(raw)
+		if err != nil {
+			return Condition{}, &QueryError{Path: path + ".value", Message: fmt.Sprintf("is not a valid %s", expr.Field)}
+		}
+		cond.values = append(cond.values, value)
+	}
+	return cond, nil
+}
+
+func fieldNames() []string {
+	names := make([]string, 0, len(Fields))
+	for name := range Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sql is the WHERE condition of the query with its parameters
+func (c Condition) sql() (string, []interface{}) {
+	switch {
+	case c.and != nil || c.or != nil:
+		conds, join := c.and, " AND "
+		if c.or != nil {
+			conds, join = c.or, " OR "
+		}
+		parts := make([]string, len(conds))
+		var args []interface{}
+		for i, cond := range conds {
+			where, condArgs := cond.sql()
+			parts[i] = where
+			args = append(args, condArgs...)
+		}
+		return "(" + strings.Join(parts, join) + ")", args
+	case c.not != nil:
+		where, args := c.not.sql()
+		return "NOT " + where, args
+	}
+
+	column := Fields[c.field].column
+	switch c.op {
+	case "in":
+		marks := strings.TrimSuffix(strings.Repeat("?, ", len(c.values)), ", ")
+		return "(" + column + " IN (" + marks + "))", c.values
+	case "contains":
+		return "(LOWER(" + column + ") LIKE ?)", []interface{}{"%" + likeEscaper.Replace(strings.ToLower(c.values[0].(string))) + "%"}
+	case "prefix":
+		return "(LOWER(" + column + ") LIKE ?)", []interface{}{likeEscaper.Replace(strings.ToLower(c.values[0].(string))) + "%"}
+	}
+	return "(" + column + " " + operators[c.op] + " ?)", c.values
+}
+
+// matches evaluates the query on a product like MySQL does, ignoring the case of text
+func (c Condition) matches(p Product) bool {
+	switch {
+	case c.and != nil:
+		for _, cond := range c.and {
+			if !cond.matches(p) {
+				return false
+			}
+		}
+		return true
+	case c.or != nil:
+		for _, cond := range c.or {
+			if cond.matches(p) {
+				return true
+			}
+		}
+		return false
+	case c.not != nil:
+		return !c.not.matches(p)
+	}
+
+	value := Fields[c.field].value(p)
+	switch c.op {
+	case "in":
+		for _, v := range c.values {
+			if compare(value, v) == 0 {
+				return true
+			}
+		}
+		return false
+	case "contains":
+		return strings.Contains(strings.ToLower(value.(string)), strings.ToLower(c.values[0].(string)))
+	case "prefix":
+		return strings.HasPrefix(strings.ToLower(value.(string)), strings.ToLower(c.values[0].(string)))
+	}
+	order := compare(value, c.values[0])
+	switch c.op {
+	case "eq":
+		return order == 0
+	case "ne":
+		return order != 0
+	case "lt":
+		return order < 0
+	case "lte":
+		return order <= 0
+	case "gt":
+		return order > 0
+	}
+	return order >= 0
+}
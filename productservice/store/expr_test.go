@@ -0,0 +1,58 @@
+package store
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func compileJSON(t *testing.T, query string) (*Condition, error) {
+	var expr Expr
+	if err := json.Unmarshal([]byte(query), &expr); err != nil {
+		t.Fatal(err)
+	}
+	return Compile(expr, "where")
+}
+
+func TestCompile(t *testing.T) {
+	cond, err := compileJSON(t, `{"and": [
+		{"field": "vendor", "op": "in", "value": ["acme", "hats inc"]},
+		{"or": [{"field": "name", "op": "contains", "value": "50%"}, {"not": {"field": "inventory", "op": "lt", "value": 5}}]}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args := cond.sql()
+	expected := "((vendor_name IN (?, ?)) AND ((LOWER(name) LIKE ?) OR NOT (inventory < ?)))"
+	if where != expected || !reflect.DeepEqual(args, []interface{}{"acme", "hats inc", `%50\%%`, 5}) {
+		t.Fatalf("Unexpected condition %s %v", where, args)
+	}
+	if !cond.matches(Product{VendorName: "ACME", Name: "Hat", Inventory: 7}) || cond.matches(Product{VendorName: "acme", Name: "Hat", Inventory: 2}) {
+		t.Fatalf("Expected the condition to match like MySQL")
+	}
+
+	nested := `{"field": "id", "op": "eq", "value": 1}`
+	for i := 0; i < MaxQueryDepth; i++ {
+		nested = `{"not": ` + nested + `}`
+	}
+	terms := strings.TrimSuffix(strings.Repeat(`{"field": "id", "op": "eq", "value": 1},`, MaxQueryTerms), ",")
+	values := strings.TrimSuffix(strings.Repeat(`1,`, MaxInValues+1), ",")
+	for query, path := range map[string]string{
+		`{"field": "price", "op": "eq", "value": 1}`:                        "where.field",
+		`{"field": "name; DROP TABLE products", "op": "eq", "value": 1}`:    "where.field",
+		`{"field": "name", "op": "like", "value": "a"}`:                     "where.op",
+		`{"field": "inventory", "op": "contains", "value": 5}`:              "where.op",
+		`{"field": "inventory", "op": "eq", "value": "5"}`:                  "where.value",
+		`{"field": "inventory", "op": "eq"}`:                                "where.value",
+		`{"and": [{"field": "id", "op": "in", "value": [` + values + `]}]}`: "where.and[0].value",
+		`{"and": []}`:             "where.and",
+		`{"and": [], "or": []}`:   "where",
+		nested:                    "where.not.not.not.not",
+		`{"or": [` + terms + `]}`: "where.or[31]",
+	} {
+		_, err := compileJSON(t, query)
+		if queryErr, ok := err.(*QueryError); !ok || queryErr.Path != path {
+			t.Fatalf("Expected %s to be rejected at %s, got %v", query, path, err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+// escapes the wildcards of LIKE, so a search for "a_b" does not match "axb"
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// GormStore keeps the products in the products table
+type GormStore struct {
+	db *gorm.DB
+}
+
+// NewGormStore uses an open connection. Auto Migrate creates the products table if it is missing.
+func NewGormStore(db *gorm.DB) (*GormStore, error) {
+	if err := db.AutoMigrate(&Product{}).Error; err != nil {
+		return nil, err
+	}
+	return &GormStore{db: db}, nil
+}
+
+// translates the gorm errors to the errors of the Store
+func storeError(err error) error {
+	if gorm.IsRecordNotFoundError(err) {
+		return ErrProductNotFound
+	}
+	return err
+}
+
+// filtered is the query of the products matching the filter. The values are always
+// parameters, only the columns of the whitelist are written into the SQL.
+func (s *GormStore) filtered(filter Filter) *gorm.DB {
+	query := s.db.Model(&Product{})
+	if filter.Vendor != "" {
+		query = query.Where("vendor_name = ?", filter.Vendor)
+	}
+	if filter.NameContains != "" {
+		query = query.Where("LOWER(name) LIKE ?", "%"+likeEscaper.Replace(strings.ToLower(filter.NameContains))+"%")
+	}
+	if filter.MinInventory != nil {
+		query = query.Where("inventory >= ?", *filter.MinInventory)
+	}
+	if filter.MaxInventory != nil {
+		query = query.Where("inventory <= ?", *filter.MaxInventory)
+	}
+	if !filter.CreatedAfter.IsZero() {
+		query = query.Where("create_at > ?", filter.CreatedAfter)
+	}
+	if !filter.CreatedBefore.IsZero() {
+		query = query.Where("create_at < ?", filter.CreatedBefore)
+	}
+	if filter.Where != nil {
+		where, args := filter.Where.sql()
+		query = query.Where(where, args...)
+	}
+	return query
+}
+
+// keyset is the condition for the rows behind the cursor, for the order a, -b, id:
+// (a > ?) OR (a = ? AND b < ?) OR (a = ? AND b = ? AND id > ?)
+func keyset(order []SortField, values []interface{}) (string, []interface{}) {
+	var clauses []string
+	var args []interface{}
+	for i, f := range order {
+		var parts []string
+		for j := 0; j < i; j++ {
+			parts = append(parts, Fields[order[j].Field].column+" = ?")
+			args = append(args, values[j])
+		}
+		op := ">"
+		if f.Desc {
+			op = "<"
+		}
+		parts = append(parts, Fields[f.Field].column+" "+op+" ?")
+		args = append(args, values[i])
+		clauses = append(clauses, "("+strings.Join(parts, " AND ")+")")
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", args
+}
+
+// List returns the page of the matching products. MySQL needs a limit for an offset, the handlers always set one.
+func (s *GormStore) List(ctx context.Context, opts ListOptions) ([]Product, error) {
+	query := s.filtered(opts.Filter)
+	order := ordering(opts.Sort)
+	if opts.After != nil {
+		where, args := keyset(order, opts.After.values)
+		query = query.Where(where, args...)
+	}
+	for _, f := range order {
+		direction := " ASC"
+		if f.Desc {
+			direction = " DESC"
+		}
+		query = query.Order(Fields[f.Field].column + direction)
+	}
+	if opts.Offset > 0 {
+		query = query.Offset(opts.Offset)
+	}
+	if opts.Limit > 0 {
+		query = query.Limit(opts.Limit)
+	}
+	products := []Product{}
+	err := query.Find(&products).Error
+	return products, err
+}
+
+// Count counts the matching products
+func (s *GormStore) Count(ctx context.Context, filter Filter) (int, error) {
+	var count int
+	err := s.filtered(filter).Count(&count).Error
+	return count, err
+}
+
+// Get finds the product with the id
+func (s *GormStore) Get(ctx context.Context, id int) (Product, error) {
+	var product Product
+	err := s.db.First(&product, "id = ?", id).Error
+	return product, storeError(err)
+}
+
+// Create inserts the product, the database assigns the id
+func (s *GormStore) Create(ctx context.Context, product *Product) error {
+	return s.db.Omit("Id").Create(product).Error
+}
+
+// Update writes all fields of the product, zero values included
+func (s *GormStore) Update(ctx context.Context, product Product) error {
+	result := s.db.Model(&Product{}).Where("id = ?", product.Id).Updates(map[string]interface{}{
+		"name":        product.Name,
+		"vendor_name": product.VendorName,
+		"inventory":   product.Inventory,
+		"description": product.Description,
+	})
+	if result.Error != nil {
+		return result.Error
+	}
+	// MySQL counts the changed rows, an update without changes also affects none
+	if result.RowsAffected == 0 {
+		var count int
+		if err := s.db.Model(&Product{}).Where("id = ?", product.Id).Count(&count).Error; err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrProductNotFound
+		}
+	}
+	return nil
+}
+
+// Delete removes the product with the id
+func (s *GormStore) Delete(ctx context.Context, id int) error {
+	result := s.db.Where("id = ?", id).Delete(&Product{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrProductNotFound
+	}
+	return nil
+}
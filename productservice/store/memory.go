@@ -0,0 +1,141 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore keeps the products in a map, for running without MySQL and for the tests
+type MemoryStore struct {
+	mu       sync.RWMutex
+	products map[int]Product
+	nextID   int
+}
+
+// NewMemoryStore returns a store with the products, their ids are assigned like on create
+func NewMemoryStore(products ...Product) *MemoryStore {
+	s := &MemoryStore{products: map[int]Product{}, nextID: 1}
+	for i := range products {
+		s.Create(context.Background(), &products[i])
+	}
+	return s
+}
+
+// matches checks the product against the filter like the SQL does. The default
+// collation of MySQL ignores the case, so we do too.
+func (f Filter) matches(p Product) bool {
+	switch {
+	case f.Vendor != "" && !strings.EqualFold(p.VendorName, f.Vendor):
+		return false
+	case f.NameContains != "" && !strings.Contains(strings.ToLower(p.Name), strings.ToLower(f.NameContains)):
+		return false
+	case f.MinInventory != nil && p.Inventory < *f.MinInventory:
+		return false
+	case f.MaxInventory != nil && p.Inventory > *f.MaxInventory:
+		return false
+	case !f.CreatedAfter.IsZero() && !p.CreateAt.After(f.CreatedAfter):
+		return false
+	case !f.CreatedBefore.IsZero() && !p.CreateAt.Before(f.CreatedBefore):
+		return false
+	case f.Where != nil && !f.Where.matches(p):
+		return false
+	}
+	return true
+}
+
+// position compares the product to the values of the sort fields, less than 0 is before them
+func position(p Product, order []SortField, values []interface{}) int {
+	for i, f := range order {
+		c := compare(Fields[f.Field].value(p), values[i])
+		if f.Desc {
+			c = -c
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// List returns the page of the matching products
+func (s *MemoryStore) List(ctx context.Context, opts ListOptions) ([]Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	order := ordering(opts.Sort)
+	products := []Product{}
+	for _, product := range s.products {
+		if opts.matches(product) && (opts.After == nil || position(product, order, opts.After.values) > 0) {
+			products = append(products, product)
+		}
+	}
+	sort.Slice(products, func(i, j int) bool {
+		return position(products[i], order, CursorAfter(products[j], opts.Sort).values) < 0
+	})
+
+	if opts.Offset >= len(products) {
+		return []Product{}, nil
+	}
+	products = products[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(products) {
+		products = products[:opts.Limit]
+	}
+	return products, nil
+}
+
+// Count counts the matching products
+func (s *MemoryStore) Count(ctx context.Context, filter Filter) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	count := 0
+	for _, product := range s.products {
+		if filter.matches(product) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Get finds the product with the id
+func (s *MemoryStore) Get(ctx context.Context, id int) (Product, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	product, ok := s.products[id]
+	if !ok {
+		return Product{}, ErrProductNotFound
+	}
+	return product, nil
+}
+
+// Create adds the product with the next id
+func (s *MemoryStore) Create(ctx context.Context, product *Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	product.Id = s.nextID
+	s.nextID++
+	s.products[product.Id] = *product
+	return nil
+}
+
+// Update replaces the product with the same id
+func (s *MemoryStore) Update(ctx context.Context, product Product) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.products[product.Id]; !ok {
+		return ErrProductNotFound
+	}
+	s.products[product.Id] = product
+	return nil
+}
+
+// Delete removes the product with the id
+func (s *MemoryStore) Delete(ctx context.Context, id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.products[id]; !ok {
+		return ErrProductNotFound
+	}
+	delete(s.products, id)
+	return nil
+}
@@ -1,6 +1,13 @@
 package store
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrProductNotFound is returned when no product has the id
+var ErrProductNotFound = errors.New("product not found")
 
 type Product struct {
 	Id          int       `json:"id"`
@@ -10,3 +17,18 @@ type Product struct {
 	Description string    `json:"description"`
 	CreateAt    time.Time `json:"create_at"`
 }
+
+// Store keeps the products. The handlers only talk to this, so the products
+// can live in MySQL or, without a database, in memory.
+type Store interface {
+	// List returns a page of the products, all of them without a limit
+	List(ctx context.Context, opts ListOptions) ([]Product, error)
+	// Count counts the products matching the filter, on all pages
+	Count(ctx context.Context, filter Filter) (int, error)
+	Get(ctx context.Context, id int) (Product, error)
+	// Create sets the id of the product
+	Create(ctx context.Context, product *Product) error
+	// Update replaces the product with the same id
+	Update(ctx context.Context, product Product) error
+	Delete(ctx context.Context, id int) error
+}
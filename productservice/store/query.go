@@ -0,0 +1,208 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned for a cursor we did not hand out, or one of another sort order
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Filter narrows the products down, the zero value matches all of them
+type Filter struct {
+	Vendor string
+	// NameContains matches a part of the name, ignoring the case
+	NameContains  string
+	MinInventory  *int
+	MaxInventory  *int
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Where is a compiled query, see Compile
+	Where *Condition
+}
+
+// SortField sorts by one field, Field is a name of Fields
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// ListOptions selects a page of the products. A page starts at Offset, or behind
+// the product of the cursor. The cursor stays right when products are added or removed meanwhile.
+type ListOptions struct {
+	Filter
+	Sort   []SortField
+	Limit  int
+	Offset int
+	After  *Cursor
+}
+
+// field is a field of the products the queries can use, with its column and how to compare it
+type field struct {
+	column string
+	value  func(Product) interface{}
+	// parse reads a value of the field from a cursor or a query
+	parse func(raw json.RawMessage) (interface{}, error)
+	// text fields can be searched with contains and prefix
+	text bool
+}
+
+func parseString(raw json.RawMessage) (interface{}, error) {
+	var s string
+	err := json.Unmarshal(raw, &s)
+	return s, err
+}
+
+func parseInt(raw json.RawMessage) (interface{}, error) {
+	var i int
+	err := json.Unmarshal(raw, &i)
+	return i, err
+}
+
+func parseTime(raw json.RawMessage) (interface{}, error) {
+	var t time.Time
+	err := json.Unmarshal(raw, &t)
+	return t, err
+}
+
+// Fields are the fields the products can be sorted and queried by, named like in the JSON of a product.
+// Only these columns ever end up in the SQL, the names in the request are never put in the query.
+var Fields = map[string]field{
+	"id":          {column: "id", value: func(p Product) interface{} { return p.Id }, parse: parseInt},
+	"name":        {column: "name", value: func(p Product) interface{} { return p.Name }, parse: parseString, text: true},
+	"vendor":      {column: "vendor_name", value: func(p Product) interface{} { return p.VendorName }, parse: parseString, text: true},
+	"inventory":   {column: "inventory", value: func(p Product) interface{} { return p.Inventory }, parse: parseInt},
+	"create_at":   {column: "create_at", value: func(p Product) interface{} { return p.CreateAt }, parse: parseTime},
+	"description": {column: "description", value: func(p Product) interface{} { return p.Description }, parse: parseString, text: true},
+}
+
+// ParseSort reads a sort like "vendor,-inventory", a leading '-' sorts descending
+func ParseSort(sort string) ([]SortField, error) {
+	var fields []SortField
+	seen := map[string]bool{}
+	for _, name := range strings.Split(sort, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		desc := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if _, ok := Fields[name]; !ok {
+			return nil, fmt.Errorf("cannot sort by %q", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("%q is sorted by twice", name)
+		}
+		seen[name] = true
+		fields = append(fields, SortField{Field: name, Desc: desc})
+	}
+	return fields, nil
+}
+
+// ordering is the sort with the id as the last field, so the order is total
+// and a cursor always points to exactly one position
+func ordering(sort []SortField) []SortField {
+	for _, f := range sort {
+		if f.Field == "id" {
+			return sort
+		}
+	}
+	return append(append([]SortField{}, sort...), SortField{Field: "id"})
+}
+
+// sortKey is the canonical form of the ordering, the cursor has to be used with the same one
+func sortKey(sort []SortField) string {
+	names := make([]string, len(sort))
+	for i, f := range sort {
+		names[i] = f.Field
+		if f.Desc {
+			names[i] = "-" + f.Field
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Cursor is the position behind a product in one sort order
+type Cursor struct {
+	sort   string
+	values []interface{}
+}
+
+// CursorAfter returns the cursor continuing behind the product
+func CursorAfter(product Product, sort []SortField) *Cursor {
+	order := ordering(sort)
+	cursor := &Cursor{sort: sortKey(order)}
+	for _, f := range order {
+		cursor.values = append(cursor.values, Fields[f.Field].value(product))
+	}
+	return cursor
+}
+
+type encodedCursor struct {
+	Sort   string            `json:"s"`
+	Values []json.RawMessage `json:"v"`
+}
+
+// Encode makes the opaque string handed to the client
+func (c *Cursor) Encode() string {
+	values := make([]json.RawMessage, len(c.values))
+	for i, value := range c.values {
+		values[i], _ = json.Marshal(value)
+	}
+	body, _ := json.Marshal(encodedCursor{Sort: c.sort, Values: values})
+	return base64.RawURLEncoding.EncodeToString(body)
+}
+
+// DecodeCursor reads a cursor of Encode for the sort of the request
+func DecodeCursor(s string, sort []SortField) (*Cursor, error) {
+	body, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var encoded encodedCursor
+	if err := json.Unmarshal(body, &encoded); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	order := ordering(sort)
+	if encoded.Sort != sortKey(order) || len(encoded.Values) != len(order) {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &Cursor{sort: encoded.Sort}
+	for i, f := range order {
+		value, err := Fields[f.Field].parse(encoded.Values[i])
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		cursor.values = append(cursor.values, value)
+	}
+	return cursor, nil
+}
+
+// compare orders two values of the same field
+func compare(a interface{}, b interface{}) int {
+	switch a := a.(type) {
+	case int:
+		b := b.(int)
+		switch {
+		case a < b:
+			return -1
+		case a > b:
+			return 1
+		}
+	case string:
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b.(string)))
+	case time.Time:
+		b := b.(time.Time)
+		switch {
+		case a.Before(b):
+			return -1
+		case a.After(b):
+			return 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,34 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKeyset(t *testing.T) {
+	order := ordering([]SortField{{Field: "vendor"}, {Field: "inventory", Desc: true}})
+	where, args := keyset(order, []interface{}{"acme", 5, 7})
+	expected := "((vendor_name > ?) OR (vendor_name = ? AND inventory < ?) OR (vendor_name = ? AND inventory = ? AND id > ?))"
+	if where != expected || !reflect.DeepEqual(args, []interface{}{"acme", "acme", 5, "acme", 5, 7}) {
+		t.Fatalf("Unexpected keyset condition %s %v", where, args)
+	}
+}
+
+func TestCursor(t *testing.T) {
+	sort, err := ParseSort("-create_at,name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	product := Product{Id: 3, Name: "Hat", CreateAt: time.Date(2021, 9, 14, 10, 0, 0, 500, time.UTC)}
+	cursor, err := DecodeCursor(CursorAfter(product, sort).Encode(), sort)
+	if err != nil || !reflect.DeepEqual(cursor.values, []interface{}{product.CreateAt, "Hat", 3}) {
+		t.Fatalf("Expected the values of the product back, got %+v %v", cursor, err)
+	}
+	if _, err := DecodeCursor(CursorAfter(product, sort).Encode(), sort[:1]); err != ErrInvalidCursor {
+		t.Fatalf("Expected the cursor of another sort to be rejected, got %v", err)
+	}
+	if _, err := ParseSort("name; DROP TABLE products"); err == nil {
+		t.Fatalf("Expected an unknown sort field to be rejected")
+	}
+}